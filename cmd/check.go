@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check <instance>",
+	Short: "Dial an instance once to test connectivity",
+	Long:  "Look up the proxy for an instance (by short name or full connection name) and dial it once with its ip_type and auth settings, without starting the daemon or binding any port. Reports how long the connection took, or why it failed, which tells a network or permissions problem with one database apart from a problem with the daemon.",
+	Args:  cobra.ExactArgs(1),
+	// A failed dial is not a usage error.
+	SilenceUsage: true,
+	RunE:         runCheck,
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
+
+func runCheck(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := findProxy(cfg.Proxies, args[0])
+	if err != nil {
+		return err
+	}
+	if err := checkCredentials(ctx, cfg); err != nil {
+		return err
+	}
+	dialer, err := newCloudSQLDialer(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("creating Cloud SQL dialer: %w", err)
+	}
+	d := newRealDialer(dialer, []config.ProxyEntry{p})
+	defer d.Close()
+	return checkInstance(ctx, cmd.OutOrStdout(), d, p)
+}
+
+// checkInstance dials the proxy's instance once through d, giving up after
+// its dial_timeout, and prints how long the connection took.
+func checkInstance(ctx context.Context, out io.Writer, d proxy.Dialer, p config.ProxyEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, p.DialTimeoutOrDefault())
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.Dial(ctx, p.Instance)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("can't connect to %s (after %s): %w", p.Instance, elapsed, err)
+	}
+	conn.Close()
+	fmt.Fprintf(out, "Connected to %s in %s\n", p.Instance, elapsed)
+	return nil
+}
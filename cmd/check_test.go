@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeDialer is a proxy.Dialer whose dials succeed with one end of a pipe,
+// after delay, and records the instances dialed.
+type pipeDialer struct {
+	delay  time.Duration
+	dialed []string
+}
+
+func (d *pipeDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	d.dialed = append(d.dialed, instance)
+	time.Sleep(d.delay)
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func (d *pipeDialer) Close() error { return nil }
+
+// blockingDialer is a proxy.Dialer whose dials never connect, and fail once
+// their context is done.
+type blockingDialer struct{}
+
+func (blockingDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingDialer) Close() error { return nil }
+
+func TestCheckInstance(t *testing.T) {
+	d := &pipeDialer{delay: 20 * time.Millisecond}
+	var out bytes.Buffer
+	if err := checkInstance(context.Background(), &out, d, proxyA); err != nil {
+		t.Fatalf("checkInstance: %v", err)
+	}
+	if len(d.dialed) != 1 || d.dialed[0] != proxyA.Instance {
+		t.Errorf("expected one dial to %s, got %v", proxyA.Instance, d.dialed)
+	}
+	if !strings.HasPrefix(out.String(), "Connected to "+proxyA.Instance+" in ") {
+		t.Errorf("expected a success line with the latency, got %q", out.String())
+	}
+}
+
+func TestCheckInstance_Failure(t *testing.T) {
+	var out bytes.Buffer
+	err := checkInstance(context.Background(), &out, failDialer{}, proxyA)
+	if err == nil || !strings.Contains(err.Error(), "can't connect to "+proxyA.Instance) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no success output, got %q", out.String())
+	}
+
+	// A dial that hangs gives up at the proxy's dial_timeout.
+	p := proxyA
+	p.DialTimeout = "50ms"
+	start := time.Now()
+	err = checkInstance(context.Background(), &out, blockingDialer{}, p)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("check took %s, want about the 50ms dial timeout", elapsed)
+	}
+}
+
+func TestRunCheck_UnknownProxy(t *testing.T) {
+	writeProxiesConfig(t, proxyA, proxyB)
+	err := runCheck(checkCmd, []string{"db-z"})
+	if err == nil || !strings.Contains(err.Error(), `no proxy for "db-z"`) {
+		t.Errorf("expected an unknown proxy error, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	"github.com/spf13/cobra"
+)
+
+var connectCmd = &cobra.Command{
+	Use:   "connect <instance>",
+	Short: "Open psql or mysql against a running proxy",
+	Long:  "Look up the proxy for an instance (by short name or full connection name), fetch its password, and replace this process with psql or mysql connected through the proxy.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConnect,
+}
+
+func init() {
+	rootCmd.AddCommand(connectCmd)
+}
+
+func runConnect(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := findProxy(cfg.Proxies, args[0])
+	if err != nil {
+		return err
+	}
+
+	state, err := proxy.ReadState(daemonPaths())
+	if err != nil || !proxy.IsRunning(state.PID) {
+		return fmt.Errorf("no daemon is running; run start first")
+	}
+	if _, err := findRunningProxy(state, p.Instance); err != nil {
+		return err
+	}
+	p = config.AssignPorts([]config.ProxyEntry{p}, state.AutoPorts)[0]
+
+	password, err := proxyPassword(ctx, cfg, p)
+	if err != nil {
+		return err
+	}
+
+	name, argv, env, err := clientCommand(p, password)
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s not found in PATH: %w", name, err)
+	}
+	return execClient(path, argv, append(os.Environ(), env...))
+}
+
+// proxyPassword fetches the password a client needs to log in through the
+// proxy. IAM proxies log in with the daemon's credentials, so for them there
+// is no password to fetch and it returns "".
+func proxyPassword(ctx context.Context, cfg *config.Config, p config.ProxyEntry) (string, error) {
+	if p.IAMAuth() {
+		return "", nil
+	}
+	var client secrets.SecretClient
+	if p.UsesSecretManager() {
+		if err := checkCredentials(ctx, cfg); err != nil {
+			return "", err
+		}
+		smClient, err := newSecretManagerClient(ctx, cfg)
+		if err != nil {
+			return "", fmt.Errorf("creating Secret Manager client: %w", err)
+		}
+		defer smClient.Close()
+		client = secrets.NewRetryingSecretClient(smClient, cfg.SecretAttemptsOrDefault())
+	}
+	return fetchPassword(ctx, client, p)
+}
+
+// findProxy returns the proxy whose instance matches name, either in full or
+// by its short name.
+func findProxy(proxies []config.ProxyEntry, name string) (config.ProxyEntry, error) {
+	var match []config.ProxyEntry
+	names := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		if p.Instance == name {
+			return p, nil
+		}
+		if instanceShortName(p.Instance) == name {
+			match = append(match, p)
+		}
+		names = append(names, instanceShortName(p.Instance))
+	}
+	switch len(match) {
+	case 1:
+		return match[0], nil
+	case 0:
+		return config.ProxyEntry{}, fmt.Errorf("no proxy for %q in config (available: %s)", name, strings.Join(names, ", "))
+	default:
+		return config.ProxyEntry{}, fmt.Errorf("%q matches several instances; use the full connection name", name)
+	}
+}
+
+// clientCommand returns the database client to run for a proxy: the program
+// name, its argv, and extra environment variables carrying the connection
+// settings and password. An empty password, as for IAM proxies, is left out.
+func clientCommand(p config.ProxyEntry, password string) (string, []string, []string, error) {
+	switch p.EngineOrDefault() {
+	case config.EngineMySQL:
+		argv := []string{"mysql"}
+		if p.Socket != "" {
+			argv = append(argv, "--socket="+p.Socket)
+		} else {
+			host, port, _ := net.SplitHostPort(p.DialAddr())
+			argv = append(argv, "--protocol=TCP", "--host="+host, "--port="+port)
+		}
+		if p.User != "" {
+			argv = append(argv, "--user="+p.User)
+		}
+		var env []string
+		if password != "" {
+			env = append(env, "MYSQL_PWD="+password)
+		}
+		return "mysql", argv, env, nil
+	default:
+		host, port, err := postgresHostPort(p)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		env := []string{"PGHOST=" + host, "PGPORT=" + port}
+		if password != "" {
+			env = append(env, "PGPASSWORD="+password)
+		}
+		if p.User != "" {
+			env = append(env, "PGUSER="+p.User)
+		}
+		return "psql", []string{"psql"}, env, nil
+	}
+}
+
+// postgresHostPort returns the host and port a Postgres client connects to
+// for the proxy. For a socket proxy the host is the socket's directory, as
+// libpq only connects to sockets named .s.PGSQL.<port> inside a directory
+// given as the host.
+func postgresHostPort(p config.ProxyEntry) (string, string, error) {
+	if p.Socket == "" {
+		host, port, _ := net.SplitHostPort(p.DialAddr())
+		return host, port, nil
+	}
+	dir, base := filepath.Split(p.Socket)
+	port, ok := strings.CutPrefix(base, ".s.PGSQL.")
+	if !ok {
+		return "", "", fmt.Errorf("postgres clients can't connect to socket %s: the file must be named .s.PGSQL.<port>", p.Socket)
+	}
+	return filepath.Clean(dir), port, nil
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestFindProxy(t *testing.T) {
+	proxies := []config.ProxyEntry{proxyA, proxyB}
+
+	p, err := findProxy(proxies, "db-b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Instance != proxyB.Instance {
+		t.Errorf("expected %s, got %s", proxyB.Instance, p.Instance)
+	}
+
+	p, err = findProxy(proxies, proxyA.Instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Instance != proxyA.Instance {
+		t.Errorf("expected %s, got %s", proxyA.Instance, p.Instance)
+	}
+
+	_, err = findProxy(proxies, "db-z")
+	if err == nil {
+		t.Fatal("expected error for unknown instance")
+	}
+	if !strings.Contains(err.Error(), "db-a, db-b") {
+		t.Errorf("expected error to list available instances, got: %v", err)
+	}
+
+	other := config.ProxyEntry{Instance: "other:us-central1:db-a", Port: 6000, Secret: "s"}
+	if _, err := findProxy(append(proxies, other), "db-a"); err == nil || !strings.Contains(err.Error(), "several") {
+		t.Errorf("expected ambiguity error, got: %v", err)
+	}
+}
+
+func TestClientCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxy    config.ProxyEntry
+		wantName string
+		wantArgv []string
+		wantEnv  []string
+	}{
+		{
+			name:     "postgres",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Port: 5432, User: "app"},
+			wantName: "psql",
+			wantArgv: []string{"psql"},
+			wantEnv:  []string{"PGHOST=localhost", "PGPORT=5432", "PGPASSWORD=pw", "PGUSER=app"},
+		},
+		{
+			name:     "postgres on wildcard host",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Host: "0.0.0.0", Port: 5433},
+			wantName: "psql",
+			wantArgv: []string{"psql"},
+			wantEnv:  []string{"PGHOST=localhost", "PGPORT=5433", "PGPASSWORD=pw"},
+		},
+		{
+			name:     "postgres socket",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Socket: "/cloudsql/p:r:db/.s.PGSQL.5432"},
+			wantName: "psql",
+			wantArgv: []string{"psql"},
+			wantEnv:  []string{"PGHOST=/cloudsql/p:r:db", "PGPORT=5432", "PGPASSWORD=pw"},
+		},
+		{
+			name:     "mysql tcp",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Port: 3306, Engine: config.EngineMySQL, User: "root"},
+			wantName: "mysql",
+			wantArgv: []string{"mysql", "--protocol=TCP", "--host=localhost", "--port=3306", "--user=root"},
+			wantEnv:  []string{"MYSQL_PWD=pw"},
+		},
+		{
+			// The engine isn't guessed from the port.
+			name:     "port 3306 without engine",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Port: 3306, User: "root"},
+			wantName: "psql",
+			wantArgv: []string{"psql"},
+			wantEnv:  []string{"PGHOST=localhost", "PGPORT=3306", "PGPASSWORD=pw", "PGUSER=root"},
+		},
+		{
+			name:     "mysql socket",
+			proxy:    config.ProxyEntry{Instance: "p:r:db", Socket: "/tmp/db.sock", Engine: config.EngineMySQL},
+			wantName: "mysql",
+			wantArgv: []string{"mysql", "--socket=/tmp/db.sock"},
+			wantEnv:  []string{"MYSQL_PWD=pw"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, argv, env, err := clientCommand(tt.proxy, "pw")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != tt.wantName || !reflect.DeepEqual(argv, tt.wantArgv) || !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("got %s %v %v, want %s %v %v", name, argv, env, tt.wantName, tt.wantArgv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestClientCommand_NoPassword(t *testing.T) {
+	p := config.ProxyEntry{Instance: "p:r:db", Port: 5432, Auth: config.AuthIAM, User: "app@proj.iam"}
+	_, _, env, err := clientCommand(p, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"PGHOST=localhost", "PGPORT=5432", "PGUSER=app@proj.iam"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got env %v, want %v", env, want)
+	}
+
+	p = config.ProxyEntry{Instance: "p:r:db", Port: 3306, Engine: config.EngineMySQL, Auth: config.AuthIAM}
+	if _, _, env, _ := clientCommand(p, ""); len(env) != 0 {
+		t.Errorf("expected no MYSQL_PWD, got %v", env)
+	}
+}
+
+func TestClientCommand_UnsupportedPostgresSocket(t *testing.T) {
+	p := config.ProxyEntry{Instance: "p:r:db", Socket: "/tmp/db.sock"}
+	if _, _, _, err := clientCommand(p, "pw"); err == nil {
+		t.Fatal("expected error for socket psql can't address")
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var connectionsCmd = &cobra.Command{
+	Use:   "connections",
+	Short: "List the client connections open through each proxy",
+	Long:  "List every client connection the daemon is proxying, with its client address, age, and bytes transferred. The running daemon is asked over its control socket; if it can't answer, the list comes from its state file, which is written every few seconds, so very short connections may not appear.",
+	Args:  cobra.NoArgs,
+	RunE:  runConnections,
+}
+
+func init() {
+	rootCmd.AddCommand(connectionsCmd)
+}
+
+func runConnections(cmd *cobra.Command, args []string) error {
+	state, err := readDaemonState(daemonPaths())
+	if err != nil || !proxy.IsRunning(state.PID) {
+		fmt.Println("No daemon is running.")
+		return nil
+	}
+	writeConnections(os.Stdout, state, time.Now())
+	return nil
+}
+
+// writeConnections prints a row per open connection, grouped by proxy in
+// config order.
+func writeConnections(out io.Writer, state *proxy.DaemonState, now time.Time) {
+	n := 0
+	for _, s := range state.Stats {
+		n += len(s.Connections)
+	}
+	if n == 0 {
+		fmt.Fprintln(out, "No open connections.")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tCLIENT\tAGE\tSENT\tRECEIVED")
+	for _, p := range state.Proxies {
+		for _, c := range state.Stats[p.Instance].Connections {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Instance, c.Client, now.Sub(c.StartedAt).Round(time.Second),
+				formatBytes(c.BytesSent), formatBytes(c.BytesReceived))
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+func TestWriteConnections(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	state := &proxy.DaemonState{
+		Proxies: []config.ProxyEntry{proxyA, proxyB, proxyC},
+		Stats: map[string]proxy.ProxyStats{
+			proxyB.Instance: {Connections: []proxy.ConnInfo{
+				{Client: "127.0.0.1:50001", StartedAt: now.Add(-90 * time.Second), BytesSent: 2048, BytesReceived: 512},
+			}},
+			proxyA.Instance: {Connections: []proxy.ConnInfo{
+				{Client: "127.0.0.1:50002", StartedAt: now.Add(-time.Hour), BytesSent: 100},
+				{Client: "127.0.0.1:50003", StartedAt: now.Add(-5 * time.Second)},
+			}},
+		},
+	}
+
+	var out bytes.Buffer
+	writeConnections(&out, state, now)
+	want := "INSTANCE                CLIENT            AGE      SENT      RECEIVED\n" +
+		"proj:us-central1:db-a   127.0.0.1:50002   1h0m0s   100 B     0 B\n" +
+		"proj:us-central1:db-a   127.0.0.1:50003   5s       0 B       0 B\n" +
+		"proj:us-central1:db-b   127.0.0.1:50001   1m30s    2.0 KiB   512 B\n"
+	if got := out.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+
+	out.Reset()
+	writeConnections(&out, &proxy.DaemonState{Proxies: []config.ProxyEntry{proxyA}}, now)
+	if got := out.String(); got != "No open connections.\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
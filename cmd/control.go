@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+// daemonControl answers control socket requests and applies reloads. Its
+// methods must only be called from the daemon's main loop, which owns the
+// state; the listeners are run by proxy.RunDaemon, which takes reloads on
+// reloads.
+type daemonControl struct {
+	set     *proxy.Manager
+	reloads chan<- proxy.Reload
+	d       *realDialer
+	paths   proxy.Paths
+	state   *proxy.DaemonState
+}
+
+func (c *daemonControl) handle(req proxy.ControlRequest) proxy.ControlResponse {
+	switch req.Command {
+	case proxy.ControlStatus:
+		state := *c.state
+		state.Stats = snapshotStats(c.set)
+		return proxy.ControlResponse{State: &state}
+	case proxy.ControlConns:
+		return proxy.ControlResponse{Connections: instanceConns(c.set)}
+	case proxy.ControlReload:
+		if err := c.reload(); err != nil {
+			return proxy.ControlResponse{Error: err.Error()}
+		}
+		return proxy.ControlResponse{}
+	}
+	return proxy.ControlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+}
+
+// readDaemonState returns the daemon's state. A running daemon is asked over
+// its control socket, for current counters; otherwise, or if it can't
+// answer, the state file it last wrote is read.
+func readDaemonState(paths proxy.Paths) (*proxy.DaemonState, error) {
+	if resp, err := proxy.QueryControl(paths.Control, proxy.ControlStatus); err == nil && resp.State != nil {
+		return resp.State, nil
+	}
+	return proxy.ReadState(paths)
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+// runTestDaemon runs listeners for proxies with proxy.RunDaemon until the
+// test ends, and returns the daemonControl the daemon's main loop would use
+// for them. Its state is written to the state file.
+func runTestDaemon(t *testing.T, proxies []config.ProxyEntry) *daemonControl {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	oldPID := pidFile
+	t.Cleanup(func() { pidFile = oldPID })
+	pidFile = ""
+	paths := daemonPaths()
+
+	ctx, stop := context.WithCancel(context.Background())
+	reloads := make(chan proxy.Reload)
+	started := make(chan *proxy.Manager, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.RunDaemon(ctx, &config.Config{Proxies: proxies}, proxy.RunOptions{
+			Dialer:      failDialer{},
+			NewListener: newListener,
+			Reloads:     reloads,
+			Started:     func(m *proxy.Manager) { started <- m },
+		})
+	}()
+	var set *proxy.Manager
+	select {
+	case set = <-started:
+	case err := <-done:
+		stop()
+		t.Fatalf("RunDaemon: %v", err)
+	}
+	t.Cleanup(func() {
+		stop()
+		<-done
+	})
+
+	state := &proxy.DaemonState{PID: os.Getpid(), StartedAt: time.Now().UTC(), Proxies: proxies}
+	writeState(t, paths, state.PID, proxies)
+	return &daemonControl{set: set, reloads: reloads, d: &realDialer{}, paths: paths, state: state}
+}
+
+// startControlDaemon runs the daemon's listeners and control socket in
+// process, answering calls the way runDaemon's main loop does.
+func startControlDaemon(t *testing.T, proxies []config.ProxyEntry) (*proxy.Manager, proxy.Paths) {
+	t.Helper()
+	ctl := runTestDaemon(t, proxies)
+	control, err := proxy.ListenControl(ctl.paths.Control)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case call := <-control.Calls():
+				call.Reply(ctl.handle(call.Request))
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		control.Close()
+		close(done)
+	})
+	return ctl.set, ctl.paths
+}
+
+func writeProxiesConfig(t *testing.T, proxies ...config.ProxyEntry) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("proxies:\n")
+	for _, p := range proxies {
+		fmt.Fprintf(&b, "  - instance: %q\n    port: %d\n    secret: %q\n", p.Instance, p.Port, p.Secret)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	oldPath, oldEnv := configPath, envName
+	t.Cleanup(func() { configPath, envName = oldPath, oldEnv })
+	configPath, envName = path, ""
+}
+
+func TestReadDaemonState_AsksDaemon(t *testing.T) {
+	ports := freePorts(t, 1)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	_, paths := startControlDaemon(t, []config.ProxyEntry{a})
+
+	// The state file has no stats yet, so stats mean the daemon answered.
+	state, err := readDaemonState(paths)
+	if err != nil {
+		t.Fatalf("readDaemonState: %v", err)
+	}
+	if _, ok := state.Stats[a.Instance]; !ok {
+		t.Errorf("expected current stats for %s, got %+v", a.Instance, state.Stats)
+	}
+}
+
+func TestReadDaemonState_FallsBackToStateFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	paths := daemonPaths()
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{proxyA})
+
+	state, err := readDaemonState(paths)
+	if err != nil {
+		t.Fatalf("readDaemonState: %v", err)
+	}
+	if len(state.Proxies) != 1 || state.Stats != nil {
+		t.Errorf("expected the state file's contents, got %+v", state)
+	}
+}
+
+func TestDaemonControl_Conns(t *testing.T) {
+	ports := freePorts(t, 1)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	_, paths := startControlDaemon(t, []config.ProxyEntry{a})
+
+	resp, err := proxy.QueryControl(paths.Control, proxy.ControlConns)
+	if err != nil {
+		t.Fatalf("conns: %v", err)
+	}
+	if _, ok := resp.Connections[a.Instance]; !ok {
+		t.Errorf("expected an entry for %s, got %+v", a.Instance, resp.Connections)
+	}
+
+	resp, err = proxy.QueryControl(paths.Control, "bogus")
+	if err != nil {
+		t.Fatalf("bogus: %v", err)
+	}
+	if !strings.Contains(resp.Error, `unknown command "bogus"`) {
+		t.Errorf("expected an unknown command error, got %q", resp.Error)
+	}
+}
+
+func TestRunReload_OverControlSocket(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	set, paths := startControlDaemon(t, []config.ProxyEntry{a})
+
+	writeProxiesConfig(t, a, b)
+	if err := runReload(reloadCmd, nil); err != nil {
+		t.Fatalf("runReload: %v", err)
+	}
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected 2 listeners after reload, got %d", got)
+	}
+	state, err := proxy.ReadState(paths)
+	if err != nil || len(state.Proxies) != 2 {
+		t.Errorf("expected the state file to list 2 proxies, got %+v, %v", state, err)
+	}
+}
+
+func TestRunReload_WithoutControlSocket(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	ctl := runTestDaemon(t, []config.ProxyEntry{a})
+
+	// Without the socket, nothing is signaled: SIGHUP only reopens the log.
+	writeProxiesConfig(t, a, b)
+	err := runReload(reloadCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "control socket is unavailable") {
+		t.Fatalf("expected an error about the control socket, got %v", err)
+	}
+	if got := len(ctl.set.Listeners()); got != 1 {
+		t.Errorf("expected the config to be left alone, got %d listeners", got)
+	}
+}
+
+func TestRunReload_RefusesOtherConfig(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	set, paths := startControlDaemon(t, []config.ProxyEntry{a})
+
+	writeProxiesConfig(t, a)
+	state, err := proxy.ReadState(paths)
+	if err != nil {
+		t.Fatalf("ReadState: %v", err)
+	}
+	state.ConfigPath = absConfigPath()
+	if err := proxy.WriteState(paths, state); err != nil {
+		t.Fatalf("WriteState: %v", err)
+	}
+
+	// A config the daemon doesn't load must not be validated in its place.
+	writeProxiesConfig(t, a, b)
+	err = runReload(reloadCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "run restart") {
+		t.Fatalf("expected reload to refuse another config, got %v", err)
+	}
+	if got := len(set.Listeners()); got != 1 {
+		t.Errorf("expected the config to be left alone, got %d listeners", got)
+	}
+}
+
+func TestRunReload_OverControlSocketReportsFailure(t *testing.T) {
+	ports := freePorts(t, 1)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	set, _ := startControlDaemon(t, []config.ProxyEntry{a})
+
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: busy.Addr().(*net.TCPAddr).Port, Secret: "s"}
+
+	writeProxiesConfig(t, a, b)
+	err = runReload(reloadCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "kept its current config") {
+		t.Fatalf("expected the daemon's reload error, got %v", err)
+	}
+	if got := len(set.Listeners()); got != 1 {
+		t.Errorf("expected the original listener to remain, got %d", got)
+	}
+}
+
+func TestRunReload_TakenPortLeavesListenersUntouched(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	set, paths := startControlDaemon(t, []config.ProxyEntry{a, b})
+
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+
+	// Move a onto the taken port and drop b: neither may happen.
+	moved := a
+	moved.Port = busy.Addr().(*net.TCPAddr).Port
+	writeProxiesConfig(t, moved)
+	if err := runReload(reloadCmd, nil); err == nil {
+		t.Fatal("expected reload onto a taken port to fail")
+	}
+
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected both original listeners to remain, got %d", got)
+	}
+	for _, p := range []config.ProxyEntry{a, b} {
+		conn, err := net.Dial("tcp", p.Addr())
+		if err != nil {
+			t.Errorf("listener for %s should still accept on %s: %v", p.Instance, p.Addr(), err)
+			continue
+		}
+		conn.Close()
+	}
+	state, err := proxy.ReadState(paths)
+	if err != nil || len(state.Proxies) != 2 || state.Proxies[0].Port != a.Port {
+		t.Errorf("expected the state file to keep the old proxies, got %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/preflight"
+
+	"cloud.google.com/go/cloudsqlconn"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// OAuth scopes requested for impersonated credentials.
+const (
+	scopeCloudPlatform = "https://www.googleapis.com/auth/cloud-platform"
+	scopeSQLAdmin      = "https://www.googleapis.com/auth/sqlservice.admin"
+	scopeSQLLogin      = "https://www.googleapis.com/auth/sqlservice.login"
+)
+
+// impersonateFlag is the service account given with --impersonate.
+var impersonateFlag string
+
+// skipAuthCheck is set by --skip-auth-check, or CSPR_SKIP_AUTH_CHECK, to
+// run without the ADC preflight check, e.g. against an emulator.
+var skipAuthCheck bool
+
+// checkCredentials runs the ADC preflight check for cfg, unless
+// --skip-auth-check was given.
+func checkCredentials(ctx context.Context, cfg *config.Config) error {
+	if skipAuthCheck {
+		return nil
+	}
+	return preflight.CheckADC(ctx, preflight.DefaultCredentialFinder, impersonatedAccount(cfg))
+}
+
+// impersonatedTokenSource returns tokens for account with the given scopes,
+// minted from the caller's ADC credentials. Tests replace it.
+var impersonatedTokenSource = func(ctx context.Context, account string, scopes ...string) (oauth2.TokenSource, error) {
+	return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: account,
+		Scopes:          scopes,
+	})
+}
+
+// impersonatedAccount returns the service account to act as: --impersonate,
+// then the config's impersonate_service_account, or "" to use the ADC
+// identity itself. cfg may be nil.
+func impersonatedAccount(cfg *config.Config) string {
+	if impersonateFlag != "" {
+		return impersonateFlag
+	}
+	if cfg != nil {
+		return cfg.ImpersonateServiceAccount
+	}
+	return ""
+}
+
+// secretClientOptions returns the Secret Manager client options for acting
+// as account, or none for the ADC identity.
+func secretClientOptions(ctx context.Context, account string) ([]option.ClientOption, error) {
+	if account == "" {
+		return nil, nil
+	}
+	ts, err := impersonatedTokenSource(ctx, account, scopeCloudPlatform)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %w", account, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// dialerOptions returns the Cloud SQL dialer options for acting as account,
+// or none for the ADC identity. IAM database logins need their own token
+// source, scoped to sqlservice.login.
+func dialerOptions(ctx context.Context, account string) ([]cloudsqlconn.Option, error) {
+	if account == "" {
+		return nil, nil
+	}
+	apiTS, err := impersonatedTokenSource(ctx, account, scopeSQLAdmin, scopeCloudPlatform)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %w", account, err)
+	}
+	loginTS, err := impersonatedTokenSource(ctx, account, scopeSQLLogin)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %w", account, err)
+	}
+	return []cloudsqlconn.Option{cloudsqlconn.WithIAMAuthNTokenSources(apiTS, loginTS)}, nil
+}
+
+// newSecretManagerClient creates a Secret Manager client acting as the
+// config's identity.
+func newSecretManagerClient(ctx context.Context, cfg *config.Config) (*secretmanager.Client, error) {
+	opts, err := secretClientOptions(ctx, impersonatedAccount(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return secretmanager.NewClient(ctx, opts...)
+}
+
+// newCloudSQLDialer creates a Cloud SQL dialer acting as the config's
+// identity.
+func newCloudSQLDialer(ctx context.Context, cfg *config.Config) (*cloudsqlconn.Dialer, error) {
+	opts, err := dialerOptions(ctx, impersonatedAccount(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return cloudsqlconn.NewDialer(ctx, opts...)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+
+	"golang.org/x/oauth2"
+)
+
+// recordTokenSources replaces impersonatedTokenSource for the test, recording
+// the scopes requested for each account.
+func recordTokenSources(t *testing.T) map[string][][]string {
+	t.Helper()
+	calls := make(map[string][][]string)
+	old := impersonatedTokenSource
+	t.Cleanup(func() { impersonatedTokenSource = old })
+	impersonatedTokenSource = func(ctx context.Context, account string, scopes ...string) (oauth2.TokenSource, error) {
+		calls[account] = append(calls[account], scopes)
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil
+	}
+	return calls
+}
+
+func TestImpersonatedAccount(t *testing.T) {
+	old := impersonateFlag
+	defer func() { impersonateFlag = old }()
+
+	cfg := &config.Config{ImpersonateServiceAccount: "cfg@proj.iam.gserviceaccount.com"}
+	impersonateFlag = ""
+	if got := impersonatedAccount(nil); got != "" {
+		t.Errorf("expected no account, got %q", got)
+	}
+	if got := impersonatedAccount(cfg); got != "cfg@proj.iam.gserviceaccount.com" {
+		t.Errorf("expected the config's account, got %q", got)
+	}
+
+	impersonateFlag = "flag@proj.iam.gserviceaccount.com"
+	if got := impersonatedAccount(cfg); got != "flag@proj.iam.gserviceaccount.com" {
+		t.Errorf("expected --impersonate to win, got %q", got)
+	}
+}
+
+func TestCredentialOptions_Impersonate(t *testing.T) {
+	calls := recordTokenSources(t)
+	account := "sa@proj.iam.gserviceaccount.com"
+	ctx := context.Background()
+
+	secretOpts, err := secretClientOptions(ctx, account)
+	if err != nil {
+		t.Fatalf("secretClientOptions: %v", err)
+	}
+	if len(secretOpts) != 1 {
+		t.Errorf("expected 1 Secret Manager option, got %d", len(secretOpts))
+	}
+	dialOpts, err := dialerOptions(ctx, account)
+	if err != nil {
+		t.Fatalf("dialerOptions: %v", err)
+	}
+	if len(dialOpts) != 1 {
+		t.Errorf("expected 1 dialer option, got %d", len(dialOpts))
+	}
+
+	want := [][]string{
+		{scopeCloudPlatform},
+		{scopeSQLAdmin, scopeCloudPlatform},
+		{scopeSQLLogin},
+	}
+	got := calls[account]
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("expected token sources with scopes %v, got %v", want, got)
+	}
+}
+
+func TestCredentialOptions_ADC(t *testing.T) {
+	calls := recordTokenSources(t)
+	ctx := context.Background()
+
+	if opts, err := secretClientOptions(ctx, ""); err != nil || opts != nil {
+		t.Errorf("expected no Secret Manager options, got %v, %v", opts, err)
+	}
+	if opts, err := dialerOptions(ctx, ""); err != nil || opts != nil {
+		t.Errorf("expected no dialer options, got %v, %v", opts, err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no impersonation, got %v", calls)
+	}
+}
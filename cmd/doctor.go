@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/preflight"
+	"cloud-sql-proxy-runner/internal/proxy"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Run every setup check and report which pass",
+	Long:  "Check Google credentials, the config, each proxy's port and access to its secret, and that a Cloud SQL dialer can be created. All checks run even if some fail; the command exits non-zero if any did.",
+	// A failed check is not a usage error.
+	SilenceUsage: true,
+	RunE:         runDoctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// check is one diagnostic run by doctor. run returns nil if it passed. A
+// warn check that doesn't pass is reported but not counted as a failure.
+type check struct {
+	name string
+	run  func() error
+	warn bool
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, cfgErr := loadConfig()
+	checks := []check{{
+		name: "Google Cloud credentials (ADC)",
+		run: func() error {
+			return preflight.CheckADC(ctx, preflight.DefaultCredentialFinder, impersonatedAccount(cfg))
+		},
+	}}
+	checks = append(checks, check{
+		name: "config " + configSource(),
+		run:  func() error { return cfgErr },
+	})
+	if cfg != nil {
+		checks = append(checks, portChecks(cfg.Proxies, runningProxies())...)
+		checks = append(checks, ephemeralPortCheck(cfg.Proxies, preflight.EphemeralPortRange()))
+		if configDir == "" && configPath != config.StdinPath {
+			checks = append(checks, configPermissionCheck(configPath))
+		}
+
+		var checker secrets.AccessChecker
+		client, err := newSecretManagerClient(ctx, cfg)
+		if err == nil {
+			defer client.Close()
+			checker = client
+		}
+		checks = append(checks, secretChecks(ctx, cfg.Proxies, checker, err)...)
+	}
+
+	checks = append(checks, check{
+		name: "Cloud SQL dialer",
+		run: func() error {
+			d, err := newCloudSQLDialer(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			return d.Close()
+		},
+	})
+
+	if failed := runChecks(cmd.OutOrStdout(), checks); failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// runChecks runs every check, printing a line for each, and returns how many
+// failed.
+func runChecks(out io.Writer, checks []check) int {
+	failed := 0
+	for _, c := range checks {
+		err := c.run()
+		if err == nil {
+			fmt.Fprintf(out, "PASS  %s\n", c.name)
+			continue
+		}
+		status := "WARN"
+		if !c.warn {
+			status = "FAIL"
+			failed++
+		}
+		// Indent continuation lines of multi-line errors under the check.
+		lines := strings.Split(strings.TrimSpace(err.Error()), "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" {
+				lines[i] = "      " + lines[i]
+			}
+		}
+		fmt.Fprintf(out, "%s  %s: %s\n", status, c.name, strings.Join(lines, "\n"))
+	}
+	return failed
+}
+
+// runningProxies returns the listener keys served by a running daemon, so
+// their ports aren't reported as taken.
+func runningProxies() map[string]bool {
+	state, err := proxy.ReadState(daemonPaths())
+	if err != nil || !proxy.IsRunning(state.PID) {
+		return nil
+	}
+	keys := make(map[string]bool, len(state.Proxies))
+	for _, p := range config.ExpandPorts(state.Proxies) {
+		keys[proxy.ListenerKey(p)] = true
+	}
+	return keys
+}
+
+// portChecks returns a check per TCP proxy that its port is free. Ports the
+// running daemon already serves for the same proxy pass.
+func portChecks(proxies []config.ProxyEntry, running map[string]bool) []check {
+	var checks []check
+	for _, p := range config.ExpandPorts(proxies) {
+		if p.Socket != "" || p.AutoPort() {
+			continue
+		}
+		checks = append(checks, check{
+			name: fmt.Sprintf("port %d (%s)", p.Port, instanceShortName(p.Instance)),
+			run: func() error {
+				if running[proxy.ListenerKey(p)] {
+					return nil
+				}
+				return preflight.CheckPortsFree([]config.ProxyEntry{p})
+			},
+		})
+	}
+	return checks
+}
+
+// ephemeralPortCheck warns if any TCP proxy's port is within the ephemeral
+// port range r.
+func ephemeralPortCheck(proxies []config.ProxyEntry, r preflight.PortRange) check {
+	return check{
+		name: "ports outside the ephemeral range " + r.String(),
+		warn: true,
+		run: func() error {
+			if warnings := preflight.EphemeralPortWarnings(proxies, r); len(warnings) > 0 {
+				return errors.New(strings.Join(warnings, "\n"))
+			}
+			return nil
+		},
+	}
+}
+
+// configPermissionCheck warns if the config file at path can be read by
+// everyone or written by other users.
+func configPermissionCheck(path string) check {
+	return check{
+		name: "config file permissions",
+		warn: true,
+		run: func() error {
+			if w := preflight.ConfigPermissionWarning(path); w != "" {
+				return errors.New(w)
+			}
+			return nil
+		},
+	}
+}
+
+// secretChecks returns a check per password proxy that its password could be
+// read, without fetching Secret Manager payloads; see checkSecretAccess. If
+// the client couldn't be created, clientErr fails each Secret Manager one.
+func secretChecks(ctx context.Context, proxies []config.ProxyEntry, checker secrets.AccessChecker, clientErr error) []check {
+	var checks []check
+	for _, p := range proxies {
+		if p.IAMAuth() {
+			continue
+		}
+		checks = append(checks, check{
+			name: fmt.Sprintf("secret %s (%s)", p.Secret, instanceShortName(p.Instance)),
+			run: func() error {
+				if p.UsesSecretManager() && clientErr != nil {
+					return fmt.Errorf("creating Secret Manager client: %w", clientErr)
+				}
+				return checkSecretAccess(ctx, checker, p)
+			},
+		})
+	}
+	return checks
+}
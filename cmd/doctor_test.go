@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/preflight"
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+func TestRunChecks_RunsAllAndCountsFailures(t *testing.T) {
+	var ran []string
+	checks := []check{
+		{name: "first", run: func() error { ran = append(ran, "first"); return errors.New("broken\n\nTry again.") }},
+		{name: "second", run: func() error { ran = append(ran, "second"); return nil }},
+		{name: "third", run: func() error { ran = append(ran, "third"); return errors.New("also broken") }},
+	}
+
+	var out bytes.Buffer
+	if failed := runChecks(&out, checks); failed != 2 {
+		t.Errorf("expected 2 failures, got %d", failed)
+	}
+	if len(ran) != 3 {
+		t.Errorf("expected every check to run, ran %v", ran)
+	}
+	want := "FAIL  first: broken\n\n      Try again.\nPASS  second\nFAIL  third: also broken\n"
+	if got := out.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPortChecks(t *testing.T) {
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+	free := freePorts(t, 1)[0]
+
+	taken := config.ProxyEntry{Instance: proxyA.Instance, Port: port}
+	ok := config.ProxyEntry{Instance: proxyB.Instance, Port: free}
+	sock := config.ProxyEntry{Instance: proxyC.Instance, Socket: "/tmp/c.sock"}
+
+	checks := portChecks([]config.ProxyEntry{taken, ok, sock}, nil)
+	if len(checks) != 2 {
+		t.Fatalf("expected a check per TCP proxy, got %d", len(checks))
+	}
+	if err := checks[0].run(); err == nil {
+		t.Error("expected port in use to fail")
+	}
+	if err := checks[1].run(); err != nil {
+		t.Errorf("expected free port to pass, got %v", err)
+	}
+
+	// The daemon serving the proxy itself is not a conflict.
+	checks = portChecks([]config.ProxyEntry{taken}, map[string]bool{proxy.ListenerKey(taken): true})
+	if err := checks[0].run(); err != nil {
+		t.Errorf("port served by the running daemon should pass, got %v", err)
+	}
+}
+
+func TestRunChecks_WarningsDontFail(t *testing.T) {
+	checks := []check{
+		{name: "warned", warn: true, run: func() error { return errors.New("careful") }},
+		{name: "fine", warn: true, run: func() error { return nil }},
+	}
+	var out bytes.Buffer
+	if failed := runChecks(&out, checks); failed != 0 {
+		t.Errorf("expected no failures, got %d", failed)
+	}
+	want := "WARN  warned: careful\nPASS  fine\n"
+	if got := out.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEphemeralPortCheck(t *testing.T) {
+	r := preflight.PortRange{Low: 32768, High: 60999}
+	inside := config.ProxyEntry{Instance: proxyA.Instance, Port: 40000}
+
+	c := ephemeralPortCheck([]config.ProxyEntry{proxyA, proxyB}, r)
+	if !c.warn {
+		t.Error("expected a warning check")
+	}
+	if err := c.run(); err != nil {
+		t.Errorf("expected ports below the range to pass, got %v", err)
+	}
+	c = ephemeralPortCheck([]config.ProxyEntry{proxyA, inside}, r)
+	if err := c.run(); err == nil || !strings.Contains(err.Error(), "port 40000") {
+		t.Errorf("expected a warning for port 40000, got %v", err)
+	}
+}
+
+// fakeAccessChecker grants access to every secret except those in denied,
+// and records the secrets it was asked about.
+type fakeAccessChecker struct {
+	denied  map[string]bool
+	checked []string
+}
+
+func (c *fakeAccessChecker) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest, opts ...gax.CallOption) (*iampb.TestIamPermissionsResponse, error) {
+	c.checked = append(c.checked, req.Resource)
+	if c.denied[req.Resource] {
+		return &iampb.TestIamPermissionsResponse{}, nil
+	}
+	return &iampb.TestIamPermissionsResponse{Permissions: req.Permissions}, nil
+}
+
+func TestSecretChecks(t *testing.T) {
+	iam := config.ProxyEntry{Instance: "proj:us-central1:db-iam", Port: 5435, Auth: config.AuthIAM}
+	proxies := []config.ProxyEntry{proxyA, proxyB, iam}
+	ctx := context.Background()
+
+	checker := &fakeAccessChecker{}
+	checks := secretChecks(ctx, proxies, checker, nil)
+	if len(checks) != 2 {
+		t.Fatalf("expected IAM proxies to be skipped, got %d checks", len(checks))
+	}
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+	// Access is tested on the secrets, not their versions' payloads.
+	want := []string{"projects/proj/secrets/secret-a", "projects/proj/secrets/secret-b"}
+	if !reflect.DeepEqual(checker.checked, want) {
+		t.Errorf("checked %v, want %v", checker.checked, want)
+	}
+
+	checker.denied = map[string]bool{"projects/proj/secrets/secret-b": true}
+	if err := checks[1].run(); err == nil || !strings.Contains(err.Error(), "Secret Accessor") {
+		t.Errorf("expected an access error for secret-b, got %v", err)
+	}
+
+	checks = secretChecks(ctx, proxies, nil, errors.New("no credentials"))
+	err := checks[0].run()
+	if err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("expected the client error, got %v", err)
+	}
+}
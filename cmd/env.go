@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	"github.com/spf13/cobra"
+)
+
+// env output formats.
+const (
+	envFormatPosix    = "posix"
+	envFormatFish     = "fish"
+	envFormatPassword = "password"
+)
+
+var envFormat string
+
+var envCmd = &cobra.Command{
+	Use:   "env <instance>",
+	Short: "Print shell commands that set a proxy's connection variables",
+	Long:  "Look up the proxy for an instance (by short name or full connection name), fetch its password, and print commands exporting the variables psql or mysql read to connect through it, for use as eval \"$(cloud-sql-proxy-runner env mydb)\". Use --format fish for fish, or --format password to print only the password.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runEnv,
+}
+
+func init() {
+	envCmd.Flags().StringVar(&envFormat, "format", envFormatPosix, "output format: posix, fish, or password")
+	rootCmd.AddCommand(envCmd)
+}
+
+func runEnv(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	switch envFormat {
+	case envFormatPosix, envFormatFish, envFormatPassword:
+	default:
+		return fmt.Errorf("invalid --format %q: must be posix, fish, or password", envFormat)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := findProxy(boundProxies(cfg.Proxies), args[0])
+	if err != nil {
+		return err
+	}
+
+	// Only passwords in Secret Manager need a client. IAM proxies log in
+	// with the daemon's credentials, so there is no password to fetch.
+	var client secrets.SecretClient
+	if p.UsesSecretManager() {
+		if err := checkCredentials(ctx, cfg); err != nil {
+			return err
+		}
+		smClient, err := newSecretManagerClient(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("creating Secret Manager client: %w", err)
+		}
+		defer smClient.Close()
+		client = secrets.NewRetryingSecretClient(smClient, cfg.SecretAttemptsOrDefault())
+	}
+	return writeEnv(ctx, cmd.OutOrStdout(), client, p, envFormat)
+}
+
+// writeEnv fetches the proxy's password, unless it uses IAM authentication,
+// and prints its connection variables in format.
+func writeEnv(ctx context.Context, out io.Writer, client secrets.SecretClient, p config.ProxyEntry, format string) error {
+	var password string
+	if p.IAMAuth() {
+		if format == envFormatPassword {
+			return fmt.Errorf("%s uses IAM database authentication and has no password", p.Instance)
+		}
+	} else {
+		var err error
+		password, err = fetchPassword(ctx, client, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if format == envFormatPassword {
+		fmt.Fprintln(out, password)
+		return nil
+	}
+	env, err := connectionEnv(p, password)
+	if err != nil {
+		return err
+	}
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if format == envFormatFish {
+			fmt.Fprintf(out, "set -gx %s %s;\n", key, fishQuote(value))
+		} else {
+			fmt.Fprintf(out, "export %s=%s\n", key, shellQuote(value))
+		}
+	}
+	return nil
+}
+
+// connectionEnv returns the KEY=value variables that point the proxy's
+// database client at it. An empty password, as for IAM proxies, is left out.
+// The mysql client has no variable for the user, so MySQL proxies' users are
+// left out too.
+func connectionEnv(p config.ProxyEntry, password string) ([]string, error) {
+	if p.EngineOrDefault() != config.EngineMySQL {
+		_, _, env, err := clientCommand(p, password)
+		return env, err
+	}
+	var env []string
+	if p.Socket != "" {
+		env = append(env, "MYSQL_UNIX_PORT="+p.Socket)
+	} else {
+		host, port, _ := net.SplitHostPort(p.DialAddr())
+		// mysql takes localhost to mean its default socket, so name the
+		// loopback address to connect over TCP.
+		if host == "localhost" {
+			host = "127.0.0.1"
+		}
+		env = append(env, "MYSQL_HOST="+host, "MYSQL_TCP_PORT="+port)
+	}
+	if password != "" {
+		env = append(env, "MYSQL_PWD="+password)
+	}
+	return env, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s for fish, where backslashes and single quotes are
+// escaped inside single quotes.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
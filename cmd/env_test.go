@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestWriteEnv(t *testing.T) {
+	client := &rotatingSecretClient{
+		payloads: map[string]string{"projects/proj/secrets/pw/versions/latest": "it's"},
+		calls:    make(map[string]int),
+	}
+	postgres := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 5432, Secret: "pw", User: "app"}
+	mysql := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 3306, Secret: "pw", Engine: config.EngineMySQL, User: "root"}
+	mysqlSocket := config.ProxyEntry{Instance: "proj:us-central1:db", Socket: "/tmp/db.sock", Engine: config.EngineMySQL, Secret: "pw"}
+	iam := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 5432, Auth: config.AuthIAM, User: "app@proj.iam"}
+
+	tests := []struct {
+		name   string
+		proxy  config.ProxyEntry
+		format string
+		want   string
+	}{
+		{
+			name:   "posix",
+			proxy:  postgres,
+			format: envFormatPosix,
+			want:   "export PGHOST='localhost'\nexport PGPORT='5432'\nexport PGPASSWORD='it'\\''s'\nexport PGUSER='app'\n",
+		},
+		{
+			name:   "fish",
+			proxy:  postgres,
+			format: envFormatFish,
+			want:   "set -gx PGHOST 'localhost';\nset -gx PGPORT '5432';\nset -gx PGPASSWORD 'it\\'s';\nset -gx PGUSER 'app';\n",
+		},
+		{
+			name:   "password",
+			proxy:  postgres,
+			format: envFormatPassword,
+			want:   "it's\n",
+		},
+		{
+			name:   "mysql",
+			proxy:  mysql,
+			format: envFormatPosix,
+			want:   "export MYSQL_HOST='127.0.0.1'\nexport MYSQL_TCP_PORT='3306'\nexport MYSQL_PWD='it'\\''s'\n",
+		},
+		{
+			name:   "mysql socket",
+			proxy:  mysqlSocket,
+			format: envFormatPosix,
+			want:   "export MYSQL_UNIX_PORT='/tmp/db.sock'\nexport MYSQL_PWD='it'\\''s'\n",
+		},
+		{
+			name:   "IAM",
+			proxy:  iam,
+			format: envFormatPosix,
+			want:   "export PGHOST='localhost'\nexport PGPORT='5432'\nexport PGUSER='app@proj.iam'\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeEnv(context.Background(), &out, client, tt.proxy, tt.format); err != nil {
+				t.Fatalf("writeEnv: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteEnv_Errors(t *testing.T) {
+	client := &rotatingSecretClient{calls: make(map[string]int)}
+	ctx := context.Background()
+
+	iam := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 5432, Auth: config.AuthIAM}
+	err := writeEnv(ctx, &bytes.Buffer{}, client, iam, envFormatPassword)
+	if err == nil || !strings.Contains(err.Error(), "no password") {
+		t.Errorf("expected an error for an IAM proxy's password, got %v", err)
+	}
+
+	var out bytes.Buffer
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 5432, Secret: "missing"}
+	if err := writeEnv(ctx, &out, client, p, envFormatPosix); err == nil {
+		t.Error("expected an error when the secret can't be fetched")
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output after an error, got %q", out.String())
+	}
+}
+
+func TestRunEnv_UnknownProxy(t *testing.T) {
+	writeProxiesConfig(t, proxyA, proxyB)
+	err := runEnv(envCmd, []string{"db-z"})
+	if err == nil || !strings.Contains(err.Error(), `no proxy for "db-z"`) {
+		t.Errorf("expected an unknown proxy error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package cmd
+
+import "syscall"
+
+// execClient replaces this process with the database client.
+func execClient(path string, argv, env []string) error {
+	return syscall.Exec(path, argv, env)
+}
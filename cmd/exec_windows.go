@@ -0,0 +1,30 @@
+//go:build windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// execClient runs the database client attached to this console and exits
+// with its status. Windows can't replace a running process the way exec(2)
+// does.
+func execClient(path string, argv, env []string) error {
+	c := exec.Command(path, argv[1:]...)
+	c.Env = env
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
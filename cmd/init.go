@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"cloud-sql-proxy-runner/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+// configTemplate is the starter config init writes. The placeholders in
+// capitals don't pass validation, so a config can't be used until they are
+// filled in.
+const configTemplate = `# cloud-sql-proxy-runner config. Replace the placeholders in capitals, then
+# check the file with: cloud-sql-proxy-runner validate
+proxies:
+  # Cloud SQL connection string, as shown on the instance's overview page.
+  - instance: "PROJECT:REGION:INSTANCE"
+    # Local port to listen on (1024-65535). Clients connect to localhost:5432.
+    port: 5432
+    # Secret Manager secret, in the instance's project, holding the database
+    # password. Not needed with auth: iam.
+    secret: "SECRET_NAME"
+    # Secret version to fetch: latest, a version number to pin, or an alias.
+    # secret_version: latest
+    # Database user for the connect command.
+    # user: postgres
+    # postgres or mysql; defaults to postgres.
+    # engine: postgres
+    # Free-form labels for filtering, e.g. list --tag team=payments.
+    # tags:
+    #   team: payments
+`
+
+var initForce bool
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a starter config",
+	Long:  "Write a commented config template with one example proxy to the --config path, creating its directory. Fill in the placeholders before use.",
+	Args:  cobra.NoArgs,
+	RunE:  runInit,
+}
+
+func init() {
+	initCmd.Flags().BoolVar(&initForce, "force", false, "overwrite an existing config")
+	rootCmd.AddCommand(initCmd)
+}
+
+func runInit(cmd *cobra.Command, args []string) error {
+	if configPath == config.StdinPath {
+		return fmt.Errorf("init needs a file path for --config, not %s", config.StdinPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return fmt.Errorf("creating config dir: %w", err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if initForce {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(configPath, flags, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists; use --force to overwrite it", configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	if _, err := f.WriteString(configTemplate); err != nil {
+		f.Close()
+		return fmt.Errorf("writing config: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s\n", configPath)
+	return nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestRunInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "dir", "config.yaml")
+
+	oldPath, oldForce := configPath, initForce
+	defer func() { configPath, initForce = oldPath, oldForce }()
+	configPath, initForce = path, false
+
+	var out bytes.Buffer
+	initCmd.SetOut(&out)
+	defer initCmd.SetOut(nil)
+
+	if err := runInit(initCmd, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.String(); got != "Wrote "+path+"\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	if _, err := config.Parse(data); err == nil {
+		t.Error("expected the template to fail validation until the placeholders are filled")
+	}
+	filled := strings.NewReplacer(
+		"PROJECT:REGION:INSTANCE", "my-project:us-central1:my-database",
+		"SECRET_NAME", "db-password",
+	).Replace(string(data))
+	cfg, err := config.Parse([]byte(filled))
+	if err != nil {
+		t.Fatalf("filled template doesn't parse: %v", err)
+	}
+	if len(cfg.Proxies) != 1 || cfg.Proxies[0].Port != 5432 {
+		t.Errorf("unexpected proxies %+v", cfg.Proxies)
+	}
+}
+
+func TestRunInit_RefusesToOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("existing"), 0644)
+
+	oldPath, oldForce := configPath, initForce
+	defer func() { configPath, initForce = oldPath, oldForce }()
+	configPath, initForce = path, false
+
+	initCmd.SetOut(&bytes.Buffer{})
+	defer initCmd.SetOut(nil)
+
+	err := runInit(initCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("expected error suggesting --force, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "existing" {
+		t.Errorf("config was overwritten: %q", data)
+	}
+
+	initForce = true
+	if err := runInit(initCmd, nil); err != nil {
+		t.Fatalf("unexpected error with --force: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != configTemplate {
+		t.Error("expected --force to write the template")
+	}
+}
@@ -3,20 +3,27 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"text/tabwriter"
+	"text/template"
 
 	"cloud-sql-proxy-runner/internal/config"
-	"cloud-sql-proxy-runner/internal/preflight"
 	"cloud-sql-proxy-runner/internal/proxy"
 	"cloud-sql-proxy-runner/internal/secrets"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
 
-var showPasswords bool
+var (
+	showPasswords bool
+	tagFilters    []string
+	listFormat    string
+)
 
 var listCmd = &cobra.Command{
 	Use:   "list",
@@ -26,86 +33,230 @@ var listCmd = &cobra.Command{
 
 func init() {
 	listCmd.Flags().BoolVar(&showPasswords, "show-passwords", false, "show database passwords")
+	listCmd.Flags().StringArrayVar(&tagFilters, "tag", nil, "only list proxies with this tag (key=value, repeatable)")
+	listCmd.Flags().StringVar(&listFormat, "format", "", "print each proxy using a Go template, e.g. '{{.Instance}} {{.Port}}'")
 	rootCmd.AddCommand(listCmd)
 }
 
 func runList(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
-	cfg, err := config.Load(configPath)
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	stateDir := proxy.StateDir()
+	tags, err := parseTagFilters(tagFilters)
+	if err != nil {
+		return err
+	}
+	proxies := filterByTags(cfg.Proxies, tags)
+
+	var tmpl *template.Template
+	if listFormat != "" {
+		if tmpl, err = parseFormat(listFormat); err != nil {
+			return err
+		}
+	}
+
 	daemonRunning := false
+	var stats map[string]proxy.ProxyStats
 
-	state, err := proxy.ReadState(stateDir)
+	state, err := readDaemonState(daemonPaths())
 	if err == nil && proxy.IsRunning(state.PID) {
 		daemonRunning = true
+		proxies = config.AssignPorts(proxies, state.AutoPorts)
+		if w := staleConfigWarning(state); w != "" {
+			fmt.Fprintln(os.Stderr, w)
+		}
+		stats = state.Stats
 	}
 
 	// Fetch passwords if requested
 	var passwords map[string]string
 	if showPasswords {
-		if err := preflight.CheckADC(ctx, preflight.DefaultCredentialFinder); err != nil {
-			return err
+		var client secrets.SecretClient
+		if needsSecretManager(proxies) {
+			if err := checkCredentials(ctx, cfg); err != nil {
+				return err
+			}
+			smClient, err := newSecretManagerClient(ctx, cfg)
+			if err != nil {
+				return fmt.Errorf("creating Secret Manager client: %w", err)
+			}
+			defer smClient.Close()
+			client = secrets.NewRetryingSecretClient(smClient, cfg.SecretAttemptsOrDefault())
 		}
 
-		client, err := secretmanager.NewClient(ctx)
+		passwords, err = fetchPasswords(ctx, client, proxies, cfg.SecretConcurrencyOrDefault())
 		if err != nil {
-			return fmt.Errorf("creating Secret Manager client: %w", err)
+			return err
 		}
-		defer client.Close()
+	}
 
-		passwords, err = fetchPasswords(ctx, client, cfg.Proxies)
-		if err != nil {
-			return err
+	status := "stopped"
+	if daemonRunning {
+		status = "running"
+	}
+	rows := make([]listRow, 0, len(proxies))
+	for _, p := range proxies {
+		// Only templates show health, so the table doesn't wait on probes.
+		var health string
+		if daemonRunning && tmpl != nil {
+			health = healthString(probePort(p))
 		}
+		rows = append(rows, listRow{
+			Instance:   p.Instance,
+			Port:       p.Port,
+			Ports:      p.Ports(),
+			Socket:     p.Socket,
+			Listen:     portOrSocket(p),
+			Project:    p.Project(),
+			Status:     status,
+			Health:     health,
+			Active:     stats[p.Instance].ActiveConns,
+			Connected:  stats[p.Instance].Connected,
+			DialErrors: stats[p.Instance].DialErrors,
+			Password:   passwords[p.Instance],
+			Tags:       p.Tags,
+		})
 	}
 
-	// Print table
-	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
-	if showPasswords {
-		fmt.Fprintln(w, "INSTANCE\tPORT\tPROJECT\tSTATUS\tPASSWORD")
-	} else {
-		fmt.Fprintln(w, "INSTANCE\tPORT\tPROJECT\tSTATUS")
+	if tmpl != nil {
+		return writeTemplate(os.Stdout, tmpl, rows)
 	}
+	writeTable(os.Stdout, rows, showPasswords, !quiet)
+	return nil
+}
+
+// listRow is one proxy as shown by list. Its fields are what --format
+// templates can reference.
+type listRow struct {
+	Instance string
+	Port     int
+	Ports    []int // every port, for proxies listening on several
+	Socket   string
+	Listen   string // the PORT column: the ports, or the socket path
+	Project  string
+	Status   string
+	Health   string // listening or unreachable, as status shows; empty while stopped
+	Active   int    // open connections, as last recorded by the daemon
+	// Connected and DialErrors are the daemon's lifetime counts of
+	// connections made to the instance and failed dial attempts.
+	Connected  int64
+	DialErrors int64
+	Password   string
+	Tags       map[string]string
+}
 
-	for _, p := range cfg.Proxies {
-		status := "stopped"
-		if daemonRunning {
-			status = "running"
+func writeTable(out io.Writer, rows []listRow, withPasswords, header bool) {
+	w := tabwriter.NewWriter(out, 0, 4, 3, ' ', 0)
+	switch {
+	case !header:
+	case withPasswords:
+		fmt.Fprintln(w, "INSTANCE\tPORT\tPROJECT\tSTATUS\tCONNECTED\tDIAL ERRORS\tACTIVE\tPASSWORD")
+	default:
+		fmt.Fprintln(w, "INSTANCE\tPORT\tPROJECT\tSTATUS\tCONNECTED\tDIAL ERRORS\tACTIVE")
+	}
+	for _, r := range rows {
+		// Counters are only known while the daemon is running.
+		connected, dialErrors, active := "-", "-", "-"
+		if r.Status == "running" {
+			connected = strconv.FormatInt(r.Connected, 10)
+			dialErrors = strconv.FormatInt(r.DialErrors, 10)
+			active = strconv.Itoa(r.Active)
 		}
-		if showPasswords {
-			pw := passwords[p.Instance]
-			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", p.Instance, p.Port, p.Project(), status, pw)
+		if withPasswords {
+			password := r.Password
+			if password == "" {
+				password = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Instance, r.Listen, r.Project, r.Status, connected, dialErrors, active, password)
 		} else {
-			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", p.Instance, p.Port, p.Project(), status)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Instance, r.Listen, r.Project, r.Status, connected, dialErrors, active)
 		}
 	}
 	w.Flush()
+}
+
+// portOrSocket returns what to show in a PORT column: the ports, separated
+// by commas, or the socket path for socket entries.
+func portOrSocket(p config.ProxyEntry) string {
+	if p.Socket != "" {
+		return p.Socket
+	}
+	return p.PortList()
+}
+
+// parseFormat parses a --format template, which is executed once per proxy.
+func parseFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func writeTemplate(out io.Writer, tmpl *template.Template, rows []listRow) error {
+	for _, r := range rows {
+		if err := tmpl.Execute(out, r); err != nil {
+			return fmt.Errorf("invalid --format template: %w", err)
+		}
+		fmt.Fprintln(out)
+	}
 	return nil
 }
 
-func fetchPasswords(ctx context.Context, client secrets.SecretClient, proxies []config.ProxyEntry) (map[string]string, error) {
-	passwords := make(map[string]string)
-	g, ctx := errgroup.WithContext(ctx)
+// parseTagFilters parses --tag arguments of the form key=value.
+func parseTagFilters(args []string) (map[string]string, error) {
+	tags := make(map[string]string, len(args))
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid --tag %q: expected key=value", arg)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
 
-	type result struct {
-		instance string
-		password string
+func filterByTags(proxies []config.ProxyEntry, tags map[string]string) []config.ProxyEntry {
+	if len(tags) == 0 {
+		return proxies
+	}
+	var out []config.ProxyEntry
+	for _, p := range proxies {
+		if p.HasTags(tags) {
+			out = append(out, p)
+		}
 	}
-	results := make(chan result, len(proxies))
+	return out
+}
+
+// fetchPasswords fetches the password for each proxy, keyed by instance, at
+// most limit at a time so a large config doesn't burst into Secret Manager's
+// rate limits. Lookups go through a cache, so proxies that share a secret
+// version trigger a single fetch. IAM proxies have no password and are
+// skipped.
+func fetchPasswords(ctx context.Context, client secrets.SecretClient, proxies []config.ProxyEntry, limit int) (map[string]string, error) {
+	cache := secrets.NewCachingSecretClient(client)
 
+	var mu sync.Mutex
+	passwords := make(map[string]string, len(proxies))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(limit)
 	for _, p := range proxies {
-		p := p
+		if p.IAMAuth() {
+			continue
+		}
 		g.Go(func() error {
-			pw, err := secrets.FetchSecret(ctx, client, p.Project(), p.Secret)
+			pw, err := fetchPassword(ctx, cache, p)
 			if err != nil {
 				return err
 			}
-			results <- result{instance: p.Instance, password: pw}
+			mu.Lock()
+			passwords[p.Instance] = pw
+			mu.Unlock()
 			return nil
 		})
 	}
@@ -113,10 +264,5 @@ func fetchPasswords(ctx context.Context, client secrets.SecretClient, proxies []
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
-	close(results)
-
-	for r := range results {
-		passwords[r.instance] = r.password
-	}
 	return passwords, nil
 }
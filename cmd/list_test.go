@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+func TestParseTagFilters(t *testing.T) {
+	tags, err := parseTagFilters([]string{"team=payments", "tier=prod"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags["team"] != "payments" || tags["tier"] != "prod" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+
+	for _, bad := range []string{"team", "=payments"} {
+		if _, err := parseTagFilters([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestFilterByTags(t *testing.T) {
+	payments := config.ProxyEntry{Instance: "proj:us-central1:pay", Port: 5432, Secret: "s", Tags: map[string]string{"team": "payments", "tier": "prod"}}
+	search := config.ProxyEntry{Instance: "proj:us-central1:search", Port: 5433, Secret: "s", Tags: map[string]string{"team": "search", "tier": "prod"}}
+	untagged := config.ProxyEntry{Instance: "proj:us-central1:misc", Port: 5434, Secret: "s"}
+	all := []config.ProxyEntry{payments, search, untagged}
+
+	if got := filterByTags(all, nil); len(got) != 3 {
+		t.Errorf("expected no filter to keep all proxies, got %d", len(got))
+	}
+	got := filterByTags(all, map[string]string{"team": "payments"})
+	if len(got) != 1 || got[0].Instance != payments.Instance {
+		t.Errorf("expected only payments proxy, got %v", got)
+	}
+	if got := filterByTags(all, map[string]string{"tier": "prod"}); len(got) != 2 {
+		t.Errorf("expected 2 prod proxies, got %d", len(got))
+	}
+	if got := filterByTags(all, map[string]string{"tier": "dev"}); len(got) != 0 {
+		t.Errorf("expected no dev proxies, got %d", len(got))
+	}
+}
+
+type countingSecretClient struct {
+	calls atomic.Int32
+}
+
+func (c *countingSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	c.calls.Add(1)
+	return &smpb.AccessSecretVersionResponse{
+		Payload: &smpb.SecretPayload{Data: []byte("pw-for-" + req.Name)},
+	}, nil
+}
+
+func TestFetchPasswords_SharedSecretFetchedOnce(t *testing.T) {
+	client := &countingSecretClient{}
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Secret: "shared"},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Secret: "shared"},
+	}
+
+	passwords, err := fetchPasswords(context.Background(), client, proxies, config.DefaultSecretConcurrency)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if n := client.calls.Load(); n != 1 {
+		t.Errorf("expected 1 secret fetch, got %d", n)
+	}
+	want := "pw-for-projects/proj/secrets/shared/versions/latest"
+	for _, p := range proxies {
+		if passwords[p.Instance] != want {
+			t.Errorf("password for %s = %q, want %q", p.Instance, passwords[p.Instance], want)
+		}
+	}
+}
+
+func TestFetchPasswords_SkipsIAMProxies(t *testing.T) {
+	client := &countingSecretClient{}
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Secret: "pw"},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Auth: config.AuthIAM},
+	}
+
+	passwords, err := fetchPasswords(context.Background(), client, proxies, config.DefaultSecretConcurrency)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if n := client.calls.Load(); n != 1 {
+		t.Errorf("expected 1 secret fetch, got %d", n)
+	}
+	if _, ok := passwords[proxies[1].Instance]; ok {
+		t.Errorf("IAM proxy should have no password, got %q", passwords[proxies[1].Instance])
+	}
+}
+
+func TestFetchPasswords_SameSecretNameDifferentProjects(t *testing.T) {
+	client := &countingSecretClient{}
+	proxies := []config.ProxyEntry{
+		{Instance: "proj-a:us-central1:db", Port: 5432, Secret: "shared"},
+		{Instance: "proj-b:us-central1:db", Port: 5433, Secret: "shared"},
+	}
+
+	passwords, err := fetchPasswords(context.Background(), client, proxies, config.DefaultSecretConcurrency)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("expected 2 secret fetches, got %d", n)
+	}
+	if passwords[proxies[0].Instance] == passwords[proxies[1].Instance] {
+		t.Error("expected distinct passwords for distinct projects")
+	}
+}
+
+// concurrentSecretClient records the most fetches it has seen in flight at
+// once. Each fetch holds its slot briefly so overlapping calls are observed.
+type concurrentSecretClient struct {
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (c *concurrentSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	n := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		seen := c.maxInFlight.Load()
+		if n <= seen || c.maxInFlight.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return &smpb.AccessSecretVersionResponse{
+		Payload: &smpb.SecretPayload{Data: []byte("pw-for-" + req.Name)},
+	}, nil
+}
+
+func TestFetchPasswords_ConcurrencyLimit(t *testing.T) {
+	client := &concurrentSecretClient{}
+	var proxies []config.ProxyEntry
+	for i := range 50 {
+		proxies = append(proxies, config.ProxyEntry{
+			Instance: fmt.Sprintf("proj:us-central1:db-%d", i),
+			Port:     5432 + i,
+			Secret:   fmt.Sprintf("pw-%d", i),
+		})
+	}
+
+	const limit = 4
+	passwords, err := fetchPasswords(context.Background(), client, proxies, limit)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if len(passwords) != len(proxies) {
+		t.Errorf("expected %d passwords, got %d", len(proxies), len(passwords))
+	}
+	if got := client.maxInFlight.Load(); got > limit {
+		t.Errorf("expected at most %d fetches in flight, saw %d", limit, got)
+	} else if got < 2 {
+		t.Errorf("expected fetches to run concurrently, saw at most %d in flight", got)
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	tmpl, err := parseFormat("{{.Instance}} {{.Port}} {{.Status}} {{index .Tags \"team\"}}")
+	if err != nil {
+		t.Fatalf("parseFormat: %v", err)
+	}
+	rows := []listRow{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Status: "running", Tags: map[string]string{"team": "payments"}},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Status: "running", Tags: map[string]string{"team": "search"}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeTemplate(&buf, tmpl, rows); err != nil {
+		t.Fatalf("writeTemplate: %v", err)
+	}
+	want := "proj:us-central1:db-a 5432 running payments\nproj:us-central1:db-b 5433 running search\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRunList_FormatHealth(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	runTestDaemon(t, []config.ProxyEntry{a})
+	writeProxiesConfig(t, a, b)
+
+	old := listFormat
+	t.Cleanup(func() { listFormat = old })
+	listFormat = "{{.Instance}} {{.Health}}"
+	var err error
+	out := captureStdout(t, func() { err = runList(listCmd, nil) })
+	if err != nil {
+		t.Fatalf("runList: %v", err)
+	}
+	want := a.Instance + " listening\n" + b.Instance + " unreachable\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestParseFormat_Invalid(t *testing.T) {
+	_, err := parseFormat("{{.Instance")
+	if err == nil {
+		t.Fatal("expected error for malformed template")
+	}
+	if !strings.Contains(err.Error(), "invalid --format template") {
+		t.Errorf("expected clear error, got: %v", err)
+	}
+}
+
+func TestWriteTemplate_UnknownField(t *testing.T) {
+	tmpl, err := parseFormat("{{.Nope}}")
+	if err != nil {
+		t.Fatalf("parseFormat: %v", err)
+	}
+	err = writeTemplate(&bytes.Buffer{}, tmpl, []listRow{{Instance: "proj:us-central1:db"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid --format template") {
+		t.Errorf("expected clear error for unknown field, got: %v", err)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	rows := []listRow{{Instance: "proj:us-central1:db", Port: 5432, Listen: "5432", Project: "proj", Status: "stopped", Password: "s3cret"}}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, true)
+	if strings.Contains(buf.String(), "s3cret") || strings.Contains(buf.String(), "PASSWORD") {
+		t.Errorf("expected no password column, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	writeTable(&buf, rows, true, true)
+	if !strings.Contains(buf.String(), "PASSWORD") || !strings.Contains(buf.String(), "s3cret") {
+		t.Errorf("expected password column, got:\n%s", buf.String())
+	}
+}
+
+func TestWriteTable_Active(t *testing.T) {
+	rows := []listRow{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Listen: "5432", Project: "proj", Status: "running", Active: 4},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Listen: "5433", Project: "proj", Status: "stopped"},
+	}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.HasSuffix(lines[0], "ACTIVE") {
+		t.Errorf("expected ACTIVE column, got header %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " 4") {
+		t.Errorf("expected 4 active connections for running proxy, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], " -") {
+		t.Errorf("expected no count for stopped proxy, got %q", lines[2])
+	}
+}
+
+func TestWriteTable_Counters(t *testing.T) {
+	rows := []listRow{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Listen: "5432", Project: "proj", Status: "running", Active: 1, Connected: 120, DialErrors: 3},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Listen: "5433", Project: "proj", Status: "stopped"},
+	}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], "CONNECTED") || !strings.Contains(lines[0], "DIAL ERRORS") {
+		t.Errorf("expected CONNECTED and DIAL ERRORS columns, got header %q", lines[0])
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 7 || fields[4] != "120" || fields[5] != "3" {
+		t.Errorf("expected 120 connected and 3 dial errors for running proxy, got %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 7 || fields[4] != "-" || fields[5] != "-" {
+		t.Errorf("expected no counts for stopped proxy, got %q", lines[2])
+	}
+}
+
+func TestWriteTable_MultiplePorts(t *testing.T) {
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 5432, ExtraPorts: []int{6432}}
+	rows := []listRow{{Instance: p.Instance, Port: p.Port, Ports: p.Ports(), Listen: portOrSocket(p), Project: "proj", Status: "running"}}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, false)
+	if fields := strings.Fields(buf.String()); len(fields) < 2 || fields[1] != "5432,6432" {
+		t.Errorf("expected both ports in the PORT column, got %q", buf.String())
+	}
+}
+
+func TestWriteTable_Socket(t *testing.T) {
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Socket: "/cloudsql/proj:us-central1:db"}
+	rows := []listRow{{Instance: p.Instance, Socket: p.Socket, Listen: portOrSocket(p), Project: "proj", Status: "running"}}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, true)
+	if !strings.Contains(buf.String(), "/cloudsql/proj:us-central1:db") {
+		t.Errorf("expected socket path in place of port, got:\n%s", buf.String())
+	}
+}
+
+func TestWriteTable_AutoPort(t *testing.T) {
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: 0}
+	rows := []listRow{{Instance: p.Instance, Ports: p.Ports(), Listen: portOrSocket(p), Project: "proj", Status: "stopped"}}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, false)
+	if fields := strings.Fields(buf.String()); len(fields) < 2 || fields[1] != "auto" {
+		t.Errorf("expected auto in the PORT column, got %q", buf.String())
+	}
+}
+
+func TestWriteTable_NoHeader(t *testing.T) {
+	rows := []listRow{{Instance: "proj:us-central1:db", Port: 5432, Listen: "5432", Project: "proj", Status: "stopped"}}
+
+	var buf bytes.Buffer
+	writeTable(&buf, rows, false, false)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "proj:us-central1:db") {
+		t.Errorf("expected only the row, got:\n%s", buf.String())
+	}
+}
+
+func TestFetchPasswords_PinnedVersions(t *testing.T) {
+	client := &countingSecretClient{}
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:us-central1:db-a", Port: 5432, Secret: "shared", SecretVersion: "3"},
+		{Instance: "proj:us-central1:db-b", Port: 5433, Secret: "shared"},
+	}
+
+	passwords, err := fetchPasswords(context.Background(), client, proxies, config.DefaultSecretConcurrency)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("expected 2 secret fetches, got %d", n)
+	}
+	want := "pw-for-projects/proj/secrets/shared/versions/3"
+	if passwords[proxies[0].Instance] != want {
+		t.Errorf("password for %s = %q, want %q", proxies[0].Instance, passwords[proxies[0].Instance], want)
+	}
+}
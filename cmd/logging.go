@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+// logOutput is where the daemon writes log entries. launchDaemon points the
+// daemon's stderr at the log file.
+var logOutput io.Writer = os.Stderr
+
+// logLevelFlag is the --log-level flag. When set it overrides every level in
+// the config.
+var logLevelFlag string
+
+// logLevel is the daemon's log level, updated when the config is reloaded.
+var logLevel slog.LevelVar
+
+// validateLogLevelFlag rejects an unknown --log-level before the daemon is
+// launched, where the error would only reach the log.
+func validateLogLevelFlag() error {
+	if logLevelFlag == "" {
+		return nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevelFlag)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: must be debug, info, warn, or error", logLevelFlag)
+	}
+	return nil
+}
+
+// logFormat is the daemon log's format, set from the config at startup.
+var logFormat = config.LogFormatText
+
+// setupLogging makes the daemon's log entries structured, in the format and
+// at the level set by cfg or --log-level. Plain log package output goes
+// through the same handler.
+func setupLogging(cfg *config.Config) {
+	applyLogLevel(cfg)
+	logFormat = cfg.LogFormatOrDefault()
+	slog.SetDefault(slog.New(newLogHandler(&logLevel)))
+}
+
+// newLogHandler returns a handler writing the daemon's log entries at level
+// to logOutput, in logFormat.
+func newLogHandler(level slog.Leveler) slog.Handler {
+	if logFormat == config.LogFormatJSON {
+		return slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: level, ReplaceAttr: jsonLogKey})
+	}
+	return slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: level})
+}
+
+// jsonLogKey renames the keys of JSON log entries to the stable names log
+// pipelines match on: ts, event, and, for connections, remote and error.
+// instance and port keep their names.
+func jsonLogKey(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.TimeKey:
+		a.Key = "ts"
+	case slog.MessageKey:
+		a.Key = "event"
+	case "client":
+		a.Key = "remote"
+	case "err":
+		a.Key = "error"
+	}
+	return a
+}
+
+// applyLogLevel sets the daemon's log level from cfg, unless --log-level
+// overrides it.
+func applyLogLevel(cfg *config.Config) {
+	if logLevelFlag != "" {
+		logLevel.Set(config.ParseLogLevel(logLevelFlag, slog.LevelInfo))
+		return
+	}
+	logLevel.Set(cfg.LogLevelOrDefault())
+}
+
+// listenerLogger returns the logger for a proxy's listener: nil, meaning the
+// daemon's default logger, unless the entry sets its own log_level.
+func listenerLogger(p config.ProxyEntry) *slog.Logger {
+	if p.LogLevel == "" || logLevelFlag != "" {
+		return nil
+	}
+	return slog.New(newLogHandler(p.LogLevelOr(slog.LevelInfo)))
+}
+
+// accessLogPath is the file connection access entries are appended to.
+// runDaemon sets it.
+var accessLogPath string
+
+var (
+	accessLogOnce sync.Once
+	accessLog     *slog.Logger
+)
+
+// accessLogger returns the logger for proxies with access_log set, which
+// writes one JSON line per connection. The file is opened on first use, so
+// configs without access_log never create it. Nil if it can't be opened.
+func accessLogger() *slog.Logger {
+	accessLogOnce.Do(func() {
+		f, err := os.OpenFile(accessLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			slog.Error("opening access log, connections will not be logged", "path", accessLogPath, "err", err)
+			return
+		}
+		accessLog = slog.New(slog.NewJSONHandler(f, nil))
+	})
+	return accessLog
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestValidateLogLevelFlag(t *testing.T) {
+	old := logLevelFlag
+	defer func() { logLevelFlag = old }()
+
+	for _, level := range []string{"", "debug", "WARN", "error"} {
+		logLevelFlag = level
+		if err := validateLogLevelFlag(); err != nil {
+			t.Errorf("--log-level %q: unexpected error: %v", level, err)
+		}
+	}
+	logLevelFlag = "verbose"
+	if err := validateLogLevelFlag(); err == nil {
+		t.Error("expected error for unknown --log-level")
+	}
+}
+
+func TestApplyLogLevel(t *testing.T) {
+	old := logLevelFlag
+	defer func() { logLevelFlag = old }()
+	cfg := &config.Config{LogLevel: "warn"}
+
+	logLevelFlag = ""
+	applyLogLevel(cfg)
+	if got := logLevel.Level(); got != slog.LevelWarn {
+		t.Errorf("level from config = %v, want WARN", got)
+	}
+
+	logLevelFlag = "debug"
+	applyLogLevel(cfg)
+	if got := logLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("--log-level should override the config, got %v", got)
+	}
+}
+
+func TestListenerLogger(t *testing.T) {
+	old := logLevelFlag
+	defer func() { logLevelFlag = old }()
+	logLevelFlag = ""
+
+	if listenerLogger(proxyA) != nil {
+		t.Error("proxy without log_level should use the default logger")
+	}
+
+	p := proxyA
+	p.LogLevel = "error"
+	lg := listenerLogger(p)
+	if lg == nil {
+		t.Fatal("expected a logger for a proxy with log_level")
+	}
+	if lg.Enabled(context.Background(), slog.LevelWarn) || !lg.Enabled(context.Background(), slog.LevelError) {
+		t.Error("proxy logger should only be enabled at error and above")
+	}
+
+	logLevelFlag = "debug"
+	if listenerLogger(p) != nil {
+		t.Error("--log-level should override the proxy's log_level")
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	oldPath := accessLogPath
+	t.Cleanup(func() {
+		accessLogPath = oldPath
+		accessLogOnce, accessLog = sync.Once{}, nil
+	})
+	accessLogPath = filepath.Join(t.TempDir(), "access.log")
+	accessLogOnce, accessLog = sync.Once{}, nil
+
+	if l := newListener(proxyA, failDialer{}); l.AccessLog != nil {
+		t.Error("expected no access log without access_log")
+	}
+	if _, err := os.Stat(accessLogPath); !os.IsNotExist(err) {
+		t.Errorf("access log created without access_log: %v", err)
+	}
+
+	p := proxyA
+	p.AccessLog = true
+	l := newListener(p, failDialer{})
+	if l.AccessLog == nil {
+		t.Fatal("expected an access log with access_log")
+	}
+	l.AccessLog.Info("connection", "client", "127.0.0.1:50000")
+	data, err := os.ReadFile(accessLogPath)
+	if err != nil {
+		t.Fatalf("reading access log: %v", err)
+	}
+	if !strings.Contains(string(data), `"client":"127.0.0.1:50000"`) {
+		t.Errorf("unexpected access log: %s", data)
+	}
+}
+
+func TestSetupLogging_JSON(t *testing.T) {
+	oldOutput, oldFormat, oldLevel, oldFlag := logOutput, logFormat, logLevel.Level(), logLevelFlag
+	oldDefault := slog.Default()
+	t.Cleanup(func() {
+		logOutput, logFormat, logLevelFlag = oldOutput, oldFormat, oldFlag
+		logLevel.Set(oldLevel)
+		slog.SetDefault(oldDefault)
+	})
+	logPath := filepath.Join(t.TempDir(), "daemon.log")
+	f, err := os.Create(logPath)
+	if err != nil {
+		t.Fatalf("creating log: %v", err)
+	}
+	defer f.Close()
+	logOutput, logLevelFlag = f, ""
+	setupLogging(&config.Config{LogFormat: config.LogFormatJSON})
+
+	p := config.ProxyEntry{Instance: proxyA.Instance, Port: freePorts(t, 1)[0], DialAttempts: 1}
+	l := newListener(p, failDialer{})
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	remote := conn.LocalAddr().String()
+	conn.Read(make([]byte, 1))
+	conn.Close()
+
+	// Find the dial failure among the listener's other entries.
+	var entry map[string]any
+	deadline := time.Now().Add(2 * time.Second)
+	for entry == nil && time.Now().Before(deadline) {
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("reading log: %v", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var e map[string]any
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("log line is not JSON: %q: %v", line, err)
+			}
+			if e["event"] == "dial failed, closing connection" {
+				entry = e
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entry == nil {
+		t.Fatal("no dial failure event logged")
+	}
+	if _, ok := entry["ts"].(string); !ok {
+		t.Errorf("expected a ts, got %v", entry)
+	}
+	want := map[string]string{
+		"instance": p.Instance,
+		"port":     fmt.Sprint(p.Port),
+		"remote":   remote,
+		"error":    "dial not supported in tests",
+	}
+	for key, value := range want {
+		if got := fmt.Sprint(entry[key]); !strings.Contains(got, value) {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logPollInterval is how often --follow checks the log file for new output.
+const logPollInterval = 250 * time.Millisecond
+
+var (
+	followLogs bool
+	logLines   int
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Print the daemon log",
+	RunE:  runLogs,
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&followLogs, "follow", "f", false, "keep printing new log lines as they are written")
+	logsCmd.Flags().IntVarP(&logLines, "lines", "n", 0, "only print the last N lines (default: all)")
+	rootCmd.AddCommand(logsCmd)
+}
+
+func runLogs(cmd *cobra.Command, args []string) error {
+	paths := daemonPaths()
+
+	f, err := os.Open(paths.LogFile)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No daemon log found at %s.\n", paths.LogFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening daemon log: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading daemon log: %w", err)
+	}
+	if logLines > 0 {
+		data = lastLines(data, logLines)
+	}
+	os.Stdout.Write(data)
+
+	if !followLogs {
+		return nil
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return followLog(ctx, f, os.Stdout, logPollInterval)
+}
+
+// lastLines returns the last n lines of data. A trailing newline does not
+// count as the start of another line.
+func lastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// followLog copies data appended to f, from its current offset, to out until
+// ctx is done. If the file shrinks, e.g. because it was truncated, it is read
+// again from the start.
+func followLog(ctx context.Context, f *os.File, out io.Writer, interval time.Duration) error {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("reading daemon log: %w", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("reading daemon log: %w", err)
+		}
+		if info.Size() < offset {
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("reading daemon log: %w", err)
+			}
+		}
+		n, err := io.Copy(out, f)
+		if err != nil {
+			return fmt.Errorf("reading daemon log: %w", err)
+		}
+		offset += n
+	}
+}
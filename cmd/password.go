@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/secrets"
+)
+
+// fetchPassword returns the password of a password proxy from its secret
+// source. client is only used for Secret Manager secrets, so it may be nil
+// for the others. Passwords read from a file or the environment are trimmed
+// of surrounding whitespace, such as a file's trailing newline.
+func fetchPassword(ctx context.Context, client secrets.SecretClient, p config.ProxyEntry) (string, error) {
+	var password string
+	switch p.SecretSourceOrDefault() {
+	case config.SecretSourceFile:
+		data, err := os.ReadFile(p.Secret)
+		if err != nil {
+			return "", fmt.Errorf("reading password file for %s: %w", p.Instance, err)
+		}
+		password = strings.TrimSpace(string(data))
+	case config.SecretSourceEnv:
+		value, ok := os.LookupEnv(p.Secret)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s, the password for %s, is not set", p.Secret, p.Instance)
+		}
+		password = strings.TrimSpace(value)
+	default:
+		return secrets.FetchSecret(ctx, client, p.Project(), p.Secret, p.SecretVersionOrLatest())
+	}
+	if password == "" {
+		return "", fmt.Errorf("password for %s in %s %s is empty", p.Instance, p.SecretSourceOrDefault(), p.Secret)
+	}
+	return password, nil
+}
+
+// checkSecretAccess reports whether the proxy's password could be read,
+// without reading it from Secret Manager: there, the caller's permission to
+// access the secret is tested instead, since policy may forbid fetching the
+// value. Password files and variables are read, as that has no such cost.
+// checker is only used for Secret Manager secrets, so it may be nil for the
+// others.
+func checkSecretAccess(ctx context.Context, checker secrets.AccessChecker, p config.ProxyEntry) error {
+	if p.UsesSecretManager() {
+		return secrets.CheckAccess(ctx, checker, p.Project(), p.Secret)
+	}
+	_, err := fetchPassword(ctx, nil, p)
+	return err
+}
+
+// needsSecretManager reports whether any of proxies fetches its password
+// from Secret Manager.
+func needsSecretManager(proxies []config.ProxyEntry) bool {
+	for _, p := range proxies {
+		if p.UsesSecretManager() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPasswords fetches the password of every password proxy, without
+// printing any, and returns an error listing the secrets that can't be
+// fetched. Lookups go through a cache, as in fetchPasswords.
+func checkPasswords(ctx context.Context, client secrets.SecretClient, proxies []config.ProxyEntry) error {
+	cache := secrets.NewCachingSecretClient(client)
+	var failed []string
+	for _, p := range proxies {
+		if p.IAMAuth() {
+			continue
+		}
+		if _, err := fetchPassword(ctx, cache, p); err != nil {
+			// Secret Manager errors carry advice on further lines.
+			reason, _, _ := strings.Cut(err.Error(), "\n")
+			failed = append(failed, fmt.Sprintf("  %s (%s): %s", p.Secret, instanceShortName(p.Instance), reason))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d secrets can't be accessed:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+	return nil
+}
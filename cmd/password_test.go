@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestFetchPassword_SecretManager(t *testing.T) {
+	client := &rotatingSecretClient{
+		payloads: map[string]string{"projects/proj/secrets/secret-a/versions/latest": "pw-a"},
+		calls:    make(map[string]int),
+	}
+	pw, err := fetchPassword(context.Background(), client, proxyA)
+	if err != nil || pw != "pw-a" {
+		t.Errorf("got %q, %v; want pw-a", pw, err)
+	}
+}
+
+func TestFetchPassword_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("  s3cret\n"), 0600)
+	p := config.ProxyEntry{Instance: proxyA.Instance, Port: 5432, Secret: path, SecretSource: config.SecretSourceFile}
+
+	// No Secret Manager client is needed.
+	pw, err := fetchPassword(context.Background(), nil, p)
+	if err != nil || pw != "s3cret" {
+		t.Errorf("got %q, %v; want the trimmed file contents", pw, err)
+	}
+
+	p.Secret = filepath.Join(t.TempDir(), "missing")
+	if _, err := fetchPassword(context.Background(), nil, p); err == nil || !strings.Contains(err.Error(), "reading password file for "+proxyA.Instance) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+
+	os.WriteFile(path, []byte("\n"), 0600)
+	p.Secret = path
+	if _, err := fetchPassword(context.Background(), nil, p); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("expected an empty password error, got %v", err)
+	}
+}
+
+func TestFetchPassword_SecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("s3cret\n"), 0600)
+	cfg, err := config.Parse([]byte(fmt.Sprintf("proxies:\n  - instance: %q\n    port: 5432\n    secret_file: %q\n", proxyA.Instance, path)))
+	if err != nil {
+		t.Fatalf("parsing config: %v", err)
+	}
+	p := cfg.Proxies[0]
+
+	// Read and trimmed without a Secret Manager client.
+	pw, err := fetchPassword(context.Background(), nil, p)
+	if err != nil || pw != "s3cret" {
+		t.Errorf("got %q, %v; want the trimmed file contents", pw, err)
+	}
+
+	os.Remove(path)
+	if _, err := fetchPassword(context.Background(), nil, p); err == nil || !strings.Contains(err.Error(), "reading password file for "+proxyA.Instance) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestFetchPassword_Env(t *testing.T) {
+	t.Setenv("CSPR_TEST_PASSWORD", "s3cret\n")
+	p := config.ProxyEntry{Instance: proxyA.Instance, Port: 5432, Secret: "CSPR_TEST_PASSWORD", SecretSource: config.SecretSourceEnv}
+
+	pw, err := fetchPassword(context.Background(), nil, p)
+	if err != nil || pw != "s3cret" {
+		t.Errorf("got %q, %v; want the trimmed variable", pw, err)
+	}
+
+	p.Secret = "CSPR_TEST_UNSET_PASSWORD"
+	if _, err := fetchPassword(context.Background(), nil, p); err == nil || !strings.Contains(err.Error(), "CSPR_TEST_UNSET_PASSWORD") {
+		t.Errorf("expected an unset variable error, got %v", err)
+	}
+}
+
+func TestFetchPasswords_MixedSources(t *testing.T) {
+	t.Setenv("CSPR_TEST_PASSWORD", "from-env")
+	client := &countingSecretClient{}
+	proxies := []config.ProxyEntry{
+		{Instance: proxyA.Instance, Port: 5432, Secret: "sm"},
+		{Instance: proxyB.Instance, Port: 5433, Secret: "CSPR_TEST_PASSWORD", SecretSource: config.SecretSourceEnv},
+	}
+	if !needsSecretManager(proxies) || needsSecretManager(proxies[1:]) {
+		t.Error("expected only the Secret Manager proxy to need a client")
+	}
+
+	passwords, err := fetchPasswords(context.Background(), client, proxies, config.DefaultSecretConcurrency)
+	if err != nil {
+		t.Fatalf("fetchPasswords: %v", err)
+	}
+	if n := client.calls.Load(); n != 1 {
+		t.Errorf("expected 1 Secret Manager fetch, got %d", n)
+	}
+	if passwords[proxyB.Instance] != "from-env" {
+		t.Errorf("expected the env password, got %q", passwords[proxyB.Instance])
+	}
+}
+
+func TestCheckPasswords(t *testing.T) {
+	client := &rotatingSecretClient{
+		payloads: map[string]string{"projects/proj/secrets/secret-a/versions/latest": "pw-a"},
+		calls:    make(map[string]int),
+	}
+	iam := config.ProxyEntry{Instance: "proj:us-central1:db-iam", Port: 5435, Auth: config.AuthIAM}
+	env := config.ProxyEntry{Instance: "proj:us-central1:db-env", Port: 5436, Secret: "CSPR_TEST_UNSET_PASSWORD", SecretSource: config.SecretSourceEnv}
+
+	if err := checkPasswords(context.Background(), client, []config.ProxyEntry{proxyA, iam}); err != nil {
+		t.Errorf("expected accessible secrets to pass, got %v", err)
+	}
+
+	err := checkPasswords(context.Background(), client, []config.ProxyEntry{proxyA, proxyB, iam, env})
+	if err == nil {
+		t.Fatal("expected an error for the inaccessible secrets")
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "2 secrets can't be accessed") {
+		t.Errorf("expected 2 inaccessible secrets, got %q", msg)
+	}
+	for _, want := range []string{"secret-b (db-b)", "CSPR_TEST_UNSET_PASSWORD (db-env)"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected %q in the error, got %q", want, msg)
+		}
+	}
+	if strings.Contains(msg, "secret-a") || strings.Contains(msg, "pw-a") {
+		t.Errorf("expected only the inaccessible secrets, and no values, got %q", msg)
+	}
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var pathsJSON bool
+
+var pathsCmd = &cobra.Command{
+	Use:   "paths",
+	Short: "Print where the config, state, and log files are",
+	Long:  "Print the config file and the daemon's state directory, PID file, state file, logs, control socket, and ports file, as resolved from --config, --state-dir, --pid-file, and --instance-name. The files need not exist yet. Use --json for a JSON object, for scripts.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writePaths(cmd.OutOrStdout(), absConfigPath(), daemonPaths(), pathsJSON)
+	},
+}
+
+func init() {
+	pathsCmd.Flags().BoolVar(&pathsJSON, "json", false, "print the paths as JSON")
+	rootCmd.AddCommand(pathsCmd)
+}
+
+// pathsInfo is paths' JSON output.
+type pathsInfo struct {
+	Config    string `json:"config"`
+	StateDir  string `json:"state_dir"`
+	PIDFile   string `json:"pid_file"`
+	StateFile string `json:"state_file"`
+	LogFile   string `json:"log_file"`
+	AccessLog string `json:"access_log"`
+	ErrorFile string `json:"error_file"`
+	Control   string `json:"control_socket"`
+	PortsFile string `json:"ports_file"`
+}
+
+func writePaths(out io.Writer, config string, paths proxy.Paths, asJSON bool) error {
+	info := pathsInfo{
+		Config:    config,
+		StateDir:  paths.Dir,
+		PIDFile:   paths.PIDFile,
+		StateFile: paths.StateFile,
+		LogFile:   paths.LogFile,
+		AccessLog: paths.AccessLog,
+		ErrorFile: paths.Error,
+		Control:   paths.Control,
+		PortsFile: paths.Ports,
+	}
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "Config:\t%s\n", info.Config)
+	fmt.Fprintf(w, "State dir:\t%s\n", info.StateDir)
+	fmt.Fprintf(w, "PID file:\t%s\n", info.PIDFile)
+	fmt.Fprintf(w, "State file:\t%s\n", info.StateFile)
+	fmt.Fprintf(w, "Log file:\t%s\n", info.LogFile)
+	fmt.Fprintf(w, "Access log:\t%s\n", info.AccessLog)
+	fmt.Fprintf(w, "Error file:\t%s\n", info.ErrorFile)
+	fmt.Fprintf(w, "Control socket:\t%s\n", info.Control)
+	fmt.Fprintf(w, "Ports file:\t%s\n", info.PortsFile)
+	return w.Flush()
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+func TestWritePaths(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(stateDirEnv, "")
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	oldPID, oldDir, oldName := pidFile, stateDir, instanceName
+	t.Cleanup(func() { pidFile, stateDir, instanceName = oldPID, oldDir, oldName })
+	pidFile, stateDir, instanceName = "", "", "proj-a"
+
+	var out bytes.Buffer
+	if err := writePaths(&out, "/etc/cspr.yaml", daemonPaths(), true); err != nil {
+		t.Fatalf("writePaths: %v", err)
+	}
+	var got pathsInfo
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	dir := proxy.StateDir()
+	want := pathsInfo{
+		Config:    "/etc/cspr.yaml",
+		StateDir:  dir,
+		PIDFile:   filepath.Join(dir, "daemon-proj-a.pid"),
+		StateFile: filepath.Join(dir, "state-proj-a.json"),
+		LogFile:   filepath.Join(dir, "daemon-proj-a.log"),
+		AccessLog: filepath.Join(dir, proxy.InstanceFile(proxy.AccessLogFile, "proj-a")),
+		ErrorFile: filepath.Join(dir, proxy.InstanceFile(proxy.ErrorFile, "proj-a")),
+		Control:   filepath.Join(dir, proxy.InstanceFile(proxy.ControlFile, "proj-a")),
+		PortsFile: filepath.Join(dir, "ports-proj-a.json"),
+	}
+	if got != want {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	out.Reset()
+	if err := writePaths(&out, "/etc/cspr.yaml", daemonPaths(), false); err != nil {
+		t.Fatalf("writePaths: %v", err)
+	}
+	if !strings.Contains(out.String(), "State dir:      "+dir+"\n") {
+		t.Errorf("expected the state dir in the text output, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the daemon config without restarting unchanged proxies",
+	RunE:  runReload,
+}
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+}
+
+func runReload(cmd *cobra.Command, args []string) error {
+	if err := saveConfigCopy(); err != nil {
+		return err
+	}
+	paths := daemonPaths()
+	pid, err := proxy.ReadPID(paths)
+	running := err == nil && proxy.IsRunning(pid)
+
+	// The daemon re-reads the config it was started with, so checking any
+	// other one here would vouch for a config it never loads.
+	if running {
+		if state, err := proxy.ReadState(paths); err == nil && state.ConfigPath != "" && state.ConfigPath != absConfigPath() {
+			return fmt.Errorf("the daemon reloads %s, not %s; run restart to switch it to another config", state.ConfigPath, absConfigPath())
+		}
+	}
+
+	// Validate locally first so a broken config is reported here rather than
+	// only in the daemon log.
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	if !running {
+		fmt.Fprintln(infoOut(), "No daemon is running.")
+		return nil
+	}
+
+	// Ask over the control socket, which reports whether the config was
+	// applied. SIGHUP only reopens the log, so there is no other way.
+	resp, err := proxy.QueryControl(paths.Control, proxy.ControlReload)
+	if err != nil {
+		return fmt.Errorf("daemon's control socket is unavailable (%v); restart it to apply the config", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("daemon kept its current config: %s", resp.Error)
+	}
+	fmt.Fprintf(infoOut(), "Daemon reloaded (pid %d).\n", pid)
+	return nil
+}
+
+// reload re-reads the config and applies it to the running listeners. On
+// any error, which is also returned, the daemon keeps running with its
+// current config.
+func (c *daemonControl) reload() error {
+	slog.Info("reloading config")
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("reload failed, keeping current config", "err", err)
+		return err
+	}
+	result := make(chan error, 1)
+	c.reloads <- proxy.Reload{Config: cfg, Result: result}
+	if err := <-result; err != nil {
+		slog.Error("reload failed, keeping current config", "err", err)
+		return err
+	}
+	c.d.setProxies(cfg.Proxies)
+	applyLogLevel(cfg)
+
+	c.state.Proxies = cfg.Proxies
+	c.state.ShutdownTimeout = cfg.ShutdownTimeoutOrDefault()
+	c.state.ConfigPath, c.state.ConfigHash = absConfigPath(), cfg.Hash
+	c.state.AutoPorts = c.set.AutoPorts()
+	if err := proxy.WriteState(c.paths, c.state); err != nil {
+		slog.Warn("failed to write state file", "err", err)
+	}
+	updatePortsFile(c.paths, cfg, c.state)
+	slog.Info("config reloaded")
+	return nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+// failDialer is a proxy.Dialer whose dials always fail, so test connections
+// are accepted and then closed.
+type failDialer struct{}
+
+func (failDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	return nil, errors.New("dial not supported in tests")
+}
+
+func (failDialer) Close() error { return nil }
+
+// freePorts returns n ports that were free at the time of the call.
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	var ports []int
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer ln.Close()
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+func TestSnapshotStats_MultiplePorts(t *testing.T) {
+	ports := freePorts(t, 3)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], ExtraPorts: []int{ports[1]}, Secret: "s"}
+
+	set := proxy.NewManager(context.Background(), failDialer{}, newListener)
+	if err := set.Start([]config.ProxyEntry{a}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+
+	if got := len(set.Listeners()); got != 2 {
+		t.Fatalf("expected a listener per port, got %d", got)
+	}
+	for _, port := range ports[:2] {
+		conn, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatalf("port %d not accepting: %v", port, err)
+		}
+		conn.Close()
+	}
+	if stats := snapshotStats(set); len(stats) != 1 {
+		t.Errorf("expected one stats entry for the instance, got %+v", stats)
+	}
+
+	// Moving one port leaves the other's listener alone.
+	kept := set.Listener(config.ProxyEntry{Instance: a.Instance, Port: ports[0]})
+	a.ExtraPorts = []int{ports[2]}
+	if err := set.Reload([]config.ProxyEntry{a}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if set.Listener(config.ProxyEntry{Instance: a.Instance, Port: ports[0]}) != kept {
+		t.Error("the unchanged port should keep its listener")
+	}
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected 2 listeners after reload, got %d", got)
+	}
+}
+
+func TestBoundProxies_AutoPorts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	oldPID := pidFile
+	t.Cleanup(func() { pidFile = oldPID })
+	pidFile = ""
+	paths := daemonPaths()
+
+	a := config.ProxyEntry{Instance: proxyA.Instance, Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Secret: "s"}
+	set := proxy.NewManager(context.Background(), failDialer{}, newListener)
+	if err := set.Start([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+
+	ports := set.AutoPorts()
+	if len(ports) != 2 || ports[a.Instance] == 0 || ports[a.Instance] == ports[b.Instance] {
+		t.Fatalf("expected two distinct assigned ports, got %v", ports)
+	}
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{a, b})
+	state, err := proxy.ReadState(paths)
+	if err != nil {
+		t.Fatalf("ReadState: %v", err)
+	}
+	state.AutoPorts = ports
+	if err := proxy.WriteState(paths, state); err != nil {
+		t.Fatalf("WriteState: %v", err)
+	}
+
+	// The CLI finds the assigned ports in the state file, and the config's
+	// proxies, with port 0, still match the daemon's.
+	for _, p := range boundProxies([]config.ProxyEntry{a, b}) {
+		if p.Port != ports[p.Instance] {
+			t.Errorf("%s: bound port %d, want %d", p.Instance, p.Port, ports[p.Instance])
+		}
+		conn, err := net.Dial("tcp", p.DialAddr())
+		if err != nil {
+			t.Fatalf("%s not accepting on its assigned port: %v", p.Instance, err)
+		}
+		conn.Close()
+	}
+	if action, _ := checkDaemon(paths, []config.ProxyEntry{a, b}); action != daemonKeep {
+		t.Errorf("checkDaemon = %v, want daemonKeep for an unchanged config", action)
+	}
+
+	// A reload that leaves a proxy alone leaves its port alone too.
+	if err := set.Reload([]config.ProxyEntry{a}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := set.AutoPorts(); len(got) != 1 || got[a.Instance] != ports[a.Instance] {
+		t.Errorf("expected %s to keep port %d after reload, got %v", a.Instance, ports[a.Instance], got)
+	}
+}
+
+func TestUpdatePortsFile(t *testing.T) {
+	ports := freePorts(t, 1)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[0], Secret: "s"}
+	ctl := runTestDaemon(t, []config.ProxyEntry{a, b})
+	ctl.state.AutoPorts = ctl.set.AutoPorts()
+
+	updatePortsFile(ctl.paths, &config.Config{PortsFile: true}, ctl.state)
+	data, err := os.ReadFile(ctl.paths.Ports)
+	if err != nil {
+		t.Fatalf("reading ports file: %v", err)
+	}
+	var got map[string]int
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("ports file is not JSON: %v\n%s", err, data)
+	}
+	auto := ctl.set.Listener(a).Port
+	if auto == 0 || got[a.Instance] != auto {
+		t.Errorf("%s: got port %d in the ports file, want the assigned port %d", a.Instance, got[a.Instance], auto)
+	}
+	if got[b.Instance] != b.Port {
+		t.Errorf("%s: got port %d in the ports file, want %d", b.Instance, got[b.Instance], b.Port)
+	}
+
+	// Turning ports_file off removes the file.
+	updatePortsFile(ctl.paths, &config.Config{}, ctl.state)
+	if _, err := os.Stat(ctl.paths.Ports); !os.IsNotExist(err) {
+		t.Error("expected the ports file to be removed")
+	}
+}
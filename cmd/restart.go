@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+// portReleaseTimeout bounds how long restart waits for the old daemon's ports
+// to become bindable again.
+const portReleaseTimeout = 5 * time.Second
+
+var graceful bool
+
+var restartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restart the proxy daemon",
+	RunE:  runRestart,
+}
+
+func init() {
+	restartCmd.Flags().BoolVar(&failFast, "fail-fast", false, "stop the daemon if any proxy fails to start")
+	restartCmd.Flags().DurationVar(&startWait, "wait", defaultStartWait, "how long to wait for every proxy to accept connections")
+	restartCmd.Flags().BoolVar(&checkSecretsFlag, "check-secrets", false, "before restarting, check that every proxy's password can be fetched")
+	restartCmd.Flags().BoolVar(&noVerify, "no-verify", false, "don't check that the proxies came up after starting the daemon")
+	restartCmd.Flags().BoolVar(&graceful, "graceful", false, "start the new daemon before stopping the old one, so the ports are never unbound")
+	restartCmd.Flags().BoolVar(&reusePort, "reuse-port", false, "bind TCP ports with SO_REUSEPORT, so that restart --graceful can replace the daemon later")
+	restartCmd.Flags().StringVar(&logLevelFlag, "log-level", "", "daemon log level: debug, info, warn, or error (default: the config's log_level, or info)")
+	rootCmd.AddCommand(restartCmd)
+}
+
+func runRestart(cmd *cobra.Command, args []string) error {
+	if err := validateLogLevelFlag(); err != nil {
+		return err
+	}
+	if (graceful || reusePort) && !proxy.ReusePortSupported {
+		return fmt.Errorf("--graceful and --reuse-port are not supported on %s", runtime.GOOS)
+	}
+	if err := saveConfigCopy(); err != nil {
+		return err
+	}
+	cfg, err := prepareStart(context.Background())
+	if err != nil {
+		return err
+	}
+
+	paths := daemonPaths()
+
+	pid, err := proxy.ReadPID(paths)
+	if err == nil && proxy.IsRunning(pid) && graceful {
+		return restartGracefully(cfg, paths, pid)
+	}
+	if err == nil && proxy.IsRunning(pid) {
+		bound := oldDaemonPorts(paths, cfg)
+		fmt.Fprintf(infoOut(), "Stopping daemon (pid %d)...\n", pid)
+		if err := stopDaemon(pid, paths); err != nil {
+			return fmt.Errorf("stopping old daemon: %w", err)
+		}
+		if err := waitPortsFree(bound, portReleaseTimeout); err != nil {
+			return err
+		}
+	}
+
+	return launchDaemon(cfg, paths)
+}
+
+// restartGracefully starts a new daemon alongside the running one with the
+// given pid, and stops the old one only once the new one is listening. Both
+// bind their ports with SO_REUSEPORT, so there is no moment without a
+// listener, and the old daemon lets open connections finish as on stop. The
+// old daemon must have been started with --reuse-port, and the new one is
+// too, so it can be replaced the same way. If the new daemon fails to start,
+// the old one keeps running.
+func restartGracefully(cfg *config.Config, paths proxy.Paths, oldPID int) error {
+	state, err := proxy.ReadState(paths)
+	if err != nil {
+		return fmt.Errorf("reading daemon state: %w", err)
+	}
+	if !state.ReusePort {
+		return fmt.Errorf("daemon %d wasn't started with --reuse-port, so a new one can't bind its ports alongside it; restart it once without --graceful, adding --reuse-port", oldPID)
+	}
+	grace := stopGracePeriod + state.ShutdownTimeout
+
+	fmt.Fprintf(infoOut(), "Starting new daemon alongside pid %d...\n", oldPID)
+	proxy.ClearLastError(paths)
+	takeover, reusePort = true, true
+	d, err := spawnDaemon(paths)
+	if err != nil {
+		return err
+	}
+	if err := waitTakeover(paths, d.pid, startWait); err != nil {
+		return fmt.Errorf("%w; daemon %d keeps running", err, oldPID)
+	}
+
+	fmt.Fprintf(infoOut(), "Stopping old daemon (pid %d)...\n", oldPID)
+	// The state files are the new daemon's now, so they are left alone.
+	terminate(oldPID, grace)
+	return checkStarted(cfg, paths, d)
+}
+
+// waitTakeover waits up to timeout for the daemon with the given pid, started
+// with --takeover, to claim the PID file, which it does once its listeners
+// are bound. It fails early if the daemon exits.
+func waitTakeover(paths proxy.Paths, pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if current, err := proxy.ReadPID(paths); err == nil && current == pid {
+			return nil
+		}
+		if !proxy.IsRunning(pid) {
+			if reason := proxy.ReadLastError(paths); reason != "" {
+				return fmt.Errorf("new daemon failed to start: %s", reason)
+			}
+			return fmt.Errorf("new daemon failed to start; see %s", paths.LogFile)
+		}
+		if time.Now().After(deadline) {
+			terminate(pid, stopGracePeriod)
+			return fmt.Errorf("new daemon didn't start listening within %s; see %s", timeout, paths.LogFile)
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// oldDaemonPorts returns the proxies the running daemon bound, with their
+// automatic ports filled in, which restart waits on once it has stopped the
+// daemon. They differ from cfg's if the config was edited since. It must be
+// read before stopping the daemon, which removes its state file. Without a
+// state file, cfg's proxies are the best guess.
+func oldDaemonPorts(paths proxy.Paths, cfg *config.Config) []config.ProxyEntry {
+	state, err := proxy.ReadState(paths)
+	if err != nil {
+		return cfg.Proxies
+	}
+	return state.BoundProxies()
+}
+
+// waitPortsFree polls until every proxy's port can be bound, or the timeout
+// elapses. Socket entries are skipped: the new daemon replaces stale socket
+// files itself. So are automatic ports, which it picks afresh.
+func waitPortsFree(proxies []config.ProxyEntry, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, p := range config.ExpandPorts(proxies) {
+		if p.Socket != "" || p.AutoPort() {
+			continue
+		}
+		for {
+			ln, err := net.Listen("tcp", p.Addr())
+			if err == nil {
+				ln.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("port %d still in use after %s", p.Port, timeout)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
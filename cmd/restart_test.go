@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+func TestWaitPortsFree_Free(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: port, Secret: "s"}
+	if err := waitPortsFree([]config.ProxyEntry{p}, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitPortsFree_ReleasedDuringWait(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	time.AfterFunc(200*time.Millisecond, func() { ln.Close() })
+
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: port, Secret: "s"}
+	if err := waitPortsFree([]config.ProxyEntry{p}, 2*time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitPortsFree_Timeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	p := config.ProxyEntry{Instance: "proj:us-central1:db", Port: port, Secret: "s"}
+	err = waitPortsFree([]config.ProxyEntry{p}, 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if !strings.Contains(err.Error(), "still in use") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewListener_SecondDaemonAddressInUse(t *testing.T) {
+	first := newListener(config.ProxyEntry{Instance: proxyA.Instance, Port: freePorts(t, 1)[0]}, failDialer{})
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("starting first listener: %v", err)
+	}
+	defer first.Close()
+
+	// A second daemon on the same port, say with another --instance-name,
+	// must not share it.
+	second := newListener(config.ProxyEntry{Instance: proxyB.Instance, Port: first.Port}, failDialer{})
+	err := second.Start(context.Background())
+	if err == nil {
+		second.Close()
+		t.Fatalf("expected a second listener on port %d to fail", first.Port)
+	}
+	if !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("expected address in use, got: %v", err)
+	}
+}
+
+func TestNewListener_ReusePort(t *testing.T) {
+	if !proxy.ReusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	t.Cleanup(func() { reusePort = false })
+	reusePort = true
+	first := newListener(config.ProxyEntry{Instance: proxyA.Instance, Port: freePorts(t, 1)[0]}, failDialer{})
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("starting first listener: %v", err)
+	}
+	defer first.Close()
+
+	second := newListener(config.ProxyEntry{Instance: proxyA.Instance, Port: first.Port}, failDialer{})
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatalf("expected a daemon taking over to bind port %d, got: %v", first.Port, err)
+	}
+	second.Close()
+}
+
+func TestRestartGracefully_RequiresReusePort(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	paths := proxy.NewPaths(t.TempDir())
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{proxyA})
+
+	err := restartGracefully(&config.Config{Proxies: []config.ProxyEntry{proxyA}}, paths, os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), "--reuse-port") {
+		t.Fatalf("expected an error about --reuse-port, got: %v", err)
+	}
+	if takeover {
+		t.Error("no new daemon should have been started")
+	}
+}
+
+func TestOldDaemonPorts(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	cfg := &config.Config{Proxies: []config.ProxyEntry{proxyA}}
+
+	// Without a state file, the config is all there is.
+	if got := oldDaemonPorts(paths, cfg); len(got) != 1 || got[0].Port != proxyA.Port {
+		t.Errorf("expected the config's proxies, got %+v", got)
+	}
+
+	// The daemon runs an older config, with an automatic port.
+	auto := config.ProxyEntry{Instance: proxyB.Instance, Secret: "s"}
+	if err := proxy.WriteState(paths, &proxy.DaemonState{
+		PID:       os.Getpid(),
+		Proxies:   []config.ProxyEntry{auto},
+		AutoPorts: map[string]int{auto.Instance: 41237},
+	}); err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+	got := oldDaemonPorts(paths, cfg)
+	if len(got) != 1 || got[0].Instance != proxyB.Instance || got[0].Port != 41237 {
+		t.Errorf("expected the daemon's bound proxies, got %+v", got)
+	}
+}
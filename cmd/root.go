@@ -1,11 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+
 	"github.com/spf13/cobra"
 )
 
@@ -15,12 +23,48 @@ var (
 	buildTime = "unknown"
 )
 
-var configPath string
+var (
+	configPath string
+	configDir  string
+	envName    string
+	profile    string
+	pidFile    string
+	stateDir   string
+	quiet      bool
+
+	// instanceName selects one of several daemons sharing the state
+	// directory. Empty is the default daemon.
+	instanceName string
+)
+
+// instanceNamePattern keeps --instance-name safe to use in file names.
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// stateDirEnv overrides the default state directory when --state-dir isn't
+// given.
+const stateDirEnv = "CLOUD_SQL_PROXY_RUNNER_STATE_DIR"
 
 var rootCmd = &cobra.Command{
 	Use:   "cloud-sql-proxy-runner",
 	Short: "Manage Cloud SQL proxy connections",
 	Long:  "Start, stop, and list Cloud SQL proxy connections defined in a YAML config.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateInstanceName(); err != nil {
+			return err
+		}
+		if err := applyProfileFlag(cmd); err != nil {
+			return err
+		}
+		if configDir != "" && cmd.Flags().Changed("config") {
+			return fmt.Errorf("--config and --config-dir can't be used together")
+		}
+		// Commands without --port-offset see the ports the running daemon
+		// actually bound.
+		if cmd.Flags().Lookup("port-offset") == nil {
+			portOffset = runningPortOffset()
+		}
+		return nil
+	},
 }
 
 func Execute() {
@@ -32,12 +76,206 @@ func Execute() {
 
 func init() {
 	built := buildTime
-	if t, err := time.Parse("20060102150405", buildTime); err == nil {
+	if t, err := time.Parse(buildTimeLayout, buildTime); err == nil {
 		built = t.UTC().Format("2006-01-02 15:04:05 UTC")
 	}
 	rootCmd.Version = fmt.Sprintf("%s (commit: %s, built: %s)", version, gitCommit, built)
 
 	home, _ := os.UserHomeDir()
 	defaultConfig := filepath.Join(home, ".config", "cloud-sql-proxy-runner", "config.yaml")
-	rootCmd.PersistentFlags().StringVar(&configPath, "config", defaultConfig, "path to config file")
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", defaultConfig, "path to config file, - to read it from stdin, or an https:// or gs:// URL to fetch it from")
+	rootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "directory whose *.yaml, *.yml, and *.json files each list proxies, used instead of --config")
+	rootCmd.PersistentFlags().StringVar(&envName, "env", os.Getenv("CSPR_ENV"), "environment to select from the config's environments (env: CSPR_ENV)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "alias of --env")
+	rootCmd.PersistentFlags().StringVar(&impersonateFlag, "impersonate", "", "service account to act as, overriding the config's impersonate_service_account")
+	rootCmd.PersistentFlags().StringVar(&pidFile, "pid-file", "", "path to the daemon PID file (default: $RUNTIME_DIRECTORY or the state dir)")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "print only errors, and leave out table headers")
+	rootCmd.PersistentFlags().StringVar(&instanceName, "instance-name", "", "name of the daemon to manage, so that several can run at once, each with its own PID, state, and log files")
+	skipAuth, _ := strconv.ParseBool(os.Getenv("CSPR_SKIP_AUTH_CHECK"))
+	rootCmd.PersistentFlags().BoolVar(&skipAuthCheck, "skip-auth-check", skipAuth, "don't require Google Cloud credentials before connecting, e.g. with an emulator (env: CSPR_SKIP_AUTH_CHECK)")
+	rootCmd.PersistentFlags().StringVar(&stateDir, "state-dir", "", "directory for the daemon's runtime files (default: $"+stateDirEnv+" or ~/"+proxy.DefaultStateDir+")")
+}
+
+// loadConfig loads the config selected by the global flags.
+// Proxy ports are shifted by portOffset.
+func loadConfig() (*config.Config, error) {
+	var cfg *config.Config
+	var err error
+	if configDir != "" {
+		cfg, err = config.LoadDir(configDir, envName)
+	} else {
+		cfg, err = config.LoadEnv(configPath, envName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if portOffset != 0 {
+		if err := cfg.ShiftPorts(portOffset); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// runningPortOffset returns the port offset the running daemon was started
+// with, or 0 if there is none.
+func runningPortOffset() int {
+	state, err := proxy.ReadState(daemonPaths())
+	if err != nil {
+		return 0
+	}
+	return state.PortOffset
+}
+
+// boundProxies returns proxies with each automatic port set to the port the
+// running daemon bound for it. Without a running daemon they are returned
+// unchanged.
+func boundProxies(proxies []config.ProxyEntry) []config.ProxyEntry {
+	state, err := proxy.ReadState(daemonPaths())
+	if err != nil || !proxy.IsRunning(state.PID) {
+		return proxies
+	}
+	return config.AssignPorts(proxies, state.AutoPorts)
+}
+
+// configSource returns where the config is read from: the --config-dir
+// directory if given, or else the config file.
+func configSource() string {
+	if configDir != "" {
+		return configDir
+	}
+	return configPath
+}
+
+// absConfigPath returns the absolute path of configSource, as far as it can
+// be resolved.
+func absConfigPath() string {
+	path := configSource()
+	if path == config.StdinPath || config.IsRemote(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// staleConfigWarning returns a warning if the config file the daemon loaded
+// has changed since, or "" if it hasn't or can't be read.
+func staleConfigWarning(state *proxy.DaemonState) string {
+	if state.ConfigHash == "" || state.ConfigPath == "" || state.ConfigPath == config.StdinPath {
+		return ""
+	}
+	data, err := os.ReadFile(state.ConfigPath)
+	if err != nil || config.Hash(data) == state.ConfigHash {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s has changed since the daemon loaded it; run reload or restart to apply it.", state.ConfigPath)
+}
+
+// stdinConfigFile and remoteConfigFile are the state directory files, plus
+// a format extension, that saveConfigCopy writes.
+const (
+	stdinConfigFile  = "config-from-stdin"
+	remoteConfigFile = "config-from-url"
+)
+
+// infoOut returns where commands print progress and other informational
+// messages: stdout, or nowhere with --quiet. Errors go to stderr either way.
+func infoOut() io.Writer {
+	if quiet {
+		return io.Discard
+	}
+	return os.Stdout
+}
+
+// saveConfigCopy saves a config piped in with --config -, or fetched from a
+// URL, to the state directory and points configPath at the copy. Commands
+// that hand the config to the daemon call it first: the daemon can't read the
+// caller's stdin, and re-reads the file when reloaded, so a remote config is
+// only fetched again by the next start, restart, or reload.
+func saveConfigCopy() error {
+	var data []byte
+	var err error
+	var name string
+	var format config.Format
+	switch {
+	case configPath == config.StdinPath:
+		if data, err = io.ReadAll(config.Stdin); err != nil {
+			return fmt.Errorf("reading config from stdin: %w", err)
+		}
+		name, format = stdinConfigFile, config.FormatForData(data)
+	case config.IsRemote(configPath):
+		if data, err = config.FetchRemote(context.Background(), configPath); err != nil {
+			return fmt.Errorf("fetching config: %w", err)
+		}
+		name, format = remoteConfigFile, config.FormatForURL(configPath, data)
+	default:
+		return nil
+	}
+	dir := daemonPaths().Dir
+	if err := proxy.EnsureStateDir(dir); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	path := filepath.Join(dir, proxy.InstanceFile(name, instanceName)+format.Ext())
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("saving config: %w", err)
+	}
+	configPath = path
+	return nil
+}
+
+// validateInstanceName rejects an --instance-name that can't be part of a
+// file name.
+func validateInstanceName() error {
+	if instanceName != "" && !instanceNamePattern.MatchString(instanceName) {
+		return fmt.Errorf("invalid --instance-name %q: use only letters, digits, '-', and '_'", instanceName)
+	}
+	return nil
+}
+
+// applyProfileFlag makes --profile select the environment, as --env does.
+// Giving both is only allowed if they agree.
+func applyProfileFlag(cmd *cobra.Command) error {
+	if !cmd.Flags().Changed("profile") {
+		return nil
+	}
+	if cmd.Flags().Changed("env") && envName != profile {
+		return fmt.Errorf("--env %q and --profile %q disagree; use one of them", envName, profile)
+	}
+	envName = profile
+	return nil
+}
+
+// resolveStateDir returns the state directory: --state-dir, then
+// $CLOUD_SQL_PROXY_RUNNER_STATE_DIR, then the default under the home
+// directory.
+func resolveStateDir() string {
+	if stateDir != "" {
+		return stateDir
+	}
+	if dir := os.Getenv(stateDirEnv); dir != "" {
+		return dir
+	}
+	return proxy.StateDir()
+}
+
+// daemonPaths resolves where the runtime files of the daemon selected by
+// --instance-name live. The PID file location is taken from --pid-file, then
+// systemd's $RUNTIME_DIRECTORY, and otherwise sits in the state directory.
+func daemonPaths() proxy.Paths {
+	paths := proxy.NewInstancePaths(resolveStateDir(), instanceName)
+	if pidFile != "" {
+		paths.PIDFile = pidFile
+	} else if dir := runtimeDirectory(); dir != "" {
+		paths.PIDFile = filepath.Join(dir, filepath.Base(paths.PIDFile))
+	}
+	return paths
+}
+
+// runtimeDirectory returns the first entry of $RUNTIME_DIRECTORY, which
+// systemd sets (colon-separated) for units with RuntimeDirectory=.
+func runtimeDirectory() string {
+	dir, _, _ := strings.Cut(os.Getenv("RUNTIME_DIRECTORY"), ":")
+	return dir
 }
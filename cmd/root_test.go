@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+func TestDaemonPaths_PIDFile(t *testing.T) {
+	defaultPID := filepath.Join(proxy.StateDir(), proxy.PIDFile)
+	tests := []struct {
+		name       string
+		flag       string
+		runtimeDir string
+		want       string
+	}{
+		{name: "default", want: defaultPID},
+		{name: "runtime directory", runtimeDir: "/run/cspr", want: "/run/cspr/daemon.pid"},
+		{name: "first runtime directory", runtimeDir: "/run/a:/run/b", want: "/run/a/daemon.pid"},
+		{name: "flag", flag: "/var/run/custom.pid", want: "/var/run/custom.pid"},
+		{name: "flag wins over runtime directory", flag: "/var/run/custom.pid", runtimeDir: "/run/cspr", want: "/var/run/custom.pid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RUNTIME_DIRECTORY", tt.runtimeDir)
+			t.Setenv(stateDirEnv, "")
+			old := pidFile
+			pidFile = tt.flag
+			t.Cleanup(func() { pidFile = old })
+
+			paths := daemonPaths()
+			if paths.PIDFile != tt.want {
+				t.Errorf("PIDFile = %q, want %q", paths.PIDFile, tt.want)
+			}
+			if paths.Dir != proxy.StateDir() {
+				t.Errorf("Dir = %q, want state dir %q", paths.Dir, proxy.StateDir())
+			}
+		})
+	}
+}
+
+func TestResolveStateDir(t *testing.T) {
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		want string
+	}{
+		{name: "default", want: proxy.StateDir()},
+		{name: "env", env: "/srv/cspr", want: "/srv/cspr"},
+		{name: "flag", flag: "/data/cspr", want: "/data/cspr"},
+		{name: "flag wins over env", flag: "/data/cspr", env: "/srv/cspr", want: "/data/cspr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(stateDirEnv, tt.env)
+			t.Setenv("RUNTIME_DIRECTORY", "")
+			old := stateDir
+			stateDir = tt.flag
+			t.Cleanup(func() { stateDir = old })
+
+			if got := resolveStateDir(); got != tt.want {
+				t.Errorf("resolveStateDir() = %q, want %q", got, tt.want)
+			}
+			paths := daemonPaths()
+			if paths.Dir != tt.want || paths.PIDFile != filepath.Join(tt.want, proxy.PIDFile) {
+				t.Errorf("daemonPaths() = %+v, want files in %q", paths, tt.want)
+			}
+		})
+	}
+}
+
+func TestDaemonPaths_InstanceName(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(stateDirEnv, "")
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	old := instanceName
+	t.Cleanup(func() { instanceName = old })
+
+	instanceName = "proj-a"
+	pathsA := daemonPaths()
+	writeState(t, pathsA, 1001, []config.ProxyEntry{proxyA})
+	instanceName = "proj-b"
+	pathsB := daemonPaths()
+	writeState(t, pathsB, 1002, []config.ProxyEntry{proxyB})
+	instanceName = ""
+	if _, err := proxy.ReadPID(daemonPaths()); !os.IsNotExist(err) {
+		t.Errorf("expected no default daemon, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		paths    proxy.Paths
+		pid      int
+		instance string
+	}{
+		{pathsA, 1001, proxyA.Instance},
+		{pathsB, 1002, proxyB.Instance},
+	} {
+		if pid, err := proxy.ReadPID(tt.paths); err != nil || pid != tt.pid {
+			t.Errorf("%s: expected pid %d, got %d, %v", tt.paths.PIDFile, tt.pid, pid, err)
+		}
+		state, err := proxy.ReadState(tt.paths)
+		if err != nil || len(state.Proxies) != 1 || state.Proxies[0].Instance != tt.instance {
+			t.Errorf("%s: expected %s, got %+v, %v", tt.paths.StateFile, tt.instance, state, err)
+		}
+	}
+	if pathsA.LogFile == pathsB.LogFile || pathsA.Control == pathsB.Control {
+		t.Errorf("expected separate log files and control sockets, got %+v and %+v", pathsA, pathsB)
+	}
+}
+
+func TestDaemonPaths_InstanceNameInRuntimeDirectory(t *testing.T) {
+	t.Setenv("RUNTIME_DIRECTORY", "/run/cspr")
+	old := instanceName
+	t.Cleanup(func() { instanceName = old })
+	instanceName = "work"
+
+	if got := daemonPaths().PIDFile; got != "/run/cspr/daemon-work.pid" {
+		t.Errorf("PIDFile = %q, want /run/cspr/daemon-work.pid", got)
+	}
+}
+
+func TestValidateInstanceName(t *testing.T) {
+	old := instanceName
+	t.Cleanup(func() { instanceName = old })
+
+	for _, name := range []string{"", "work", "proj_b-2"} {
+		instanceName = name
+		if err := validateInstanceName(); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"../x", "a b", "a.b"} {
+		instanceName = name
+		if err := validateInstanceName(); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+func TestApplyProfileFlag(t *testing.T) {
+	oldEnv, oldProfile := envName, profile
+	t.Cleanup(func() { envName, profile = oldEnv, oldProfile })
+
+	parse := func(args ...string) *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().StringVar(&envName, "env", "", "")
+		cmd.Flags().StringVar(&profile, "profile", "", "")
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatalf("parsing %v: %v", args, err)
+		}
+		return cmd
+	}
+
+	if err := applyProfileFlag(parse("--profile", "prod")); err != nil || envName != "prod" {
+		t.Errorf("--profile prod: got env %q, err %v", envName, err)
+	}
+	if err := applyProfileFlag(parse("--env", "dev")); err != nil || envName != "dev" {
+		t.Errorf("--env dev: got env %q, err %v", envName, err)
+	}
+	if err := applyProfileFlag(parse("--env", "prod", "--profile", "prod")); err != nil || envName != "prod" {
+		t.Errorf("matching --env and --profile: got env %q, err %v", envName, err)
+	}
+	if err := applyProfileFlag(parse("--env", "dev", "--profile", "prod")); err == nil {
+		t.Error("expected an error when --env and --profile disagree")
+	}
+}
+
+func TestSaveConfigCopy_Stdin(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	oldPath, oldStdin := configPath, config.Stdin
+	t.Cleanup(func() { configPath, config.Stdin = oldPath, oldStdin })
+
+	input := `{"proxies": [{"instance": "proj:us-central1:name", "port": 5432, "secret": "pw"}]}`
+	configPath = config.StdinPath
+	config.Stdin = strings.NewReader(input)
+	if err := saveConfigCopy(); err != nil {
+		t.Fatalf("saveConfigCopy: %v", err)
+	}
+
+	want := filepath.Join(proxy.StateDir(), "config-from-stdin.json")
+	if configPath != want {
+		t.Fatalf("configPath = %q, want %q", configPath, want)
+	}
+	data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatalf("reading saved config: %v", err)
+	}
+	if string(data) != input {
+		t.Errorf("saved config = %q, want %q", data, input)
+	}
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("loading saved config: %v", err)
+	}
+
+	// A real path is left alone.
+	if err := saveConfigCopy(); err != nil || configPath != want {
+		t.Errorf("second call: configPath = %q, err = %v", configPath, err)
+	}
+}
+
+func TestSaveConfigCopy_URL(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	oldPath := configPath
+	t.Cleanup(func() { configPath = oldPath })
+
+	input := "proxies:\n  - instance: \"proj:us-central1:name\"\n    port: 5432\n    secret: \"pw\"\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(input))
+	}))
+	defer srv.Close()
+
+	configPath = srv.URL + "/cspr.yaml"
+	if got := absConfigPath(); got != configPath {
+		t.Errorf("absConfigPath() = %q, want the URL unchanged", got)
+	}
+	if err := saveConfigCopy(); err != nil {
+		t.Fatalf("saveConfigCopy: %v", err)
+	}
+
+	// The daemon is handed a copy, since it re-reads the file on reload.
+	want := filepath.Join(proxy.StateDir(), "config-from-url.yaml")
+	if configPath != want {
+		t.Fatalf("configPath = %q, want %q", configPath, want)
+	}
+	data, err := os.ReadFile(want)
+	if err != nil || string(data) != input {
+		t.Errorf("saved config = %q, %v; want %q", data, err, input)
+	}
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("loading saved config: %v", err)
+	}
+}
+
+func TestStaleConfigWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := []byte("proxies: []\n")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	state := &proxy.DaemonState{ConfigPath: path, ConfigHash: config.Hash(data)}
+	if w := staleConfigWarning(state); w != "" {
+		t.Errorf("expected no warning for an unchanged config, got %q", w)
+	}
+
+	if err := os.WriteFile(path, []byte("proxies: [] # edited\n"), 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	if w := staleConfigWarning(state); !strings.Contains(w, path) || !strings.Contains(w, "changed") {
+		t.Errorf("expected a warning naming %s, got %q", path, w)
+	}
+
+	// Daemons that recorded no hash, and configs that are gone, aren't
+	// warned about.
+	if w := staleConfigWarning(&proxy.DaemonState{ConfigPath: path}); w != "" {
+		t.Errorf("expected no warning without a recorded hash, got %q", w)
+	}
+	state.ConfigPath = filepath.Join(t.TempDir(), "missing.yaml")
+	if w := staleConfigWarning(state); w != "" {
+		t.Errorf("expected no warning for a missing config, got %q", w)
+	}
+}
+
+func TestLoadConfig_ConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("proxies:\n  - instance: \"proj:us-central1:db-a\"\n    port: 5432\n    secret: \"pw\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("proxies:\n  - instance: \"proj:us-central1:db-b\"\n    port: 5433\n    secret: \"pw\"\n"), 0644)
+	oldDir, oldEnv := configDir, envName
+	t.Cleanup(func() { configDir, envName = oldDir, oldEnv })
+	configDir, envName = dir, ""
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Proxies) != 2 {
+		t.Errorf("expected the proxies of both files, got %+v", cfg.Proxies)
+	}
+
+	// The daemon is started with the directory rather than a config file.
+	args := strings.Join(daemonArgs(proxy.NewPaths(t.TempDir())), " ")
+	if !strings.Contains(args, "--config-dir "+dir) || strings.Contains(args, "--config ") {
+		t.Errorf("daemon args should pass --config-dir only, got %s", args)
+	}
+}
+
+func TestDaemonArgs_Takeover(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	if args := strings.Join(daemonArgs(paths), " "); strings.Contains(args, "--takeover") {
+		t.Errorf("daemon args should not pass --takeover by default, got %s", args)
+	}
+	t.Cleanup(func() { takeover = false })
+	takeover = true
+	if args := strings.Join(daemonArgs(paths), " "); !strings.Contains(args, "--takeover") {
+		t.Errorf("daemon args should pass --takeover for a graceful restart, got %s", args)
+	}
+}
+
+func TestDaemonArgs_ReusePort(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	if args := strings.Join(daemonArgs(paths), " "); strings.Contains(args, "--reuse-port") {
+		t.Errorf("daemon args should not pass --reuse-port by default, got %s", args)
+	}
+	t.Cleanup(func() { reusePort = false })
+	reusePort = true
+	if args := strings.Join(daemonArgs(paths), " "); !strings.Contains(args, "--reuse-port") {
+		t.Errorf("daemon args should pass --reuse-port, got %s", args)
+	}
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+// secretsConfirmTimeout bounds how long reload-secrets waits for the daemon
+// to report its secret check.
+const secretsConfirmTimeout = 30 * time.Second
+
+var reloadSecretsCmd = &cobra.Command{
+	Use:   "reload-secrets",
+	Short: "Have the daemon re-fetch every proxy's secret and report rotated ones",
+	Long:  "Signal the running daemon to re-fetch the Secret Manager secret of every password proxy, without touching its listeners, and print which secrets changed since the last check and which can no longer be read. The proxy forwards raw bytes and never uses the passwords itself, so this validates that rotated secrets are readable rather than changing how connections are made.",
+	RunE:  runReloadSecrets,
+}
+
+func init() {
+	rootCmd.AddCommand(reloadSecretsCmd)
+}
+
+func runReloadSecrets(cmd *cobra.Command, args []string) error {
+	paths := daemonPaths()
+
+	pid, err := proxy.ReadPID(paths)
+	if err != nil || !proxy.IsRunning(pid) {
+		fmt.Println("No daemon is running.")
+		return nil
+	}
+
+	sent := time.Now()
+	if err := proxy.SignalProcess(pid, proxy.SigReloadSecrets); err != nil {
+		return fmt.Errorf("signaling daemon: %w", err)
+	}
+
+	deadline := sent.Add(secretsConfirmTimeout)
+	for time.Now().Before(deadline) {
+		if state, err := proxy.ReadState(paths); err == nil && state.Secrets != nil && !state.Secrets.StartedAt.Before(sent) {
+			return printSecretsReport(cmd, state.Secrets)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("daemon did not report a secret check; see %s", paths.LogFile)
+}
+
+// printSecretsReport prints a secret check and returns an error if any secret
+// couldn't be fetched.
+func printSecretsReport(cmd *cobra.Command, r *proxy.SecretsReport) error {
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Checked %d secrets: %d changed, %d failed.\n", r.Checked, len(r.Changed), len(r.Failed))
+	for _, name := range r.Changed {
+		fmt.Fprintf(out, "  changed: %s\n", name)
+	}
+	names := make([]string, 0, len(r.Failed))
+	for name := range r.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  failed:  %s: %s\n", name, strings.ReplaceAll(r.Failed[name], "\n", " "))
+	}
+	if len(r.Failed) > 0 {
+		return fmt.Errorf("%d secrets could not be fetched", len(r.Failed))
+	}
+	return nil
+}
+
+// secretRef is a secret version and the proxies that use it.
+type secretRef struct {
+	project, secret, version string
+	instances                []string
+}
+
+// checkSecrets re-fetches the Secret Manager secret of every password proxy
+// through tracker, logging which changed and which can't be read. Proxies
+// sharing a secret version are checked once, and at most limit secrets are
+// fetched at a time. tracker may be nil if no Secret Manager client could be
+// created, in which case every secret fails with trackerErr.
+func checkSecrets(ctx context.Context, tracker *secrets.Tracker, trackerErr error, proxies []config.ProxyEntry, limit int) *proxy.SecretsReport {
+	report := &proxy.SecretsReport{StartedAt: time.Now().UTC()}
+
+	refs := make(map[string]*secretRef)
+	for _, p := range proxies {
+		if !p.UsesSecretManager() {
+			continue
+		}
+		name := secrets.VersionName(p.Project(), p.Secret, p.SecretVersionOrLatest())
+		ref, ok := refs[name]
+		if !ok {
+			ref = &secretRef{project: p.Project(), secret: p.Secret, version: p.SecretVersionOrLatest()}
+			refs[name] = ref
+		}
+		ref.instances = append(ref.instances, p.Instance)
+	}
+
+	type result struct {
+		changed bool
+		err     error
+	}
+	results := make(map[string]result, len(refs))
+	var mu sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(limit)
+	for name, ref := range refs {
+		g.Go(func() error {
+			var r result
+			if tracker == nil {
+				r.err = trackerErr
+			} else {
+				r.changed, r.err = tracker.Check(ctx, ref.project, ref.secret, ref.version)
+			}
+			mu.Lock()
+			results[name] = r
+			mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r, instances := results[name], refs[name].instances
+		report.Checked++
+		switch {
+		case r.err != nil:
+			if report.Failed == nil {
+				report.Failed = make(map[string]string)
+			}
+			report.Failed[name] = r.err.Error()
+			slog.Error("secret not accessible", "secret", name, "instances", instances, "err", r.err)
+		case r.changed:
+			report.Changed = append(report.Changed, name)
+			slog.Info("secret changed", "secret", name, "instances", instances)
+		}
+	}
+	slog.Info("secrets checked", "checked", report.Checked, "changed", len(report.Changed), "failed", len(report.Failed))
+	return report
+}
+
+// secretChecker runs checkSecrets in the background for the daemon's main
+// loop, one check at a time. Its methods must only be called from that loop.
+type secretChecker struct {
+	tracker *secrets.Tracker
+	err     error // why tracker is nil, if it is
+	limit   int   // most secrets fetched at once
+
+	// done receives each finished check's report.
+	done    chan *proxy.SecretsReport
+	running bool
+	pending bool
+}
+
+// newSecretChecker creates a checker with its own Secret Manager client. If
+// the client can't be created, the checker still works but reports every
+// secret as failed. The returned func closes the client.
+func newSecretChecker(ctx context.Context, cfg *config.Config) (*secretChecker, func()) {
+	c := &secretChecker{limit: cfg.SecretConcurrencyOrDefault(), done: make(chan *proxy.SecretsReport, 1)}
+	client, err := newSecretManagerClient(ctx, cfg)
+	if err != nil {
+		c.err = fmt.Errorf("creating Secret Manager client: %w", err)
+		slog.Warn("secret checks unavailable", "err", c.err)
+		return c, func() {}
+	}
+	c.tracker = secrets.NewTracker(client)
+	return c, func() { client.Close() }
+}
+
+// request starts a check of the proxies' secrets. If one is already running,
+// another starts when it finishes, so the caller gets a report that began
+// after its request.
+func (c *secretChecker) request(ctx context.Context, proxies []config.ProxyEntry) {
+	if c.running {
+		c.pending = true
+		return
+	}
+	c.running = true
+	go func() {
+		c.done <- checkSecrets(ctx, c.tracker, c.err, proxies, c.limit)
+	}()
+}
+
+// finished must be called with each report received from done.
+func (c *secretChecker) finished(ctx context.Context, proxies []config.ProxyEntry) {
+	c.running = false
+	if c.pending {
+		c.pending = false
+		c.request(ctx, proxies)
+	}
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// rotatingSecretClient serves payloads from a map keyed by version name, so
+// tests can rotate or break individual secrets.
+type rotatingSecretClient struct {
+	mu       sync.Mutex
+	payloads map[string]string
+	calls    map[string]int
+}
+
+func (c *rotatingSecretClient) set(name, payload string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.payloads[name] = payload
+}
+
+func (c *rotatingSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[req.Name]++
+	payload, ok := c.payloads[req.Name]
+	if !ok {
+		return nil, errors.New("permission denied")
+	}
+	return &smpb.AccessSecretVersionResponse{Payload: &smpb.SecretPayload{Data: []byte(payload)}}, nil
+}
+
+func TestCheckSecrets(t *testing.T) {
+	nameA := "projects/proj/secrets/secret-a/versions/latest"
+	nameB := "projects/proj/secrets/secret-b/versions/latest"
+	client := &rotatingSecretClient{
+		payloads: map[string]string{nameA: "pw-a", nameB: "pw-b"},
+		calls:    make(map[string]int),
+	}
+	shared := proxyC
+	shared.Secret = proxyA.Secret
+	iam := config.ProxyEntry{Instance: "proj:us-central1:db-iam", Port: 5435, Auth: config.AuthIAM}
+	proxies := []config.ProxyEntry{proxyA, proxyB, shared, iam}
+
+	tracker := secrets.NewTracker(client)
+	ctx := context.Background()
+
+	baseline := checkSecrets(ctx, tracker, nil, proxies, 4)
+	if baseline.Checked != 2 || len(baseline.Changed) != 0 || len(baseline.Failed) != 0 {
+		t.Fatalf("baseline: got %+v, want 2 checked and nothing changed or failed", baseline)
+	}
+	if client.calls[nameA] != 1 {
+		t.Errorf("shared secret fetched %d times, want 1", client.calls[nameA])
+	}
+
+	client.set(nameA, "rotated")
+	delete(client.payloads, nameB)
+	report := checkSecrets(ctx, tracker, nil, proxies, 4)
+	if len(report.Changed) != 1 || report.Changed[0] != nameA {
+		t.Errorf("expected only %s changed, got %v", nameA, report.Changed)
+	}
+	if _, ok := report.Failed[nameB]; !ok || len(report.Failed) != 1 {
+		t.Errorf("expected only %s failed, got %v", nameB, report.Failed)
+	}
+}
+
+func TestCheckSecrets_NoClient(t *testing.T) {
+	report := checkSecrets(context.Background(), nil, errors.New("no credentials"), []config.ProxyEntry{proxyA}, 4)
+	if report.Failed["projects/proj/secrets/secret-a/versions/latest"] != "no credentials" {
+		t.Errorf("expected the client error for every secret, got %v", report.Failed)
+	}
+}
+
+func TestCheckSecrets_ConcurrencyLimit(t *testing.T) {
+	client := &concurrentSecretClient{}
+	var proxies []config.ProxyEntry
+	for i := range 50 {
+		proxies = append(proxies, config.ProxyEntry{
+			Instance: fmt.Sprintf("proj:us-central1:db-%d", i),
+			Port:     5432 + i,
+			Secret:   fmt.Sprintf("pw-%d", i),
+		})
+	}
+
+	const limit = 4
+	report := checkSecrets(context.Background(), secrets.NewTracker(client), nil, proxies, limit)
+	if report.Checked != len(proxies) || len(report.Failed) != 0 {
+		t.Errorf("expected %d secrets checked and none failed, got %+v", len(proxies), report)
+	}
+	if got := client.maxInFlight.Load(); got > limit {
+		t.Errorf("expected at most %d checks in flight, saw %d", limit, got)
+	} else if got < 2 {
+		t.Errorf("expected checks to run concurrently, saw at most %d in flight", got)
+	}
+}
+
+func TestSecretChecker_RequestWhileRunning(t *testing.T) {
+	c := &secretChecker{err: errors.New("no client"), limit: 1, done: make(chan *proxy.SecretsReport, 1)}
+	ctx := context.Background()
+	proxies := []config.ProxyEntry{proxyA}
+
+	c.request(ctx, proxies)
+	c.request(ctx, proxies)
+	first := <-c.done
+	c.finished(ctx, proxies)
+	if !c.running {
+		t.Fatal("expected a second check for the request made while running")
+	}
+	select {
+	case second := <-c.done:
+		if second.StartedAt.Before(first.StartedAt) {
+			t.Error("second check should start after the first")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second check not run")
+	}
+	c.finished(ctx, proxies)
+	if c.running {
+		t.Error("no further check should be running")
+	}
+}
+
+func TestPrintSecretsReport(t *testing.T) {
+	var out bytes.Buffer
+	reloadSecretsCmd.SetOut(&out)
+	defer reloadSecretsCmd.SetOut(nil)
+
+	err := printSecretsReport(reloadSecretsCmd, &proxy.SecretsReport{
+		Checked: 3,
+		Changed: []string{"projects/p/secrets/a/versions/latest"},
+		Failed:  map[string]string{"projects/p/secrets/b/versions/latest": "Failed to access secret.\n\nEnsure access."},
+	})
+	if err == nil {
+		t.Error("expected error when a secret failed")
+	}
+	got := out.String()
+	for _, want := range []string{
+		"Checked 3 secrets: 1 changed, 1 failed.",
+		"changed: projects/p/secrets/a/versions/latest",
+		"failed:  projects/p/secrets/b/versions/latest: Failed to access secret.  Ensure access.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, got)
+		}
+	}
+}
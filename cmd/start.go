@@ -1,20 +1,30 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"cloud-sql-proxy-runner/internal/config"
 	"cloud-sql-proxy-runner/internal/preflight"
 	"cloud-sql-proxy-runner/internal/proxy"
+	"cloud-sql-proxy-runner/internal/secrets"
 
 	"cloud.google.com/go/cloudsqlconn"
 	"github.com/spf13/cobra"
@@ -28,7 +38,31 @@ const (
 	daemonRestart
 )
 
-var daemonFlag bool
+// statsInterval is how often the daemon records listener counters in its
+// state file.
+const statsInterval = 5 * time.Second
+
+// defaultStartWait is how long start waits for the proxies to accept
+// connections, unless --wait says otherwise.
+const defaultStartWait = 5 * time.Second
+
+// probeInterval is how often probeProxies retries a proxy that isn't up yet.
+const probeInterval = 100 * time.Millisecond
+
+var (
+	daemonFlag bool
+	takeover   bool
+	reusePort  bool
+	failFast   bool
+	foreground bool
+	startWait  time.Duration
+	dryRun     bool
+	portOffset int
+	noVerify   bool
+	watch      bool
+
+	checkSecretsFlag bool
+)
 
 var startCmd = &cobra.Command{
 	Use:   "start",
@@ -39,89 +73,472 @@ var startCmd = &cobra.Command{
 func init() {
 	startCmd.Flags().BoolVar(&daemonFlag, "daemon", false, "internal: run as daemon process")
 	startCmd.Flags().MarkHidden("daemon")
+	startCmd.Flags().BoolVar(&takeover, "takeover", false, "internal: with --daemon, take over from the running daemon")
+	startCmd.Flags().MarkHidden("takeover")
+	startCmd.Flags().BoolVar(&failFast, "fail-fast", false, "stop the daemon if any proxy fails to start")
+	startCmd.Flags().BoolVar(&reusePort, "reuse-port", false, "bind TCP ports with SO_REUSEPORT, so that restart --graceful can replace the daemon later")
+	startCmd.Flags().DurationVar(&startWait, "wait", defaultStartWait, "how long to wait for every proxy to accept connections")
+	startCmd.Flags().BoolVar(&noVerify, "no-verify", false, "don't check that the proxies came up after starting the daemon")
+	startCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print what start would do without starting or stopping anything")
+	startCmd.Flags().BoolVar(&foreground, "foreground", false, "run the daemon in this process, logging to stderr, instead of detaching")
+	startCmd.Flags().BoolVar(&watch, "watch", false, "with --foreground, reload the config whenever the file changes")
+	startCmd.Flags().BoolVar(&checkSecretsFlag, "check-secrets", false, "before starting, check that every proxy's password can be fetched")
+	startCmd.Flags().IntVar(&portOffset, "port-offset", 0, "add this to every proxy's port, without editing the config")
+	startCmd.Flags().StringVar(&logLevelFlag, "log-level", "", "daemon log level: debug, info, warn, or error (default: the config's log_level, or info)")
 	rootCmd.AddCommand(startCmd)
 }
 
 func runStart(cmd *cobra.Command, args []string) error {
+	if err := validateLogLevelFlag(); err != nil {
+		return err
+	}
+	if reusePort && !proxy.ReusePortSupported {
+		return fmt.Errorf("--reuse-port is not supported on %s", runtime.GOOS)
+	}
 	if daemonFlag {
-		return runDaemon()
+		err := runDaemon()
+		if err != nil {
+			// The starter only sees its probes fail, so leave it the reason.
+			proxy.WriteLastError(daemonPaths(), err)
+		}
+		return err
+	}
+	if watch {
+		if !foreground {
+			return fmt.Errorf("--watch requires --foreground")
+		}
+		if configPath == config.StdinPath || config.IsRemote(configPath) || configDir != "" {
+			return fmt.Errorf("--watch needs a config file to watch, not stdin, a URL, or --config-dir")
+		}
+	}
+	if dryRun {
+		return runStartDryRun(cmd.OutOrStdout())
+	}
+	if err := saveConfigCopy(); err != nil {
+		return err
+	}
+	if foreground {
+		return runDaemonAttached()
 	}
 	return runStartForeground()
 }
 
-func runStartForeground() error {
-	ctx := context.Background()
+// runDaemonAttached runs the daemon in the current process, for supervisors
+// like systemd and container runtimes that expect it not to detach. It logs
+// to stderr and still writes the PID and state files, so stop, status, and
+// list work as usual.
+func runDaemonAttached() error {
+	cfg, err := prepareStart(context.Background())
+	if err != nil {
+		return err
+	}
 
-	// Preflight: check ADC
-	if err := preflight.CheckADC(ctx, preflight.DefaultCredentialFinder); err != nil {
+	if err := proxy.CleanupStale(daemonPaths()); err != nil {
+		return fmt.Errorf("%w; stop it first", err)
+	}
+	if err := preflight.CheckPortsFree(cfg.Proxies); err != nil {
 		return err
 	}
+	return runDaemon()
+}
 
-	// Load config
-	cfg, err := config.Load(configPath)
+func runStartForeground() error {
+	cfg, err := prepareStart(context.Background())
 	if err != nil {
 		return err
 	}
 
-	stateDir := proxy.StateDir()
+	paths := daemonPaths()
 
 	// Check for existing daemon
-	action, pid := checkDaemon(stateDir, cfg.Proxies)
+	action, pid := checkDaemon(paths, cfg.Proxies)
 	switch action {
 	case daemonKeep:
-		fmt.Printf("Daemon already running (pid %d)\n", pid)
+		fmt.Fprintf(infoOut(), "Daemon already running (pid %d)\n", pid)
 		return nil
 	case daemonRestart:
-		fmt.Println("Config changed, restarting daemon...")
-		if err := stopDaemon(pid, stateDir); err != nil {
+		fmt.Fprintln(infoOut(), "Config changed, restarting daemon...")
+		if err := stopDaemon(pid, paths); err != nil {
 			return fmt.Errorf("stopping old daemon: %w", err)
 		}
 	}
 
-	// Clean up stale PID file if any
-	proxy.CleanupStale(stateDir)
+	return launchDaemon(cfg, paths)
+}
+
+// runStartDryRun runs the preflight checks and prints what runStartForeground
+// would do with the daemon, without doing it.
+func runStartDryRun(out io.Writer) error {
+	cfg, err := prepareStart(context.Background())
+	if err != nil {
+		return err
+	}
+
+	paths := daemonPaths()
+	action, pid := checkDaemon(paths, cfg.Proxies)
+	var running []config.ProxyEntry
+	if action == daemonRestart {
+		if state, err := proxy.ReadState(paths); err == nil {
+			running = state.Proxies
+		}
+	}
+	printStartPlan(out, action, pid, running, cfg.Proxies)
+	return nil
+}
+
+// printStartPlan describes a daemonAction for --dry-run. For a restart,
+// running is the daemon's current proxies, which are compared with next by
+// instance; it is nil if the daemon's state couldn't be read.
+func printStartPlan(out io.Writer, action daemonAction, pid int, running, next []config.ProxyEntry) {
+	switch action {
+	case daemonKeep:
+		fmt.Fprintf(out, "Daemon already running (pid %d) with this config; nothing to do.\n", pid)
+	case daemonStart:
+		fmt.Fprintf(out, "Would start the daemon with %d proxies:\n", len(next))
+		for _, p := range next {
+			fmt.Fprintf(out, "  + %s on %s\n", instanceShortName(p.Instance), p.Endpoint())
+		}
+	case daemonRestart:
+		if running == nil {
+			fmt.Fprintf(out, "Would restart the daemon (pid %d); its state file is unreadable, so all %d proxies would be restarted.\n", pid, len(next))
+			return
+		}
+		fmt.Fprintf(out, "Would restart the daemon (pid %d) because the config changed:\n", pid)
+		added, removed, changed := planChanges(running, next)
+		for _, p := range added {
+			fmt.Fprintf(out, "  + %s on %s\n", instanceShortName(p.Instance), p.Endpoint())
+		}
+		for _, p := range removed {
+			fmt.Fprintf(out, "  - %s on %s\n", instanceShortName(p.Instance), p.Endpoint())
+		}
+		for _, p := range changed {
+			fmt.Fprintf(out, "  ~ %s on %s\n", instanceShortName(p.Instance), p.Endpoint())
+		}
+	}
+}
+
+// planChanges compares the running proxies with the new config by instance:
+// added and removed are only in next or running, and changed are in both
+// with different settings. Each is in config order.
+func planChanges(running, next []config.ProxyEntry) (added, removed, changed []config.ProxyEntry) {
+	old := make(map[string]config.ProxyEntry, len(running))
+	for _, p := range running {
+		old[p.Instance] = p
+	}
+	seen := make(map[string]bool, len(next))
+	for _, p := range next {
+		seen[p.Instance] = true
+		prev, ok := old[p.Instance]
+		switch {
+		case !ok:
+			added = append(added, p)
+		case proxyKey(prev) != proxyKey(p):
+			changed = append(changed, p)
+		}
+	}
+	for _, p := range running {
+		if !seen[p.Instance] {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed, changed
+}
+
+// prepareStart runs the preflight checks and loads the config for commands
+// that start the daemon.
+func prepareStart(ctx context.Context) (*config.Config, error) {
+	// Load config
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Preflight: check ADC
+	if err := checkCredentials(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	// Preflight: PSC endpoints must resolve inside the VPC. This only warns,
+	// since DNS may be set up differently where the daemon runs.
+	for _, p := range cfg.Proxies {
+		if p.IPType != config.IPTypePSC {
+			continue
+		}
+		if err := preflight.CheckPSCDNS(ctx, p.Instance, preflight.DefaultPSCNameFinder, preflight.DefaultHostResolver); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
+	// Preflight: with --check-secrets, a secret that can't be fetched is
+	// reported now rather than on the first connection.
+	if checkSecretsFlag {
+		if err := preflightSecrets(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// preflightSecrets checks that every password proxy's password can be
+// fetched, creating a Secret Manager client only if one is needed.
+func preflightSecrets(ctx context.Context, cfg *config.Config) error {
+	var client secrets.SecretClient
+	if needsSecretManager(cfg.Proxies) {
+		smClient, err := newSecretManagerClient(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("creating Secret Manager client: %w", err)
+		}
+		defer smClient.Close()
+		client = secrets.NewRetryingSecretClient(smClient, cfg.SecretAttemptsOrDefault())
+	}
+	return checkPasswords(ctx, client, cfg.Proxies)
+}
+
+// launchDaemon re-execs the binary as a detached daemon and reports whether
+// each proxy came up.
+func launchDaemon(cfg *config.Config, paths proxy.Paths) error {
+	if err := preflight.CheckPortsFree(cfg.Proxies); err != nil {
+		return err
+	}
+
+	// Clean up stale PID file if any, and any error left by an earlier
+	// daemon, so a failure reported below is this one's.
+	proxy.CleanupStale(paths)
+	proxy.ClearLastError(paths)
+
+	d, err := spawnDaemon(paths)
+	if err != nil {
+		return err
+	}
+	return checkStarted(cfg, paths, d)
+}
+
+// daemonExecutable returns the binary spawnDaemon runs. Tests replace it.
+var daemonExecutable = os.Executable
+
+// spawnedDaemon is a daemon process started by spawnDaemon.
+type spawnedDaemon struct {
+	pid int
+	// logStart is the size of the log file before the daemon started, so
+	// where its own output begins.
+	logStart int64
+}
 
-	// Daemonize: re-exec with --daemon flag
-	execPath, err := os.Executable()
+// spawnDaemon re-executes this command as the daemon, detached and logging
+// to the log file.
+func spawnDaemon(paths proxy.Paths) (spawnedDaemon, error) {
+	execPath, err := daemonExecutable()
 	if err != nil {
-		return fmt.Errorf("finding executable: %w", err)
+		return spawnedDaemon{}, fmt.Errorf("finding executable: %w", err)
 	}
 
-	if err := proxy.EnsureStateDir(stateDir); err != nil {
-		return fmt.Errorf("creating state dir: %w", err)
+	if err := proxy.EnsureStateDir(paths.Dir); err != nil {
+		return spawnedDaemon{}, fmt.Errorf("creating state dir: %w", err)
 	}
 
-	logFile, err := os.OpenFile(proxy.LogPath(stateDir), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	logFile, err := os.OpenFile(paths.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("opening log file: %w", err)
+		return spawnedDaemon{}, fmt.Errorf("opening log file: %w", err)
+	}
+	var logStart int64
+	if info, err := logFile.Stat(); err == nil {
+		logStart = info.Size()
 	}
 
-	daemonCmd := exec.Command(execPath, "start", "--daemon", "--config", configPath)
+	daemonCmd := exec.Command(execPath, daemonArgs(paths)...)
 	daemonCmd.Stdout = logFile
 	daemonCmd.Stderr = logFile
-	daemonCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	daemonCmd.SysProcAttr = proxy.DaemonSysProcAttr()
 
 	if err := daemonCmd.Start(); err != nil {
 		logFile.Close()
-		return fmt.Errorf("starting daemon: %w", err)
+		return spawnedDaemon{}, fmt.Errorf("starting daemon: %w", err)
 	}
 	logFile.Close()
+	// Reap the daemon if it exits while we're still around, so a crashed
+	// daemon doesn't linger as a zombie that still looks alive.
+	go daemonCmd.Wait()
+	return spawnedDaemon{pid: daemonCmd.Process.Pid, logStart: logStart}, nil
+}
+
+// checkStarted reports whether the proxies came up after the daemon d was
+// started, stopping it with --fail-fast if any didn't. A daemon that has
+// already exited is reported with what it logged, however the probe went.
+func checkStarted(cfg *config.Config, paths proxy.Paths, d spawnedDaemon) error {
+	pid := d.pid
+	// With --quiet, only the proxies that failed are reported, as errors.
+	failOut := io.Writer(os.Stdout)
+	if quiet {
+		failOut = os.Stderr
+	}
+	failed := verifyStart(infoOut(), failOut, cfg.Proxies, pid)
+	if !proxy.IsRunning(pid) {
+		return daemonExited(paths, d)
+	}
+	if failed == 0 {
+		return nil
+	}
+	if failFast {
+		if proxy.IsRunning(pid) {
+			fmt.Fprintln(infoOut(), "Stopping partially started daemon...")
+			if err := stopDaemon(pid, paths); err != nil {
+				return fmt.Errorf("stopping daemon: %w", err)
+			}
+		}
+	}
+	return startFailure(paths, failed, len(cfg.Proxies))
+}
 
-	// Wait briefly for daemon to start and confirm ports
-	time.Sleep(500 * time.Millisecond)
+// daemonExitLogLines is how many lines of its log daemonExited reports for a
+// daemon that exited without recording an error.
+const daemonExitLogLines = 20
 
-	for _, p := range cfg.Proxies {
+// daemonExited returns the error for a daemon that exited straight after it
+// was started: the error it recorded on exit, or else the end of what it
+// wrote to the log, which for a crash is the panic.
+func daemonExited(paths proxy.Paths, d spawnedDaemon) error {
+	if reason := proxy.ReadLastError(paths); reason != "" {
+		return fmt.Errorf("daemon (pid %d) exited: %s; see %s", d.pid, reason, paths.LogFile)
+	}
+	var output []byte
+	if f, err := os.Open(paths.LogFile); err == nil {
+		output, _ = io.ReadAll(io.NewSectionReader(f, d.logStart, 1<<62))
+		f.Close()
+	}
+	output = bytes.TrimSpace(lastLines(output, daemonExitLogLines))
+	if len(output) == 0 {
+		return fmt.Errorf("daemon (pid %d) exited without logging a reason; see %s", d.pid, paths.LogFile)
+	}
+	return fmt.Errorf("daemon (pid %d) exited; the end of its log, %s:\n%s", d.pid, paths.LogFile, output)
+}
+
+// daemonArgs returns the arguments that re-execute this command as the
+// daemon, passing on the flags it needs to load the same config and use the
+// same files.
+func daemonArgs(paths proxy.Paths) []string {
+	args := []string{"start", "--daemon", "--env", envName, "--pid-file", paths.PIDFile, "--state-dir", paths.Dir}
+	if configDir != "" {
+		args = append(args, "--config-dir", configDir)
+	} else {
+		args = append(args, "--config", configPath)
+	}
+	if logLevelFlag != "" {
+		args = append(args, "--log-level", logLevelFlag)
+	}
+	if impersonateFlag != "" {
+		args = append(args, "--impersonate", impersonateFlag)
+	}
+	if instanceName != "" {
+		args = append(args, "--instance-name", instanceName)
+	}
+	if portOffset != 0 {
+		args = append(args, "--port-offset", strconv.Itoa(portOffset))
+	}
+	if takeover {
+		args = append(args, "--takeover")
+	}
+	if reusePort {
+		args = append(args, "--reuse-port")
+	}
+	return args
+}
+
+// startFailure returns the error for failed of total proxies not coming up,
+// carrying the daemon's own error if it recorded one on exit.
+func startFailure(paths proxy.Paths, failed, total int) error {
+	if reason := proxy.ReadLastError(paths); reason != "" {
+		return fmt.Errorf("%d of %d proxies failed to start: daemon exited: %s; see %s", failed, total, reason, paths.LogFile)
+	}
+	return fmt.Errorf("%d of %d proxies failed to start; see %s", failed, total, paths.LogFile)
+}
+
+// verifyStart checks that the proxies came up after the daemon with the given
+// pid was started, and returns how many didn't; see probeProxies. With
+// --no-verify it only reports that the daemon was started.
+func verifyStart(out, errOut io.Writer, proxies []config.ProxyEntry, pid int) int {
+	if noVerify {
+		fmt.Fprintf(out, "Daemon started (pid %d).\n", pid)
+		return 0
+	}
+	return probeProxies(out, errOut, proxies, startWait)
+}
+
+// probeProxies waits up to wait for each proxy to come up, its ports
+// accepting connections or its socket file created, polling them all at
+// once, then prints a line per proxy, to out for those that came up and
+// errOut for the rest, and returns how many never came up.
+func probeProxies(out, errOut io.Writer, proxies []config.ProxyEntry, wait time.Duration) int {
+	deadline := time.Now().Add(wait)
+	up := make([]bool, len(proxies))
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			up[i] = waitForProxy(p, deadline)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, p := range boundProxies(proxies) {
 		name := instanceShortName(p.Instance)
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", p.Port), 2*time.Second)
-		if err != nil {
-			fmt.Printf("%-8s failed to start on port %d\n", name+":", p.Port)
+		if !up[i] {
+			fmt.Fprintf(errOut, "%-8s failed to start on %s\n", name+":", p.Endpoint())
+			failed++
 			continue
 		}
-		conn.Close()
-		fmt.Printf("%-8s started on port %d\n", name+":", p.Port)
+		fmt.Fprintf(out, "%-8s started on %s\n", name+":", p.Endpoint())
 	}
+	return failed
+}
 
-	return nil
+// waitForProxy reports whether each of the proxy's ports, or its socket,
+// accepts connections by the deadline.
+func waitForProxy(p config.ProxyEntry, deadline time.Time) bool {
+	for _, e := range config.ExpandPorts([]config.ProxyEntry{p}) {
+		if !waitForAddr(e, deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForAddr checks a single-port proxy every probeInterval until it is up
+// or the deadline passes. It always makes at least one attempt.
+func waitForAddr(p config.ProxyEntry, deadline time.Time) bool {
+	for {
+		if addrUp(p) {
+			return true
+		}
+		if time.Until(deadline) < probeInterval {
+			return false
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// addrUp reports whether a single-port proxy is up. A TCP proxy is up once
+// it accepts a connection. A socket proxy is up once its socket file exists:
+// the starter may not be allowed to connect to it, and a connection would
+// make the daemon dial the instance.
+func addrUp(p config.ProxyEntry) bool {
+	if p.AutoPort() {
+		// The daemon records the port it picked once it is listening.
+		if p = boundProxies([]config.ProxyEntry{p})[0]; p.AutoPort() {
+			return false
+		}
+	}
+	if p.Socket != "" {
+		info, err := os.Stat(p.Socket)
+		return err == nil && info.Mode()&os.ModeSocket != 0
+	}
+	conn, err := net.DialTimeout("tcp", p.DialAddr(), 2*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
 }
 
 func instanceShortName(instance string) string {
@@ -136,92 +553,401 @@ func runDaemon() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	stateDir := proxy.StateDir()
+	paths := daemonPaths()
 
-	// Write PID
-	if err := proxy.WritePID(stateDir, os.Getpid()); err != nil {
-		return fmt.Errorf("writing PID: %w", err)
+	// Write PID. A daemon taking over only claims the state files once it
+	// is listening, so if it fails the old daemon's are left in place.
+	if !takeover {
+		if err := proxy.WritePID(paths, os.Getpid()); err != nil {
+			return fmt.Errorf("writing PID: %w", err)
+		}
 	}
 
 	// Load config
-	cfg, err := config.Load(configPath)
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
+	setupLogging(cfg)
+	accessLogPath = paths.AccessLog
 
 	// Create Cloud SQL dialer
-	dialer, err := cloudsqlconn.NewDialer(ctx)
+	dialer, err := newCloudSQLDialer(ctx, cfg)
 	if err != nil {
 		return fmt.Errorf("creating Cloud SQL dialer: %w", err)
 	}
 	defer dialer.Close()
 
 	// Wrap the real dialer to match our interface
-	d := &realDialer{dialer: dialer}
-
-	// Start listeners
-	var listeners []*proxy.Listener
-	for _, p := range cfg.Proxies {
-		l := proxy.NewListener(p.Instance, p.Port, d)
-		if err := l.Start(ctx); err != nil {
-			log.Printf("failed to start listener for %s on port %d: %v", p.Instance, p.Port, err)
-			// Clean up already-started listeners
-			for _, started := range listeners {
-				started.Close()
-			}
-			proxy.RemoveStateFiles(stateDir)
-			return err
+	d := newRealDialer(dialer, cfg.Proxies)
+
+	// Serve health checks before starting listeners, so /readyz reports
+	// not ready until they are all bound.
+	var running atomic.Pointer[proxy.Manager]
+	listeners := func() []*proxy.Listener {
+		if m := running.Load(); m != nil {
+			return m.Listeners()
 		}
-		listeners = append(listeners, l)
-		log.Printf("listening on port %d for %s", p.Port, p.Instance)
+		return nil
+	}
+	health := startHealthServer(cfg.HealthPort, listeners, func() bool { return running.Load() != nil })
+
+	// Start listeners. They are run by proxy.RunDaemon until stop is
+	// called, and this loop hands it reloads.
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	reloads := make(chan proxy.Reload)
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.RunDaemon(runCtx, cfg, proxy.RunOptions{
+			Dialer:      d,
+			NewListener: newListener,
+			Reloads:     reloads,
+			Started: func(m *proxy.Manager) {
+				running.Store(m)
+				close(started)
+			},
+		})
+	}()
+	select {
+	case <-started:
+	case err := <-done:
+		shutdownServers(health)
+		if !takeover {
+			proxy.RemoveStateFiles(paths)
+		}
+		return err
 	}
+	set := running.Load()
+	if takeover {
+		if err := proxy.WritePID(paths, os.Getpid()); err != nil {
+			slog.Warn("failed to write PID file", "err", err)
+		}
+	}
+	proxy.ClearLastError(paths)
+
+	metrics := startMetricsServer(cfg.MetricsPort, listeners)
 
 	// Write state file
 	state := &proxy.DaemonState{
-		PID:       os.Getpid(),
-		StartedAt: time.Now().UTC(),
-		Proxies:   cfg.Proxies,
+		PID:             os.Getpid(),
+		StartedAt:       time.Now().UTC(),
+		Proxies:         cfg.Proxies,
+		ShutdownTimeout: cfg.ShutdownTimeoutOrDefault(),
+		PortOffset:      portOffset,
+		ReusePort:       reusePort,
+		ConfigPath:      absConfigPath(),
+		ConfigHash:      cfg.Hash,
+		AutoPorts:       set.AutoPorts(),
 	}
-	if err := proxy.WriteState(stateDir, state); err != nil {
-		log.Printf("warning: failed to write state file: %v", err)
+	if err := proxy.WriteState(paths, state); err != nil {
+		slog.Warn("failed to write state file", "err", err)
 	}
+	updatePortsFile(paths, cfg, state)
 
-	// Handle signals
+	// Answer CLI queries on the control socket. Without it, the CLI falls
+	// back to the state file and signals.
+	control, err := proxy.ListenControl(paths.Control)
+	if err != nil {
+		slog.Warn("control socket unavailable", "err", err)
+	}
+	ctl := &daemonControl{set: set, reloads: reloads, d: d, paths: paths, state: state}
+
+	// Fetch the secrets once at startup, so that the first reload-secrets
+	// can tell which of them changed.
+	checker, closeChecker := newSecretChecker(ctx, cfg)
+	defer closeChecker()
+	if checker.tracker != nil {
+		checker.request(ctx, state.Proxies)
+	}
+
+	// With --watch, edits to the config file reload it like reload does.
+	var configChanged <-chan struct{}
+	if watch {
+		configChanged = watchConfig(ctx, configPath, cfg.Hash, watchInterval)
+	}
+
+	// Handle signals. SIGHUP only reopens the log file, so that logrotate
+	// doesn't also apply a half-edited config; the config is reloaded over
+	// the control socket. SIGUSR1 re-fetches the secrets, and SIGUSR2 logs
+	// the state of the listeners. SIGQUIT shuts down like SIGTERM but first dumps all
+	// goroutine stacks to the log, which helps debug a stuck daemon. In
+	// between, listener counters are recorded in the state file for status
+	// and list.
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
-	<-sigCh
+	proxy.NotifySignals(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP, proxy.SigReloadSecrets, proxy.SigDumpState)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			recordStats(set, paths, state)
+		case call := <-control.Calls():
+			call.Reply(ctl.handle(call.Request))
+		case report := <-checker.done:
+			state.Secrets = report
+			if err := proxy.WriteState(paths, state); err != nil {
+				slog.Warn("failed to write state file", "err", err)
+			}
+			checker.finished(ctx, state.Proxies)
+		case <-configChanged:
+			slog.Info("config file changed")
+			ctl.reload()
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				// logrotate renames the log and sends SIGHUP, so carry on
+				// in a new file. In the foreground, stderr is left to the
+				// supervisor.
+				if daemonFlag {
+					if err := proxy.ReopenLog(paths.LogFile); err != nil {
+						slog.Warn("failed to reopen log file", "err", err)
+					}
+				}
+				slog.Info("received SIGHUP")
+				continue
+			}
+			if sig == proxy.SigReloadSecrets {
+				slog.Info("received reload-secrets request")
+				checker.request(ctx, state.Proxies)
+				continue
+			}
+			if sig == proxy.SigDumpState {
+				dumpState(set, state.StartedAt)
+				continue
+			}
+			if sig == syscall.SIGQUIT {
+				dumpGoroutines()
+			}
+			break loop
+		}
+	}
 
-	log.Println("shutting down...")
+	slog.Info("shutting down")
+	control.Close()
+	shutdownServers(metrics, health)
+	// RunDaemon stops accepting at once but lets open connections finish,
+	// up to the configured timeout, before the dialer goes away.
+	stop()
+	<-done
 	cancel()
-	for _, l := range listeners {
-		l.Close()
+	// After restart --graceful, the state files belong to the new daemon.
+	if pid, err := proxy.ReadPID(paths); err != nil || pid == os.Getpid() {
+		proxy.RemoveStateFiles(paths)
 	}
-	proxy.RemoveStateFiles(stateDir)
-	log.Println("daemon stopped")
+	slog.Info("daemon stopped")
 	return nil
 }
 
+// updatePortsFile writes the ports file with the daemon's bound proxies if
+// cfg sets ports_file, and removes any left by an earlier config otherwise.
+func updatePortsFile(paths proxy.Paths, cfg *config.Config, state *proxy.DaemonState) {
+	if !cfg.PortsFile {
+		os.Remove(paths.Ports)
+		return
+	}
+	if err := proxy.WritePorts(paths, state.BoundProxies()); err != nil {
+		slog.Warn("failed to write ports file", "err", err)
+	}
+}
+
+// startMetricsServer serves Prometheus metrics for the listeners on
+// localhost:port, returning nil if port is 0. A port that can't be bound is
+// logged rather than stopping the daemon, since the proxies still work.
+func startMetricsServer(port int, listeners func() []*proxy.Listener) *http.Server {
+	if port == 0 {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", proxy.MetricsHandler(listeners))
+	return serveHTTP("metrics", net.JoinHostPort(config.DefaultHost, strconv.Itoa(port)), mux)
+}
+
+// startHealthServer serves /healthz and /readyz for the listeners on port,
+// returning nil if port is 0. It binds all interfaces because orchestrators
+// like Kubernetes probe the pod IP rather than localhost. ready reports
+// whether the listeners have been started.
+func startHealthServer(port int, listeners func() []*proxy.Listener, ready func() bool) *http.Server {
+	if port == 0 {
+		return nil
+	}
+	return serveHTTP("health checks", net.JoinHostPort("", strconv.Itoa(port)), proxy.HealthHandler(listeners, ready))
+}
+
+// serveHTTP serves handler on addr in the background. A failure to bind is
+// logged and nil returned. Like the listeners, it binds with SO_REUSEPORT
+// under --reuse-port, so a daemon taking over can serve on the same port.
+func serveHTTP(name, addr string, handler http.Handler) *http.Server {
+	ln, err := proxy.ListenTCP(addr, reusePort)
+	if err != nil {
+		slog.Warn("failed to start "+name+" server", "err", err)
+		return nil
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error(name+" server failed", "err", err)
+		}
+	}()
+	slog.Info("serving "+name, "addr", ln.Addr().String())
+	return srv
+}
+
+// shutdownServers gracefully stops the daemon's HTTP servers, skipping nil
+// ones.
+func shutdownServers(servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		if srv != nil {
+			srv.Shutdown(ctx)
+		}
+	}
+}
+
+// recordStats writes a snapshot of each listener's counters to the state
+// file.
+func recordStats(set *proxy.Manager, paths proxy.Paths, state *proxy.DaemonState) {
+	state.Stats = snapshotStats(set)
+	if err := proxy.WriteState(paths, state); err != nil {
+		slog.Warn("failed to write state file", "err", err)
+	}
+}
+
+// snapshotStats returns each listener's counters, keyed by instance.
+func snapshotStats(set *proxy.Manager) map[string]proxy.ProxyStats {
+	stats := make(map[string]proxy.ProxyStats)
+	conns := instanceConns(set)
+	for _, l := range set.Listeners() {
+		// A proxy with several ports has a listener per port; its stats
+		// are their sums.
+		s := stats[l.Instance]
+		s.ActiveConns += l.ActiveConns()
+		s.BytesSent += l.BytesSent()
+		s.BytesReceived += l.BytesReceived()
+		s.Connected += l.DialedConns()
+		s.DialErrors += l.DialErrors()
+		if e := l.LastDialError(); e != nil && (s.LastDialError == nil || e.At.After(s.LastDialError.At)) {
+			s.LastDialError = e
+		}
+		s.Connections = conns[l.Instance]
+		stats[l.Instance] = s
+	}
+	return stats
+}
+
+// instanceConns returns the open connections of each proxy, keyed by
+// instance and oldest first, across all of its ports.
+func instanceConns(set *proxy.Manager) map[string][]proxy.ConnInfo {
+	conns := make(map[string][]proxy.ConnInfo)
+	for _, l := range set.Listeners() {
+		conns[l.Instance] = append(conns[l.Instance], l.Connections()...)
+	}
+	for _, c := range conns {
+		sort.SliceStable(c, func(i, j int) bool { return c[i].StartedAt.Before(c[j].StartedAt) })
+	}
+	return conns
+}
+
+// dumpState logs a snapshot of the daemon for debugging: its uptime and
+// goroutine count, then each listener's connections and traffic. It only
+// reads counters, so it is cheap enough to run on every SIGUSR2.
+func dumpState(set *proxy.Manager, startedAt time.Time) {
+	listeners := set.Listeners()
+	slog.Info("daemon state", "uptime", time.Since(startedAt).Round(time.Second),
+		"goroutines", runtime.NumGoroutine(), "listeners", len(listeners))
+	for _, l := range listeners {
+		slog.Info("listener state", "instance", l.Instance, "addr", l.Addr().String(),
+			"active_conns", l.ActiveConns(), "connections", l.TotalConns(), "dial_errors", l.DialErrors(),
+			"sent", l.BytesSent(), "received", l.BytesReceived())
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines to the log output.
+func dumpGoroutines() {
+	slog.Info("received SIGQUIT, dumping goroutines")
+	pprof.Lookup("goroutine").WriteTo(logOutput, 2)
+}
+
+// newListener creates the listener for a proxy entry. Under --reuse-port its
+// port is bound with SO_REUSEPORT, so restart --graceful can start a new
+// daemon alongside this one. Otherwise a second daemon on the same port fails
+// with "address already in use", as it should.
+func newListener(p config.ProxyEntry, d proxy.Dialer) *proxy.Listener {
+	l := proxy.NewProxyListener(p, d)
+	l.ReusePort = reusePort
+	l.Logger = listenerLogger(p)
+	if p.AccessLog {
+		l.AccessLog = accessLogger()
+	}
+	return l
+}
+
+// realDialer adapts a cloudsqlconn.Dialer to proxy.Dialer. The dialer is
+// shared by all proxies, so per-proxy settings are applied as dial options on
+// each call.
 type realDialer struct {
 	dialer *cloudsqlconn.Dialer
+
+	mu   sync.RWMutex
+	opts map[string][]cloudsqlconn.DialOption
+}
+
+func newRealDialer(dialer *cloudsqlconn.Dialer, proxies []config.ProxyEntry) *realDialer {
+	r := &realDialer{dialer: dialer}
+	r.setProxies(proxies)
+	return r
+}
+
+// setProxies replaces the per-instance dial options, e.g. after a reload.
+func (r *realDialer) setProxies(proxies []config.ProxyEntry) {
+	opts := make(map[string][]cloudsqlconn.DialOption, len(proxies))
+	for _, p := range proxies {
+		opts[p.Instance] = dialOptions(p)
+	}
+	r.mu.Lock()
+	r.opts = opts
+	r.mu.Unlock()
+}
+
+// dialOptions returns the per-dial options for a proxy entry.
+func dialOptions(p config.ProxyEntry) []cloudsqlconn.DialOption {
+	var opts []cloudsqlconn.DialOption
+	switch p.IPType {
+	case config.IPTypePrivate:
+		opts = append(opts, cloudsqlconn.WithPrivateIP())
+	case config.IPTypePSC:
+		opts = append(opts, cloudsqlconn.WithPSC())
+	default:
+		opts = append(opts, cloudsqlconn.WithPublicIP())
+	}
+	if p.IAMAuth() {
+		opts = append(opts, cloudsqlconn.WithDialIAMAuthN(true))
+	}
+	return opts
 }
 
 func (r *realDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
-	return r.dialer.Dial(ctx, instance)
+	r.mu.RLock()
+	opts := r.opts[instance]
+	r.mu.RUnlock()
+	return r.dialer.Dial(ctx, instance, opts...)
 }
 
 func (r *realDialer) Close() error {
 	return r.dialer.Close()
 }
 
-func checkDaemon(stateDir string, proxies []config.ProxyEntry) (daemonAction, int) {
-	pid, err := proxy.ReadPID(stateDir)
+func checkDaemon(paths proxy.Paths, proxies []config.ProxyEntry) (daemonAction, int) {
+	pid, err := proxy.ReadPID(paths)
 	if err != nil {
 		return daemonStart, 0
 	}
 	if !proxy.IsRunning(pid) {
 		return daemonStart, 0
 	}
-	state, err := proxy.ReadState(stateDir)
+	state, err := proxy.ReadState(paths)
 	if err != nil {
 		return daemonRestart, pid
 	}
@@ -235,15 +961,24 @@ func proxiesEqual(a, b []config.ProxyEntry) bool {
 	if len(a) != len(b) {
 		return false
 	}
-	counts := make(map[config.ProxyEntry]int, len(a))
+	counts := make(map[string]int, len(a))
 	for _, e := range a {
-		counts[e]++
+		counts[proxyKey(e)]++
 	}
 	for _, e := range b {
-		counts[e]--
-		if counts[e] < 0 {
+		k := proxyKey(e)
+		counts[k]--
+		if counts[k] < 0 {
 			return false
 		}
 	}
 	return true
 }
+
+// proxyKey returns a comparable representation of a proxy entry. Entries hold
+// maps (tags), so they can't be used as map keys directly; encoding/json sorts
+// map keys, which makes the encoding stable.
+func proxyKey(p config.ProxyEntry) string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
@@ -1,13 +1,30 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/preflight"
 	"cloud-sql-proxy-runner/internal/proxy"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"golang.org/x/oauth2/google"
 )
 
 var (
@@ -27,12 +44,12 @@ func deadPID(t *testing.T) int {
 }
 
 // writeState is a test helper that writes both PID and state files.
-func writeState(t *testing.T, dir string, pid int, proxies []config.ProxyEntry) {
+func writeState(t *testing.T, paths proxy.Paths, pid int, proxies []config.ProxyEntry) {
 	t.Helper()
-	if err := proxy.WritePID(dir, pid); err != nil {
+	if err := proxy.WritePID(paths, pid); err != nil {
 		t.Fatalf("writing PID: %v", err)
 	}
-	if err := proxy.WriteState(dir, &proxy.DaemonState{
+	if err := proxy.WriteState(paths, &proxy.DaemonState{
 		PID:       pid,
 		StartedAt: time.Now().UTC(),
 		Proxies:   proxies,
@@ -44,8 +61,8 @@ func writeState(t *testing.T, dir string, pid int, proxies []config.ProxyEntry)
 // --- checkDaemon tests ---
 
 func TestCheckDaemon_NoPIDFile(t *testing.T) {
-	dir := t.TempDir()
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA})
+	paths := proxy.NewPaths(t.TempDir())
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA})
 	if action != daemonStart {
 		t.Errorf("expected daemonStart, got %d", action)
 	}
@@ -55,11 +72,11 @@ func TestCheckDaemon_NoPIDFile(t *testing.T) {
 }
 
 func TestCheckDaemon_StalePID(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	dead := deadPID(t)
-	writeState(t, dir, dead, []config.ProxyEntry{proxyA})
+	writeState(t, paths, dead, []config.ProxyEntry{proxyA})
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA})
 	if action != daemonStart {
 		t.Errorf("expected daemonStart for dead process, got %d", action)
 	}
@@ -69,11 +86,11 @@ func TestCheckDaemon_StalePID(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithSameConfig(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid() // test process is alive
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA, proxyB})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA, proxyB})
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA, proxyB})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA, proxyB})
 	if action != daemonKeep {
 		t.Errorf("expected daemonKeep, got %d", action)
 	}
@@ -83,12 +100,12 @@ func TestCheckDaemon_RunningWithSameConfig(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithReorderedConfig(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA, proxyB, proxyC})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA, proxyB, proxyC})
 
 	// Same proxies in different order should be kept
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyC, proxyA, proxyB})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyC, proxyA, proxyB})
 	if action != daemonKeep {
 		t.Errorf("expected daemonKeep for reordered config, got %d", action)
 	}
@@ -98,11 +115,11 @@ func TestCheckDaemon_RunningWithReorderedConfig(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithProxyAdded(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA})
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA, proxyB})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA, proxyB})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when proxy added, got %d", action)
 	}
@@ -112,11 +129,11 @@ func TestCheckDaemon_RunningWithProxyAdded(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithProxyRemoved(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA, proxyB})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA, proxyB})
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when proxy removed, got %d", action)
 	}
@@ -126,50 +143,50 @@ func TestCheckDaemon_RunningWithProxyRemoved(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithPortChanged(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA})
 
 	changed := config.ProxyEntry{Instance: proxyA.Instance, Port: 9999, Secret: proxyA.Secret}
-	action, _ := checkDaemon(dir, []config.ProxyEntry{changed})
+	action, _ := checkDaemon(paths, []config.ProxyEntry{changed})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when port changed, got %d", action)
 	}
 }
 
 func TestCheckDaemon_RunningWithSecretChanged(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA})
 
 	changed := config.ProxyEntry{Instance: proxyA.Instance, Port: proxyA.Port, Secret: "new-secret"}
-	action, _ := checkDaemon(dir, []config.ProxyEntry{changed})
+	action, _ := checkDaemon(paths, []config.ProxyEntry{changed})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when secret changed, got %d", action)
 	}
 }
 
 func TestCheckDaemon_RunningWithProxyReplaced(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA, proxyB})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA, proxyB})
 
 	// Replace B with C
-	action, _ := checkDaemon(dir, []config.ProxyEntry{proxyA, proxyC})
+	action, _ := checkDaemon(paths, []config.ProxyEntry{proxyA, proxyC})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when proxy replaced, got %d", action)
 	}
 }
 
 func TestCheckDaemon_RunningWithMissingStateFile(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
 	// Write only PID file, no state.json
-	if err := proxy.WritePID(dir, livePID); err != nil {
+	if err := proxy.WritePID(paths, livePID); err != nil {
 		t.Fatalf("writing PID: %v", err)
 	}
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when state.json missing, got %d", action)
 	}
@@ -179,17 +196,17 @@ func TestCheckDaemon_RunningWithMissingStateFile(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithCorruptStateFile(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	if err := proxy.WritePID(dir, livePID); err != nil {
+	if err := proxy.WritePID(paths, livePID); err != nil {
 		t.Fatalf("writing PID: %v", err)
 	}
 	// Write garbage to state.json
-	if err := os.WriteFile(dir+"/state.json", []byte("{invalid json"), 0644); err != nil {
+	if err := os.WriteFile(paths.StateFile, []byte("{invalid json"), 0644); err != nil {
 		t.Fatalf("writing corrupt state: %v", err)
 	}
 
-	action, pid := checkDaemon(dir, []config.ProxyEntry{proxyA})
+	action, pid := checkDaemon(paths, []config.ProxyEntry{proxyA})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart when state.json corrupt, got %d", action)
 	}
@@ -199,12 +216,12 @@ func TestCheckDaemon_RunningWithCorruptStateFile(t *testing.T) {
 }
 
 func TestCheckDaemon_RunningWithCompletelyDifferentConfig(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	livePID := os.Getpid()
-	writeState(t, dir, livePID, []config.ProxyEntry{proxyA})
+	writeState(t, paths, livePID, []config.ProxyEntry{proxyA})
 
 	// Completely different proxy
-	action, _ := checkDaemon(dir, []config.ProxyEntry{proxyB})
+	action, _ := checkDaemon(paths, []config.ProxyEntry{proxyB})
 	if action != daemonRestart {
 		t.Errorf("expected daemonRestart for completely different config, got %d", action)
 	}
@@ -213,7 +230,7 @@ func TestCheckDaemon_RunningWithCompletelyDifferentConfig(t *testing.T) {
 // --- stopDaemon tests ---
 
 func TestStopDaemon_TerminatesProcess(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 
 	// Spawn a long-running process to stop
 	cmd := exec.Command("sleep", "60")
@@ -223,14 +240,14 @@ func TestStopDaemon_TerminatesProcess(t *testing.T) {
 	pid := cmd.Process.Pid
 	// Reap the child in the background so it doesn't become a zombie after kill.
 	go cmd.Wait()
-	writeState(t, dir, pid, []config.ProxyEntry{proxyA})
+	writeState(t, paths, pid, []config.ProxyEntry{proxyA})
 
 	// Verify it's alive
 	if !proxy.IsRunning(pid) {
 		t.Fatal("sleep process should be running before stop")
 	}
 
-	if err := stopDaemon(pid, dir); err != nil {
+	if err := stopDaemon(pid, paths); err != nil {
 		t.Fatalf("stopDaemon: %v", err)
 	}
 
@@ -243,30 +260,258 @@ func TestStopDaemon_TerminatesProcess(t *testing.T) {
 	}
 
 	// State files should be cleaned up
-	if _, err := proxy.ReadPID(dir); err == nil {
+	if _, err := proxy.ReadPID(paths); err == nil {
 		t.Error("PID file should be removed after stopDaemon")
 	}
-	if _, err := proxy.ReadState(dir); err == nil {
+	if _, err := proxy.ReadState(paths); err == nil {
 		t.Error("state file should be removed after stopDaemon")
 	}
 }
 
+// startIgnoringTerm starts a process that ignores SIGTERM, so only SIGKILL
+// stops it.
+func startIgnoringTerm(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", `trap "" TERM; exec sleep 60`)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting process: %v", err)
+	}
+	go cmd.Wait()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	// Give the shell time to install the trap before it's signaled.
+	time.Sleep(100 * time.Millisecond)
+	return cmd.Process.Pid
+}
+
+func TestStopDaemonWithin_ExitsInWindow(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting sleep process: %v", err)
+	}
+	go cmd.Wait()
+	pid := cmd.Process.Pid
+	writeState(t, paths, pid, []config.ProxyEntry{proxyA})
+
+	start := time.Now()
+	if err := stopDaemonWithin(pid, paths, 5*time.Second); err != nil {
+		t.Fatalf("stopDaemonWithin: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s to stop a process that exits on SIGTERM", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if proxy.IsRunning(pid) {
+		t.Error("process should not be running after stopDaemonWithin")
+	}
+}
+
+func TestStopDaemonWithin_KillsAfterTimeout(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	pid := startIgnoringTerm(t)
+	writeState(t, paths, pid, []config.ProxyEntry{proxyA})
+
+	start := time.Now()
+	if err := stopDaemonWithin(pid, paths, 300*time.Millisecond); err != nil {
+		t.Fatalf("stopDaemonWithin: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("killed after %s, before the 300ms timeout", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if proxy.IsRunning(pid) {
+		t.Error("process ignoring SIGTERM should have been killed")
+	}
+	if _, err := proxy.ReadPID(paths); err == nil {
+		t.Error("PID file should be removed after the kill")
+	}
+}
+
+func TestStopDaemonWithin_KillsWhenSignalFails(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting sleep process: %v", err)
+	}
+	go cmd.Wait()
+	pid := cmd.Process.Pid
+	writeState(t, paths, pid, []config.ProxyEntry{proxyA})
+
+	// As on Windows, when the daemon isn't listening for the stop event.
+	t.Cleanup(func() { signalProcess = proxy.SignalProcess })
+	signalProcess = func(int, syscall.Signal) error {
+		return fmt.Errorf("process %d is not accepting SIGTERM", pid)
+	}
+
+	start := time.Now()
+	if err := stopDaemonWithin(pid, paths, 5*time.Second); err != nil {
+		t.Fatalf("stopDaemonWithin: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s; a failed signal should skip the grace period", elapsed)
+	}
+	if proxy.IsRunning(pid) {
+		t.Error("process should have been killed after the signal failed")
+	}
+	if _, err := proxy.ReadPID(paths); err == nil {
+		t.Error("PID file should be removed once the process is gone")
+	}
+}
+
+func TestStopDaemonWithin_ZeroKillsAtOnce(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	pid := startIgnoringTerm(t)
+	writeState(t, paths, pid, []config.ProxyEntry{proxyA})
+
+	start := time.Now()
+	if err := stopDaemonWithin(pid, paths, 0); err != nil {
+		t.Fatalf("stopDaemonWithin: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to kill with no grace period", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if proxy.IsRunning(pid) {
+		t.Error("process should have been killed")
+	}
+}
+
 func TestStopDaemon_DeadProcess(t *testing.T) {
-	dir := t.TempDir()
+	paths := proxy.NewPaths(t.TempDir())
 	dead := deadPID(t)
-	writeState(t, dir, dead, []config.ProxyEntry{proxyA})
+	writeState(t, paths, dead, []config.ProxyEntry{proxyA})
 
 	// Should not error on already-dead process
-	if err := stopDaemon(dead, dir); err != nil {
+	if err := stopDaemon(dead, paths); err != nil {
 		t.Fatalf("stopDaemon on dead process: %v", err)
 	}
 
 	// State files should be cleaned up
-	if _, err := proxy.ReadPID(dir); err == nil {
+	if _, err := proxy.ReadPID(paths); err == nil {
 		t.Error("PID file should be removed")
 	}
 }
 
+// --- runStop tests ---
+
+// setupStop points the stop command at a state directory and config in a
+// temp dir, with the given flags.
+func setupStop(t *testing.T, force, purge bool) proxy.Paths {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	cfgFile := filepath.Join(dir, "config.yaml")
+	os.WriteFile(cfgFile, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:db-s"
+    socket: "/tmp/db-s"
+    secret: "pw"
+`), 0644)
+
+	oldPath, oldEnv, oldPID, oldForce, oldPurge := configPath, envName, pidFile, stopForce, stopPurge
+	t.Cleanup(func() {
+		configPath, envName, pidFile, stopForce, stopPurge = oldPath, oldEnv, oldPID, oldForce, oldPurge
+	})
+	configPath, envName, pidFile, stopForce, stopPurge = cfgFile, "", "", force, purge
+	return daemonPaths()
+}
+
+func TestRunStop_NoDaemon(t *testing.T) {
+	paths := setupStop(t, false, false)
+	if err := runStop(nil, nil); err != nil {
+		t.Fatalf("runStop: %v", err)
+	}
+	if _, err := os.Stat(paths.Dir); !os.IsNotExist(err) {
+		t.Errorf("stop with no daemon should leave no state dir, got: %v", err)
+	}
+}
+
+func TestRunStop_StaleState(t *testing.T) {
+	paths := setupStop(t, false, false)
+	writeState(t, paths, deadPID(t), []config.ProxyEntry{proxyA})
+	os.WriteFile(paths.LogFile, []byte("log"), 0644)
+
+	if err := runStop(nil, nil); err != nil {
+		t.Fatalf("runStop: %v", err)
+	}
+	if _, err := proxy.ReadPID(paths); err == nil {
+		t.Error("stale PID file should be removed")
+	}
+	if _, err := proxy.ReadState(paths); err == nil {
+		t.Error("stale state file should be removed")
+	}
+	if _, err := os.Stat(paths.LogFile); err != nil {
+		t.Errorf("log should be kept without --purge: %v", err)
+	}
+}
+
+func TestRunStop_Purge(t *testing.T) {
+	paths := setupStop(t, false, true)
+	writeState(t, paths, deadPID(t), []config.ProxyEntry{proxyA})
+	os.WriteFile(paths.LogFile, []byte("log"), 0644)
+	os.WriteFile(paths.AccessLog, []byte("{}"), 0644)
+
+	if err := runStop(nil, nil); err != nil {
+		t.Fatalf("runStop: %v", err)
+	}
+	for _, f := range []string{paths.PIDFile, paths.StateFile, paths.LogFile, paths.AccessLog} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed with --purge", f)
+		}
+	}
+}
+
+func TestRunStop_ForceWithFreePorts(t *testing.T) {
+	paths := setupStop(t, true, false)
+	free := config.ProxyEntry{Instance: proxyB.Instance, Port: freePorts(t, 1)[0], Secret: "s"}
+	writeState(t, paths, deadPID(t), []config.ProxyEntry{free})
+	// Only the state's free port, so nothing real on 5432 is touched.
+	configPath = filepath.Join(t.TempDir(), "missing.yaml")
+
+	if err := runStop(nil, nil); err != nil {
+		t.Fatalf("runStop: %v", err)
+	}
+	if _, err := proxy.ReadState(paths); err == nil {
+		t.Error("stale state file should be removed")
+	}
+}
+
+func TestForcePorts(t *testing.T) {
+	paths := setupStop(t, true, false)
+
+	// Without state, the config's TCP ports.
+	ports, err := forcePorts(paths)
+	if err != nil {
+		t.Fatalf("forcePorts: %v", err)
+	}
+	if !reflect.DeepEqual(ports, []int{5432}) {
+		t.Errorf("ports = %v, want [5432]", ports)
+	}
+
+	// The state's ports come first, without duplicates.
+	writeState(t, paths, deadPID(t), []config.ProxyEntry{proxyB, proxyA})
+	ports, err = forcePorts(paths)
+	if err != nil {
+		t.Fatalf("forcePorts: %v", err)
+	}
+	if !reflect.DeepEqual(ports, []int{5433, 5432}) {
+		t.Errorf("ports = %v, want [5433 5432]", ports)
+	}
+
+	// A broken config is fine while the state lists the ports.
+	configPath = filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := forcePorts(paths); err != nil {
+		t.Errorf("forcePorts with state and no config: %v", err)
+	}
+	proxy.RemoveStateFiles(paths)
+	if _, err := forcePorts(paths); err == nil {
+		t.Error("expected error with neither state nor config")
+	}
+}
+
 // --- proxiesEqual tests ---
 
 func TestProxiesEqual(t *testing.T) {
@@ -353,6 +598,18 @@ func TestProxiesEqual(t *testing.T) {
 			b:    []config.ProxyEntry{{Instance: "other:us-central1:db", Port: proxyA.Port, Secret: proxyA.Secret}},
 			want: false,
 		},
+		{
+			name: "tags changed",
+			a:    []config.ProxyEntry{{Instance: proxyA.Instance, Port: proxyA.Port, Secret: proxyA.Secret, Tags: map[string]string{"team": "a"}}},
+			b:    []config.ProxyEntry{{Instance: proxyA.Instance, Port: proxyA.Port, Secret: proxyA.Secret, Tags: map[string]string{"team": "b"}}},
+			want: false,
+		},
+		{
+			name: "same tags",
+			a:    []config.ProxyEntry{{Instance: proxyA.Instance, Port: proxyA.Port, Secret: proxyA.Secret, Tags: map[string]string{"team": "a", "tier": "prod"}}},
+			b:    []config.ProxyEntry{{Instance: proxyA.Instance, Port: proxyA.Port, Secret: proxyA.Secret, Tags: map[string]string{"tier": "prod", "team": "a"}}},
+			want: true,
+		},
 		{
 			name: "empty vs non-empty",
 			a:    []config.ProxyEntry{},
@@ -376,3 +633,599 @@ func TestProxiesEqual(t *testing.T) {
 		})
 	}
 }
+
+// --- dialOptions tests ---
+
+// optionName returns the name of the function behind a dial option. Options
+// are opaque closures, but their names include the constructor they came from
+// (e.g. "cloudsqlconn.WithPSC.func1"), even when inlined.
+func optionName(opt cloudsqlconn.DialOption) string {
+	return runtime.FuncForPC(reflect.ValueOf(opt).Pointer()).Name()
+}
+
+func TestDialOptions_IPType(t *testing.T) {
+	tests := []struct {
+		ipType string
+		want   string
+	}{
+		{ipType: "", want: "WithPublicIP"},
+		{ipType: config.IPTypePublic, want: "WithPublicIP"},
+		{ipType: config.IPTypePrivate, want: "WithPrivateIP"},
+		{ipType: config.IPTypePSC, want: "WithPSC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ipType, func(t *testing.T) {
+			p := proxyA
+			p.IPType = tt.ipType
+			opts := dialOptions(p)
+			if len(opts) != 1 {
+				t.Fatalf("expected 1 dial option, got %d", len(opts))
+			}
+			if name := optionName(opts[0]); !strings.Contains(name, tt.want) {
+				t.Errorf("ip_type %q: got option %s, want %s", tt.ipType, name, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialOptions_IAMAuth(t *testing.T) {
+	p := proxyA
+	p.Auth = config.AuthIAM
+	opts := dialOptions(p)
+	if len(opts) != 2 {
+		t.Fatalf("expected 2 dial options, got %d", len(opts))
+	}
+	if name := optionName(opts[1]); !strings.Contains(name, "WithDialIAMAuthN") {
+		t.Errorf("got option %s, want WithDialIAMAuthN", name)
+	}
+
+	if opts := dialOptions(proxyA); len(opts) != 1 {
+		t.Errorf("password auth should only set the IP type, got %d options", len(opts))
+	}
+}
+
+// --- dry-run tests ---
+
+// dryRunPlan runs checkDaemon against the state in paths and returns the plan
+// printed for next.
+func dryRunPlan(t *testing.T, paths proxy.Paths, next []config.ProxyEntry) string {
+	t.Helper()
+	action, pid := checkDaemon(paths, next)
+	var running []config.ProxyEntry
+	if action == daemonRestart {
+		state, err := proxy.ReadState(paths)
+		if err != nil {
+			t.Fatalf("reading state: %v", err)
+		}
+		running = state.Proxies
+	}
+	var out bytes.Buffer
+	printStartPlan(&out, action, pid, running, next)
+	return out.String()
+}
+
+func TestStartPlan_Start(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+
+	got := dryRunPlan(t, paths, []config.ProxyEntry{proxyA, proxyB})
+	want := "Would start the daemon with 2 proxies:\n" +
+		"  + db-a on port 5432\n" +
+		"  + db-b on port 5433\n"
+	if got != want {
+		t.Errorf("unexpected plan:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStartPlan_Keep(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{proxyA, proxyB})
+
+	got := dryRunPlan(t, paths, []config.ProxyEntry{proxyB, proxyA})
+	want := fmt.Sprintf("Daemon already running (pid %d) with this config; nothing to do.\n", os.Getpid())
+	if got != want {
+		t.Errorf("unexpected plan %q, want %q", got, want)
+	}
+}
+
+func TestStartPlan_Restart(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{proxyA, proxyB})
+
+	movedB := proxyB
+	movedB.Port = 6543
+	got := dryRunPlan(t, paths, []config.ProxyEntry{proxyA, movedB, proxyC})
+	want := fmt.Sprintf("Would restart the daemon (pid %d) because the config changed:\n", os.Getpid()) +
+		"  + db-c on port 5434\n" +
+		"  ~ db-b on port 6543\n"
+	if got != want {
+		t.Errorf("unexpected plan:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = dryRunPlan(t, paths, []config.ProxyEntry{proxyB})
+	want = fmt.Sprintf("Would restart the daemon (pid %d) because the config changed:\n", os.Getpid()) +
+		"  - db-a on port 5432\n"
+	if got != want {
+		t.Errorf("unexpected plan:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStartPlan_RestartWithoutState(t *testing.T) {
+	var out bytes.Buffer
+	printStartPlan(&out, daemonRestart, 42, nil, []config.ProxyEntry{proxyA})
+	if !strings.Contains(out.String(), "all 1 proxies would be restarted") {
+		t.Errorf("unexpected plan %q", out.String())
+	}
+}
+
+func TestRunStartDryRun_LeavesDaemonAlone(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	cfgFile := filepath.Join(dir, "config.yaml")
+	os.WriteFile(cfgFile, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "secret-a"
+  - instance: "proj:us-central1:db-c"
+    port: 5434
+    secret: "secret-c"
+`), 0644)
+	paths := proxy.NewPaths(proxy.StateDir())
+	writeState(t, paths, os.Getpid(), []config.ProxyEntry{proxyA, proxyB})
+
+	oldPath, oldEnv, oldPID, oldFinder := configPath, envName, pidFile, preflight.DefaultCredentialFinder
+	defer func() {
+		configPath, envName, pidFile, preflight.DefaultCredentialFinder = oldPath, oldEnv, oldPID, oldFinder
+	}()
+	configPath, envName, pidFile = cfgFile, "", ""
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	preflight.DefaultCredentialFinder = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return &google.Credentials{}, nil
+	}
+
+	var out bytes.Buffer
+	if err := runStartDryRun(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "  + db-c on port 5434\n  - db-b on port 5433\n") {
+		t.Errorf("unexpected plan:\n%s", out.String())
+	}
+	if _, err := os.Stat(paths.PIDFile); err != nil {
+		t.Errorf("expected the PID file to be left in place: %v", err)
+	}
+}
+
+func TestPrepareStart_SkipAuthCheck(t *testing.T) {
+	writeProxiesConfig(t, proxyA)
+	oldFinder, oldSkip := preflight.DefaultCredentialFinder, skipAuthCheck
+	t.Cleanup(func() { preflight.DefaultCredentialFinder, skipAuthCheck = oldFinder, oldSkip })
+	var lookups int
+	preflight.DefaultCredentialFinder = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		lookups++
+		return nil, errors.New("no credentials")
+	}
+
+	skipAuthCheck = false
+	if _, err := prepareStart(context.Background()); err == nil || !strings.Contains(err.Error(), "No Google Cloud credentials") {
+		t.Errorf("expected the ADC check to fail, got %v", err)
+	}
+
+	lookups = 0
+	skipAuthCheck = true
+	if _, err := prepareStart(context.Background()); err != nil {
+		t.Errorf("expected --skip-auth-check to start without credentials, got %v", err)
+	}
+	if lookups != 0 {
+		t.Errorf("expected no credential lookups with --skip-auth-check, got %d", lookups)
+	}
+}
+
+// --- probeProxies tests ---
+
+func TestProbeProxies(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	up := config.ProxyEntry{Instance: "proj:us-central1:up", Port: ln.Addr().(*net.TCPAddr).Port, Secret: "s"}
+
+	// Grab a free port, then release it so nothing is listening there.
+	tmp, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	down := config.ProxyEntry{Instance: "proj:us-central1:down", Port: tmp.Addr().(*net.TCPAddr).Port, Secret: "s"}
+	tmp.Close()
+
+	var out bytes.Buffer
+	failed := probeProxies(&out, &out, []config.ProxyEntry{up, down}, 200*time.Millisecond)
+	if failed != 1 {
+		t.Errorf("expected 1 failed proxy, got %d", failed)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("up:      started on port %d", up.Port)) {
+		t.Errorf("expected started line for up, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("down:    failed to start on port %d", down.Port)) {
+		t.Errorf("expected failure line for down, got:\n%s", out.String())
+	}
+}
+
+func TestProbeProxies_WaitsForSlowListener(t *testing.T) {
+	// Reserve a port, then bind it again only after a delay, like a daemon
+	// that takes a while to start its listeners.
+	tmp, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := tmp.Addr().String()
+	slow := config.ProxyEntry{Instance: "proj:us-central1:slow", Port: tmp.Addr().(*net.TCPAddr).Port, Secret: "s"}
+	tmp.Close()
+
+	bound := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("listen: %v", err)
+		}
+		bound <- ln
+	}()
+	defer func() {
+		if ln := <-bound; ln != nil {
+			ln.Close()
+		}
+	}()
+
+	var out bytes.Buffer
+	if failed := probeProxies(&out, &out, []config.ProxyEntry{slow}, 5*time.Second); failed != 0 {
+		t.Errorf("expected the slow proxy to come up, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "slow:    started on port") {
+		t.Errorf("expected started line, got:\n%s", out.String())
+	}
+}
+
+// --- runDaemonAttached tests ---
+
+func TestRunDaemonAttached_RefusesWhenDaemonRunning(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	cfgFile := filepath.Join(dir, "config.yaml")
+	os.WriteFile(cfgFile, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "pw"
+`), 0644)
+	pid := filepath.Join(dir, "daemon.pid")
+	os.WriteFile(pid, []byte(strconv.Itoa(os.Getpid())), 0644)
+
+	oldPath, oldEnv, oldPID, oldFinder := configPath, envName, pidFile, preflight.DefaultCredentialFinder
+	defer func() {
+		configPath, envName, pidFile, preflight.DefaultCredentialFinder = oldPath, oldEnv, oldPID, oldFinder
+	}()
+	configPath, envName, pidFile = cfgFile, "", pid
+	preflight.DefaultCredentialFinder = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return &google.Credentials{}, nil
+	}
+
+	err := runDaemonAttached()
+	if err == nil {
+		t.Fatal("expected error when a daemon is already running")
+	}
+	if !strings.Contains(err.Error(), "still running") {
+		t.Errorf("expected error to say the daemon is running, got: %v", err)
+	}
+}
+
+// --- startHealthServer tests ---
+
+func TestStartHealthServer(t *testing.T) {
+	ports := freePorts(t, 2)
+	p := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+
+	set := proxy.NewManager(context.Background(), failDialer{}, newListener)
+	ready := false
+	srv := startHealthServer(ports[1], set.Listeners, func() bool { return ready })
+	if srv == nil {
+		t.Fatal("expected health server to start")
+	}
+	defer shutdownServers(srv)
+	url := fmt.Sprintf("http://localhost:%d", ports[1])
+
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before listeners start: got %d, want 503", got)
+	}
+	if err := set.Start([]config.ProxyEntry{p}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+	ready = true
+
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz after listeners start: got %d, want 200", got)
+	}
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz: got %d, want 200", got)
+	}
+
+	set.Listener(p).Close()
+	if got := status("/healthz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/healthz after listener failed: got %d, want 503", got)
+	}
+}
+
+// --- --quiet tests ---
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		done <- buf.String()
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestRunStartForeground_Quiet(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	cfgFile := filepath.Join(dir, "config.yaml")
+	os.WriteFile(cfgFile, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "secret-a"
+`), 0644)
+	writeState(t, proxy.NewPaths(proxy.StateDir()), os.Getpid(), []config.ProxyEntry{proxyA})
+
+	oldPath, oldEnv, oldPID, oldQuiet, oldFinder := configPath, envName, pidFile, quiet, preflight.DefaultCredentialFinder
+	defer func() {
+		configPath, envName, pidFile, quiet, preflight.DefaultCredentialFinder = oldPath, oldEnv, oldPID, oldQuiet, oldFinder
+	}()
+	configPath, envName, pidFile = cfgFile, "", ""
+	preflight.DefaultCredentialFinder = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return &google.Credentials{}, nil
+	}
+
+	quiet = false
+	out := captureStdout(t, func() {
+		if err := runStartForeground(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Daemon already running") {
+		t.Errorf("expected a message without --quiet, got %q", out)
+	}
+
+	quiet = true
+	out = captureStdout(t, func() {
+		if err := runStartForeground(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	if out != "" {
+		t.Errorf("expected no output with --quiet, got %q", out)
+	}
+}
+
+func TestProbeProxies_FailuresToErrOut(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	up := config.ProxyEntry{Instance: "proj:us-central1:up", Port: ln.Addr().(*net.TCPAddr).Port, Secret: "s"}
+	down := config.ProxyEntry{Instance: "proj:us-central1:down", Port: freePorts(t, 1)[0], Secret: "s"}
+
+	var out, errOut bytes.Buffer
+	if failed := probeProxies(&out, &errOut, []config.ProxyEntry{up, down}, 100*time.Millisecond); failed != 1 {
+		t.Errorf("expected 1 failed proxy, got %d", failed)
+	}
+	if !strings.Contains(out.String(), "up:") || strings.Contains(out.String(), "down:") {
+		t.Errorf("expected only the started proxy on out, got %q", out.String())
+	}
+	if !strings.Contains(errOut.String(), "down:    failed to start") {
+		t.Errorf("expected the failed proxy on errOut, got %q", errOut.String())
+	}
+}
+
+func TestStartFailure_ReportsDaemonError(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+
+	err := startFailure(paths, 1, 2)
+	if err == nil || strings.Contains(err.Error(), "daemon exited") {
+		t.Errorf("expected a plain failure with no recorded error, got %v", err)
+	}
+
+	if err := proxy.WriteLastError(paths, errors.New("creating Cloud SQL dialer: no credentials")); err != nil {
+		t.Fatalf("WriteLastError: %v", err)
+	}
+	err = startFailure(paths, 2, 2)
+	if err == nil || !strings.Contains(err.Error(), "daemon exited: creating Cloud SQL dialer: no credentials") {
+		t.Errorf("expected the daemon's error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), paths.LogFile) {
+		t.Errorf("expected the log file to be named, got %v", err)
+	}
+}
+
+func TestLaunchDaemon_ReportsCrash(t *testing.T) {
+	// The "daemon" logs a panic and exits at once.
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "daemon")
+	script := "#!/bin/sh\necho 'panic: runtime error: invalid memory address'\necho 'goroutine 1 [running]:'\nexit 2\n"
+	if err := os.WriteFile(exe, []byte(script), 0755); err != nil {
+		t.Fatalf("writing daemon script: %v", err)
+	}
+	oldExe, oldWait := daemonExecutable, startWait
+	t.Cleanup(func() { daemonExecutable, startWait = oldExe, oldWait })
+	daemonExecutable = func() (string, error) { return exe, nil }
+	startWait = 200 * time.Millisecond
+
+	paths := proxy.NewPaths(filepath.Join(dir, "state"))
+	if err := proxy.EnsureStateDir(paths.Dir); err != nil {
+		t.Fatalf("EnsureStateDir: %v", err)
+	}
+	// Output from an earlier daemon isn't this one's reason.
+	os.WriteFile(paths.LogFile, []byte("level=INFO msg=\"daemon stopped\"\n"), 0644)
+
+	cfg := &config.Config{Proxies: []config.ProxyEntry{{Instance: proxyA.Instance, Port: freePorts(t, 1)[0], Secret: "s"}}}
+	var err error
+	captureStdout(t, func() { err = launchDaemon(cfg, paths) })
+	if err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expected a daemon exit error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "panic: runtime error: invalid memory address") {
+		t.Errorf("expected the daemon's logged panic, got %v", err)
+	}
+	if strings.Contains(err.Error(), "daemon stopped") {
+		t.Errorf("expected only this daemon's output, got %v", err)
+	}
+}
+
+func TestDaemonExited(t *testing.T) {
+	paths := proxy.NewPaths(t.TempDir())
+	d := spawnedDaemon{pid: 42}
+
+	err := daemonExited(paths, d)
+	if err == nil || !strings.Contains(err.Error(), "without logging a reason") {
+		t.Errorf("expected an exit with no reason, got %v", err)
+	}
+
+	if err := proxy.WriteLastError(paths, errors.New("creating Cloud SQL dialer: no credentials")); err != nil {
+		t.Fatalf("WriteLastError: %v", err)
+	}
+	err = daemonExited(paths, d)
+	if err == nil || !strings.Contains(err.Error(), "exited: creating Cloud SQL dialer: no credentials") {
+		t.Errorf("expected the daemon's recorded error, got %v", err)
+	}
+}
+
+func TestLoadConfig_PortOffset(t *testing.T) {
+	writeProxiesConfig(t, proxyA, proxyB)
+	oldOffset := portOffset
+	defer func() { portOffset = oldOffset }()
+
+	portOffset = 10
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if a, b := cfg.Proxies[0].Port, cfg.Proxies[1].Port; a != proxyA.Port+10 || b != proxyB.Port+10 {
+		t.Errorf("expected ports shifted by 10, got %d and %d", a, b)
+	}
+
+	portOffset = 70000
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "port offset 70000") {
+		t.Errorf("expected an out-of-range error, got %v", err)
+	}
+}
+
+func TestRunningPortOffset(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	paths := daemonPaths()
+	if got := runningPortOffset(); got != 0 {
+		t.Errorf("expected 0 with no daemon, got %d", got)
+	}
+	if err := proxy.WriteState(paths, &proxy.DaemonState{PID: os.Getpid(), PortOffset: 100}); err != nil {
+		t.Fatalf("WriteState: %v", err)
+	}
+	if got := runningPortOffset(); got != 100 {
+		t.Errorf("expected the daemon's offset 100, got %d", got)
+	}
+}
+
+func TestVerifyStart_NoVerifySkipsProbe(t *testing.T) {
+	old := noVerify
+	defer func() { noVerify = old }()
+	noVerify = true
+
+	// Nothing listens on the port, so a probe would fail.
+	down := config.ProxyEntry{Instance: "proj:us-central1:down", Port: freePorts(t, 1)[0], Secret: "s"}
+	var out, errOut bytes.Buffer
+	start := time.Now()
+	if failed := verifyStart(&out, &errOut, []config.ProxyEntry{down}, 4242); failed != 0 {
+		t.Errorf("expected no failures without verification, got %d", failed)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, expected the probe to be skipped", elapsed)
+	}
+	if out.String() != "Daemon started (pid 4242).\n" || errOut.Len() != 0 {
+		t.Errorf("unexpected output %q, errors %q", out.String(), errOut.String())
+	}
+}
+
+func TestProbeProxies_SocketFileExists(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, "up.sock"))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	up := config.ProxyEntry{Instance: "proj:us-central1:up", Socket: ln.Addr().String(), Secret: "s"}
+	down := config.ProxyEntry{Instance: "proj:us-central1:down", Socket: filepath.Join(dir, "down.sock"), Secret: "s"}
+
+	var out bytes.Buffer
+	if failed := probeProxies(&out, &out, []config.ProxyEntry{up, down}, 200*time.Millisecond); failed != 1 {
+		t.Errorf("expected 1 failed proxy, got %d:\n%s", failed, out.String())
+	}
+	if !strings.Contains(out.String(), "up:      started on socket") || !strings.Contains(out.String(), "down:    failed to start on socket") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	// Only the file was checked; the probe never connected.
+	ln.(*net.UnixListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+		t.Error("expected the probe not to connect to the socket")
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	ctl := runTestDaemon(t, []config.ProxyEntry{a, b})
+
+	var buf bytes.Buffer
+	oldDefault := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(oldDefault) })
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	// Dumps only read counters, so repeated ones must each log in full.
+	for range 2 {
+		dumpState(ctl.set, time.Now().Add(-time.Minute))
+	}
+	out := buf.String()
+	if n := strings.Count(out, `msg="daemon state"`); n != 2 {
+		t.Errorf("expected 2 daemon state entries, got %d:\n%s", n, out)
+	}
+	for _, want := range []string{"uptime=1m0s", "goroutines=", "listeners=2",
+		"instance=" + a.Instance, "instance=" + b.Instance, "active_conns=0", "sent=0", "received=0"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the dump, got:\n%s", want, out)
+		}
+	}
+}
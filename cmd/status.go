@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var statusInstance string
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show daemon uptime and per-proxy port health",
+	RunE:  runStatus,
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusInstance, "instance", "", "only show the proxy for this instance")
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	state, err := readDaemonState(daemonPaths())
+	if err != nil || !proxy.IsRunning(state.PID) {
+		fmt.Fprintln(infoOut(), "No daemon is running.")
+		return nil
+	}
+
+	// Show the ports the daemon picked rather than 0.
+	state.Proxies = state.BoundProxies()
+	if statusInstance != "" {
+		p, err := findRunningProxy(state, statusInstance)
+		if err != nil {
+			return err
+		}
+		writeInstanceStatus(os.Stdout, p, probePort(p), state.Stats[p.Instance])
+		return nil
+	}
+
+	if w := staleConfigWarning(state); w != "" {
+		fmt.Fprintln(os.Stderr, w)
+	}
+	health := make(map[string]bool, len(state.Proxies))
+	for _, p := range state.Proxies {
+		health[p.Instance] = probePort(p)
+	}
+	writeStatus(os.Stdout, state, time.Now(), health, !quiet)
+	return nil
+}
+
+// probePort reports whether each of the proxy's local ports, or its socket,
+// accepts connections.
+func probePort(p config.ProxyEntry) bool {
+	for _, e := range config.ExpandPorts([]config.ProxyEntry{p}) {
+		conn, err := net.DialTimeout(e.Network(), e.DialAddr(), time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+func healthString(ok bool) string {
+	if ok {
+		return "listening"
+	}
+	return "unreachable"
+}
+
+// activeString formats a proxy's open connection count, with its limit if it
+// has one.
+func activeString(p config.ProxyEntry, active int) string {
+	if p.MaxConnections > 0 {
+		return fmt.Sprintf("%d/%d", active, p.MaxConnections)
+	}
+	return strconv.Itoa(active)
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// writeStatus prints the daemon's summary and a row per proxy. Without
+// headers, only the rows are printed.
+func writeStatus(out io.Writer, state *proxy.DaemonState, now time.Time, health map[string]bool, headers bool) {
+	w := tabwriter.NewWriter(out, 0, 4, 3, ' ', 0)
+	if headers {
+		fmt.Fprintf(out, "Daemon:  running (pid %d)\n", state.PID)
+		fmt.Fprintf(out, "Started: %s\n", state.StartedAt.UTC().Format("2006-01-02 15:04:05 UTC"))
+		fmt.Fprintf(out, "Uptime:  %s\n\n", now.Sub(state.StartedAt).Round(time.Second))
+		fmt.Fprintln(w, "INSTANCE\tPORT\tHEALTH\tACTIVE\tSENT\tRECEIVED")
+	}
+	for _, p := range state.Proxies {
+		s := state.Stats[p.Instance]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Instance, portOrSocket(p), healthString(health[p.Instance]),
+			activeString(p, s.ActiveConns), formatBytes(s.BytesSent), formatBytes(s.BytesReceived))
+	}
+	w.Flush()
+}
+
+// findRunningProxy returns the proxy for instance from the daemon's running
+// set, erroring with the valid instances if it isn't there.
+func findRunningProxy(state *proxy.DaemonState, instance string) (config.ProxyEntry, error) {
+	names := make([]string, 0, len(state.Proxies))
+	for _, p := range state.Proxies {
+		if p.Instance == instance {
+			return p, nil
+		}
+		names = append(names, p.Instance)
+	}
+	return config.ProxyEntry{}, fmt.Errorf("instance %q is not running (running instances: %s)", instance, strings.Join(names, ", "))
+}
+
+// writeInstanceStatus prints one proxy's address, health, traffic, and the
+// last time its instance couldn't be dialed.
+func writeInstanceStatus(out io.Writer, p config.ProxyEntry, healthy bool, stats proxy.ProxyStats) {
+	w := tabwriter.NewWriter(out, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "Instance:\t%s\n", p.Instance)
+	fmt.Fprintf(w, "Address:\t%s\n", p.Addr())
+	fmt.Fprintf(w, "Health:\t%s\n", healthString(healthy))
+	fmt.Fprintf(w, "Active:\t%s connections\n", activeString(p, stats.ActiveConns))
+	fmt.Fprintf(w, "Sent:\t%s\n", formatBytes(stats.BytesSent))
+	fmt.Fprintf(w, "Received:\t%s\n", formatBytes(stats.BytesReceived))
+	if e := stats.LastDialError; e != nil {
+		fmt.Fprintf(w, "Last error:\t%s (%s)\n", e.Err, e.At.UTC().Format("2006-01-02 15:04:05 UTC"))
+	} else {
+		fmt.Fprintf(w, "Last error:\tnone\n")
+	}
+	w.Flush()
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/proxy"
+)
+
+func TestWriteStatus(t *testing.T) {
+	started := time.Date(2026, 2, 25, 10, 0, 0, 0, time.UTC)
+	state := &proxy.DaemonState{
+		PID:       4242,
+		StartedAt: started,
+		Proxies:   []config.ProxyEntry{proxyA, proxyB},
+
+		Stats: map[string]proxy.ProxyStats{
+			proxyA.Instance: {ActiveConns: 7, BytesSent: 2048, BytesReceived: 3 << 20},
+		},
+	}
+	health := map[string]bool{proxyA.Instance: true, proxyB.Instance: false}
+
+	var buf bytes.Buffer
+	writeStatus(&buf, state, started.Add(90*time.Minute), health, true)
+	out := buf.String()
+
+	for _, want := range []string{
+		"running (pid 4242)",
+		"2026-02-25 10:00:00 UTC",
+		"Uptime:  1h30m0s",
+		"INSTANCE",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	last := lines[len(lines)-2:]
+	if !strings.Contains(last[0], proxyA.Instance) || !strings.Contains(last[0], "listening") || !strings.HasSuffix(strings.Join(strings.Fields(last[0]), " "), "7 2.0 KiB 3.0 MiB") {
+		t.Errorf("unexpected line for proxyA: %q", last[0])
+	}
+	if !strings.Contains(last[1], proxyB.Instance) || !strings.Contains(last[1], "unreachable") || !strings.HasSuffix(strings.Join(strings.Fields(last[1]), " "), "0 0 B 0 B") {
+		t.Errorf("unexpected line for proxyB: %q", last[1])
+	}
+}
+
+func TestFindRunningProxy(t *testing.T) {
+	state := &proxy.DaemonState{Proxies: []config.ProxyEntry{proxyA, proxyB}}
+
+	p, err := findRunningProxy(state, proxyB.Instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Port != proxyB.Port {
+		t.Errorf("expected port %d, got %d", proxyB.Port, p.Port)
+	}
+
+	_, err = findRunningProxy(state, proxyC.Instance)
+	if err == nil {
+		t.Fatal("expected error for instance not in running set")
+	}
+	if !strings.Contains(err.Error(), proxyA.Instance) || !strings.Contains(err.Error(), proxyB.Instance) {
+		t.Errorf("expected error to list running instances, got: %v", err)
+	}
+}
+
+func TestWriteInstanceStatus(t *testing.T) {
+	var buf bytes.Buffer
+	writeInstanceStatus(&buf, proxyA, true, proxy.ProxyStats{ActiveConns: 3, BytesSent: 100, BytesReceived: 1536})
+	out := buf.String()
+	for _, want := range []string{proxyA.Instance, "localhost:5432", "listening", "3 connections", "100 B", "1.5 KiB", "Last error: none"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	failedAt := time.Date(2026, 2, 25, 10, 0, 0, 0, time.UTC)
+	writeInstanceStatus(&buf, proxyA, false, proxy.ProxyStats{LastDialError: &proxy.DialError{Err: "connection refused", At: failedAt}})
+	if want := "Last error: connection refused (2026-02-25 10:00:00 UTC)"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected output to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestActiveString(t *testing.T) {
+	if got := activeString(proxyA, 3); got != "3" {
+		t.Errorf("expected %q, got %q", "3", got)
+	}
+	limited := proxyA
+	limited.MaxConnections = 10
+	if got := activeString(limited, 3); got != "3/10" {
+		t.Errorf("expected %q, got %q", "3/10", got)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestWriteStatus_NoHeaders(t *testing.T) {
+	state := &proxy.DaemonState{PID: 4242, StartedAt: time.Now(), Proxies: []config.ProxyEntry{proxyA, proxyB}}
+
+	var buf bytes.Buffer
+	writeStatus(&buf, state, time.Now(), nil, false)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], proxyA.Instance) || !strings.HasPrefix(lines[1], proxyB.Instance) {
+		t.Errorf("expected only the proxy rows, got:\n%s", buf.String())
+	}
+}
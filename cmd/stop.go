@@ -6,69 +6,211 @@ import (
 	"syscall"
 	"time"
 
+	"cloud-sql-proxy-runner/internal/config"
 	"cloud-sql-proxy-runner/internal/proxy"
 
 	"github.com/spf13/cobra"
 )
 
+// stopGracePeriod is how long stop waits for the daemon to exit after
+// SIGTERM, on top of its connection draining time, before killing it.
+const stopGracePeriod = 5 * time.Second
+
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop the proxy daemon",
-	RunE:  runStop,
+	Long: `Stop the proxy daemon.
+
+--force also kills whatever is listening on the configured ports, to clear
+out a daemon whose PID file was lost. It kills any process on those ports,
+not just this tool's daemon, so check with status first.`,
+	RunE: runStop,
 }
 
+var (
+	stopForce   bool
+	stopPurge   bool
+	stopTimeout time.Duration
+)
+
 func init() {
+	stopCmd.Flags().BoolVar(&stopForce, "force", false, "also kill any process listening on a configured port (best effort)")
+	stopCmd.Flags().BoolVar(&stopPurge, "purge", false, "also remove the daemon and access logs")
+	stopCmd.Flags().DurationVar(&stopTimeout, "timeout", stopGracePeriod, "how long to wait for the daemon to exit before killing it, or 0 to kill it at once; when unset, the daemon's shutdown_timeout is added")
 	rootCmd.AddCommand(stopCmd)
 }
 
 func runStop(cmd *cobra.Command, args []string) error {
-	stateDir := proxy.StateDir()
+	if stopTimeout < 0 {
+		return fmt.Errorf("invalid --timeout %s: must not be negative", stopTimeout)
+	}
+	paths := daemonPaths()
 
-	pid, err := proxy.ReadPID(stateDir)
+	// Gather the ports before stopping removes the state file.
+	var ports []int
+	if stopForce {
+		var err error
+		if ports, err = forcePorts(paths); err != nil {
+			return err
+		}
+	}
+
+	pid, err := proxy.ReadPID(paths)
 	if err != nil || !proxy.IsRunning(pid) {
 		// Clean up stale files if any
 		if err == nil {
-			proxy.RemoveStateFiles(stateDir)
+			proxy.RemoveStateFiles(paths)
+		}
+		fmt.Fprintln(infoOut(), "No daemon is running.")
+	} else {
+		stop := stopDaemon
+		if cmd.Flags().Changed("timeout") {
+			if stopTimeout == 0 {
+				fmt.Fprintln(os.Stderr, "Warning: --timeout 0 kills the daemon without letting it close its connections.")
+			}
+			stop = func(pid int, paths proxy.Paths) error {
+				return stopDaemonWithin(pid, paths, stopTimeout)
+			}
+		}
+		if err := stop(pid, paths); err != nil {
+			return err
 		}
-		fmt.Println("No daemon is running.")
-		return nil
+		fmt.Fprintln(infoOut(), "Daemon stopped.")
 	}
 
-	if err := stopDaemon(pid, stateDir); err != nil {
-		return err
+	if stopForce {
+		killPortOwners(ports)
+	}
+	if stopPurge {
+		os.Remove(paths.LogFile)
+		os.Remove(paths.AccessLog)
+		fmt.Fprintln(infoOut(), "Logs removed.")
 	}
-	fmt.Println("Daemon stopped.")
 	return nil
 }
 
-// stopDaemon sends SIGTERM to the given pid, waits up to 5s, then SIGKILL if needed.
-// It cleans up state files in all cases.
-func stopDaemon(pid int, stateDir string) error {
+// forcePorts returns the TCP ports stop --force clears: those in the daemon's
+// state file, including the ones it picked, if any, and those in the config.
+func forcePorts(paths proxy.Paths) ([]int, error) {
+	var proxies []config.ProxyEntry
+	if state, err := proxy.ReadState(paths); err == nil {
+		proxies = state.BoundProxies()
+	}
+	cfg, err := loadConfig()
+	if err != nil && proxies == nil {
+		return nil, err
+	}
+	if err == nil {
+		proxies = append(proxies, cfg.Proxies...)
+	}
+
+	seen := make(map[int]bool)
+	var ports []int
+	for _, p := range proxies {
+		if p.AutoPort() {
+			continue
+		}
+		for _, port := range p.Ports() {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// killPortOwners kills every process, other than this one, listening on one
+// of ports. Failures are reported and skipped.
+func killPortOwners(ports []int) {
+	for _, port := range ports {
+		pids, err := proxy.PortOwners(port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: finding the owner of port %d: %v\n", port, err)
+			continue
+		}
+		for _, pid := range pids {
+			if pid == os.Getpid() {
+				continue
+			}
+			proc, err := os.FindProcess(pid)
+			if err == nil {
+				err = proc.Kill()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: killing pid %d on port %d: %v\n", pid, port, err)
+				continue
+			}
+			fmt.Fprintf(infoOut(), "Killed pid %d listening on port %d.\n", pid, port)
+		}
+	}
+}
+
+// stopDaemon stops the daemon with the given pid, waiting 5s plus the time
+// the daemon spends draining connections before killing it.
+func stopDaemon(pid int, paths proxy.Paths) error {
+	grace := stopGracePeriod
+	if state, err := proxy.ReadState(paths); err == nil {
+		grace += state.ShutdownTimeout
+	}
+	return stopDaemonWithin(pid, paths, grace)
+}
+
+// stopDaemonWithin sends SIGTERM to the given pid, waits up to grace for it
+// to exit, then SIGKILL if needed. A zero grace skips SIGTERM and kills it at
+// once. The state files are removed once the daemon is gone, and left alone
+// if it somehow survives, so that it can still be found and stopped.
+func stopDaemonWithin(pid int, paths proxy.Paths, grace time.Duration) error {
+	if !terminate(pid, grace) {
+		return fmt.Errorf("daemon (pid %d) is still running after being killed", pid)
+	}
+	proxy.RemoveStateFiles(paths)
+	return nil
+}
+
+// signalProcess sends terminate its SIGTERM. Tests replace it.
+var signalProcess = proxy.SignalProcess
+
+// killWait is how long terminate waits for a killed process to disappear.
+const killWait = time.Second
+
+// terminate sends SIGTERM to the given pid, waits up to grace for it to
+// exit, then SIGKILL if needed, and reports whether the process is gone. A
+// zero grace skips SIGTERM. If SIGTERM can't be sent, as on Windows when the
+// daemon isn't listening for it, the process is killed without waiting.
+func terminate(pid int, grace time.Duration) bool {
 	proc, err := os.FindProcess(pid)
 	if err != nil {
-		proxy.RemoveStateFiles(stateDir)
-		return nil
+		return !proxy.IsRunning(pid)
 	}
 
 	// Send SIGTERM
-	if err := proc.Signal(syscall.SIGTERM); err != nil {
-		proxy.RemoveStateFiles(stateDir)
-		return nil
+	if grace > 0 {
+		if err := signalProcess(pid, syscall.SIGTERM); err != nil {
+			grace = 0
+		}
 	}
 
-	// Wait up to 5 seconds for exit
-	deadline := time.Now().Add(5 * time.Second)
+	// Wait for exit
+	deadline := time.Now().Add(grace)
 	for time.Now().Before(deadline) {
 		if !proxy.IsRunning(pid) {
-			proxy.RemoveStateFiles(stateDir)
-			return nil
+			return true
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
+	if !proxy.IsRunning(pid) {
+		return true
+	}
 
-	// Force kill
-	proc.Signal(syscall.SIGKILL)
-	time.Sleep(100 * time.Millisecond)
-	proxy.RemoveStateFiles(stateDir)
-	return nil
+	// Force kill (SIGKILL, or TerminateProcess on Windows)
+	proc.Kill()
+	deadline = time.Now().Add(killWait)
+	for proxy.IsRunning(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
 }
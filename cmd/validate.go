@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud-sql-proxy-runner/internal/config"
+	"cloud-sql-proxy-runner/internal/preflight"
+	"cloud-sql-proxy-runner/internal/secrets"
+
+	"github.com/spf13/cobra"
+)
+
+var validateSecrets bool
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config without starting anything",
+	Long:  "Parse the config and run the schema and uniqueness checks, and warn about ports the OS may hand to outbound connections and about a config file other users can read or write. Does not contact the daemon, Secret Manager, or Google credentials, so it is safe to run in CI. With --secrets, also check that each proxy's secret could be read, without fetching any Secret Manager payloads.",
+	// A failed validation is not a usage error.
+	SilenceUsage: true,
+	RunE:         runValidate,
+}
+
+func init() {
+	validateCmd.Flags().BoolVar(&validateSecrets, "secrets", false, "also check access to each proxy's secret, without fetching Secret Manager payloads")
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "config OK (%d proxies)\n", len(cfg.Proxies))
+	warnings := preflight.EphemeralPortWarnings(cfg.Proxies, preflight.EphemeralPortRange())
+	if configDir == "" && configPath != config.StdinPath {
+		if w := preflight.ConfigPermissionWarning(configPath); w != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(cmd.ErrOrStderr(), "warning: %s\n", w)
+	}
+	if !validateSecrets {
+		return nil
+	}
+
+	// Only secrets in Secret Manager need credentials and a client.
+	ctx := context.Background()
+	var checker secrets.AccessChecker
+	if needsSecretManager(cfg.Proxies) {
+		if err := checkCredentials(ctx, cfg); err != nil {
+			return err
+		}
+		client, err := newSecretManagerClient(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("creating Secret Manager client: %w", err)
+		}
+		defer client.Close()
+		checker = client
+	}
+	return validateSecretAccess(ctx, cmd.OutOrStdout(), cfg.Proxies, checker)
+}
+
+// validateSecretAccess prints whether each password proxy's secret can be
+// accessed, and returns an error if any can't.
+func validateSecretAccess(ctx context.Context, out io.Writer, proxies []config.ProxyEntry, checker secrets.AccessChecker) error {
+	if failed := runChecks(out, secretChecks(ctx, proxies, checker, nil)); failed > 0 {
+		return fmt.Errorf("%d secrets can't be accessed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+func TestRunValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	os.WriteFile(valid, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:db-b"
+    port: 5433
+    secret: "pw"
+`), 0644)
+	invalid := filepath.Join(dir, "invalid.yaml")
+	os.WriteFile(invalid, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 80
+    secret: "pw"
+`), 0644)
+
+	oldPath, oldEnv := configPath, envName
+	defer func() { configPath, envName = oldPath, oldEnv }()
+	envName = ""
+
+	var out bytes.Buffer
+	validateCmd.SetOut(&out)
+	defer validateCmd.SetOut(nil)
+
+	configPath = valid
+	if err := runValidate(validateCmd, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.String(); got != "config OK (2 proxies)\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	configPath = invalid
+	err := runValidate(validateCmd, nil)
+	if err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	if !strings.Contains(err.Error(), "port") {
+		t.Errorf("expected error to mention port, got: %v", err)
+	}
+}
+
+func TestRunValidate_WarnsOnLooseConfigMode(t *testing.T) {
+	writeProxiesConfig(t, proxyA)
+	var out, errOut bytes.Buffer
+	validateCmd.SetOut(&out)
+	validateCmd.SetErr(&errOut)
+	defer validateCmd.SetOut(nil)
+	defer validateCmd.SetErr(nil)
+
+	os.Chmod(configPath, 0600)
+	if err := runValidate(validateCmd, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(errOut.String(), "chmod") {
+		t.Errorf("expected no permission warning for mode 0600, got %q", errOut.String())
+	}
+
+	os.Chmod(configPath, 0644)
+	if err := runValidate(validateCmd, nil); err != nil {
+		t.Fatalf("a loose mode should only warn, got: %v", err)
+	}
+	if !strings.Contains(errOut.String(), "warning: config file "+configPath+" has mode 0644") {
+		t.Errorf("expected a permission warning, got %q", errOut.String())
+	}
+}
+
+func TestValidateSecretAccess(t *testing.T) {
+	t.Setenv("CSPR_TEST_PASSWORD", "pw")
+	env := config.ProxyEntry{Instance: "proj:us-central1:db-env", Port: 5436, Secret: "CSPR_TEST_PASSWORD", SecretSource: config.SecretSourceEnv}
+	checker := &fakeAccessChecker{denied: map[string]bool{"projects/proj/secrets/secret-b": true}}
+
+	var out bytes.Buffer
+	err := validateSecretAccess(context.Background(), &out, []config.ProxyEntry{proxyA, proxyB, env}, checker)
+	if err == nil || !strings.Contains(err.Error(), "1 secrets can't be accessed") {
+		t.Errorf("expected one inaccessible secret, got %v", err)
+	}
+	for _, want := range []string{"PASS  secret secret-a (db-a)", "FAIL  secret secret-b (db-b)", "PASS  secret CSPR_TEST_PASSWORD (db-env)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the output, got:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := validateSecretAccess(context.Background(), &out, []config.ProxyEntry{proxyA}, checker); err != nil {
+		t.Errorf("expected an accessible secret to pass, got %v", err)
+	}
+}
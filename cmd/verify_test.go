@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"cloud-sql-proxy-runner/internal/config"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// fakePostgres serves one Postgres connection on a free port, asking for a
+// cleartext password. If it matches password, it answers a simple query with
+// a single 1; otherwise it rejects the login with an error quoting the
+// password it got, as a careless server might.
+func fakePostgres(t *testing.T, password string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := pgproto3.NewBackend(conn, conn)
+		if _, err := b.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		b.Send(&pgproto3.AuthenticationCleartextPassword{})
+		if err := b.Flush(); err != nil {
+			return
+		}
+		b.SetAuthType(pgproto3.AuthTypeCleartextPassword)
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+		if got := msg.(*pgproto3.PasswordMessage).Password; got != password {
+			b.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password " + got + " is wrong"})
+			b.Flush()
+			return
+		}
+		b.Send(&pgproto3.AuthenticationOk{})
+		b.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+		b.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+		b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		b.Flush()
+		for {
+			msg, err := b.Receive()
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*pgproto3.Query); !ok {
+				return
+			}
+			b.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("?column?"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}})
+			b.Send(&pgproto3.DataRow{Values: [][]byte{[]byte("1")}})
+			b.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			b.Flush()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestVerifyLogin_Postgres(t *testing.T) {
+	p := config.ProxyEntry{Instance: proxyA.Instance, Host: "127.0.0.1", Port: fakePostgres(t, "hunter2"), Engine: config.EnginePostgres, User: "app"}
+
+	var out bytes.Buffer
+	if err := verifyLogin(context.Background(), &out, p, "hunter2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Logged in to "+p.Instance+" as app and ran SELECT 1 in ") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("output shows the password: %q", out.String())
+	}
+}
+
+func TestVerifyLogin_RedactsPassword(t *testing.T) {
+	p := config.ProxyEntry{Instance: proxyA.Instance, Host: "127.0.0.1", Port: fakePostgres(t, "right"), Engine: config.EnginePostgres, User: "app"}
+
+	err := verifyLogin(context.Background(), &bytes.Buffer{}, p, "hunter2")
+	if err == nil {
+		t.Fatal("expected the login to fail")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error shows the password: %v", err)
+	}
+	if !strings.Contains(err.Error(), "[redacted]") {
+		t.Errorf("expected the server's error with the password redacted, got: %v", err)
+	}
+}
+
+func TestVerifyLogin_MySQLRefused(t *testing.T) {
+	port := freePorts(t, 1)[0]
+	p := config.ProxyEntry{Instance: proxyA.Instance, Host: "127.0.0.1", Port: port, Engine: config.EngineMySQL, User: "app"}
+
+	err := verifyLogin(context.Background(), &bytes.Buffer{}, p, "hunter2")
+	if err == nil {
+		t.Fatal("expected an error with nothing listening")
+	}
+	if !strings.Contains(err.Error(), "can't run SELECT 1 on "+p.Instance+" as app") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error shows the password: %v", err)
+	}
+}
+
+func TestVerifyTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	p := config.ProxyEntry{Instance: proxyA.Instance, Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	var out bytes.Buffer
+	if err := verifyTCP(context.Background(), &out, p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Connected to the proxy for "+p.Instance) || !strings.Contains(out.String(), "No engine set") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}
+
+func TestVerifyTCP_Refused(t *testing.T) {
+	p := config.ProxyEntry{Instance: proxyA.Instance, Host: "127.0.0.1", Port: freePorts(t, 1)[0]}
+	if err := verifyTCP(context.Background(), &bytes.Buffer{}, p); err == nil {
+		t.Fatal("expected an error with nothing listening")
+	}
+}
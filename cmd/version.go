@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// buildTimeLayout is how buildTime is set at link time.
+const buildTimeLayout = "20060102150405"
+
+var versionJSON bool
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print build information",
+	Long:  "Print the version, commit, and build time of this binary, along with the Go version and platform it was built for. Use --json for a JSON object with a field for each, for scripts checking which build is deployed.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeVersion(cmd.OutOrStdout(), versionJSON)
+	},
+}
+
+func init() {
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "print build information as JSON")
+	rootCmd.AddCommand(versionCmd)
+}
+
+// buildInfo is version's JSON output.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// currentBuild returns the build information linked into this binary. The
+// build time is RFC 3339 when it parses, and left as set otherwise.
+func currentBuild() buildInfo {
+	built := buildTime
+	if t, err := time.Parse(buildTimeLayout, buildTime); err == nil {
+		built = t.UTC().Format(time.RFC3339)
+	}
+	return buildInfo{
+		Version:   version,
+		Commit:    gitCommit,
+		BuildTime: built,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+}
+
+func writeVersion(out io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(currentBuild())
+	}
+	b := currentBuild()
+	fmt.Fprintf(out, "%s version %s\n", rootCmd.Name(), rootCmd.Version)
+	fmt.Fprintf(out, "%s %s/%s\n", b.GoVersion, b.OS, b.Arch)
+	return nil
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+func TestWriteVersion_JSON(t *testing.T) {
+	oldVersion, oldCommit, oldBuilt := version, gitCommit, buildTime
+	t.Cleanup(func() { version, gitCommit, buildTime = oldVersion, oldCommit, oldBuilt })
+	version, gitCommit, buildTime = "1.2.3", "abc1234", "20261015091203"
+
+	var out bytes.Buffer
+	if err := writeVersion(&out, true); err != nil {
+		t.Fatalf("writeVersion: %v", err)
+	}
+	var got buildInfo
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	want := buildInfo{
+		Version:   "1.2.3",
+		Commit:    "abc1234",
+		BuildTime: "2026-10-15T09:12:03Z",
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCurrentBuild_UnparsedBuildTime(t *testing.T) {
+	old := buildTime
+	t.Cleanup(func() { buildTime = old })
+	buildTime = "unknown"
+
+	if got := currentBuild().BuildTime; got != "unknown" {
+		t.Errorf("BuildTime = %q, want the raw value", got)
+	}
+}
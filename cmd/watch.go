@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+// watchInterval is how often start --watch checks the config file for
+// changes.
+const watchInterval = time.Second
+
+// watchConfig reads the config file at path every interval and sends on the
+// returned channel each time its contents stop matching hash, the hash of
+// the contents last seen. Config files are small, so hashing them is cheaper
+// than trusting modification times that some filesystems keep coarsely. A change is reported once, however the reload it
+// triggers goes, so an invalid edit is retried only when the file changes
+// again. Polling stops when ctx is done.
+func watchConfig(ctx context.Context, path, hash string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				// Editors often replace the file, leaving it briefly
+				// missing; the next poll sees the new one.
+				continue
+			}
+			if h := config.Hash(data); h != hash {
+				hash = h
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+// waitChange waits for the watcher to report a change.
+func waitChange(t *testing.T, changed <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("config change not detected")
+	}
+}
+
+// rewriteProxiesConfig replaces the config at configPath with one listing
+// proxies, the way an editor saving it would.
+func rewriteProxiesConfig(t *testing.T, proxies ...config.ProxyEntry) {
+	t.Helper()
+	path := configPath
+	writeProxiesConfig(t, proxies...)
+	if err := os.Rename(configPath, path); err != nil {
+		t.Fatalf("replacing config: %v", err)
+	}
+	configPath = path
+}
+
+func TestWatchConfig_ReloadsListeners(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	writeProxiesConfig(t, a)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	ctl := runTestDaemon(t, cfg.Proxies)
+	set := ctl.set
+	before := set.Listener(a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := watchConfig(ctx, configPath, cfg.Hash, 10*time.Millisecond)
+
+	// Adding a proxy starts its listener and leaves the other alone.
+	path := configPath
+	rewriteProxiesConfig(t, a, b)
+	waitChange(t, changed)
+	if err := ctl.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected 2 listeners after adding a proxy, got %d", got)
+	}
+	if set.Listener(a) != before {
+		t.Error("unchanged proxy should keep its listener")
+	}
+
+	// An invalid edit keeps the running config.
+	if err := os.WriteFile(path, []byte("proxies: [\n"), 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	waitChange(t, changed)
+	if err := ctl.reload(); err == nil {
+		t.Error("expected the invalid config to fail to reload")
+	}
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected the 2 listeners to keep running, got %d", got)
+	}
+
+	// Removing a proxy closes only its listener.
+	rewriteProxiesConfig(t, b)
+	waitChange(t, changed)
+	if err := ctl.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if set.Listener(a) != nil {
+		t.Error("removed proxy should have no listener")
+	}
+	if got := len(set.Listeners()); got != 1 {
+		t.Errorf("expected 1 listener after removing a proxy, got %d", got)
+	}
+}
+
+func TestWatchConfig_IgnoresUnchangedFile(t *testing.T) {
+	writeProxiesConfig(t, proxyA)
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := watchConfig(ctx, configPath, config.Hash(data), 10*time.Millisecond)
+
+	// Rewriting the same bytes touches the file without changing it.
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	select {
+	case <-changed:
+		t.Error("expected no change for identical contents")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,13 +1,26 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 	"gopkg.in/yaml.v3"
@@ -18,10 +31,109 @@ var printer = message.NewPrinter(language.English)
 //go:embed schema.json
 var schemaJSON []byte
 
+// CurrentVersion is the newest config format version this release reads. A
+// config without a version field is version 1.
+const CurrentVersion = 1
+
+// schemas holds the JSON schema for each supported config version.
+var schemas = map[int][]byte{
+	1: schemaJSON,
+}
+
+// DefaultHost is the address listeners bind to when an entry sets no host.
+const DefaultHost = "localhost"
+
+// The range of local ports a proxy may listen on, matching the schema.
+const (
+	MinPort = 1024
+	MaxPort = 65535
+)
+
+// LatestSecretVersion is the secret version fetched when an entry doesn't pin one.
+const LatestSecretVersion = "latest"
+
+// DefaultShutdownTimeout is how long the daemon lets open connections finish
+// when it stops, unless the config sets shutdown_timeout.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Defaults for retrying failed dials to an instance.
+const (
+	DefaultDialAttempts   = 3
+	DefaultDialRetryDelay = 250 * time.Millisecond
+	DefaultDialTimeout    = 30 * time.Second
+)
+
+// DefaultBufferSize is the size of the buffers connections are copied
+// through, unless the config sets buffer_size.
+const DefaultBufferSize = 32 * 1024
+
+// DefaultSecretAttempts is how many times a secret fetch is tried, unless the
+// config sets secret_attempts.
+const DefaultSecretAttempts = 3
+
+// DefaultSecretConcurrency is how many secrets are fetched at once, unless
+// the config sets secret_concurrency.
+const DefaultSecretConcurrency = 8
+
+// Database engines, which decide the client connect launches.
+const (
+	EnginePostgres = "postgres"
+	EngineMySQL    = "mysql"
+)
+
+// Daemon log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// IP types a proxy can use to reach its instance.
+const (
+	IPTypePublic  = "public"
+	IPTypePrivate = "private"
+	IPTypePSC     = "psc"
+)
+
+// Ways a proxy can authenticate database users. With IAM auth the connector
+// logs in as the caller's IAM identity, so no password secret is needed.
+const (
+	AuthPassword = "password"
+	AuthIAM      = "iam"
+)
+
+// Where a password proxy's secret comes from. For Secret Manager, secret is
+// the secret's name; for a file, its path; for env, the variable's name.
+const (
+	SecretSourceManager = "secret_manager"
+	SecretSourceFile    = "file"
+	SecretSourceEnv     = "env"
+)
+
 type ProxyEntry struct {
-	Instance string `yaml:"instance" json:"instance"`
-	Port     int    `yaml:"port" json:"port"`
-	Secret   string `yaml:"secret" json:"secret"`
+	Instance       string            `yaml:"instance" json:"instance"`
+	Host           string            `yaml:"host,omitempty" json:"host,omitempty"`
+	Port           int               `yaml:"port,omitempty" json:"port,omitempty"`
+	ExtraPorts     []int             `yaml:"-" json:"extra_ports,omitempty"`
+	Socket         string            `yaml:"socket,omitempty" json:"socket,omitempty"`
+	Secret         string            `yaml:"secret,omitempty" json:"secret,omitempty"`
+	SecretVersion  string            `yaml:"secret_version,omitempty" json:"secret_version,omitempty"`
+	SecretSource   string            `yaml:"secret_source,omitempty" json:"secret_source,omitempty"`
+	SecretFile     string            `yaml:"secret_file,omitempty" json:"-"` // decoded into Secret and SecretSource
+	IPType         string            `yaml:"ip_type,omitempty" json:"ip_type,omitempty"`
+	Auth           string            `yaml:"auth,omitempty" json:"auth,omitempty"`
+	DialAttempts   int               `yaml:"dial_attempts,omitempty" json:"dial_attempts,omitempty"`
+	DialRetryDelay string            `yaml:"dial_retry_delay,omitempty" json:"dial_retry_delay,omitempty"`
+	DialTimeout    string            `yaml:"dial_timeout,omitempty" json:"dial_timeout,omitempty"`
+	IdleTimeout    string            `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	MaxLifetime    string            `yaml:"max_conn_lifetime,omitempty" json:"max_conn_lifetime,omitempty"`
+	MaxConnections int               `yaml:"max_connections,omitempty" json:"max_connections,omitempty"`
+	RateLimit      int               `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	BufferSize     int               `yaml:"buffer_size,omitempty" json:"buffer_size,omitempty"`
+	Engine         string            `yaml:"engine,omitempty" json:"engine,omitempty"`
+	User           string            `yaml:"user,omitempty" json:"user,omitempty"`
+	LogLevel       string            `yaml:"log_level,omitempty" json:"log_level,omitempty"`
+	AccessLog      bool              `yaml:"access_log,omitempty" json:"access_log,omitempty"`
+	Tags           map[string]string `yaml:"tags,omitempty" json:"tags,omitempty"`
 }
 
 func (p ProxyEntry) Project() string {
@@ -32,51 +144,896 @@ func (p ProxyEntry) Project() string {
 	return parts[0]
 }
 
+// SecretVersionOrLatest returns the secret version to fetch for the proxy.
+func (p ProxyEntry) SecretVersionOrLatest() string {
+	if p.SecretVersion == "" {
+		return LatestSecretVersion
+	}
+	return p.SecretVersion
+}
+
+// IAMAuth reports whether the proxy uses IAM database authentication instead
+// of a password from Secret Manager.
+func (p ProxyEntry) IAMAuth() bool {
+	return p.Auth == AuthIAM
+}
+
+// SecretSourceOrDefault returns where the proxy's secret comes from.
+func (p ProxyEntry) SecretSourceOrDefault() string {
+	if p.SecretSource == "" {
+		return SecretSourceManager
+	}
+	return p.SecretSource
+}
+
+// UsesSecretManager reports whether the proxy's password is fetched from
+// Secret Manager.
+func (p ProxyEntry) UsesSecretManager() bool {
+	return !p.IAMAuth() && p.SecretSourceOrDefault() == SecretSourceManager
+}
+
+// DialAttemptsOrDefault returns how many times to try dialing the instance
+// for each client connection.
+func (p ProxyEntry) DialAttemptsOrDefault() int {
+	if p.DialAttempts == 0 {
+		return DefaultDialAttempts
+	}
+	return p.DialAttempts
+}
+
+// DialRetryDelayOrDefault returns the wait before the first dial retry.
+func (p ProxyEntry) DialRetryDelayOrDefault() time.Duration {
+	return parseDuration(p.DialRetryDelay, DefaultDialRetryDelay)
+}
+
+// DialTimeoutOrDefault returns how long each dial attempt may take.
+func (p ProxyEntry) DialTimeoutOrDefault() time.Duration {
+	return parseDuration(p.DialTimeout, DefaultDialTimeout)
+}
+
+// IdleTimeoutDuration returns how long a proxied connection may go without
+// traffic before it is closed, or 0 for no limit.
+func (p ProxyEntry) IdleTimeoutDuration() time.Duration {
+	return parseDuration(p.IdleTimeout, 0)
+}
+
+// MaxLifetimeDuration returns how long a proxied connection may stay open,
+// busy or not, before it is closed, or 0 for no limit.
+func (p ProxyEntry) MaxLifetimeDuration() time.Duration {
+	return parseDuration(p.MaxLifetime, 0)
+}
+
+// BufferSizeOrDefault returns the size of the buffer each direction of the
+// proxy's connections is copied through.
+func (p ProxyEntry) BufferSizeOrDefault() int {
+	if p.BufferSize == 0 {
+		return DefaultBufferSize
+	}
+	return p.BufferSize
+}
+
+// ShutdownTimeoutOrDefault returns how long the daemon lets open connections
+// finish when it stops.
+func (c *Config) ShutdownTimeoutOrDefault() time.Duration {
+	return parseDuration(c.ShutdownTimeout, DefaultShutdownTimeout)
+}
+
+// SecretAttemptsOrDefault returns how many times to try each secret fetch.
+func (c *Config) SecretAttemptsOrDefault() int {
+	if c.SecretAttempts == 0 {
+		return DefaultSecretAttempts
+	}
+	return c.SecretAttempts
+}
+
+// SecretConcurrencyOrDefault returns how many secrets to fetch at once.
+func (c *Config) SecretConcurrencyOrDefault() int {
+	if c.SecretConcurrency == 0 {
+		return DefaultSecretConcurrency
+	}
+	return c.SecretConcurrency
+}
+
+// LogLevelOrDefault returns the daemon's log level, info unless set.
+func (c *Config) LogLevelOrDefault() slog.Level {
+	return ParseLogLevel(c.LogLevel, slog.LevelInfo)
+}
+
+// LogFormatOrDefault returns the daemon log's format, text unless set.
+func (c *Config) LogFormatOrDefault() string {
+	if c.LogFormat == "" {
+		return LogFormatText
+	}
+	return c.LogFormat
+}
+
+// LogLevelOr returns the level for the proxy's log entries, or def if the
+// entry doesn't set one.
+func (p ProxyEntry) LogLevelOr(def slog.Level) slog.Level {
+	return ParseLogLevel(p.LogLevel, def)
+}
+
+// ParseLogLevel parses a level name (debug, info, warn, or error), returning
+// def if s is empty or not a level.
+func ParseLogLevel(s string, def slog.Level) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return def
+	}
+	return level
+}
+
+// parseDuration parses a duration field, returning def if it is unset. The
+// schema has already checked the syntax.
+func parseDuration(s string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// EngineOrDefault returns the proxy's database engine, postgres unless set.
+// It isn't guessed from the port, which --port-offset shifts.
+func (p ProxyEntry) EngineOrDefault() string {
+	if p.Engine != "" {
+		return p.Engine
+	}
+	return EnginePostgres
+}
+
+// UnmarshalYAML decodes an entry whose port may be a list of ports, in which
+// case the first becomes Port and the rest ExtraPorts. A secret_file becomes
+// a file secret_source with the path as Secret, so the rest of the code only
+// knows one form.
+func (p *ProxyEntry) UnmarshalYAML(n *yaml.Node) error {
+	type plain ProxyEntry
+	var extra []int
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			value := n.Content[i+1]
+			if n.Content[i].Value != "port" || value.Kind != yaml.SequenceNode || len(value.Content) == 0 {
+				continue
+			}
+			var ports []int
+			if err := value.Decode(&ports); err != nil {
+				return err
+			}
+			single := *n
+			single.Content = append([]*yaml.Node(nil), n.Content...)
+			single.Content[i+1] = value.Content[0]
+			n = &single
+			if len(ports) > 1 {
+				extra = ports[1:]
+			}
+			break
+		}
+	}
+	if err := n.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.ExtraPorts = extra
+	if p.SecretFile != "" {
+		p.Secret, p.SecretSource, p.SecretFile = p.SecretFile, SecretSourceFile, ""
+	}
+	return nil
+}
+
+// AutoPort reports whether the proxy listens on a TCP port the daemon picks,
+// because its port is omitted or 0.
+func (p ProxyEntry) AutoPort() bool {
+	return p.Socket == "" && p.Port == 0
+}
+
+// AssignPorts returns a copy of proxies with each automatic port set to the
+// port bound for that instance in ports, if there is one.
+func AssignPorts(proxies []ProxyEntry, ports map[string]int) []ProxyEntry {
+	assigned := make([]ProxyEntry, len(proxies))
+	for i, p := range proxies {
+		if port, ok := ports[p.Instance]; ok && p.AutoPort() {
+			p.Port = port
+		}
+		assigned[i] = p
+	}
+	return assigned
+}
+
+// Ports returns every port the proxy listens on: Port, then ExtraPorts.
+// Socket entries have none.
+func (p ProxyEntry) Ports() []int {
+	if p.Socket != "" {
+		return nil
+	}
+	return append([]int{p.Port}, p.ExtraPorts...)
+}
+
+// ExpandPorts returns proxies with every multi-port entry replaced by one
+// entry per port, in order, so that each result needs exactly one listener.
+func ExpandPorts(proxies []ProxyEntry) []ProxyEntry {
+	var expanded []ProxyEntry
+	for _, p := range proxies {
+		if len(p.ExtraPorts) == 0 {
+			expanded = append(expanded, p)
+			continue
+		}
+		for _, port := range p.Ports() {
+			e := p
+			e.Port, e.ExtraPorts = port, nil
+			expanded = append(expanded, e)
+		}
+	}
+	return expanded
+}
+
+// ListenHost returns the host the proxy's listener binds to.
+func (p ProxyEntry) ListenHost() string {
+	if p.Host == "" {
+		return DefaultHost
+	}
+	return p.Host
+}
+
+// Network returns the network the proxy listens on: "unix" for socket
+// entries, otherwise "tcp".
+func (p ProxyEntry) Network() string {
+	if p.Socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Addr returns the address the proxy's listener binds to: host:port, or the
+// socket path for socket entries.
+func (p ProxyEntry) Addr() string {
+	if p.Socket != "" {
+		return p.Socket
+	}
+	return net.JoinHostPort(p.ListenHost(), strconv.Itoa(p.Port))
+}
+
+// DialAddr returns an address clients on this machine can use to reach the
+// proxy. Wildcard hosts such as 0.0.0.0 are reached via localhost.
+func (p ProxyEntry) DialAddr() string {
+	if p.Socket != "" {
+		return p.Socket
+	}
+	host := p.ListenHost()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = DefaultHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.Port))
+}
+
+// Endpoint describes where the proxy listens, e.g. "port 5432" or
+// "socket /cloudsql/proj:region:db".
+func (p ProxyEntry) Endpoint() string {
+	if p.Socket != "" {
+		return "socket " + p.Socket
+	}
+	if len(p.ExtraPorts) > 0 {
+		return "ports " + p.PortList()
+	}
+	if p.AutoPort() {
+		return "an automatic port"
+	}
+	return fmt.Sprintf("port %d", p.Port)
+}
+
+// PortList returns the proxy's ports separated by commas, e.g. "5432,6432",
+// or "auto" for an automatic port.
+func (p ProxyEntry) PortList() string {
+	if p.AutoPort() {
+		return "auto"
+	}
+	ports := make([]string, 0, 1+len(p.ExtraPorts))
+	for _, port := range p.Ports() {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return strings.Join(ports, ",")
+}
+
+// HasTags reports whether every key/value pair in want is present in the
+// entry's tags.
+func (p ProxyEntry) HasTags(want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := p.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
 type Config struct {
+	// Version is the config format version, 1 if the file sets none.
+	Version int `yaml:"version,omitempty" json:"version,omitempty"`
+
+	Proxies      []ProxyEntry           `yaml:"proxies" json:"proxies"`
+	Include      []string               `yaml:"include,omitempty" json:"include,omitempty"`
+	Environments map[string]Environment `yaml:"environments,omitempty" json:"environments,omitempty"`
+	MetricsPort  int                    `yaml:"metrics_port,omitempty" json:"metrics_port,omitempty"`
+	HealthPort   int                    `yaml:"health_port,omitempty" json:"health_port,omitempty"`
+
+	// DefaultEnvironment is selected when none is given with --env.
+	DefaultEnvironment string `yaml:"default_environment,omitempty" json:"default_environment,omitempty"`
+
+	ShutdownTimeout string `yaml:"shutdown_timeout,omitempty" json:"shutdown_timeout,omitempty"`
+	LogLevel        string `yaml:"log_level,omitempty" json:"log_level,omitempty"`
+	LogFormat       string `yaml:"log_format,omitempty" json:"log_format,omitempty"`
+
+	// SecretAttempts is how many times to try a secret fetch that fails with
+	// a transient error.
+	SecretAttempts int `yaml:"secret_attempts,omitempty" json:"secret_attempts,omitempty"`
+
+	// SecretConcurrency is how many secrets to fetch from Secret Manager at
+	// once.
+	SecretConcurrency int `yaml:"secret_concurrency,omitempty" json:"secret_concurrency,omitempty"`
+
+	// ImpersonateServiceAccount is the service account the daemon and
+	// Secret Manager lookups act as, instead of the ADC identity.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account,omitempty" json:"impersonate_service_account,omitempty"`
+
+	// AccessLog turns on access_log for every proxy.
+	AccessLog bool `yaml:"access_log,omitempty" json:"access_log,omitempty"`
+
+	// BufferSize is the buffer_size of every proxy that doesn't set its own.
+	BufferSize int `yaml:"buffer_size,omitempty" json:"buffer_size,omitempty"`
+
+	// PortsFile has the daemon keep ports.json in the state directory up to
+	// date with the port of each proxy.
+	PortsFile bool `yaml:"ports_file,omitempty" json:"ports_file,omitempty"`
+
+	// OnStart and OnStop are commands, as a program and its arguments, the
+	// daemon runs for each proxy once it is listening and once it has shut
+	// down.
+	OnStart []string `yaml:"on_start,omitempty" json:"on_start,omitempty"`
+	OnStop  []string `yaml:"on_stop,omitempty" json:"on_stop,omitempty"`
+
+	// Environment is the name of the selected environment, if any.
+	Environment string `yaml:"-" json:"-"`
+
+	// Hash is the Hash of the bytes LoadEnv read the config from. Included
+	// files aren't part of it.
+	Hash string `yaml:"-" json:"-"`
+}
+
+// Hash returns the hex-encoded SHA-256 of a config's bytes, which tells
+// whether a config file has changed since it was loaded.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Environment is a named set of proxies within a config file.
+type Environment struct {
 	Proxies []ProxyEntry `yaml:"proxies" json:"proxies"`
 }
 
 func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	return LoadEnv(path, "")
+}
+
+// StdinPath is the config path that means standard input.
+const StdinPath = "-"
+
+// Stdin is where a config with path StdinPath is read from.
+var Stdin io.Reader = os.Stdin
+
+// LoadEnv reads and parses the config at path, selecting the named
+// environment. The format is chosen by FormatForPath, or by FormatForData
+// when path is StdinPath. A path for which IsRemote is true is fetched, and
+// its format chosen by FormatForURL; its include patterns, like those of a
+// config from stdin, are resolved against the working directory. See
+// ParseFormat.
+func LoadEnv(path, env string) (*Config, error) {
+	var data []byte
+	var cfg *Config
+	var err error
+	if path == StdinPath {
+		if data, err = io.ReadAll(Stdin); err != nil {
+			return nil, fmt.Errorf("reading config from stdin: %w", err)
+		}
+		cfg, err = ParseFormat(data, FormatForData(data), env)
+	} else if IsRemote(path) {
+		if data, err = FetchRemote(context.Background(), path); err != nil {
+			return nil, fmt.Errorf("fetching config: %w", err)
+		}
+		cfg, err = ParseFormat(data, FormatForURL(path, data), env)
+	} else {
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+		cfg, err = parseFile(data, FormatForPath(path), env, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.Hash = Hash(data)
+	return cfg, nil
+}
+
+// dirConfigExts are the extensions of the files LoadDir reads.
+var dirConfigExts = []string{".yaml", ".yml", ".json"}
+
+// LoadDir reads every *.yaml, *.yml, and *.json file in dir, in name order,
+// and merges their proxies into one config, as if a config included them
+// all. Like included files, each may only set proxies and include. Proxies
+// must be unique across the files, and errors name the file an entry came
+// from. Such a config has no environments, so env must be empty.
+func LoadDir(dir, env string) (*Config, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading config dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("reading config dir: %s is not a directory", dir)
+	}
+	var files []string
+	for _, ext := range dirConfigExts {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return nil, fmt.Errorf("reading config dir: %w", err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	proxies, locs, err := loadIncludes(files, dir, make(map[string]bool))
 	if err != nil {
-		return nil, fmt.Errorf("reading config: %w", err)
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return nil, &ConfigError{Path: dir, Kind: KindEmpty, Message: "no proxies found in the *.yaml, *.yml, or *.json files, so there is nothing to start"}
+	}
+	cfg := &Config{Version: CurrentVersion, Proxies: proxies}
+	if err := selectEnvironment(cfg, env); err != nil {
+		return nil, err
 	}
-	return Parse(data)
+	if err := validateUniqueness(cfg.Proxies, locs); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 func Parse(data []byte) (*Config, error) {
-	// Parse YAML into a generic interface for schema validation
+	return ParseEnv(data, "")
+}
+
+// ParseEnv parses a YAML config. See ParseFormat.
+func ParseEnv(data []byte, env string) (*Config, error) {
+	return ParseFormat(data, FormatYAML, env)
+}
+
+// Format is a config file syntax.
+type Format int
+
+const (
+	FormatYAML Format = iota
+	FormatJSON
+)
+
+// FormatForPath picks the config format from a file's extension: JSON for
+// .json, and YAML for anything else.
+func FormatForPath(path string) Format {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// FormatForData guesses the format of a config read without a file name:
+// JSON if it starts with an object, otherwise YAML.
+func FormatForData(data []byte) Format {
+	if bytes.HasPrefix(bytes.TrimSpace(normalize(data)), []byte("{")) {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// Ext returns the file extension for configs in the format.
+func (f Format) Ext() string {
+	if f == FormatJSON {
+		return ".json"
+	}
+	return ".yaml"
+}
+
+// ParseFormat parses a config and, if it defines environments, makes the
+// named environment's proxies the config's Proxies. env must be empty for
+// configs with a flat proxies list. Environment variable references in string
+// values are expanded before validation; see expandEnv. Relative include
+// patterns are resolved against the working directory.
+func ParseFormat(data []byte, format Format, env string) (*Config, error) {
+	return parseFile(data, format, env, "")
+}
+
+// parseFile is ParseFormat for a config read from src, or from nowhere in
+// particular if src is "". The proxies of included files are appended to
+// the config's own, and relative include patterns are resolved against the
+// directory of src.
+func parseFile(data []byte, format Format, env, src string) (*Config, error) {
+	cfg, err := decode(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Select the environment, if any
+	path := "proxies"
+	if err := selectEnvironment(cfg, env); err != nil {
+		return nil, err
+	}
+	if cfg.Environment != "" {
+		path = fmt.Sprintf("environments.%s.proxies", cfg.Environment)
+	}
+	locs := make([]string, len(cfg.Proxies))
+	for i := range cfg.Proxies {
+		locs[i] = fmt.Sprintf("%s.%d", path, i)
+	}
+
+	// Merge in the included files' proxies
+	if len(cfg.Include) > 0 {
+		if len(cfg.Environments) > 0 {
+			return nil, fmt.Errorf("Invalid config: include: not allowed with environments")
+		}
+		stack := make(map[string]bool)
+		if src != "" {
+			stack[absPath(src)] = true
+		}
+		proxies, incLocs, err := loadIncludes(cfg.Include, filepath.Dir(src), stack)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Proxies = append(cfg.Proxies, proxies...)
+		locs = append(locs, incLocs...)
+	}
+
+	// The schema only sees one file at a time, so it can't tell that the
+	// merged config, which the daemon would start, has no proxies.
+	if len(cfg.Proxies) == 0 {
+		return nil, &ConfigError{Path: "include", Kind: KindEmpty, Message: "no proxies found in the included files, so there is nothing to start"}
+	}
+
+	// Go-level uniqueness checks
+	if err := validateUniqueness(cfg.Proxies, locs); err != nil {
+		return nil, err
+	}
+	if cfg.HealthPort != 0 && cfg.HealthPort == cfg.MetricsPort {
+		return nil, &ConfigError{Path: "health_port", Kind: KindConflict, Message: fmt.Sprintf("same port as metrics_port (%d)", cfg.HealthPort)}
+	}
+
+	// Applying the top-level access_log to the entries means toggling it
+	// changes every proxy, so a reload restarts their listeners.
+	if cfg.AccessLog {
+		for i := range cfg.Proxies {
+			cfg.Proxies[i].AccessLog = true
+		}
+	}
+	// The same goes for buffer_size, which entries may override.
+	if cfg.BufferSize != 0 {
+		for i := range cfg.Proxies {
+			if cfg.Proxies[i].BufferSize == 0 {
+				cfg.Proxies[i].BufferSize = cfg.BufferSize
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadIncludes reads the files matching the include patterns, in order, and
+// returns their proxies along with each entry's location for error messages.
+// Relative patterns are resolved against dir. stack holds the absolute paths
+// of the files whose includes are being read, to catch cycles.
+func loadIncludes(patterns []string, dir string, stack map[string]bool) ([]ProxyEntry, []string, error) {
+	var proxies []ProxyEntry
+	var locs []string
+	for _, pattern := range patterns {
+		full := pattern
+		if !filepath.IsAbs(full) {
+			full = filepath.Join(dir, full)
+		}
+		matches, err := filepath.Glob(full)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid config: include: bad pattern %q", pattern)
+		}
+		// A pattern without wildcards names one file, which must exist.
+		if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[\`) {
+			return nil, nil, fmt.Errorf("Invalid config: include: %s: no such file", full)
+		}
+
+		for _, file := range matches {
+			abs := absPath(file)
+			if stack[abs] {
+				return nil, nil, fmt.Errorf("Invalid config: include: %s is included by itself", file)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading included config: %w", err)
+			}
+			inc, err := decode(data, FormatForPath(file))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", file, err)
+			}
+			rest := *inc
+			rest.Version, rest.Proxies, rest.Include = 0, nil, nil
+			if !reflect.DeepEqual(rest, Config{}) {
+				return nil, nil, fmt.Errorf("%s: Invalid config: only proxies and include may be set in an included file", file)
+			}
+			for i, p := range inc.Proxies {
+				proxies = append(proxies, p)
+				locs = append(locs, fmt.Sprintf("%s: proxies.%d", file, i))
+			}
+
+			stack[abs] = true
+			nested, nestedLocs, err := loadIncludes(inc.Include, filepath.Dir(file), stack)
+			delete(stack, abs)
+			if err != nil {
+				return nil, nil, err
+			}
+			proxies = append(proxies, nested...)
+			locs = append(locs, nestedLocs...)
+		}
+	}
+	return proxies, locs, nil
+}
+
+// absPath returns path made absolute, or path itself if that fails.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// decode parses and validates a single config file, without selecting an
+// environment or reading includes.
+func decode(data []byte, format Format) (*Config, error) {
+	data = normalize(data)
+
+	// Both formats are decoded into a YAML node tree, so expansion,
+	// validation, and typed decoding are shared.
+	var doc *yaml.Node
+	var err error
+	if format == FormatJSON {
+		doc, err = decodeJSON(data)
+	} else {
+		doc, err = decodeYAML(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := expandEnv(doc); err != nil {
+		return nil, err
+	}
+	if err := renameAliases(doc); err != nil {
+		return nil, err
+	}
+
+	// Decode into a generic interface for schema validation
 	var raw any
-	if err := yaml.Unmarshal(data, &raw); err != nil {
-		return nil, fmt.Errorf("parsing YAML: %w", err)
+	if err := doc.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	// Check the version first: a newer config is likely to fail the schema
+	// too, and upgrading is the fix for both.
+	version := versionOf(raw)
+	schema, ok := schemas[version]
+	if !ok {
+		if version > CurrentVersion {
+			return nil, &ConfigError{Path: "version", Kind: KindUnsupported, Message: fmt.Sprintf("%d is newer than this release of cloud-sql-proxy-runner supports (up to %d); upgrade it to read this config", version, CurrentVersion)}
+		}
+		return nil, &ConfigError{Path: "version", Kind: KindUnsupported, Message: fmt.Sprintf("%d is not a config version (want 1 to %d)", version, CurrentVersion)}
 	}
 
 	// Validate against JSON Schema
-	if err := validateSchema(raw); err != nil {
+	if err := validateSchema(schema, raw); err != nil {
 		return nil, err
 	}
 
-	// Parse into typed struct
+	// Decode into typed struct
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := doc.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	cfg.Version = version
+	return &cfg, nil
+}
 
-	// Go-level uniqueness checks
-	if err := validateUniqueness(&cfg); err != nil {
-		return nil, err
+// fieldAliases maps top-level fields accepted under another name to the
+// field they stand for.
+var fieldAliases = map[string]string{
+	"profiles":        "environments",
+	"default_profile": "default_environment",
+}
+
+// renameAliases renames the aliased top-level fields of doc to the fields
+// they stand for, so the schema and the typed decoding only know one name.
+// Setting both names is an error.
+func renameAliases(doc *yaml.Node) error {
+	root := doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil
 	}
+	keys := make(map[string]bool)
+	for i := 0; i < len(root.Content); i += 2 {
+		keys[root.Content[i].Value] = true
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		key := root.Content[i]
+		name, ok := fieldAliases[key.Value]
+		if !ok {
+			continue
+		}
+		if keys[name] {
+			return &ConfigError{Path: key.Value, Kind: KindConflict, Message: fmt.Sprintf("is another name for %s; set only one of them", name)}
+		}
+		key.Value = name
+	}
+	return nil
+}
 
-	return &cfg, nil
+// versionOf returns the version field of a decoded config, or 1 if it has
+// none. A version that isn't an integer is also taken as 1, so that the
+// schema reports it.
+func versionOf(raw any) int {
+	m, _ := raw.(map[string]any)
+	if v, ok := m["version"].(int); ok {
+		return v
+	}
+	return 1
 }
 
-func validateSchema(data any) error {
+func decodeYAML(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	return &doc, nil
+}
+
+func decodeJSON(data []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("parsing JSON: unexpected data after top-level value")
+	}
+	var doc yaml.Node
+	if err := doc.Encode(fromJSON(v)); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	return &doc, nil
+}
+
+// fromJSON converts the json.Number values in a decoded JSON value to int64
+// or float64, so they encode as YAML numbers rather than strings.
+func fromJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	}
+	return v
+}
+
+// normalize strips a leading UTF-8 byte order mark and converts CRLF line
+// endings to LF, so files saved by Windows editors parse cleanly.
+func normalize(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// expandEnv replaces $VAR and ${VAR} references in the string values under n
+// with the variables' values; $$ produces a literal $. Keys and non-string
+// values are left alone. Referencing an unset variable is an error rather
+// than silently expanding to "".
+func expandEnv(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.ShortTag() != "!!str" {
+			return nil
+		}
+		var missing string
+		value := os.Expand(n.Value, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			v, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return v
+		})
+		if missing != "" && n.Line == 0 {
+			return fmt.Errorf("Invalid config: environment variable %q is not set", missing)
+		}
+		if missing != "" {
+			return fmt.Errorf("Invalid config: line %d: environment variable %q is not set", n.Line, missing)
+		}
+		n.Value = value
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			if err := expandEnv(n.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := expandEnv(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Kinds of ConfigError found by checks beyond the schema's.
+const (
+	// KindDuplicate is a port, socket, or instance used by two proxies.
+	KindDuplicate = "duplicate"
+	// KindConflict is a field whose value clashes with another field's.
+	KindConflict = "conflict"
+	// KindUnknown is a reference to something the config doesn't define.
+	KindUnknown = "unknown"
+	// KindUnsupported is a config version this release can't read.
+	KindUnsupported = "unsupported"
+	// KindNotAllowed is a property the schema forbids where it is set,
+	// such as port alongside socket.
+	KindNotAllowed = "not_allowed"
+	// KindEmpty is a config whose files, once merged, list no proxies.
+	KindEmpty = "empty"
+)
+
+// ConfigError is a config that fails validation. Its message reads
+// "Invalid config: <path>: <message>"; callers wanting the details can get
+// at it with errors.As.
+type ConfigError struct {
+	// Path is the dotted location of the offending value, e.g.
+	// proxies.1.port, or "/" for the config as a whole.
+	Path string
+	// Kind is the kind of violation: the JSON Schema keyword that failed,
+	// e.g. required, type, or enum, or one of the Kind constants.
+	Kind string
+	// Message describes the violation.
+	Message string
+	// Err is the underlying cause, such as a *jsonschema.ValidationError,
+	// or nil.
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid config: %s: %s", e.Path, e.Message)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func validateSchema(schema []byte, data any) error {
 	var schemaDoc any
-	if err := json.Unmarshal(schemaJSON, &schemaDoc); err != nil {
+	if err := json.Unmarshal(schema, &schemaDoc); err != nil {
 		return fmt.Errorf("parsing schema: %w", err)
 	}
 
 	c := jsonschema.NewCompiler()
+	c.AssertFormat()
 	if err := c.AddResource("schema.json", schemaDoc); err != nil {
 		return fmt.Errorf("adding schema resource: %w", err)
 	}
@@ -86,37 +1043,147 @@ func validateSchema(data any) error {
 	}
 
 	if err := sch.Validate(data); err != nil {
-		return fmt.Errorf("Invalid config: %s", formatValidationError(err))
+		if ve, ok := err.(*jsonschema.ValidationError); ok {
+			return schemaError(ve)
+		}
+		return fmt.Errorf("Invalid config: %w", err)
+	}
+	return nil
+}
+
+// schemaError describes the violation behind ve, a schema validation
+// failure, as a ConfigError wrapping ve.
+func schemaError(ve *jsonschema.ValidationError) *ConfigError {
+	leaf := ve
+	for len(leaf.Causes) > 0 {
+		leaf = mainCause(leaf)
+	}
+	e := &ConfigError{Path: strings.Join(leaf.InstanceLocation, "."), Err: ve}
+	if e.Path == "" {
+		e.Path = "/"
 	}
+	if kw := leaf.ErrorKind.KeywordPath(); len(kw) > 0 {
+		e.Kind = kw[0]
+	}
+	switch k := leaf.ErrorKind.(type) {
+	case *kind.FalseSchema:
+		// Properties forbidden by a conditional, e.g. port with socket
+		e.Kind, e.Message = KindNotAllowed, "not allowed here"
+	case *kind.Pattern:
+		if strings.HasSuffix(e.Path, ".instance") {
+			// The raw pattern is no help in spotting a mistyped region.
+			e.Message = fmt.Sprintf("%q is not a Cloud SQL connection string (want project:region:name, e.g. my-project:us-central1:my-database)", k.Got)
+			break
+		}
+		e.Message = k.LocalizedString(printer)
+	default:
+		e.Message = k.LocalizedString(printer)
+	}
+	return e
+}
+
+// mainCause returns the cause of ve to report. When no branch of a oneOf
+// matched, that is the branch for the value's type, e.g. the list form of
+// port for a list, rather than a branch rejecting the type outright.
+func mainCause(ve *jsonschema.ValidationError) *jsonschema.ValidationError {
+	if _, ok := ve.ErrorKind.(*kind.OneOf); ok {
+		for _, c := range ve.Causes {
+			leaf := c
+			for len(leaf.Causes) > 0 {
+				leaf = leaf.Causes[0]
+			}
+			if _, ok := leaf.ErrorKind.(*kind.Type); !ok {
+				return c
+			}
+		}
+	}
+	return ve.Causes[0]
+}
+
+func selectEnvironment(cfg *Config, env string) error {
+	if len(cfg.Environments) == 0 {
+		if env != "" {
+			return fmt.Errorf("environment %q selected but config defines no environments", env)
+		}
+		return nil
+	}
+	names := make([]string, 0, len(cfg.Environments))
+	for name := range cfg.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if d := cfg.DefaultEnvironment; d != "" {
+		if _, ok := cfg.Environments[d]; !ok {
+			return &ConfigError{Path: "default_environment", Kind: KindUnknown, Message: fmt.Sprintf("unknown environment %q (available: %s)", d, strings.Join(names, ", "))}
+		}
+	}
+	if env == "" {
+		env = cfg.DefaultEnvironment
+	}
+	if env == "" {
+		return fmt.Errorf("config defines environments; select one with --env or CSPR_ENV, or set default_environment (available: %s)", strings.Join(names, ", "))
+	}
+	e, ok := cfg.Environments[env]
+	if !ok {
+		return fmt.Errorf("unknown environment %q (available: %s)", env, strings.Join(names, ", "))
+	}
+	cfg.Proxies = e.Proxies
+	cfg.Environment = env
 	return nil
 }
 
-func formatValidationError(err error) string {
-	if ve, ok := err.(*jsonschema.ValidationError); ok {
-		if len(ve.Causes) > 0 {
-			return formatValidationError(ve.Causes[0])
+// ShiftPorts adds offset to every TCP proxy's port, so that a config can run
+// beside another copy of itself. It fails if a port would leave the
+// MinPort-MaxPort range or land on another proxy's port.
+func (c *Config) ShiftPorts(offset int) error {
+	locs := make([]string, len(c.Proxies))
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+		locs[i] = fmt.Sprintf("proxies.%d", i)
+		if p.Socket != "" || p.AutoPort() {
+			continue
+		}
+		ports := p.Ports()
+		for j, port := range ports {
+			ports[j] = port + offset
+			if ports[j] < MinPort || ports[j] > MaxPort {
+				return fmt.Errorf("port offset %d moves %s from port %d to %d, outside %d-%d", offset, p.Instance, port, ports[j], MinPort, MaxPort)
+			}
 		}
-		path := strings.Join(ve.InstanceLocation, ".")
-		if path == "" {
-			path = "/"
+		p.Port = ports[0]
+		if len(p.ExtraPorts) > 0 {
+			p.ExtraPorts = ports[1:]
 		}
-		return fmt.Sprintf("%s: %s", path, ve.ErrorKind.LocalizedString(printer))
 	}
-	return err.Error()
+	return validateUniqueness(c.Proxies, locs)
 }
 
-func validateUniqueness(cfg *Config) error {
+// validateUniqueness checks that ports and instances are unique across
+// proxies, counting every port of multi-port entries. locs holds each
+// entry's config location, such as proxies.0, for error messages.
+func validateUniqueness(proxies []ProxyEntry, locs []string) error {
 	ports := make(map[int]int)
+	sockets := make(map[string]int)
 	instances := make(map[string]int)
 
-	for i, p := range cfg.Proxies {
-		if prev, ok := ports[p.Port]; ok {
-			return fmt.Errorf("Invalid config: proxies.%d.port: duplicate port %d (same as proxies.%d)", i, p.Port, prev)
+	for i, p := range proxies {
+		if p.Socket != "" {
+			if prev, ok := sockets[p.Socket]; ok {
+				return &ConfigError{Path: locs[i] + ".socket", Kind: KindDuplicate, Message: fmt.Sprintf("duplicate socket %q (same as %s)", p.Socket, locs[prev])}
+			}
+			sockets[p.Socket] = i
+		} else if !p.AutoPort() {
+			for _, port := range p.Ports() {
+				if prev, ok := ports[port]; ok {
+					return &ConfigError{Path: locs[i] + ".port", Kind: KindDuplicate, Message: fmt.Sprintf("duplicate port %d (same as %s)", port, locs[prev])}
+				}
+				ports[port] = i
+			}
 		}
-		ports[p.Port] = i
 
 		if prev, ok := instances[p.Instance]; ok {
-			return fmt.Errorf("Invalid config: proxies.%d.instance: duplicate instance %q (same as proxies.%d)", i, p.Instance, prev)
+			return &ConfigError{Path: locs[i] + ".instance", Kind: KindDuplicate, Message: fmt.Sprintf("duplicate instance %q (same as %s)", p.Instance, locs[prev])}
 		}
 		instances[p.Instance] = i
 	}
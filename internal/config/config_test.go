@@ -1,8 +1,15 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidConfig(t *testing.T) {
@@ -68,17 +75,10 @@ func TestMissingRequiredField(t *testing.T) {
     secret: "pw"`,
 			want: "instance",
 		},
-		{
-			name: "missing port",
-			yaml: `proxies:
-  - instance: "proj:region:name"
-    secret: "pw"`,
-			want: "port",
-		},
 		{
 			name: "missing secret",
 			yaml: `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5432`,
 			want: "secret",
 		},
@@ -118,29 +118,65 @@ func TestInvalidInstanceFormat(t *testing.T) {
 	}
 }
 
+func TestInstanceShape(t *testing.T) {
+	parse := func(instance string) error {
+		_, err := Parse([]byte(fmt.Sprintf(`proxies:
+  - instance: %q
+    port: 5432
+    secret: "pw"`, instance)))
+		return err
+	}
+
+	for _, instance := range []string{
+		"org-123456:us-central1:org-clone",
+		"p1:europe-west2:db",
+		"my-project:northamerica-northeast1:db",
+		"abcdefghijklmnopqrstuvwxyz0123:asia-southeast1:db",
+	} {
+		if err := parse(instance); err != nil {
+			t.Errorf("%s: unexpected error: %v", instance, err)
+		}
+	}
+
+	for _, instance := range []string{
+		"1proj:us-central1:db",
+		"Proj:us-central1:db",
+		"proj-:us-central1:db",
+		"proj_x:us-central1:db",
+		"abcdefghijklmnopqrstuvwxyz01234:us-central1:db",
+		"proj:region:db",
+		"proj:uscentral1:db",
+		"proj:us-central:db",
+		"proj:US-central1:db",
+		"proj:us-central1:",
+	} {
+		err := parse(instance)
+		if err == nil {
+			t.Errorf("%s: expected error", instance)
+			continue
+		}
+		if !strings.Contains(err.Error(), "proxies.0.instance") || !strings.Contains(err.Error(), "project:region:name") {
+			t.Errorf("%s: expected error to point at proxies.0.instance, got: %v", instance, err)
+		}
+	}
+}
+
 func TestPortOutOfRange(t *testing.T) {
 	tests := []struct {
 		name string
 		yaml string
 	}{
-		{
-			name: "port 0",
-			yaml: `proxies:
-  - instance: "proj:region:name"
-    port: 0
-    secret: "pw"`,
-		},
 		{
 			name: "port 1023",
 			yaml: `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 1023
     secret: "pw"`,
 		},
 		{
 			name: "port 65536",
 			yaml: `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 65536
     secret: "pw"`,
 		},
@@ -160,7 +196,7 @@ func TestPortOutOfRange(t *testing.T) {
 
 func TestEmptySecret(t *testing.T) {
 	yaml := `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5432
     secret: ""`
 	_, err := Parse([]byte(yaml))
@@ -174,10 +210,10 @@ func TestEmptySecret(t *testing.T) {
 
 func TestDuplicatePorts(t *testing.T) {
 	yaml := `proxies:
-  - instance: "proj1:region:name1"
+  - instance: "proj1:us-central1:name1"
     port: 5432
     secret: "pw1"
-  - instance: "proj2:region:name2"
+  - instance: "proj2:us-central1:name2"
     port: 5432
     secret: "pw2"`
 	_, err := Parse([]byte(yaml))
@@ -189,12 +225,60 @@ func TestDuplicatePorts(t *testing.T) {
 	}
 }
 
+func TestConfigError(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		wantPath string
+		wantKind string
+		wantMsg  string
+	}{
+		{
+			name: "duplicate port",
+			yaml: `proxies:
+  - instance: "proj1:us-central1:name1"
+    port: 5432
+    secret: "pw1"
+  - instance: "proj2:us-central1:name2"
+    port: 5432
+    secret: "pw2"`,
+			wantPath: "proxies.1.port",
+			wantKind: KindDuplicate,
+			wantMsg:  "Invalid config: proxies.1.port: duplicate port 5432 (same as proxies.0)",
+		},
+		{
+			name: "missing field",
+			yaml: `proxies:
+  - instance: "proj1:us-central1:name1"
+    port: 5432`,
+			wantPath: "proxies.0",
+			wantKind: "required",
+			wantMsg:  "Invalid config: proxies.0: missing property 'secret'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			var ce *ConfigError
+			if !errors.As(err, &ce) {
+				t.Fatalf("expected a *ConfigError, got %T: %v", err, err)
+			}
+			if ce.Path != tt.wantPath || ce.Kind != tt.wantKind {
+				t.Errorf("Path, Kind = %q, %q; want %q, %q", ce.Path, ce.Kind, tt.wantPath, tt.wantKind)
+			}
+			if err.Error() != tt.wantMsg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.wantMsg)
+			}
+		})
+	}
+}
+
 func TestDuplicateInstances(t *testing.T) {
 	yaml := `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5432
     secret: "pw1"
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5433
     secret: "pw2"`
 	_, err := Parse([]byte(yaml))
@@ -208,7 +292,7 @@ func TestDuplicateInstances(t *testing.T) {
 
 func TestExtraUnknownField(t *testing.T) {
 	yaml := `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5432
     secret: "pw"
     extra: "bad"`
@@ -223,7 +307,7 @@ func TestExtraUnknownField(t *testing.T) {
 
 func TestExtraTopLevelField(t *testing.T) {
 	yaml := `proxies:
-  - instance: "proj:region:name"
+  - instance: "proj:us-central1:name"
     port: 5432
     secret: "pw"
 extra: "bad"`
@@ -247,3 +331,1811 @@ func TestProjectParsedFromInstance(t *testing.T) {
 		t.Errorf("expected project 'org-123456', got %q", project)
 	}
 }
+
+func TestTags(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    tags:
+      team: payments
+      tier: prod`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := cfg.Proxies[0]
+	if p.Tags["team"] != "payments" || p.Tags["tier"] != "prod" {
+		t.Errorf("unexpected tags: %v", p.Tags)
+	}
+	if !p.HasTags(map[string]string{"team": "payments"}) {
+		t.Error("expected HasTags to match team=payments")
+	}
+	if p.HasTags(map[string]string{"team": "search"}) {
+		t.Error("expected HasTags not to match team=search")
+	}
+}
+
+func TestNonStringTagValue(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    tags:
+      tier: 3`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for non-string tag value")
+	}
+	if !strings.Contains(err.Error(), "tags") {
+		t.Errorf("expected error to mention tags, got: %v", err)
+	}
+}
+
+func TestIPType(t *testing.T) {
+	for _, ipType := range []string{"public", "private", "psc"} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ip_type: ` + ipType
+		cfg, err := Parse([]byte(yaml))
+		if err != nil {
+			t.Fatalf("ip_type %s: unexpected error: %v", ipType, err)
+		}
+		if cfg.Proxies[0].IPType != ipType {
+			t.Errorf("expected ip_type %q, got %q", ipType, cfg.Proxies[0].IPType)
+		}
+	}
+
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ip_type: vpn`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for unknown ip_type")
+	}
+	if !strings.Contains(err.Error(), "ip_type") {
+		t.Errorf("expected error to mention ip_type, got: %v", err)
+	}
+}
+
+func TestBOMAndCRLF(t *testing.T) {
+	yaml := "\xef\xbb\xbfproxies:\r\n" +
+		"  - instance: \"proj:us-central1:name\"\r\n" +
+		"    port: 5432\r\n" +
+		"    secret: \"pw\"\r\n"
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Proxies[0].Instance != "proj:us-central1:name" {
+		t.Errorf("unexpected instance: %q", cfg.Proxies[0].Instance)
+	}
+	if cfg.Proxies[0].Secret != "pw" {
+		t.Errorf("unexpected secret: %q", cfg.Proxies[0].Secret)
+	}
+}
+
+const environmentsYAML = `environments:
+  staging:
+    proxies:
+      - instance: "org-staging:us-central1:db"
+        port: 5432
+        secret: "pw"
+  prod:
+    proxies:
+      - instance: "org-prod:us-central1:db"
+        port: 5432
+        secret: "pw"
+      - instance: "org-prod:us-central1:replica"
+        port: 5433
+        secret: "pw"
+`
+
+func TestEnvironmentSelected(t *testing.T) {
+	cfg, err := ParseEnv([]byte(environmentsYAML), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Environment != "prod" {
+		t.Errorf("expected environment 'prod', got %q", cfg.Environment)
+	}
+	if len(cfg.Proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(cfg.Proxies))
+	}
+	if cfg.Proxies[0].Instance != "org-prod:us-central1:db" {
+		t.Errorf("unexpected instance: %s", cfg.Proxies[0].Instance)
+	}
+}
+
+func TestEnvironmentNotSelected(t *testing.T) {
+	_, err := Parse([]byte(environmentsYAML))
+	if err == nil {
+		t.Fatal("expected error when no environment is selected")
+	}
+	if !strings.Contains(err.Error(), "prod, staging") {
+		t.Errorf("expected error to list environments, got: %v", err)
+	}
+}
+
+func TestUnknownEnvironment(t *testing.T) {
+	_, err := ParseEnv([]byte(environmentsYAML), "dev")
+	if err == nil {
+		t.Fatal("expected error for unknown environment")
+	}
+	if !strings.Contains(err.Error(), `unknown environment "dev"`) {
+		t.Errorf("expected unknown environment error, got: %v", err)
+	}
+}
+
+func TestDefaultEnvironment(t *testing.T) {
+	yaml := "default_environment: staging\n" + environmentsYAML
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Environment != "staging" {
+		t.Errorf("expected default environment 'staging', got %q", cfg.Environment)
+	}
+
+	cfg, err = ParseEnv([]byte(yaml), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Environment != "prod" {
+		t.Errorf("--env should override default_environment, got %q", cfg.Environment)
+	}
+}
+
+func TestUnknownDefaultEnvironment(t *testing.T) {
+	yaml := "default_environment: dev\n" + environmentsYAML
+	_, err := ParseEnv([]byte(yaml), "prod")
+	if err == nil {
+		t.Fatal("expected error for unknown default_environment")
+	}
+	if !strings.Contains(err.Error(), `default_environment: unknown environment "dev"`) {
+		t.Errorf("expected unknown default_environment error, got: %v", err)
+	}
+
+	yaml = `default_environment: prod
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	if _, err := Parse([]byte(yaml)); err == nil {
+		t.Fatal("expected error for default_environment without environments")
+	}
+}
+
+func TestProfileAliases(t *testing.T) {
+	yaml := "default_profile: staging\n" + strings.Replace(environmentsYAML, "environments:", "profiles:", 1)
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Environment != "staging" || len(cfg.Environments) != 2 {
+		t.Errorf("expected profiles to work as environments, got environment %q of %d", cfg.Environment, len(cfg.Environments))
+	}
+
+	// The JSON format goes through the same renaming.
+	data := `{"profiles": {"dev": {"proxies": [{"instance": "proj:us-central1:name", "port": 5432, "secret": "pw"}]}}, "default_profile": "dev"}`
+	cfg, err = ParseFormat([]byte(data), FormatJSON, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Environment != "dev" {
+		t.Errorf("expected default profile 'dev', got %q", cfg.Environment)
+	}
+}
+
+func TestProfileAliasConflict(t *testing.T) {
+	yaml := "default_profile: staging\ndefault_environment: prod\n" + environmentsYAML
+	_, err := Parse([]byte(yaml))
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || cerr.Path != "default_profile" || cerr.Kind != KindConflict {
+		t.Fatalf("expected a conflict on default_profile, got: %v", err)
+	}
+}
+
+func TestEnvironmentWithFlatConfig(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	if _, err := ParseEnv([]byte(yaml), "prod"); err == nil {
+		t.Fatal("expected error selecting an environment from a flat config")
+	}
+}
+
+func TestEnvironmentUniquenessIsPerEnvironment(t *testing.T) {
+	// Both environments use port 5432, which is fine. A duplicate within
+	// one environment is not.
+	yaml := environmentsYAML + `  dev:
+    proxies:
+      - instance: "org-dev:us-central1:a"
+        port: 6000
+        secret: "pw"
+      - instance: "org-dev:us-central1:b"
+        port: 6000
+        secret: "pw"
+`
+	if _, err := ParseEnv([]byte(yaml), "staging"); err != nil {
+		t.Fatalf("unexpected error for staging: %v", err)
+	}
+	_, err := ParseEnv([]byte(yaml), "dev")
+	if err == nil {
+		t.Fatal("expected duplicate port error in dev")
+	}
+	if !strings.Contains(err.Error(), "environments.dev.proxies.1.port: duplicate port 6000") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHost(t *testing.T) {
+	for _, host := range []string{"localhost", "0.0.0.0", "127.0.0.1", "::1", "proxy.internal"} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    host: "` + host + `"
+    port: 5432
+    secret: "pw"`
+		cfg, err := Parse([]byte(yaml))
+		if err != nil {
+			t.Fatalf("host %s: unexpected error: %v", host, err)
+		}
+		if cfg.Proxies[0].Host != host {
+			t.Errorf("expected host %q, got %q", host, cfg.Proxies[0].Host)
+		}
+	}
+
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    host: "not a host!"
+    port: 5432
+    secret: "pw"`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for invalid host")
+	}
+	if !strings.Contains(err.Error(), "host") {
+		t.Errorf("expected error to mention host, got: %v", err)
+	}
+}
+
+func TestProxyAddresses(t *testing.T) {
+	tests := []struct {
+		host     string
+		addr     string
+		dialAddr string
+	}{
+		{host: "", addr: "localhost:5432", dialAddr: "localhost:5432"},
+		{host: "127.0.0.1", addr: "127.0.0.1:5432", dialAddr: "127.0.0.1:5432"},
+		{host: "0.0.0.0", addr: "0.0.0.0:5432", dialAddr: "localhost:5432"},
+		{host: "::", addr: "[::]:5432", dialAddr: "localhost:5432"},
+		{host: "::1", addr: "[::1]:5432", dialAddr: "[::1]:5432"},
+	}
+	for _, tt := range tests {
+		p := ProxyEntry{Instance: "proj:us-central1:name", Host: tt.host, Port: 5432}
+		if got := p.Addr(); got != tt.addr {
+			t.Errorf("host %q: Addr() = %q, want %q", tt.host, got, tt.addr)
+		}
+		if got := p.DialAddr(); got != tt.dialAddr {
+			t.Errorf("host %q: DialAddr() = %q, want %q", tt.host, got, tt.dialAddr)
+		}
+	}
+}
+
+func TestSocket(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    socket: "/cloudsql/proj:us-central1:name"
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := cfg.Proxies[0]
+	if p.Socket != "/cloudsql/proj:us-central1:name" {
+		t.Errorf("unexpected socket: %q", p.Socket)
+	}
+	if p.Network() != "unix" || p.Addr() != p.Socket || p.DialAddr() != p.Socket {
+		t.Errorf("expected unix addresses for socket entry, got %s %s %s", p.Network(), p.Addr(), p.DialAddr())
+	}
+}
+
+func TestSocketExclusiveWithPortAndHost(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "socket and port",
+			yaml: `proxies:
+  - instance: "proj:us-central1:name"
+    socket: "/tmp/db.sock"
+    port: 5432
+    secret: "pw"`,
+			want: "proxies.0.port",
+		},
+		{
+			name: "socket and host",
+			yaml: `proxies:
+  - instance: "proj:us-central1:name"
+    socket: "/tmp/db.sock"
+    host: "0.0.0.0"
+    secret: "pw"`,
+			want: "proxies.0.host",
+		},
+		{
+			name: "relative socket path",
+			yaml: `proxies:
+  - instance: "proj:us-central1:name"
+    socket: "db.sock"
+    secret: "pw"`,
+			want: "proxies.0.socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error to mention %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestDuplicateSockets(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:a"
+    socket: "/tmp/db.sock"
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    socket: "/tmp/db.sock"
+    secret: "pw"`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "duplicate socket") {
+		t.Errorf("expected 'duplicate socket' in error, got: %v", err)
+	}
+}
+
+func TestSecretVersion(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "latest"},
+		{value: `secret_version: latest`, want: "latest"},
+		{value: `secret_version: "7"`, want: "7"},
+		{value: `secret_version: 12`, want: "12"},
+		{value: `secret_version: production`, want: "production"},
+		{value: `secret_version: "v2"`, want: "v2"},
+		{value: `secret_version: blue_green-1`, want: "blue_green-1"},
+	}
+	for _, tt := range tests {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ` + tt.value
+		cfg, err := Parse([]byte(yaml))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.value, err)
+		}
+		if got := cfg.Proxies[0].SecretVersionOrLatest(); got != tt.want {
+			t.Errorf("%q: expected version %q, got %q", tt.value, tt.want, got)
+		}
+	}
+
+	for _, value := range []string{`"0"`, `0`, `"01"`, `""`, `"prod/db"`, `"-prod"`, `"prod db"`, `"1a"`, `"` + strings.Repeat("a", 64) + `"`} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    secret_version: ` + value
+		_, err := Parse([]byte(yaml))
+		if err == nil {
+			t.Fatalf("secret_version %s: expected error", value)
+		}
+		if !strings.Contains(err.Error(), "secret_version") {
+			t.Errorf("secret_version %s: expected error to mention secret_version, got: %v", value, err)
+		}
+	}
+}
+
+func TestSecretSource(t *testing.T) {
+	tests := []struct {
+		value      string
+		want       string
+		usesSecMgr bool
+	}{
+		{value: "", want: SecretSourceManager, usesSecMgr: true},
+		{value: `secret_source: secret_manager`, want: SecretSourceManager, usesSecMgr: true},
+		{value: `secret_source: file`, want: SecretSourceFile},
+		{value: `secret_source: env`, want: SecretSourceEnv},
+	}
+	for _, tt := range tests {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ` + tt.value
+		cfg, err := Parse([]byte(yaml))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.value, err)
+		}
+		p := cfg.Proxies[0]
+		if got := p.SecretSourceOrDefault(); got != tt.want {
+			t.Errorf("%q: expected source %q, got %q", tt.value, tt.want, got)
+		}
+		if got := p.UsesSecretManager(); got != tt.usesSecMgr {
+			t.Errorf("%q: UsesSecretManager() = %v, want %v", tt.value, got, tt.usesSecMgr)
+		}
+	}
+
+	iam := ProxyEntry{Instance: "proj:us-central1:name", Port: 5432, Auth: AuthIAM}
+	if iam.UsesSecretManager() {
+		t.Error("IAM proxies should not use Secret Manager")
+	}
+}
+
+func TestSecretSourceInvalid(t *testing.T) {
+	for _, extra := range []string{
+		"secret_source: vault",
+		"secret_source: file\n    secret_version: 2",
+		"secret_source: env\n    secret_version: latest",
+	} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ` + extra
+		_, err := Parse([]byte(yaml))
+		if err == nil {
+			t.Errorf("%q: expected error", extra)
+			continue
+		}
+		if !strings.Contains(err.Error(), "secret_") {
+			t.Errorf("%q: expected error to name the field, got: %v", extra, err)
+		}
+	}
+}
+
+func TestSecretFile(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret_file: /var/run/secrets/db/password`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := cfg.Proxies[0]
+	if p.Secret != "/var/run/secrets/db/password" || p.SecretSourceOrDefault() != SecretSourceFile || p.SecretFile != "" {
+		t.Errorf("expected secret_file to become a file secret, got %+v", p)
+	}
+	if p.UsesSecretManager() {
+		t.Error("a secret_file proxy should not use Secret Manager")
+	}
+}
+
+func TestSecretFileExclusive(t *testing.T) {
+	for _, extra := range []string{
+		"secret: pw",
+		"secret_source: file",
+		"secret_version: 2",
+	} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret_file: /run/password
+    ` + extra
+		_, err := Parse([]byte(yaml))
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) || cerr.Kind != KindNotAllowed {
+			t.Errorf("%q: expected it to be refused alongside secret_file, got: %v", extra, err)
+			continue
+		}
+		field, _, _ := strings.Cut(extra, ":")
+		if cerr.Path != "proxies.0."+field {
+			t.Errorf("%q: expected the error on proxies.0.%s, got %s", extra, field, cerr.Path)
+		}
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"
+    dial_attempts: 5
+    dial_retry_delay: 1.5s
+    dial_timeout: 10s`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, b := cfg.Proxies[0], cfg.Proxies[1]
+	if a.DialAttemptsOrDefault() != DefaultDialAttempts || a.DialRetryDelayOrDefault() != DefaultDialRetryDelay {
+		t.Errorf("expected defaults, got %d %s", a.DialAttemptsOrDefault(), a.DialRetryDelayOrDefault())
+	}
+	if b.DialAttemptsOrDefault() != 5 || b.DialRetryDelayOrDefault() != 1500*time.Millisecond {
+		t.Errorf("expected 5 attempts and 1.5s, got %d %s", b.DialAttemptsOrDefault(), b.DialRetryDelayOrDefault())
+	}
+	if a.DialTimeoutOrDefault() != DefaultDialTimeout || b.DialTimeoutOrDefault() != 10*time.Second {
+		t.Errorf("expected dial timeouts of 30s and 10s, got %s %s", a.DialTimeoutOrDefault(), b.DialTimeoutOrDefault())
+	}
+
+	for _, field := range []string{"dial_attempts: 0", "dial_retry_delay: fast", "dial_retry_delay: 5", "dial_timeout: never"} {
+		yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    ` + field
+		_, err := Parse([]byte(yaml))
+		if err == nil {
+			t.Fatalf("%s: expected error", field)
+		}
+		name, _, _ := strings.Cut(field, ":")
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected error to mention %s, got: %v", field, name, err)
+		}
+	}
+}
+
+func TestEnvExpansion(t *testing.T) {
+	t.Setenv("CSPR_TEST_PROJECT", "my-proj")
+	t.Setenv("CSPR_TEST_SECRET", "db-password")
+
+	yaml := `proxies:
+  - instance: "${CSPR_TEST_PROJECT}:us-central1:db"
+    port: 5432
+    secret: $CSPR_TEST_SECRET
+    tags:
+      cost: "$$5"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := cfg.Proxies[0]
+	if p.Instance != "my-proj:us-central1:db" {
+		t.Errorf("unexpected instance %q", p.Instance)
+	}
+	if p.Secret != "db-password" {
+		t.Errorf("unexpected secret %q", p.Secret)
+	}
+	if p.Tags["cost"] != "$5" {
+		t.Errorf("expected $$ to produce a literal $, got %q", p.Tags["cost"])
+	}
+}
+
+func TestEnvExpansionUnset(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "${CSPR_TEST_UNSET_VARIABLE}"`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+	if !strings.Contains(err.Error(), "CSPR_TEST_UNSET_VARIABLE") || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("expected error to name the variable and line, got: %v", err)
+	}
+}
+
+func TestEnvExpansionValidated(t *testing.T) {
+	t.Setenv("CSPR_TEST_INSTANCE", "not-a-connection-name")
+
+	yaml := `proxies:
+  - instance: "${CSPR_TEST_INSTANCE}"
+    port: 5432
+    secret: "pw"`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected schema error for expanded value")
+	}
+	if !strings.Contains(err.Error(), "instance") {
+		t.Errorf("expected error to mention instance, got: %v", err)
+	}
+}
+
+func TestEnvExpansionIgnoresComments(t *testing.T) {
+	yaml := `# costs $5 a month
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432 # not $PORT
+    secret: "pw"`
+	if _, err := Parse([]byte(yaml)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"
+    idle_timeout: 1h30m`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Proxies[0].IdleTimeoutDuration(); got != 0 {
+		t.Errorf("expected no idle timeout by default, got %s", got)
+	}
+	if got := cfg.Proxies[1].IdleTimeoutDuration(); got != 90*time.Minute {
+		t.Errorf("expected 1h30m, got %s", got)
+	}
+
+	yaml = `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    idle_timeout: forever`
+	_, err = Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for invalid idle_timeout")
+	}
+	if !strings.Contains(err.Error(), "idle_timeout") {
+		t.Errorf("expected error to mention idle_timeout, got: %v", err)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"
+    max_conn_lifetime: 1h`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Proxies[0].MaxLifetimeDuration(); got != 0 {
+		t.Errorf("expected no max lifetime by default, got %s", got)
+	}
+	if got := cfg.Proxies[1].MaxLifetimeDuration(); got != time.Hour {
+		t.Errorf("expected 1h, got %s", got)
+	}
+
+	_, err = Parse([]byte(`proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+    max_conn_lifetime: 3600`))
+	if err == nil || !strings.Contains(err.Error(), "max_conn_lifetime") {
+		t.Errorf("expected an error mentioning max_conn_lifetime, got %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    max_connections: 20`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Proxies[0].MaxConnections != 20 {
+		t.Errorf("expected max_connections 20, got %d", cfg.Proxies[0].MaxConnections)
+	}
+
+	yaml = `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    max_connections: 0`
+	_, err = Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for max_connections 0")
+	}
+	if !strings.Contains(err.Error(), "max_connections") {
+		t.Errorf("expected error to mention max_connections, got: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"
+    rate_limit: 1048576`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Proxies[0].RateLimit != 1048576 {
+		t.Errorf("expected rate_limit 1048576, got %d", cfg.Proxies[0].RateLimit)
+	}
+
+	yaml = `proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"
+    rate_limit: 0`
+	_, err = Parse([]byte(yaml))
+	if err == nil || !strings.Contains(err.Error(), "rate_limit") {
+		t.Errorf("expected an error mentioning rate_limit, got %v", err)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	cfg, err := Parse([]byte(`buffer_size: 65536
+proxies:
+  - instance: "proj:us-central1:db1"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:db2"
+    port: 5433
+    secret: "pw"
+    buffer_size: 4096`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Proxies[0].BufferSizeOrDefault(); got != 65536 {
+		t.Errorf("expected the top-level buffer_size 65536 to apply, got %d", got)
+	}
+	if got := cfg.Proxies[1].BufferSizeOrDefault(); got != 4096 {
+		t.Errorf("expected the proxy's own buffer_size 4096, got %d", got)
+	}
+
+	if got := (ProxyEntry{}).BufferSizeOrDefault(); got != DefaultBufferSize {
+		t.Errorf("expected default %d, got %d", DefaultBufferSize, got)
+	}
+
+	for _, size := range []string{"0", "512", "33554432", `"64k"`} {
+		_, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"
+    buffer_size: ` + size))
+		if err == nil || !strings.Contains(err.Error(), "buffer_size") {
+			t.Errorf("buffer_size %s: expected an error mentioning buffer_size, got %v", size, err)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	cfg, err := Parse([]byte(`on_start: ["notify", "--up"]
+on_stop: ["notify", "--down"]
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.OnStart, []string{"notify", "--up"}) || !reflect.DeepEqual(cfg.OnStop, []string{"notify", "--down"}) {
+		t.Errorf("on_start = %q, on_stop = %q", cfg.OnStart, cfg.OnStop)
+	}
+
+	for _, hook := range []string{`[]`, `[""]`, `"notify --up"`, `[1]`} {
+		_, err := Parse([]byte(`on_start: ` + hook + `
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"`))
+		if err == nil || !strings.Contains(err.Error(), "on_start") {
+			t.Errorf("on_start %s: expected an error mentioning on_start, got %v", hook, err)
+		}
+	}
+}
+
+func TestMetricsPort(t *testing.T) {
+	yaml := `metrics_port: 9090
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MetricsPort != 9090 {
+		t.Errorf("expected metrics_port 9090, got %d", cfg.MetricsPort)
+	}
+
+	yaml = `metrics_port: 80
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	_, err = Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for privileged metrics_port")
+	}
+	if !strings.Contains(err.Error(), "metrics_port") {
+		t.Errorf("expected error to mention metrics_port, got: %v", err)
+	}
+}
+
+func TestHealthPort(t *testing.T) {
+	yaml := `health_port: 8080
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.HealthPort != 8080 {
+		t.Errorf("expected health_port 8080, got %d", cfg.HealthPort)
+	}
+
+	yaml = `health_port: 9090
+metrics_port: 9090
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`
+	_, err = Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for health_port equal to metrics_port")
+	}
+	if !strings.Contains(err.Error(), "health_port") {
+		t.Errorf("expected error to mention health_port, got: %v", err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	yaml := `log_level: warn
+proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+    log_level: debug
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.LogLevelOrDefault(); got != slog.LevelWarn {
+		t.Errorf("LogLevelOrDefault() = %v, want WARN", got)
+	}
+	if got := cfg.Proxies[0].LogLevelOr(slog.LevelWarn); got != slog.LevelDebug {
+		t.Errorf("proxy log level = %v, want DEBUG", got)
+	}
+	if got := cfg.Proxies[1].LogLevelOr(slog.LevelWarn); got != slog.LevelWarn {
+		t.Errorf("proxy without log_level = %v, want the default WARN", got)
+	}
+	if got := (&Config{}).LogLevelOrDefault(); got != slog.LevelInfo {
+		t.Errorf("default log level = %v, want INFO", got)
+	}
+
+	yaml = `log_level: verbose
+proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"`
+	_, err = Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for unknown log_level")
+	}
+	if !strings.Contains(err.Error(), "log_level") {
+		t.Errorf("expected error to mention log_level, got: %v", err)
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	cfg, err := Parse([]byte(`log_format: json
+proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.LogFormatOrDefault(); got != LogFormatJSON {
+		t.Errorf("LogFormatOrDefault() = %q, want json", got)
+	}
+	if got := (&Config{}).LogFormatOrDefault(); got != LogFormatText {
+		t.Errorf("default log format = %q, want text", got)
+	}
+
+	_, err = Parse([]byte(`log_format: xml
+proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"`))
+	if err == nil || !strings.Contains(err.Error(), "log_format") {
+		t.Errorf("expected an error mentioning log_format, got: %v", err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+    access_log: true
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Proxies[0].AccessLog || cfg.Proxies[1].AccessLog {
+		t.Errorf("access_log = %v, %v; want true, false", cfg.Proxies[0].AccessLog, cfg.Proxies[1].AccessLog)
+	}
+
+	cfg, err = Parse([]byte(`access_log: true
+proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range cfg.Proxies {
+		if !p.AccessLog {
+			t.Errorf("expected the top-level access_log to apply to %s", p.Instance)
+		}
+	}
+
+	_, err = Parse([]byte(`proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+    access_log: "yes"`))
+	if err == nil || !strings.Contains(err.Error(), "access_log") {
+		t.Errorf("expected error mentioning access_log, got: %v", err)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	tests := []struct {
+		entry ProxyEntry
+		want  string
+	}{
+		{ProxyEntry{Port: 5432}, EnginePostgres},
+		{ProxyEntry{Port: 3306}, EnginePostgres},
+		{ProxyEntry{Port: 3307, Engine: EngineMySQL}, EngineMySQL},
+		{ProxyEntry{Port: 3306, Engine: EnginePostgres}, EnginePostgres},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.EngineOrDefault(); got != tt.want {
+			t.Errorf("EngineOrDefault() for %+v = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    engine: oracle`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for unknown engine")
+	}
+	if !strings.Contains(err.Error(), "engine") {
+		t.Errorf("expected error to mention engine, got: %v", err)
+	}
+}
+
+func TestIAMAuth(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    auth: iam
+    user: "app@proj.iam"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("IAM proxy without secret should be valid: %v", err)
+	}
+	if !cfg.Proxies[0].IAMAuth() {
+		t.Error("expected IAMAuth() to be true")
+	}
+
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "password auth without secret",
+			yaml: `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    auth: password`,
+			want: "secret",
+		},
+		{
+			name: "unknown auth",
+			yaml: `proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"
+    auth: kerberos`,
+			want: "auth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error to mention %q, got: %v", tt.want, err)
+			}
+		})
+	}
+
+	if (ProxyEntry{Secret: "pw"}).IAMAuth() {
+		t.Error("expected password auth by default")
+	}
+}
+
+func TestJSONMatchesYAML(t *testing.T) {
+	yamlData := `metrics_port: 9090
+proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "pw-a"
+    secret_version: 3
+    ip_type: private
+    tags:
+      team: payments
+  - instance: "proj:us-central1:db-b"
+    socket: "/cloudsql/db-b/.s.PGSQL.5432"
+    secret: "pw-b"
+    idle_timeout: 10m`
+	jsonData := `{
+	"metrics_port": 9090,
+	"proxies": [
+		{
+			"instance": "proj:us-central1:db-a",
+			"port": 5432,
+			"secret": "pw-a",
+			"secret_version": 3,
+			"ip_type": "private",
+			"tags": {"team": "payments"}
+		},
+		{
+			"instance": "proj:us-central1:db-b",
+			"socket": "/cloudsql/db-b/.s.PGSQL.5432",
+			"secret": "pw-b",
+			"idle_timeout": "10m"
+		}
+	]
+}`
+	fromYAML, err := ParseFormat([]byte(yamlData), FormatYAML, "")
+	if err != nil {
+		t.Fatalf("YAML: unexpected error: %v", err)
+	}
+	fromJSON, err := ParseFormat([]byte(jsonData), FormatJSON, "")
+	if err != nil {
+		t.Fatalf("JSON: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("JSON config differs from YAML:\n%+v\n%+v", fromJSON, fromYAML)
+	}
+}
+
+func TestJSONValidated(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"schema", `{"proxies": [{"instance": "proj:us-central1:db", "port": "5432", "secret": "pw"}]}`, "port"},
+		{"uniqueness", `{"proxies": [
+			{"instance": "proj:us-central1:a", "port": 5432, "secret": "pw"},
+			{"instance": "proj:us-central1:b", "port": 5432, "secret": "pw"}]}`, "5432"},
+		{"fractional port", `{"proxies": [{"instance": "proj:us-central1:db", "port": 5432.5, "secret": "pw"}]}`, "port"},
+		{"syntax", `{"proxies": [}`, "parsing JSON"},
+		{"trailing data", `{"proxies": []} {}`, "parsing JSON"},
+		{"unset variable", `{"proxies": [{"instance": "proj:us-central1:db", "port": 5432, "secret": "${CSPR_TEST_UNSET_VARIABLE}"}]}`, "CSPR_TEST_UNSET_VARIABLE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFormat([]byte(tt.json), FormatJSON, "")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error to mention %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadPicksFormatByExtension(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "config.JSON")
+	os.WriteFile(jsonPath, []byte(`{"proxies": [{"instance": "proj:us-central1:db", "port": 5432, "secret": "pw"}]}`), 0644)
+	cfg, err := Load(jsonPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Proxies[0].Port != 5432 {
+		t.Errorf("expected port 5432, got %d", cfg.Proxies[0].Port)
+	}
+
+	if FormatForPath("config.yml") != FormatYAML || FormatForPath("config") != FormatYAML || FormatForPath("c.json") != FormatJSON {
+		t.Error("unexpected format for path")
+	}
+}
+
+func TestLoadFromStdin(t *testing.T) {
+	orig := Stdin
+	defer func() { Stdin = orig }()
+
+	for _, input := range []string{
+		"proxies:\n  - instance: \"proj:us-central1:name\"\n    port: 5432\n    secret: \"pw\"\n",
+		`{"proxies": [{"instance": "proj:us-central1:name", "port": 5432, "secret": "pw"}]}`,
+	} {
+		Stdin = strings.NewReader(input)
+		cfg, err := LoadEnv(StdinPath, "")
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if cfg.Proxies[0].Port != 5432 {
+			t.Errorf("expected port 5432, got %d", cfg.Proxies[0].Port)
+		}
+	}
+
+	if FormatForData([]byte("\ufeff  {}")) != FormatJSON || FormatForData([]byte("proxies: []")) != FormatYAML {
+		t.Error("unexpected format for data")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.ShutdownTimeoutOrDefault(); got != DefaultShutdownTimeout {
+		t.Errorf("expected default %s, got %s", DefaultShutdownTimeout, got)
+	}
+
+	cfg, err = Parse([]byte(`shutdown_timeout: 1m
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.ShutdownTimeoutOrDefault(); got != time.Minute {
+		t.Errorf("expected 1m, got %s", got)
+	}
+}
+
+func TestSecretAttempts(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SecretAttemptsOrDefault(); got != DefaultSecretAttempts {
+		t.Errorf("expected default %d, got %d", DefaultSecretAttempts, got)
+	}
+
+	cfg, err = Parse([]byte(`secret_attempts: 5
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SecretAttemptsOrDefault(); got != 5 {
+		t.Errorf("expected 5, got %d", got)
+	}
+
+	if _, err := Parse([]byte(`secret_attempts: 0
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`)); err == nil {
+		t.Error("expected error for secret_attempts: 0")
+	}
+}
+
+func TestSecretConcurrency(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SecretConcurrencyOrDefault(); got != DefaultSecretConcurrency {
+		t.Errorf("expected default %d, got %d", DefaultSecretConcurrency, got)
+	}
+
+	cfg, err = Parse([]byte(`secret_concurrency: 2
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SecretConcurrencyOrDefault(); got != 2 {
+		t.Errorf("expected 2, got %d", got)
+	}
+
+	if _, err := Parse([]byte(`secret_concurrency: 0
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`)); err == nil {
+		t.Error("expected error for secret_concurrency: 0")
+	}
+}
+
+func TestImpersonateServiceAccount(t *testing.T) {
+	cfg, err := Parse([]byte(`impersonate_service_account: proxy@proj.iam.gserviceaccount.com
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ImpersonateServiceAccount != "proxy@proj.iam.gserviceaccount.com" {
+		t.Errorf("unexpected account %q", cfg.ImpersonateServiceAccount)
+	}
+
+	_, err = Parse([]byte(`impersonate_service_account: someone@example.com
+proxies:
+  - instance: "proj:us-central1:name"
+    port: 5432
+    secret: "pw"`))
+	if err == nil || !strings.Contains(err.Error(), "impersonate_service_account") {
+		t.Errorf("expected error for a non-service-account email, got: %v", err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.WriteFile(filepath.Join(dir, "conf.d", "a.yaml"), []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5433
+    secret: "pw"`), 0644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "b.json"), []byte(`{"proxies": [{"instance": "proj:us-central1:db-b", "port": 5434, "secret": "pw"}]}`), 0644)
+	main := filepath.Join(dir, "config.yaml")
+	os.WriteFile(main, []byte(`include: ["conf.d/*"]
+access_log: true
+proxies:
+  - instance: "proj:us-central1:main"
+    port: 5432
+    secret: "pw"`), 0644)
+
+	cfg, err := Load(main)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range cfg.Proxies {
+		got = append(got, p.Instance)
+		if !p.AccessLog {
+			t.Errorf("expected the top-level access_log to apply to %s", p.Instance)
+		}
+	}
+	if want := []string{"proj:us-central1:main", "proj:us-central1:db-a", "proj:us-central1:db-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected proxies %v, got %v", want, got)
+	}
+
+	// A config can consist of includes alone.
+	os.WriteFile(main, []byte(`include: ["conf.d/*.yaml"]`), 0644)
+	if cfg, err = Load(main); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Proxies) != 1 || cfg.Proxies[0].Port != 5433 {
+		t.Errorf("unexpected proxies %+v", cfg.Proxies)
+	}
+}
+
+func TestIncludeDuplicatePortAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.yaml")
+	b := filepath.Join(dir, "b.yaml")
+	os.WriteFile(a, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5433
+    secret: "pw"`), 0644)
+	os.WriteFile(b, []byte(`proxies:
+  - instance: "proj:us-central1:db-b"
+    port: 5434
+    secret: "pw"
+  - instance: "proj:us-central1:db-c"
+    port: 5433
+    secret: "pw"`), 0644)
+	main := filepath.Join(dir, "config.yaml")
+	os.WriteFile(main, []byte(`include: ["a.yaml", "b.yaml"]`), 0644)
+
+	_, err := Load(main)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	want := b + ": proxies.1.port: duplicate port 5433 (same as " + a + ": proxies.0)"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error to contain %q, got: %v", want, err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "20-b.json"), []byte(`{"proxies": [{"instance": "proj:us-central1:db-b", "port": 5434, "secret": "pw"}]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "10-a.yaml"), []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5433
+    secret: "pw"`), 0644)
+	os.WriteFile(filepath.Join(dir, "30-c.yml"), []byte(`proxies:
+  - instance: "proj:us-central1:db-c"
+    port: 5435
+    secret: "pw"`), 0644)
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("not a config"), 0644)
+
+	cfg, err := LoadDir(dir, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range cfg.Proxies {
+		got = append(got, p.Instance)
+	}
+	want := []string{"proj:us-central1:db-a", "proj:us-central1:db-b", "proj:us-central1:db-c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("proxies = %v, want %v in file name order", got, want)
+	}
+
+	if _, err := LoadDir(dir, "dev"); err == nil {
+		t.Error("expected an error selecting an environment")
+	}
+}
+
+func TestLoadDir_DuplicateAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.yaml")
+	b := filepath.Join(dir, "b.json")
+	os.WriteFile(a, []byte(`proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5433
+    secret: "pw"`), 0644)
+	os.WriteFile(b, []byte(`{"proxies": [{"instance": "proj:us-central1:db-a", "port": 5434, "secret": "pw"}]}`), 0644)
+
+	_, err := LoadDir(dir, "")
+	want := b + `: proxies.0.instance: duplicate instance "proj:us-central1:db-a" (same as ` + a + ": proxies.0)"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error to contain %q, got: %v", want, err)
+	}
+}
+
+func TestLoadDir_Errors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadDir(dir, ""); err == nil || !strings.Contains(err.Error(), "no proxies found") {
+		t.Errorf("expected an error for an empty directory, got: %v", err)
+	}
+
+	file := filepath.Join(dir, "config.yaml")
+	os.WriteFile(file, []byte(`metrics_port: 9090
+proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5433
+    secret: "pw"`), 0644)
+	if _, err := LoadDir(dir, ""); err == nil || !strings.Contains(err.Error(), "only proxies and include") {
+		t.Errorf("expected an error for a top-level setting, got: %v", err)
+	}
+	if _, err := LoadDir(file, ""); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expected an error for a file, got: %v", err)
+	}
+}
+
+func TestNoProxiesAfterMerge(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0644)
+		return path
+	}
+	// Each file is valid on its own, but the nested include matches nothing.
+	write("empty.yaml", `include: ["none/*.yaml"]`)
+	main := write("main.yaml", `include: ["empty.yaml"]`)
+
+	_, err := LoadEnv(main, "")
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a *ConfigError, got %T: %v", err, err)
+	}
+	if ce.Kind != KindEmpty || ce.Path != "include" {
+		t.Errorf("got path %q, kind %q; want include, %s", ce.Path, ce.Kind, KindEmpty)
+	}
+	if !strings.Contains(ce.Message, "included files") {
+		t.Errorf("expected the message to blame the included files, got %q", ce.Message)
+	}
+
+	// An environment selected with an empty list is rejected by the schema
+	// at the list itself, rather than as an empty merge.
+	_, err = ParseEnv([]byte(`environments:
+  dev:
+    proxies: []
+`), "dev")
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a *ConfigError, got %T: %v", err, err)
+	}
+	if ce.Kind == KindEmpty || !strings.Contains(ce.Path, "environments.dev.proxies") {
+		t.Errorf("expected a schema error at environments.dev.proxies, got path %q, kind %q", ce.Path, ce.Kind)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0644)
+		return path
+	}
+	proxy := `
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5433
+    secret: "pw"`
+
+	tests := []struct {
+		name string
+		main string
+		env  string
+		want string
+	}{
+		{
+			name: "cycle",
+			main: write("cycle.yaml", `include: ["loop.yaml"]`),
+			want: "is included by itself",
+		},
+		{
+			name: "missing file",
+			main: write("missing.yaml", `include: ["nope.yaml"]`),
+			want: "no such file",
+		},
+		{
+			name: "settings in included file",
+			main: write("settings.yaml", `include: ["metrics.yaml"]`),
+			want: "only proxies and include may be set",
+		},
+		{
+			name: "no proxies",
+			main: write("empty.yaml", `include: ["none/*.yaml"]`),
+			want: "no proxies found",
+		},
+		{
+			name: "with environments",
+			main: write("envs.yaml", `include: ["loop.yaml"]
+environments:
+  dev:`+strings.ReplaceAll(proxy, "\n", "\n    ")),
+			env:  "dev",
+			want: "include: not allowed with environments",
+		},
+	}
+	write("loop.yaml", `include: ["cycle.yaml"]`+proxy)
+	write("metrics.yaml", "metrics_port: 9090"+proxy)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadEnv(tt.main, tt.env)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error to contain %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestVersionDefaultsTo1(t *testing.T) {
+	cfg, err := Parse([]byte(`
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "s"
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Version != 1 {
+		t.Errorf("expected version 1, got %d", cfg.Version)
+	}
+}
+
+func TestVersion1(t *testing.T) {
+	yaml := `
+version: 1
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "s"
+`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Version != 1 {
+		t.Errorf("expected version 1, got %d", cfg.Version)
+	}
+
+	json := `{"version": 1, "proxies": [{"instance": "proj:us-central1:db", "port": 5432, "secret": "s"}]}`
+	if _, err := ParseFormat([]byte(json), FormatJSON, ""); err != nil {
+		t.Errorf("unexpected error for JSON: %v", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	// A newer config may use fields this release doesn't know; the version
+	// error, not the schema's, should be reported.
+	yaml := `
+version: 2
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "s"
+    some_future_field: true
+`
+	_, err := Parse([]byte(yaml))
+	if err == nil {
+		t.Fatal("expected error for a future version")
+	}
+	if !strings.Contains(err.Error(), "version: 2 is newer") || !strings.Contains(err.Error(), "upgrade") {
+		t.Errorf("expected an upgrade hint, got: %v", err)
+	}
+
+	for _, v := range []string{"0", `"1"`, "1.5"} {
+		_, err := Parse([]byte("version: " + v + `
+proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "s"
+`))
+		if err == nil || !strings.Contains(err.Error(), "Invalid config: version") {
+			t.Errorf("version %s: expected a version error, got: %v", v, err)
+		}
+	}
+}
+
+func TestIncludedFileMaySetVersion(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`
+version: 1
+proxies:
+  - instance: "proj:us-central1:db-a"
+    port: 5432
+    secret: "s"
+`), 0644)
+	main := filepath.Join(dir, "main.yaml")
+	os.WriteFile(main, []byte("version: 1\ninclude: [a.yaml]\n"), 0644)
+
+	cfg, err := Load(main)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Proxies) != 1 {
+		t.Errorf("expected 1 proxy, got %d", len(cfg.Proxies))
+	}
+}
+
+func TestShiftPorts(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    socket: "/tmp/b.sock"
+    secret: "pw"
+  - instance: "proj:us-central1:c"
+    port: 5433
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cfg.ShiftPorts(100); err != nil {
+		t.Fatalf("ShiftPorts: %v", err)
+	}
+	if a, b, c := cfg.Proxies[0], cfg.Proxies[1], cfg.Proxies[2]; a.Port != 5532 || b.Port != 0 || c.Port != 5533 {
+		t.Errorf("expected ports 5532, 0 (socket), and 5533, got %d, %d, %d", a.Port, b.Port, c.Port)
+	}
+
+	for _, offset := range []int{-4500, 60200} {
+		cfg, err := Parse([]byte(yaml))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = cfg.ShiftPorts(offset)
+		if err == nil || !strings.Contains(err.Error(), "outside 1024-65535") {
+			t.Errorf("offset %d: expected an out-of-range error, got %v", offset, err)
+		}
+	}
+}
+
+func TestMultiplePorts(t *testing.T) {
+	yaml := `proxies:
+  - instance: "proj:us-central1:a"
+    port: [5432, 6432]
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: [5433]
+    secret: "pw"`
+	cfg, err := Parse([]byte(yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, b := cfg.Proxies[0], cfg.Proxies[1]
+	if a.Port != 5432 || !reflect.DeepEqual(a.ExtraPorts, []int{6432}) {
+		t.Errorf("expected port 5432 and extra port 6432, got %d %v", a.Port, a.ExtraPorts)
+	}
+	if a.Endpoint() != "ports 5432,6432" {
+		t.Errorf("unexpected endpoint %q", a.Endpoint())
+	}
+	if b.Port != 5433 || b.ExtraPorts != nil {
+		t.Errorf("a one-port list should be a plain port, got %d %v", b.Port, b.ExtraPorts)
+	}
+
+	expanded := ExpandPorts(cfg.Proxies)
+	if len(expanded) != 3 {
+		t.Fatalf("expected 3 entries after expansion, got %d", len(expanded))
+	}
+	for i, want := range []int{5432, 6432, 5433} {
+		if expanded[i].Port != want || expanded[i].ExtraPorts != nil {
+			t.Errorf("entry %d: expected port %d alone, got %d %v", i, want, expanded[i].Port, expanded[i].ExtraPorts)
+		}
+	}
+	if expanded[1].Instance != a.Instance {
+		t.Errorf("expanded entries should keep the instance, got %q", expanded[1].Instance)
+	}
+
+	cfg, err = ParseFormat([]byte(`{"proxies": [{"instance": "proj:us-central1:a", "port": [5432, 6432], "secret": "pw"}]}`), FormatJSON, "")
+	if err != nil {
+		t.Fatalf("JSON: unexpected error: %v", err)
+	}
+	if got := cfg.Proxies[0].Ports(); !reflect.DeepEqual(got, []int{5432, 6432}) {
+		t.Errorf("JSON: expected ports 5432,6432, got %v", got)
+	}
+}
+
+func TestMultiplePorts_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "duplicate across entries",
+			yaml: `proxies:
+  - instance: "proj:us-central1:a"
+    port: [5432, 5433]
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 5433
+    secret: "pw"`,
+			want: "proxies.1.port: duplicate port 5433 (same as proxies.0)",
+		},
+		{
+			name: "duplicate within entry",
+			yaml: `proxies:
+  - instance: "proj:us-central1:a"
+    port: [5432, 5432]
+    secret: "pw"`,
+			want: "proxies.0.port",
+		},
+		{
+			name: "out of range",
+			yaml: `proxies:
+  - instance: "proj:us-central1:a"
+    port: [5432, 80]
+    secret: "pw"`,
+			want: "proxies.0.port.1: minimum",
+		},
+		{
+			name: "empty",
+			yaml: `proxies:
+  - instance: "proj:us-central1:a"
+    port: []
+    secret: "pw"`,
+			want: "proxies.0.port: minItems",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	data := []byte(`proxies:
+  - instance: "proj:us-central1:a"
+    port: 5432
+    secret: "pw"`)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// sha256 of "abc", a known vector.
+	if got, want := Hash([]byte("abc")), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+		t.Errorf("Hash(abc) = %s, want %s", got, want)
+	}
+	if cfg.Hash != Hash(data) {
+		t.Errorf("cfg.Hash = %s, want the hash of its bytes %s", cfg.Hash, Hash(data))
+	}
+	changed := append([]byte("# edited\n"), data...)
+	if Hash(changed) == cfg.Hash {
+		t.Error("expected a different hash for different bytes")
+	}
+}
+
+func TestAutoPort(t *testing.T) {
+	cfg, err := Parse([]byte(`proxies:
+  - instance: "proj:us-central1:a"
+    secret: "pw"
+  - instance: "proj:us-central1:b"
+    port: 0
+    secret: "pw"
+  - instance: "proj:us-central1:c"
+    port: 5432
+    secret: "pw"`))
+	if err != nil {
+		t.Fatalf("auto ports should not count as duplicates: %v", err)
+	}
+	if !cfg.Proxies[0].AutoPort() || !cfg.Proxies[1].AutoPort() || cfg.Proxies[2].AutoPort() {
+		t.Errorf("AutoPort() = %v, %v, %v; want true, true, false",
+			cfg.Proxies[0].AutoPort(), cfg.Proxies[1].AutoPort(), cfg.Proxies[2].AutoPort())
+	}
+	if got := cfg.Proxies[0].PortList(); got != "auto" {
+		t.Errorf("PortList() = %q, want auto", got)
+	}
+	if err := cfg.ShiftPorts(100); err != nil {
+		t.Fatalf("ShiftPorts: %v", err)
+	}
+	if cfg.Proxies[0].Port != 0 || cfg.Proxies[2].Port != 5532 {
+		t.Errorf("ShiftPorts should leave auto ports alone, got %d and %d", cfg.Proxies[0].Port, cfg.Proxies[2].Port)
+	}
+
+	assigned := AssignPorts(cfg.Proxies, map[string]int{"proj:us-central1:a": 40001, "proj:us-central1:c": 40002})
+	if assigned[0].Port != 40001 || assigned[1].Port != 0 || assigned[2].Port != 5532 {
+		t.Errorf("AssignPorts set ports %d, %d, %d; want 40001, 0, 5532", assigned[0].Port, assigned[1].Port, assigned[2].Port)
+	}
+	if cfg.Proxies[0].Port != 0 {
+		t.Error("AssignPorts should not modify its argument")
+	}
+}
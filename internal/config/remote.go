@@ -0,0 +1,104 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// maxRemoteConfigSize caps the size of a fetched config, so a wrong URL
+// can't fill memory.
+const maxRemoteConfigSize = 10 << 20
+
+// scopeStorageRead is the OAuth scope gs:// configs are fetched with.
+const scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// HTTPClient fetches http:// and https:// configs. Tests replace it.
+var HTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// GCSClient returns the client gs:// configs are fetched with, authorized by
+// the ADC credentials. Tests replace it.
+var GCSClient = func(ctx context.Context) (*http.Client, error) {
+	client, err := google.DefaultClient(ctx, scopeStorageRead)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = HTTPClient.Timeout
+	return client, nil
+}
+
+// gcsEndpoint is the Cloud Storage JSON API that gs:// objects are
+// downloaded from.
+var gcsEndpoint = "https://storage.googleapis.com/storage/v1"
+
+// IsRemote reports whether path is a URL that LoadEnv fetches the config
+// from, rather than a file: http://, https://, or gs://bucket/object.
+func IsRemote(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "gs://"} {
+		if len(path) > len(scheme) && strings.EqualFold(path[:len(scheme)], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchRemote downloads the config at a URL for which IsRemote is true.
+func FetchRemote(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config URL: %w", err)
+	}
+	client := HTTPClient
+	if strings.EqualFold(u.Scheme, "gs") {
+		object := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || object == "" {
+			return nil, fmt.Errorf("invalid config URL %s: want gs://bucket/object", rawURL)
+		}
+		if client, err = GCSClient(ctx); err != nil {
+			return nil, fmt.Errorf("authorizing Cloud Storage access: %w", err)
+		}
+		rawURL = fmt.Sprintf("%s/b/%s/o/%s?alt=media", gcsEndpoint, url.PathEscape(u.Host), url.PathEscape(object))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config URL: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u.Redacted(), resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", u.Redacted(), maxRemoteConfigSize)
+	}
+	return data, nil
+}
+
+// FormatForURL picks the format of a fetched config from the extension of
+// the URL's path, falling back to FormatForData for URLs without one.
+func FormatForURL(rawURL string, data []byte) Format {
+	if u, err := url.Parse(rawURL); err == nil {
+		switch strings.ToLower(path.Ext(u.Path)) {
+		case ".json":
+			return FormatJSON
+		case ".yaml", ".yml":
+			return FormatYAML
+		}
+	}
+	return FormatForData(data)
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const remoteYAML = `proxies:
+  - instance: "proj:us-central1:db"
+    port: 5432
+    secret: "pw"
+`
+
+// serveConfigs serves each body at its path, and 404 for any other.
+func serveConfigs(t *testing.T, bodies map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIsRemote(t *testing.T) {
+	for path, want := range map[string]bool{
+		"https://example.com/cspr.yaml": true,
+		"http://example.com/cspr.yaml":  true,
+		"HTTPS://example.com/cspr.yaml": true,
+		"gs://bucket/cspr.yaml":         true,
+		"https://":                      false,
+		"config.yaml":                   false,
+		"/etc/cspr/config.yaml":         false,
+		"-":                             false,
+	} {
+		if got := IsRemote(path); got != want {
+			t.Errorf("IsRemote(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestLoadRemote(t *testing.T) {
+	srv := serveConfigs(t, map[string]string{
+		"/cspr.yaml":  remoteYAML,
+		"/cspr.json":  `{"proxies": [{"instance": "proj:us-central1:db", "port": 5432, "secret": "pw"}]}`,
+		"/config":     `{"proxies": [{"instance": "proj:us-central1:db", "port": 5432, "secret": "pw"}]}`,
+		"/dupes.yaml": remoteYAML + "  - instance: \"proj:us-central1:db2\"\n    port: 5432\n    secret: \"pw\"\n",
+	})
+
+	for _, path := range []string{"/cspr.yaml", "/cspr.json", "/config"} {
+		cfg, err := LoadEnv(srv.URL+path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if len(cfg.Proxies) != 1 || cfg.Proxies[0].Instance != "proj:us-central1:db" {
+			t.Errorf("%s: got proxies %+v", path, cfg.Proxies)
+		}
+		if cfg.Hash == "" {
+			t.Errorf("%s: expected the fetched bytes to be hashed", path)
+		}
+	}
+
+	// Fetched configs are validated like files.
+	_, err := LoadEnv(srv.URL+"/dupes.yaml", "")
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || cerr.Kind != KindDuplicate {
+		t.Errorf("expected a duplicate port error, got %v", err)
+	}
+
+	_, err = LoadEnv(srv.URL+"/missing.yaml", "")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestFetchRemote_TooLarge(t *testing.T) {
+	srv := serveConfigs(t, map[string]string{"/big.yaml": strings.Repeat("#", maxRemoteConfigSize+1)})
+	_, err := FetchRemote(context.Background(), srv.URL+"/big.yaml")
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected a size error, got %v", err)
+	}
+}
+
+func TestFetchRemote_GCS(t *testing.T) {
+	srv := serveConfigs(t, map[string]string{"/b/my-bucket/o/team/cspr.yaml": remoteYAML})
+	oldClient, oldEndpoint := GCSClient, gcsEndpoint
+	t.Cleanup(func() { GCSClient, gcsEndpoint = oldClient, oldEndpoint })
+	GCSClient = func(ctx context.Context) (*http.Client, error) { return srv.Client(), nil }
+	gcsEndpoint = srv.URL
+
+	data, err := FetchRemote(context.Background(), "gs://my-bucket/team/cspr.yaml")
+	if err != nil {
+		t.Fatalf("FetchRemote: %v", err)
+	}
+	if string(data) != remoteYAML {
+		t.Errorf("got %q, want %q", data, remoteYAML)
+	}
+
+	if _, err := FetchRemote(context.Background(), "gs://my-bucket"); err == nil || !strings.Contains(err.Error(), "gs://bucket/object") {
+		t.Errorf("expected an invalid URL error, got %v", err)
+	}
+}
@@ -3,14 +3,27 @@ package preflight
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"cloud-sql-proxy-runner/internal/config"
 
 	"golang.org/x/oauth2/google"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
 type CredentialFinder func(ctx context.Context, scopes ...string) (*google.Credentials, error)
 
-func CheckADC(ctx context.Context, finder CredentialFinder) error {
+// CheckADC verifies that Application Default Credentials are available. If
+// impersonate names a service account, ADC is still needed: it is the
+// identity that mints that account's tokens.
+func CheckADC(ctx context.Context, finder CredentialFinder, impersonate string) error {
 	_, err := finder(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil && impersonate != "" {
+		return fmt.Errorf("No Google Cloud credentials found to impersonate %s.\n\nRun: gcloud auth application-default login\n\nThe account you log in with needs the Service Account Token Creator role on %s.", impersonate, impersonate)
+	}
 	if err != nil {
 		return fmt.Errorf("No Google Cloud credentials found.\n\nRun: gcloud auth application-default login")
 	}
@@ -18,3 +31,154 @@ func CheckADC(ctx context.Context, finder CredentialFinder) error {
 }
 
 var DefaultCredentialFinder CredentialFinder = google.FindDefaultCredentials
+
+// PSCNameFinder returns the Private Service Connect DNS name of an instance
+// given its connection name (project:region:name).
+type PSCNameFinder func(ctx context.Context, instance string) (string, error)
+
+// HostResolver resolves a host name to addresses.
+type HostResolver func(ctx context.Context, host string) ([]string, error)
+
+// CheckPSCDNS verifies that the PSC DNS name of instance resolves. PSC
+// endpoints are only reachable when that name resolves inside the caller's
+// VPC, so a failure here usually means a missing DNS record.
+func CheckPSCDNS(ctx context.Context, instance string, finder PSCNameFinder, resolve HostResolver) error {
+	name, err := finder(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("looking up PSC DNS name for %s: %w", instance, err)
+	}
+	if name == "" {
+		return fmt.Errorf("instance %s has no PSC DNS name; is PSC enabled?", instance)
+	}
+	if _, err := resolve(ctx, strings.TrimSuffix(name, ".")); err != nil {
+		return fmt.Errorf("PSC DNS name %s for %s does not resolve; add a DNS record for the PSC endpoint in your VPC", name, instance)
+	}
+	return nil
+}
+
+var DefaultHostResolver HostResolver = net.DefaultResolver.LookupHost
+
+// DefaultPSCNameFinder asks the Cloud SQL Admin API for the instance's PSC
+// DNS name.
+func DefaultPSCNameFinder(ctx context.Context, instance string) (string, error) {
+	parts := strings.Split(instance, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid instance connection name %q", instance)
+	}
+	svc, err := sqladmin.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	settings, err := svc.Connect.Get(parts[0], parts[2]).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	for _, dnm := range settings.DnsNames {
+		if dnm.ConnectionType == "PRIVATE_SERVICE_CONNECT" {
+			return dnm.Name, nil
+		}
+	}
+	return settings.DnsName, nil
+}
+
+// CheckPortsFree verifies that every TCP port in proxies can be bound, so a
+// port held by another process is reported before the daemon starts rather
+// than leaving it half up. The probe listeners are closed immediately. Socket
+// entries are skipped: the daemon replaces stale socket files itself. So are
+// automatic ports, which the OS picks from the free ones.
+func CheckPortsFree(proxies []config.ProxyEntry) error {
+	var conflicts []string
+	for _, p := range config.ExpandPorts(proxies) {
+		if p.Socket != "" || p.AutoPort() {
+			continue
+		}
+		ln, err := net.Listen("tcp", p.Addr())
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("port %d (%s) is already in use", p.Port, p.Instance))
+			continue
+		}
+		ln.Close()
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s\n\nStop the process using it or change the port in the config.", strings.Join(conflicts, "\n"))
+	}
+	return nil
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Low, High int
+}
+
+// Contains reports whether port is within the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Low && port <= r.High
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// DefaultEphemeralPorts is the IANA dynamic port range, which macOS, the
+// BSDs, and Windows use by default.
+var DefaultEphemeralPorts = PortRange{Low: 49152, High: 65535}
+
+// linuxPortRangeFile holds Linux's ephemeral port range as "low\thigh".
+const linuxPortRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// EphemeralPortRange returns the range the OS picks the local ports of
+// outbound connections from. Where it can't be read, as on anything but
+// Linux, it is DefaultEphemeralPorts.
+func EphemeralPortRange() PortRange {
+	r, err := readPortRange(linuxPortRangeFile)
+	if err != nil {
+		return DefaultEphemeralPorts
+	}
+	return r
+}
+
+func readPortRange(path string) (PortRange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PortRange{}, err
+	}
+	var r PortRange
+	if _, err := fmt.Sscan(string(data), &r.Low, &r.High); err != nil {
+		return PortRange{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// EphemeralPortWarnings returns a warning for each TCP proxy whose port is
+// within the ephemeral range r. Such a port works until the OS happens to
+// give it to an outbound connection, when the daemon fails to bind it.
+func EphemeralPortWarnings(proxies []config.ProxyEntry, r PortRange) []string {
+	var warnings []string
+	for _, p := range config.ExpandPorts(proxies) {
+		if p.Socket != "" || p.AutoPort() || !r.Contains(p.Port) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("port %d (%s) is in the OS ephemeral port range %s and may be taken by an outbound connection; choose a port below %d", p.Port, p.Instance, r, r.Low))
+	}
+	return warnings
+}
+
+// looseConfigBits are the permission bits that make a config file readable by
+// everyone or writable by anyone but its owner. 0600 and 0640 are fine.
+const looseConfigBits = 0o026
+
+// ConfigPermissionWarning returns a warning if the config file at path is
+// world-readable or writable by its group or everyone, or "" if its mode is
+// fine. The config names the secrets holding database passwords, and anyone
+// who can write it can point the proxies elsewhere. Windows has no such
+// permission bits, so nothing is reported there.
+func ConfigPermissionWarning(path string) string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm()&looseConfigBits == 0 {
+		return ""
+	}
+	return fmt.Sprintf("config file %s has mode %04o, readable or writable by other users; restrict it with chmod 600 %s", path, info.Mode().Perm(), path)
+}
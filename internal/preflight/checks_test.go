@@ -3,9 +3,15 @@ package preflight
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"cloud-sql-proxy-runner/internal/config"
+
 	"golang.org/x/oauth2/google"
 )
 
@@ -13,7 +19,7 @@ func TestCheckADC_CredentialsFound(t *testing.T) {
 	finder := func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
 		return &google.Credentials{}, nil
 	}
-	err := CheckADC(context.Background(), finder)
+	err := CheckADC(context.Background(), finder, "")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -23,7 +29,7 @@ func TestCheckADC_CredentialsMissing(t *testing.T) {
 	finder := func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
 		return nil, errors.New("could not find default credentials")
 	}
-	err := CheckADC(context.Background(), finder)
+	err := CheckADC(context.Background(), finder, "")
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -34,3 +40,167 @@ func TestCheckADC_CredentialsMissing(t *testing.T) {
 		t.Errorf("expected error to mention missing credentials, got: %v", err)
 	}
 }
+
+func TestCheckADC_CredentialsMissingForImpersonation(t *testing.T) {
+	finder := func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return nil, errors.New("could not find default credentials")
+	}
+	err := CheckADC(context.Background(), finder, "sa@proj.iam.gserviceaccount.com")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "impersonate sa@proj.iam.gserviceaccount.com") {
+		t.Errorf("expected error to name the impersonated account, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Service Account Token Creator") {
+		t.Errorf("expected error to mention the Token Creator role, got: %v", err)
+	}
+}
+
+func TestCheckPSCDNS_Resolves(t *testing.T) {
+	finder := func(ctx context.Context, instance string) (string, error) {
+		return "abc123.us-central1.sql.goog.", nil
+	}
+	var resolved string
+	resolve := func(ctx context.Context, host string) ([]string, error) {
+		resolved = host
+		return []string{"10.0.0.5"}, nil
+	}
+	if err := CheckPSCDNS(context.Background(), "proj:us-central1:db", finder, resolve); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved != "abc123.us-central1.sql.goog" {
+		t.Errorf("expected trailing dot to be trimmed, resolved %q", resolved)
+	}
+}
+
+func TestCheckPSCDNS_DoesNotResolve(t *testing.T) {
+	finder := func(ctx context.Context, instance string) (string, error) {
+		return "abc123.us-central1.sql.goog.", nil
+	}
+	resolve := func(ctx context.Context, host string) ([]string, error) {
+		return nil, errors.New("no such host")
+	}
+	err := CheckPSCDNS(context.Background(), "proj:us-central1:db", finder, resolve)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "abc123.us-central1.sql.goog.") {
+		t.Errorf("expected error to name the DNS name, got: %v", err)
+	}
+}
+
+func TestCheckPSCDNS_NoName(t *testing.T) {
+	finder := func(ctx context.Context, instance string) (string, error) {
+		return "", nil
+	}
+	resolve := func(ctx context.Context, host string) ([]string, error) {
+		t.Fatal("resolver should not be called")
+		return nil, nil
+	}
+	err := CheckPSCDNS(context.Background(), "proj:us-central1:db", finder, resolve)
+	if err == nil || !strings.Contains(err.Error(), "PSC enabled") {
+		t.Errorf("expected PSC-not-enabled error, got: %v", err)
+	}
+}
+
+func TestCheckPortsFree_AllFree(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:region:db", Port: port},
+		{Instance: "proj:region:sock", Socket: filepath.Join(t.TempDir(), ".s.PGSQL.5432")},
+	}
+	if err := CheckPortsFree(proxies); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// The probe must not keep the port bound.
+	ln, err = net.Listen("tcp", proxies[0].Addr())
+	if err != nil {
+		t.Fatalf("port still bound after check: %v", err)
+	}
+	ln.Close()
+}
+
+func TestCheckPortsFree_PortInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	err = CheckPortsFree([]config.ProxyEntry{{Instance: "proj:region:db", Port: port}})
+	if err == nil {
+		t.Fatal("expected error for port in use")
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("port %d (proj:region:db) is already in use", port)) {
+		t.Errorf("error should name the port and instance, got: %v", err)
+	}
+}
+
+func TestEphemeralPortWarnings(t *testing.T) {
+	r := PortRange{Low: 32768, High: 60999}
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:region:below", Port: 5432},
+		{Instance: "proj:region:low", Port: 32768},
+		{Instance: "proj:region:inside", Port: 50000},
+		{Instance: "proj:region:high", Port: 60999},
+		{Instance: "proj:region:above", Port: 61000},
+		{Instance: "proj:region:sock", Socket: "/tmp/.s.PGSQL.5432"},
+	}
+	warnings := EphemeralPortWarnings(proxies, r)
+	if len(warnings) != 3 {
+		t.Fatalf("expected 3 warnings, got %q", warnings)
+	}
+	for i, instance := range []string{"low", "inside", "high"} {
+		if !strings.Contains(warnings[i], "(proj:region:"+instance+")") || !strings.Contains(warnings[i], "32768-60999") {
+			t.Errorf("warning %d should name %s and the range, got %q", i, instance, warnings[i])
+		}
+	}
+}
+
+func TestReadPortRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_local_port_range")
+	os.WriteFile(path, []byte("32768\t60999\n"), 0644)
+	r, err := readPortRange(path)
+	if err != nil {
+		t.Fatalf("readPortRange: %v", err)
+	}
+	if r != (PortRange{Low: 32768, High: 60999}) {
+		t.Errorf("got %v", r)
+	}
+
+	os.WriteFile(path, []byte("garbage"), 0644)
+	if _, err := readPortRange(path); err == nil {
+		t.Error("expected an error for an unparseable range")
+	}
+	if _, err := readPortRange(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestConfigPermissionWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("proxies: []\n"), 0600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	for _, mode := range []os.FileMode{0600, 0640, 0400} {
+		os.Chmod(path, mode)
+		if w := ConfigPermissionWarning(path); w != "" {
+			t.Errorf("mode %04o: expected no warning, got %q", mode, w)
+		}
+	}
+	for _, mode := range []os.FileMode{0644, 0660, 0602} {
+		os.Chmod(path, mode)
+		w := ConfigPermissionWarning(path)
+		if want := fmt.Sprintf("mode %04o", mode); !strings.Contains(w, want) || !strings.Contains(w, "chmod 600") {
+			t.Errorf("mode %04o: expected a warning naming the mode, got %q", mode, w)
+		}
+	}
+}
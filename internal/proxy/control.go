@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ControlVersion is the version of the control socket protocol. Each request
+// and response carries it, and the daemon refuses requests of any other
+// version, so a CLI and daemon from different releases notice and the CLI
+// falls back to the state file and signals.
+const ControlVersion = 1
+
+// Control commands.
+const (
+	// ControlStatus returns the daemon's state with current counters.
+	ControlStatus = "status"
+	// ControlConns returns the open connections of each proxy.
+	ControlConns = "conns"
+	// ControlReload re-reads the config and reports whether it was applied.
+	ControlReload = "reload"
+)
+
+const (
+	// controlDialTimeout bounds connecting to the control socket.
+	controlDialTimeout = time.Second
+	// controlTimeout bounds a whole request, which for reload includes
+	// binding new listeners.
+	controlTimeout = 30 * time.Second
+)
+
+// ErrControlVersion is returned by QueryControl when the daemon speaks a
+// different protocol version.
+var ErrControlVersion = errors.New("daemon speaks a different control protocol version")
+
+// ControlRequest is sent by the CLI as a single line of JSON.
+type ControlRequest struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+}
+
+// ControlResponse is the daemon's single line of JSON in reply. Error is set
+// if the command failed; otherwise the field for the command is.
+type ControlResponse struct {
+	Version int    `json:"version"`
+	Error   string `json:"error,omitempty"`
+
+	// State answers ControlStatus.
+	State *DaemonState `json:"state,omitempty"`
+	// Connections answers ControlConns, keyed by instance.
+	Connections map[string][]ConnInfo `json:"connections,omitempty"`
+}
+
+// ControlCall is a request waiting for the daemon to answer it.
+type ControlCall struct {
+	Request ControlRequest
+	reply   chan ControlResponse
+}
+
+// Reply answers the call. It must be called exactly once.
+func (c *ControlCall) Reply(resp ControlResponse) {
+	resp.Version = ControlVersion
+	c.reply <- resp
+}
+
+// ControlServer accepts requests on the daemon's control socket and passes
+// them to Calls, so that the daemon can answer them from its main loop.
+type ControlServer struct {
+	path string
+	// file identifies the socket file, so Close leaves one bound since by
+	// a daemon taking over.
+	file     os.FileInfo
+	listener net.Listener
+	calls    chan *ControlCall
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// ListenControl starts a control server on the Unix socket at path,
+// replacing a stale socket left by a previous daemon. Only the owner may
+// connect.
+func ListenControl(path string) (*ControlServer, error) {
+	ln, info, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("securing control socket: %w", err)
+	}
+	s := &ControlServer{
+		path:     path,
+		file:     info,
+		listener: ln,
+		calls:    make(chan *ControlCall),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Calls receives each valid request. A nil server has no calls.
+func (s *ControlServer) Calls() <-chan *ControlCall {
+	if s == nil {
+		return nil
+	}
+	return s.calls
+}
+
+// Close stops accepting requests, waits for those in progress, and removes
+// the socket. Requests not yet answered fail. A nil server is a no-op.
+func (s *ControlServer) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.done)
+	err := s.listener.Close()
+	s.wg.Wait()
+	removeSocket(s.path, s.file)
+	return err
+}
+
+func (s *ControlServer) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req ControlRequest
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var resp ControlResponse
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if req.Version != ControlVersion {
+		resp.Error = fmt.Sprintf("unsupported control protocol version %d (daemon speaks %d)", req.Version, ControlVersion)
+	} else {
+		call := &ControlCall{Request: req, reply: make(chan ControlResponse, 1)}
+		select {
+		case s.calls <- call:
+		case <-s.done:
+			return
+		}
+		select {
+		case resp = <-call.reply:
+		case <-s.done:
+			return
+		}
+	}
+	resp.Version = ControlVersion
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// QueryControl sends command to the daemon's control socket at path and
+// returns the response. An error means the daemon couldn't be asked: it
+// isn't listening, didn't answer, or speaks another protocol version
+// (ErrControlVersion). A command that the daemon ran but that failed is
+// reported in the response's Error instead.
+func QueryControl(path, command string) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, controlDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(ControlRequest{Version: ControlVersion, Command: command}); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading control response: %w", err)
+	}
+	var resp ControlResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("parsing control response: %w", err)
+	}
+	if resp.Version != ControlVersion {
+		return nil, fmt.Errorf("%w (%d, not %d)", ErrControlVersion, resp.Version, ControlVersion)
+	}
+	return &resp, nil
+}
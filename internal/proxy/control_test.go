@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveControl answers each call on s with answer until s is closed.
+func serveControl(s *ControlServer, answer func(ControlRequest) ControlResponse) {
+	go func() {
+		for call := range s.Calls() {
+			call.Reply(answer(call.Request))
+		}
+	}()
+}
+
+func TestControl_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ControlFile)
+	s, err := ListenControl(path)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	defer s.Close()
+	serveControl(s, func(req ControlRequest) ControlResponse {
+		switch req.Command {
+		case ControlStatus:
+			return ControlResponse{State: &DaemonState{PID: 42}}
+		case ControlConns:
+			return ControlResponse{Connections: map[string][]ConnInfo{"proj:us-central1:db": {{Client: "127.0.0.1:50000"}}}}
+		}
+		return ControlResponse{Error: "unknown command"}
+	})
+
+	resp, err := QueryControl(path, ControlStatus)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if resp.State == nil || resp.State.PID != 42 {
+		t.Errorf("expected state with pid 42, got %+v", resp.State)
+	}
+
+	resp, err = QueryControl(path, ControlConns)
+	if err != nil {
+		t.Fatalf("conns: %v", err)
+	}
+	if conns := resp.Connections["proj:us-central1:db"]; len(conns) != 1 || conns[0].Client != "127.0.0.1:50000" {
+		t.Errorf("expected one connection, got %+v", resp.Connections)
+	}
+
+	resp, err = QueryControl(path, "bogus")
+	if err != nil {
+		t.Fatalf("bogus: %v", err)
+	}
+	if resp.Error != "unknown command" {
+		t.Errorf("expected the command's error in the response, got %q", resp.Error)
+	}
+}
+
+func TestControl_RejectsOtherVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ControlFile)
+	s, err := ListenControl(path)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	defer s.Close()
+	serveControl(s, func(req ControlRequest) ControlResponse {
+		t.Errorf("request of another version reached the daemon: %+v", req)
+		return ControlResponse{}
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(ControlRequest{Version: ControlVersion + 1, Command: ControlStatus}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if resp.Version != ControlVersion || !strings.Contains(resp.Error, "unsupported control protocol version") {
+		t.Errorf("expected a version error, got %+v", resp)
+	}
+}
+
+func TestQueryControl_DetectsOtherVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ControlFile)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadBytes('\n')
+		json.NewEncoder(conn).Encode(ControlResponse{Version: ControlVersion + 1})
+	}()
+
+	if _, err := QueryControl(path, ControlStatus); !errors.Is(err, ErrControlVersion) {
+		t.Errorf("expected ErrControlVersion, got %v", err)
+	}
+}
+
+func TestQueryControl_NoDaemon(t *testing.T) {
+	if _, err := QueryControl(filepath.Join(t.TempDir(), ControlFile), ControlStatus); err == nil {
+		t.Error("expected an error with no socket")
+	}
+}
+
+func TestControlServer_CloseRemovesSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ControlFile)
+	s, err := ListenControl(path)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	s.Close()
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Error("expected the socket to be gone after Close")
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"cloud-sql-proxy-runner/internal/config"
@@ -18,12 +17,127 @@ const (
 	PIDFile         = "daemon.pid"
 	StateFile       = "state.json"
 	LogFile         = "daemon.log"
+	AccessLogFile   = "access.log"
+	ControlFile     = "control.sock"
+	ErrorFile       = "daemon.err"
+	PortsFile       = "ports.json"
 )
 
 type DaemonState struct {
-	PID       int                  `json:"pid"`
-	StartedAt time.Time            `json:"started_at"`
-	Proxies   []config.ProxyEntry  `json:"proxies"`
+	PID       int                 `json:"pid"`
+	StartedAt time.Time           `json:"started_at"`
+	Proxies   []config.ProxyEntry `json:"proxies"`
+
+	// ShutdownTimeout is how long the daemon drains connections when it
+	// stops, so that stop knows how long to wait before killing it.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout,omitempty"`
+
+	// PortOffset is the --port-offset the daemon was started with. Proxies
+	// already hold the shifted ports.
+	PortOffset int `json:"port_offset,omitempty"`
+
+	// ReusePort records that the daemon bound its TCP ports with
+	// SO_REUSEPORT, which restart --graceful needs to start a new daemon
+	// alongside it.
+	ReusePort bool `json:"reuse_port,omitempty"`
+
+	// ConfigPath and ConfigHash identify the config file the daemon last
+	// loaded and its contents then, so the CLI can tell when it has changed.
+	ConfigPath string `json:"config_path,omitempty"`
+	ConfigHash string `json:"config_hash,omitempty"`
+
+	// AutoPorts maps the instances of proxies with an automatic port to the
+	// port the daemon bound for them. Proxies keep port 0, as configured.
+	AutoPorts map[string]int `json:"auto_ports,omitempty"`
+
+	// Stats holds each proxy's counters, keyed by instance, as last recorded
+	// by the daemon.
+	Stats map[string]ProxyStats `json:"stats,omitempty"`
+
+	// Secrets is the outcome of the daemon's latest secret check.
+	Secrets *SecretsReport `json:"secrets,omitempty"`
+}
+
+// BoundProxies returns Proxies with each automatic port replaced by the port
+// the daemon bound for it.
+func (s *DaemonState) BoundProxies() []config.ProxyEntry {
+	return config.AssignPorts(s.Proxies, s.AutoPorts)
+}
+
+// SecretsReport is the outcome of re-fetching every proxy's secret. Secrets
+// are identified by version resource name.
+type SecretsReport struct {
+	// StartedAt is when the check began, so a caller that requested it can
+	// tell its own check from an earlier one.
+	StartedAt time.Time `json:"started_at"`
+	Checked   int       `json:"checked"`
+
+	// Changed lists secrets whose payload differs from the previous check.
+	Changed []string `json:"changed,omitempty"`
+	// Failed maps secrets that couldn't be fetched to the error.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// ProxyStats is a snapshot of a proxy's listener counters.
+type ProxyStats struct {
+	ActiveConns   int   `json:"active_conns"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	// Connected counts the connections whose instance was dialed, and
+	// DialErrors the failed dial attempts, since the daemon started.
+	Connected  int64 `json:"connected"`
+	DialErrors int64 `json:"dial_errors"`
+
+	// LastDialError is the most recent failed dial attempt, if any.
+	LastDialError *DialError `json:"last_dial_error,omitempty"`
+
+	// Connections lists the open client connections, oldest first.
+	Connections []ConnInfo `json:"connections,omitempty"`
+}
+
+// Paths locates the files the daemon keeps at runtime.
+type Paths struct {
+	Dir       string
+	PIDFile   string
+	StateFile string
+	LogFile   string
+	AccessLog string
+	Control   string
+	Error     string
+	Ports     string
+}
+
+// NewPaths returns the default file locations within the state directory dir.
+func NewPaths(dir string) Paths {
+	return NewInstancePaths(dir, "")
+}
+
+// NewInstancePaths returns the file locations of the daemon instance name
+// within the state directory dir, so that several daemons can share it. The
+// empty name is the default instance.
+func NewInstancePaths(dir, name string) Paths {
+	return Paths{
+		Dir:       dir,
+		PIDFile:   filepath.Join(dir, InstanceFile(PIDFile, name)),
+		StateFile: filepath.Join(dir, InstanceFile(StateFile, name)),
+		LogFile:   filepath.Join(dir, InstanceFile(LogFile, name)),
+		AccessLog: filepath.Join(dir, InstanceFile(AccessLogFile, name)),
+		Control:   filepath.Join(dir, InstanceFile(ControlFile, name)),
+		Error:     filepath.Join(dir, InstanceFile(ErrorFile, name)),
+		Ports:     filepath.Join(dir, InstanceFile(PortsFile, name)),
+	}
+}
+
+// InstanceFile returns the name of file for the daemon instance name:
+// daemon.pid becomes daemon-<name>.pid. The default instance, with the empty
+// name, keeps file unchanged.
+func InstanceFile(file, name string) string {
+	if name == "" {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + name + ext
 }
 
 func StateDir() string {
@@ -38,34 +152,34 @@ func EnsureStateDir(dir string) error {
 	return os.MkdirAll(dir, 0755)
 }
 
-func WritePID(dir string, pid int) error {
-	if err := EnsureStateDir(dir); err != nil {
+func WritePID(p Paths, pid int) error {
+	if err := EnsureStateDir(filepath.Dir(p.PIDFile)); err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(dir, PIDFile), []byte(strconv.Itoa(pid)), 0644)
+	return os.WriteFile(p.PIDFile, []byte(strconv.Itoa(pid)), 0644)
 }
 
-func ReadPID(dir string) (int, error) {
-	data, err := os.ReadFile(filepath.Join(dir, PIDFile))
+func ReadPID(p Paths) (int, error) {
+	data, err := os.ReadFile(p.PIDFile)
 	if err != nil {
 		return 0, err
 	}
 	return strconv.Atoi(strings.TrimSpace(string(data)))
 }
 
-func WriteState(dir string, state *DaemonState) error {
-	if err := EnsureStateDir(dir); err != nil {
+func WriteState(p Paths, state *DaemonState) error {
+	if err := EnsureStateDir(filepath.Dir(p.StateFile)); err != nil {
 		return err
 	}
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(dir, StateFile), data, 0644)
+	return os.WriteFile(p.StateFile, data, 0644)
 }
 
-func ReadState(dir string) (*DaemonState, error) {
-	data, err := os.ReadFile(filepath.Join(dir, StateFile))
+func ReadState(p Paths) (*DaemonState, error) {
+	data, err := os.ReadFile(p.StateFile)
 	if err != nil {
 		return nil, err
 	}
@@ -76,18 +190,32 @@ func ReadState(dir string) (*DaemonState, error) {
 	return &state, nil
 }
 
-func IsRunning(pid int) bool {
-	proc, err := os.FindProcess(pid)
+// WritePorts writes the ports file, a JSON object mapping the instance of
+// each TCP proxy to the port it listens on, including automatic ones. It is
+// replaced by a rename, so tools never read a partly written file.
+func WritePorts(p Paths, proxies []config.ProxyEntry) error {
+	if err := EnsureStateDir(filepath.Dir(p.Ports)); err != nil {
+		return err
+	}
+	ports := make(map[string]int, len(proxies))
+	for _, proxy := range proxies {
+		if proxy.Socket == "" {
+			ports[proxy.Instance] = proxy.Port
+		}
+	}
+	data, err := json.MarshalIndent(ports, "", "  ")
 	if err != nil {
-		return false
+		return err
 	}
-	// On Unix, FindProcess always succeeds. Send signal 0 to check if alive.
-	err = proc.Signal(syscall.Signal(0))
-	return err == nil
+	tmp := p.Ports + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.Ports)
 }
 
-func CleanupStale(dir string) error {
-	pid, err := ReadPID(dir)
+func CleanupStale(p Paths) error {
+	pid, err := ReadPID(p)
 	if err != nil {
 		return nil // no PID file, nothing to clean
 	}
@@ -95,16 +223,37 @@ func CleanupStale(dir string) error {
 		return fmt.Errorf("daemon is still running (pid %d)", pid)
 	}
 	// Stale PID file - clean up
-	os.Remove(filepath.Join(dir, PIDFile))
-	os.Remove(filepath.Join(dir, StateFile))
+	RemoveStateFiles(p)
 	return nil
 }
 
-func RemoveStateFiles(dir string) {
-	os.Remove(filepath.Join(dir, PIDFile))
-	os.Remove(filepath.Join(dir, StateFile))
+func RemoveStateFiles(p Paths) {
+	os.Remove(p.PIDFile)
+	os.Remove(p.StateFile)
+	os.Remove(p.Control)
+	os.Remove(p.Ports)
+}
+
+// WriteLastError records the error the daemon exited with, so the process
+// that launched it can report why it failed rather than just that it did.
+func WriteLastError(p Paths, err error) error {
+	if err := EnsureStateDir(filepath.Dir(p.Error)); err != nil {
+		return err
+	}
+	return os.WriteFile(p.Error, []byte(err.Error()+"\n"), 0644)
+}
+
+// ReadLastError returns the error the daemon last exited with, or "" if none
+// is recorded.
+func ReadLastError(p Paths) string {
+	data, err := os.ReadFile(p.Error)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
 
-func LogPath(dir string) string {
-	return filepath.Join(dir, LogFile)
+// ClearLastError removes any recorded daemon error.
+func ClearLastError(p Paths) {
+	os.Remove(p.Error)
 }
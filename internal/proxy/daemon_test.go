@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -10,12 +13,12 @@ import (
 )
 
 func TestWriteReadPIDRoundtrip(t *testing.T) {
-	dir := t.TempDir()
+	paths := NewPaths(t.TempDir())
 	pid := 12345
-	if err := WritePID(dir, pid); err != nil {
+	if err := WritePID(paths, pid); err != nil {
 		t.Fatalf("WritePID: %v", err)
 	}
-	got, err := ReadPID(dir)
+	got, err := ReadPID(paths)
 	if err != nil {
 		t.Fatalf("ReadPID: %v", err)
 	}
@@ -25,7 +28,7 @@ func TestWriteReadPIDRoundtrip(t *testing.T) {
 }
 
 func TestWriteReadStateRoundtrip(t *testing.T) {
-	dir := t.TempDir()
+	paths := NewPaths(t.TempDir())
 	state := &DaemonState{
 		PID:       42,
 		StartedAt: time.Date(2026, 2, 25, 10, 0, 0, 0, time.UTC),
@@ -33,10 +36,10 @@ func TestWriteReadStateRoundtrip(t *testing.T) {
 			{Instance: "proj:region:db", Port: 5432, Secret: "pw"},
 		},
 	}
-	if err := WriteState(dir, state); err != nil {
+	if err := WriteState(paths, state); err != nil {
 		t.Fatalf("WriteState: %v", err)
 	}
-	got, err := ReadState(dir)
+	got, err := ReadState(paths)
 	if err != nil {
 		t.Fatalf("ReadState: %v", err)
 	}
@@ -54,6 +57,38 @@ func TestWriteReadStateRoundtrip(t *testing.T) {
 	}
 }
 
+func TestWritePorts(t *testing.T) {
+	paths := NewPaths(t.TempDir())
+	proxies := []config.ProxyEntry{
+		{Instance: "proj:region:db1", Port: 5432},
+		{Instance: "proj:region:db2", Port: 6543},
+		{Instance: "proj:region:db3", Socket: "/tmp/db3.sock"},
+	}
+	if err := WritePorts(paths, proxies); err != nil {
+		t.Fatalf("WritePorts: %v", err)
+	}
+	data, err := os.ReadFile(paths.Ports)
+	if err != nil {
+		t.Fatalf("reading ports file: %v", err)
+	}
+	var got map[string]int
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("ports file is not JSON: %v\n%s", err, data)
+	}
+	want := map[string]int{"proj:region:db1": 5432, "proj:region:db2": 6543}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(paths.Ports + ".tmp"); !os.IsNotExist(err) {
+		t.Error("expected no temporary file left behind")
+	}
+
+	RemoveStateFiles(paths)
+	if _, err := os.Stat(paths.Ports); !os.IsNotExist(err) {
+		t.Error("expected RemoveStateFiles to remove the ports file")
+	}
+}
+
 func TestIsRunning_OwnPID(t *testing.T) {
 	if !IsRunning(os.Getpid()) {
 		t.Error("expected IsRunning to return true for own PID")
@@ -69,16 +104,17 @@ func TestIsRunning_NonExistentPID(t *testing.T) {
 
 func TestCleanupStale(t *testing.T) {
 	dir := t.TempDir()
+	paths := NewPaths(dir)
 	// Write a PID file with a non-existent PID
-	if err := WritePID(dir, 99999999); err != nil {
+	if err := WritePID(paths, 99999999); err != nil {
 		t.Fatalf("WritePID: %v", err)
 	}
 	state := &DaemonState{PID: 99999999, StartedAt: time.Now()}
-	if err := WriteState(dir, state); err != nil {
+	if err := WriteState(paths, state); err != nil {
 		t.Fatalf("WriteState: %v", err)
 	}
 
-	if err := CleanupStale(dir); err != nil {
+	if err := CleanupStale(paths); err != nil {
 		t.Fatalf("CleanupStale: %v", err)
 	}
 
@@ -105,3 +141,89 @@ func TestStateDirCreation(t *testing.T) {
 		t.Error("expected directory")
 	}
 }
+
+func TestPIDFileOutsideStateDir(t *testing.T) {
+	paths := NewPaths(t.TempDir())
+	paths.PIDFile = filepath.Join(t.TempDir(), "run", "custom.pid")
+
+	if err := WritePID(paths, 4242); err != nil {
+		t.Fatalf("WritePID: %v", err)
+	}
+	if _, err := os.Stat(paths.PIDFile); err != nil {
+		t.Fatalf("expected PID file at override path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Dir, PIDFile)); !os.IsNotExist(err) {
+		t.Error("expected no PID file in the state dir")
+	}
+	got, err := ReadPID(paths)
+	if err != nil {
+		t.Fatalf("ReadPID: %v", err)
+	}
+	if got != 4242 {
+		t.Errorf("expected pid 4242, got %d", got)
+	}
+
+	RemoveStateFiles(paths)
+	if _, err := os.Stat(paths.PIDFile); !os.IsNotExist(err) {
+		t.Error("expected RemoveStateFiles to remove the overridden PID file")
+	}
+}
+
+func TestNewInstancePaths(t *testing.T) {
+	dir := t.TempDir()
+	if got, want := NewInstancePaths(dir, ""), NewPaths(dir); got != want {
+		t.Errorf("default instance: got %+v, want %+v", got, want)
+	}
+
+	paths := NewInstancePaths(dir, "work")
+	want := Paths{
+		Dir:       dir,
+		PIDFile:   filepath.Join(dir, "daemon-work.pid"),
+		StateFile: filepath.Join(dir, "state-work.json"),
+		LogFile:   filepath.Join(dir, "daemon-work.log"),
+		AccessLog: filepath.Join(dir, "access-work.log"),
+		Control:   filepath.Join(dir, "control-work.sock"),
+		Error:     filepath.Join(dir, "daemon-work.err"),
+		Ports:     filepath.Join(dir, "ports-work.json"),
+	}
+	if paths != want {
+		t.Errorf("got %+v, want %+v", paths, want)
+	}
+}
+
+func TestInstancePaths_Independent(t *testing.T) {
+	dir := t.TempDir()
+	a, b := NewInstancePaths(dir, "a"), NewInstancePaths(dir, "b")
+	if err := WriteState(a, &DaemonState{PID: 1}); err != nil {
+		t.Fatalf("WriteState a: %v", err)
+	}
+	if err := WriteState(b, &DaemonState{PID: 2}); err != nil {
+		t.Fatalf("WriteState b: %v", err)
+	}
+
+	RemoveStateFiles(a)
+	if _, err := ReadState(a); !os.IsNotExist(err) {
+		t.Errorf("expected a's state to be removed, got %v", err)
+	}
+	state, err := ReadState(b)
+	if err != nil || state.PID != 2 {
+		t.Errorf("expected b's state to survive, got %+v, %v", state, err)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	paths := NewPaths(t.TempDir())
+	if got := ReadLastError(paths); got != "" {
+		t.Errorf("expected no error before one is written, got %q", got)
+	}
+	if err := WriteLastError(paths, errors.New("listen tcp 127.0.0.1:5432: address already in use")); err != nil {
+		t.Fatalf("WriteLastError: %v", err)
+	}
+	if got, want := ReadLastError(paths), "listen tcp 127.0.0.1:5432: address already in use"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	ClearLastError(paths)
+	if got := ReadLastError(paths); got != "" {
+		t.Errorf("expected no error after clearing, got %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthDialTimeout bounds each instance dial made by /healthz?dial=1.
+const healthDialTimeout = 5 * time.Second
+
+// HealthHandler serves liveness and readiness probes for the listeners:
+//
+//   - /readyz returns 200 once ready reports true, i.e. every listener has
+//     been bound.
+//   - /healthz returns 200 while every listener is accepting connections.
+//     With ?dial=1 it also dials each instance and fails if any can't be
+//     reached.
+//
+// Failures return 503 with one line per problem. listeners is called on
+// every request so that reloaded proxies are picked up.
+func HealthHandler(listeners func() []*Listener, ready func() bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			writeHealth(w, []string{"listeners not started"})
+			return
+		}
+		writeHealth(w, nil)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			writeHealth(w, []string{"listeners not started"})
+			return
+		}
+		ls := listeners()
+		var problems []string
+		for _, l := range ls {
+			if !l.Accepting() {
+				problems = append(problems, fmt.Sprintf("%s: not accepting connections", l.Instance))
+			}
+		}
+		if r.URL.Query().Get("dial") != "" {
+			problems = append(problems, checkDials(r.Context(), ls)...)
+		}
+		writeHealth(w, problems)
+	})
+	return mux
+}
+
+// checkDials dials every listener's instance concurrently and returns a line
+// for each that failed, in listener order.
+func checkDials(ctx context.Context, ls []*Listener) []string {
+	errs := make([]error, len(ls))
+	var wg sync.WaitGroup
+	for i, l := range ls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthDialTimeout)
+			defer cancel()
+			errs[i] = l.CheckDial(ctx)
+		}()
+	}
+	wg.Wait()
+
+	var problems []string
+	for i, err := range errs {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: dial failed: %v", ls[i].Instance, err))
+		}
+	}
+	return problems
+}
+
+func writeHealth(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getStatus(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthHandler(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+	a := NewListener("proj:region:a", "", 0, dialer)
+	b := NewListener("proj:region:b", "", 0, dialer)
+	ls := []*Listener{a, b}
+	ready := false
+
+	srv := httptest.NewServer(HealthHandler(func() []*Listener { return ls }, func() bool { return ready }))
+	defer srv.Close()
+
+	if code, _ := getStatus(t, srv.URL+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before start: got %d, want 503", code)
+	}
+
+	for _, l := range ls {
+		if err := l.Start(context.Background()); err != nil {
+			t.Fatalf("failed to start listener: %v", err)
+		}
+		defer l.Close()
+	}
+	ready = true
+
+	if code, _ := getStatus(t, srv.URL+"/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz after start: got %d, want 200", code)
+	}
+	if code, body := getStatus(t, srv.URL+"/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz with all listeners accepting: got %d, want 200 (%s)", code, body)
+	}
+
+	code, body := getStatus(t, srv.URL+"/healthz?dial=1")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "proj:region:a: dial failed") {
+		t.Errorf("/healthz?dial=1 with unreachable instances: got %d %q", code, body)
+	}
+
+	b.Close()
+	code, body = getStatus(t, srv.URL+"/healthz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz after a listener stopped: got %d, want 503", code)
+	}
+	if !strings.Contains(body, "proj:region:b: not accepting") || strings.Contains(body, "proj:region:a") {
+		t.Errorf("expected only the stopped listener reported, got %q", body)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook events, passed to hook commands in CSPR_HOOK.
+const (
+	HookStart = "on_start"
+	HookStop  = "on_stop"
+)
+
+// hookTimeout bounds each hook command, so a hung one can't hold up the
+// daemon's shutdown.
+const hookTimeout = 30 * time.Second
+
+// runHooks runs command once for each listener, in order, with the listener
+// described in its environment: CSPR_HOOK is the event, CSPR_INSTANCE the
+// instance, and CSPR_HOST and CSPR_PORT, or CSPR_SOCKET, where it listens.
+// The output of each run is logged. Hooks are side effects, so a command
+// that fails or times out is logged and the rest still run. An empty command
+// does nothing.
+func runHooks(ctx context.Context, event string, command []string, listeners []*Listener) {
+	if len(command) == 0 {
+		return
+	}
+	for _, l := range listeners {
+		runHook(ctx, event, command, l)
+	}
+}
+
+func runHook(ctx context.Context, event string, command []string, l *Listener) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	env := append(os.Environ(), "CSPR_HOOK="+event, "CSPR_INSTANCE="+l.Instance)
+	if l.Socket != "" {
+		env = append(env, "CSPR_SOCKET="+l.Socket)
+	} else {
+		env = append(env, "CSPR_HOST="+l.Host, "CSPR_PORT="+strconv.Itoa(l.Port))
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = env
+
+	log := slog.With("hook", event, "instance", l.Instance)
+	out, err := cmd.CombinedOutput()
+	if output := strings.TrimSpace(string(out)); output != "" {
+		log.Info("hook output", "output", output)
+	}
+	if err != nil {
+		log.Warn("hook failed", "command", command[0], "err", err)
+	}
+}
@@ -0,0 +1,122 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+// recordingHook returns a hook command that appends its event, instance, and
+// address to a file, and the file's path.
+func recordingHook(t *testing.T) ([]string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hooks.log")
+	script := `echo "$CSPR_HOOK $CSPR_INSTANCE $CSPR_HOST:$CSPR_PORT$CSPR_SOCKET" >> "$1"`
+	return []string{"sh", "-c", script, "hook", path}, path
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestRunHooks(t *testing.T) {
+	command, path := recordingHook(t)
+	listeners := []*Listener{
+		NewListener(proxyA.Instance, "", 5432, nil),
+		NewSocketListener(proxyB.Instance, "/tmp/db.sock", nil),
+	}
+	runHooks(context.Background(), HookStart, command, listeners)
+
+	got := readLines(t, path)
+	want := []string{
+		"on_start " + proxyA.Instance + " localhost:5432",
+		"on_start " + proxyB.Instance + " :/tmp/db.sock",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got hook runs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunHooks_FailureDoesNotStopOthers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.log")
+	// Fails for the first listener only.
+	command := []string{"sh", "-c", `echo "$CSPR_INSTANCE" >> "$1"; [ "$CSPR_PORT" != 1 ]`, "hook", path}
+	listeners := []*Listener{
+		NewListener(proxyA.Instance, "", 1, nil),
+		NewListener(proxyB.Instance, "", 2, nil),
+	}
+	runHooks(context.Background(), HookStop, command, listeners)
+	if got := readLines(t, path); len(got) != 2 {
+		t.Errorf("expected the hook to run for both listeners, got %q", got)
+	}
+
+	// A command that can't be run at all is only logged too.
+	runHooks(context.Background(), HookStop, []string{filepath.Join(t.TempDir(), "missing")}, listeners)
+}
+
+func TestRunDaemon_Hooks(t *testing.T) {
+	onStart, startPath := recordingHook(t)
+	onStop, stopPath := recordingHook(t)
+	cfg := &config.Config{
+		Proxies: []config.ProxyEntry{{Instance: proxyA.Instance}},
+		OnStart: onStart,
+		OnStop:  onStop,
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	started := make(chan *Manager, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunDaemon(ctx, cfg, RunOptions{
+			Dialer:  echoDialer{},
+			Started: func(m *Manager) { started <- m },
+		})
+	}()
+	var port int
+	select {
+	case m := <-started:
+		port = m.Listeners()[0].Port
+	case err := <-done:
+		t.Fatalf("RunDaemon: %v", err)
+	}
+
+	// The start hook sees the port that was bound.
+	want := proxyA.Instance + " localhost:" + strconv.Itoa(port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, _ := os.ReadFile(startPath); len(data) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("on_start hook didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := readLines(t, startPath); len(got) != 1 || got[0] != "on_start "+want {
+		t.Errorf("on_start hook runs = %q, want [%q]", got, "on_start "+want)
+	}
+	if _, err := os.Stat(stopPath); !os.IsNotExist(err) {
+		t.Error("on_stop hook ran before shutdown")
+	}
+
+	stop()
+	if err := <-done; err != nil {
+		t.Fatalf("RunDaemon: %v", err)
+	}
+	if got := readLines(t, stopPath); len(got) != 1 || got[0] != "on_stop "+want {
+		t.Errorf("on_stop hook runs = %q, want [%q]", got, "on_stop "+want)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePortSupported reports whether listeners can bind with SO_REUSEPORT,
+// which restart --graceful needs.
+const ReusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound, so that another
+// socket that sets it too can bind the same port alongside it.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ReusePortSupported reports whether listeners can bind with SO_REUSEPORT,
+// which restart --graceful needs.
+const ReusePortSupported = false
+
+// reusePort fails: Windows has no SO_REUSEPORT, and SO_REUSEADDR there lets
+// any process steal a port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on Windows")
+}
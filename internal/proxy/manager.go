@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+// NewProxyListener creates a listener for a config entry, with its dial,
+// idle, lifetime, connection, and rate limits applied. Entries with several
+// ports need one per port; see config.ExpandPorts.
+func NewProxyListener(p config.ProxyEntry, d Dialer) *Listener {
+	var l *Listener
+	if p.Socket != "" {
+		l = NewSocketListener(p.Instance, p.Socket, d)
+	} else {
+		l = NewListener(p.Instance, p.Host, p.Port, d)
+	}
+	l.DialAttempts = p.DialAttemptsOrDefault()
+	l.DialRetryDelay = p.DialRetryDelayOrDefault()
+	l.DialTimeout = p.DialTimeoutOrDefault()
+	l.IdleTimeout = p.IdleTimeoutDuration()
+	l.MaxLifetime = p.MaxLifetimeDuration()
+	l.MaxConns = p.MaxConnections
+	l.RateLimit = p.RateLimit
+	l.BufferSize = p.BufferSizeOrDefault()
+	l.Tags = p.Tags
+	return l
+}
+
+// ListenerKey identifies the listener a proxy entry needs. Entries with the
+// same key keep their running listener, and its connections, across a reload,
+// unless its settings changed.
+func ListenerKey(p config.ProxyEntry) string {
+	return p.Instance + " " + p.Network() + ":" + p.Addr()
+}
+
+// sameListenerSettings reports whether two entries with the same ListenerKey
+// configure their listeners alike: every setting NewProxyListener applies,
+// plus the log level, access log, and tags a daemon may apply on top.
+func sameListenerSettings(a, b config.ProxyEntry) bool {
+	return a.DialAttemptsOrDefault() == b.DialAttemptsOrDefault() &&
+		a.DialRetryDelayOrDefault() == b.DialRetryDelayOrDefault() &&
+		a.DialTimeoutOrDefault() == b.DialTimeoutOrDefault() &&
+		a.IdleTimeoutDuration() == b.IdleTimeoutDuration() &&
+		a.MaxLifetimeDuration() == b.MaxLifetimeDuration() &&
+		a.MaxConnections == b.MaxConnections &&
+		a.RateLimit == b.RateLimit &&
+		a.BufferSizeOrDefault() == b.BufferSizeOrDefault() &&
+		a.LogLevel == b.LogLevel &&
+		a.AccessLog == b.AccessLog &&
+		maps.Equal(a.Tags, b.Tags)
+}
+
+// diffProxies compares the running proxies with a newly loaded config and
+// returns the entries whose listeners must be started and stopped. An entry
+// whose listener settings changed is both, so its listener is replaced.
+// Changes that don't affect the listener, such as a rotated secret, are
+// neither.
+func diffProxies(running, next []config.ProxyEntry) (added, removed []config.ProxyEntry) {
+	runningByKey := make(map[string]config.ProxyEntry, len(running))
+	for _, p := range running {
+		runningByKey[ListenerKey(p)] = p
+	}
+	nextByKey := make(map[string]config.ProxyEntry, len(next))
+	for _, p := range next {
+		nextByKey[ListenerKey(p)] = p
+		if prev, ok := runningByKey[ListenerKey(p)]; !ok || !sameListenerSettings(prev, p) {
+			added = append(added, p)
+		}
+	}
+	for _, p := range running {
+		if n, ok := nextByKey[ListenerKey(p)]; !ok || !sameListenerSettings(p, n) {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+// Manager runs a listener per proxy entry, and switches them to a new config
+// in place, so a reload only replaces the ones that changed. Start, Reload,
+// Drain, and Close must be called from a single goroutine; the other methods
+// may be called from any.
+type Manager struct {
+	ctx         context.Context
+	dialer      Dialer
+	newListener func(config.ProxyEntry, Dialer) *Listener
+
+	// mu guards proxies and byKey.
+	mu      sync.RWMutex
+	proxies []config.ProxyEntry
+	byKey   map[string]*Listener
+}
+
+// NewManager creates a Manager whose listeners dial through d and run until
+// ctx is done. newListener creates each listener before it is started; nil
+// means NewProxyListener.
+func NewManager(ctx context.Context, d Dialer, newListener func(config.ProxyEntry, Dialer) *Listener) *Manager {
+	if newListener == nil {
+		newListener = NewProxyListener
+	}
+	return &Manager{ctx: ctx, dialer: d, newListener: newListener, byKey: make(map[string]*Listener)}
+}
+
+// Start starts a listener for every entry, one per port for entries with
+// several. If any fails, the ones already started are closed.
+func (m *Manager) Start(proxies []config.ProxyEntry) error {
+	proxies = config.ExpandPorts(proxies)
+	for _, p := range proxies {
+		l, err := m.startListener(p)
+		if err != nil {
+			m.Close()
+			return err
+		}
+		m.mu.Lock()
+		m.byKey[ListenerKey(p)] = l
+		m.mu.Unlock()
+	}
+	m.mu.Lock()
+	m.proxies = proxies
+	m.mu.Unlock()
+	return nil
+}
+
+// Reload switches the listeners to a new config. Listeners for new addresses
+// are bound before anything is torn down, so a port that is already in use
+// aborts the reload and leaves the running proxies untouched.
+func (m *Manager) Reload(next []config.ProxyEntry) error {
+	next = config.ExpandPorts(next)
+	added, removed := diffProxies(m.proxies, next)
+
+	// Addresses freed by removed listeners can only be bound once those are
+	// closed.
+	freed := make(map[string]bool, len(removed))
+	for _, p := range removed {
+		freed[p.Network()+":"+p.Addr()] = true
+	}
+
+	started := make(map[string]*Listener, len(added))
+	closeStarted := func() {
+		for _, l := range started {
+			l.Close()
+		}
+	}
+	var deferred []config.ProxyEntry
+	for _, p := range added {
+		if freed[p.Network()+":"+p.Addr()] {
+			deferred = append(deferred, p)
+			continue
+		}
+		l, err := m.startListener(p)
+		if err != nil {
+			closeStarted()
+			return err
+		}
+		started[ListenerKey(p)] = l
+	}
+
+	for _, p := range removed {
+		key := ListenerKey(p)
+		l := m.byKey[key]
+		if l == nil {
+			// A failed restore left the entry without a listener.
+			continue
+		}
+		addr := l.Addr().String()
+		l.Close()
+		m.mu.Lock()
+		delete(m.byKey, key)
+		m.mu.Unlock()
+		slog.Info("stopped listening", "instance", p.Instance, "addr", addr)
+	}
+
+	for _, p := range deferred {
+		l, err := m.startListener(p)
+		if err != nil {
+			closeStarted()
+			m.restore(removed)
+			return err
+		}
+		started[ListenerKey(p)] = l
+	}
+
+	m.mu.Lock()
+	for key, l := range started {
+		m.byKey[key] = l
+	}
+	m.proxies = next
+	m.mu.Unlock()
+	return nil
+}
+
+// restore restarts listeners for entries that a failed reload had already
+// stopped. Entries whose listener can't be restarted are dropped from the
+// running config, so that it only lists proxies that have a listener.
+func (m *Manager) restore(proxies []config.ProxyEntry) {
+	lost := make(map[string]bool)
+	for _, p := range proxies {
+		l, err := m.startListener(p)
+		if err != nil {
+			slog.Error("failed to restore listener", "instance", p.Instance, "addr", p.Addr(), "err", err)
+			lost[ListenerKey(p)] = true
+			continue
+		}
+		m.mu.Lock()
+		m.byKey[ListenerKey(p)] = l
+		m.mu.Unlock()
+	}
+	if len(lost) == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.proxies = slices.DeleteFunc(slices.Clone(m.proxies), func(p config.ProxyEntry) bool {
+		return lost[ListenerKey(p)]
+	})
+	m.mu.Unlock()
+}
+
+func (m *Manager) startListener(p config.ProxyEntry) (*Listener, error) {
+	l := m.newListener(p, m.dialer)
+	if err := l.Start(m.ctx); err != nil {
+		slog.Error("failed to start listener", "instance", p.Instance, "addr", p.Addr(), "err", err)
+		return nil, fmt.Errorf("starting listener for %s on %s: %w", p.Instance, p.Addr(), err)
+	}
+	slog.Info("listening", "instance", p.Instance, "addr", l.Addr().String())
+	return l, nil
+}
+
+// Listener returns the running listener for an entry, or nil if there is
+// none. For an entry with several ports, it is the listener on its first.
+func (m *Manager) Listener(p config.ProxyEntry) *Listener {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.byKey[ListenerKey(p)]
+}
+
+// AutoPorts returns the ports bound for entries with an automatic port, keyed
+// by instance, or nil if there are none.
+func (m *Manager) AutoPorts() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ports map[string]int
+	for _, p := range m.proxies {
+		if !p.AutoPort() {
+			continue
+		}
+		if l, ok := m.byKey[ListenerKey(p)]; ok {
+			if ports == nil {
+				ports = make(map[string]int)
+			}
+			ports[p.Instance] = l.Port
+		}
+	}
+	return ports
+}
+
+// Listeners returns the running listeners in config order.
+func (m *Manager) Listeners() []*Listener {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ls []*Listener
+	for _, p := range m.proxies {
+		if l, ok := m.byKey[ListenerKey(p)]; ok {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// Drain drains every listener concurrently, giving open connections up to
+// timeout to finish. See Listener.Drain.
+func (m *Manager) Drain(timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var wg sync.WaitGroup
+	for key, l := range m.byKey {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Drain(timeout)
+		}()
+		delete(m.byKey, key)
+	}
+	wg.Wait()
+}
+
+// Close closes every listener and its connections at once.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, l := range m.byKey {
+		l.Close()
+		delete(m.byKey, key)
+	}
+}
+
+// Reload asks RunDaemon to switch to Config. The outcome of Manager.Reload is
+// sent on Result, if it is set.
+type Reload struct {
+	Config *config.Config
+	Result chan<- error
+}
+
+// RunOptions configures RunDaemon.
+type RunOptions struct {
+	// Dialer connects the listeners to their instances.
+	Dialer Dialer
+
+	// NewListener creates each listener before it is started, e.g. to set
+	// its loggers. Nil means NewProxyListener.
+	NewListener func(config.ProxyEntry, Dialer) *Listener
+
+	// Reloads carries configs to switch the running listeners to. Nil
+	// means the config is never reloaded.
+	Reloads <-chan Reload
+
+	// Started, if set, is called once every listener is bound, with the
+	// Manager running them.
+	Started func(*Manager)
+}
+
+// RunDaemon serves cfg's proxies until ctx is done, applying the reloads it
+// receives in between, then stops accepting connections and gives open ones
+// up to the config's shutdown timeout to finish. The config's on_start hook
+// runs for each listener once they are all bound, and its on_stop hook once
+// they have been drained. It returns an error only if the listeners can't be
+// started.
+func RunDaemon(ctx context.Context, cfg *config.Config, opts RunOptions) error {
+	// The listeners outlive ctx until they are drained, so connections
+	// aren't cut off as soon as shutdown begins.
+	listenCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	m := NewManager(listenCtx, opts.Dialer, opts.NewListener)
+	if err := m.Start(cfg.Proxies); err != nil {
+		return err
+	}
+	startedAt := time.Now()
+	if opts.Started != nil {
+		opts.Started(m)
+	}
+
+	// Start hooks run in the background, so a slow one doesn't hold up
+	// reloads, but are waited for before the stop hooks.
+	startHooks := make(chan struct{})
+	go func() {
+		defer close(startHooks)
+		runHooks(listenCtx, HookStart, cfg.OnStart, m.Listeners())
+	}()
+
+	for {
+		select {
+		case r := <-opts.Reloads:
+			err := m.Reload(r.Config.Proxies)
+			if err == nil {
+				cfg = r.Config
+			}
+			if r.Result != nil {
+				r.Result <- err
+			}
+		case <-ctx.Done():
+			listeners := m.Listeners()
+			m.Drain(cfg.ShutdownTimeoutOrDefault())
+			logShutdownSummary(listeners, time.Since(startedAt))
+			<-startHooks
+			runHooks(listenCtx, HookStop, cfg.OnStop, listeners)
+			return nil
+		}
+	}
+}
+
+// logShutdownSummary logs per-instance and total traffic served by the daemon.
+// Listeners must be closed first so that all in-flight copies are counted.
+func logShutdownSummary(listeners []*Listener, uptime time.Duration) {
+	var conns, sent, received int64
+	for _, l := range listeners {
+		slog.Info("traffic served", "instance", l.Instance,
+			"connections", l.TotalConns(), "sent", l.BytesSent(), "received", l.BytesReceived())
+		conns += l.TotalConns()
+		sent += l.BytesSent()
+		received += l.BytesReceived()
+	}
+	slog.Info("total traffic served", "connections", conns, "sent", sent, "received", received,
+		"uptime", uptime.Round(time.Second))
+}
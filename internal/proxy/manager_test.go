@@ -0,0 +1,474 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud-sql-proxy-runner/internal/config"
+)
+
+var (
+	proxyA = config.ProxyEntry{Instance: "proj:us-central1:db-a", Port: 5432, Secret: "secret-a"}
+	proxyB = config.ProxyEntry{Instance: "proj:us-central1:db-b", Port: 5433, Secret: "secret-b"}
+	proxyC = config.ProxyEntry{Instance: "proj:us-central1:db-c", Port: 5434, Secret: "secret-c"}
+)
+
+func instances(proxies []config.ProxyEntry) []string {
+	var names []string
+	for _, p := range proxies {
+		names = append(names, p.Instance)
+	}
+	return names
+}
+
+func TestDiffProxies_Unchanged(t *testing.T) {
+	added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB}, []config.ProxyEntry{proxyA, proxyB})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no changes, got added=%v removed=%v", instances(added), instances(removed))
+	}
+}
+
+func TestDiffProxies_Reordered(t *testing.T) {
+	added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB, proxyC}, []config.ProxyEntry{proxyC, proxyA, proxyB})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no changes, got added=%v removed=%v", instances(added), instances(removed))
+	}
+}
+
+func TestDiffProxies_ProxyAdded(t *testing.T) {
+	added, removed := diffProxies([]config.ProxyEntry{proxyA}, []config.ProxyEntry{proxyA, proxyB})
+	if len(added) != 1 || added[0].Instance != proxyB.Instance {
+		t.Errorf("expected %s added, got %v", proxyB.Instance, instances(added))
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected nothing removed, got %v", instances(removed))
+	}
+}
+
+func TestDiffProxies_ProxyRemoved(t *testing.T) {
+	added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB}, []config.ProxyEntry{proxyA})
+	if len(added) != 0 {
+		t.Errorf("expected nothing added, got %v", instances(added))
+	}
+	if len(removed) != 1 || removed[0].Instance != proxyB.Instance {
+		t.Errorf("expected %s removed, got %v", proxyB.Instance, instances(removed))
+	}
+}
+
+func TestDiffProxies_PortChanged(t *testing.T) {
+	changed := proxyA
+	changed.Port = 6000
+
+	added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB}, []config.ProxyEntry{changed, proxyB})
+	if len(added) != 1 || added[0].Port != 6000 {
+		t.Errorf("expected port 6000 added, got %v", added)
+	}
+	if len(removed) != 1 || removed[0].Port != proxyA.Port {
+		t.Errorf("expected port %d removed, got %v", proxyA.Port, removed)
+	}
+}
+
+func TestDiffProxies_SocketChanged(t *testing.T) {
+	sock := config.ProxyEntry{Instance: proxyA.Instance, Socket: "/tmp/a/.s.PGSQL.5432", Secret: "secret-a"}
+
+	added, removed := diffProxies([]config.ProxyEntry{proxyA}, []config.ProxyEntry{sock})
+	if len(added) != 1 || added[0].Socket != sock.Socket {
+		t.Errorf("expected socket listener added, got %v", added)
+	}
+	if len(removed) != 1 || removed[0].Port != proxyA.Port {
+		t.Errorf("expected port listener removed, got %v", removed)
+	}
+}
+
+func TestDiffProxies_SecretChanged(t *testing.T) {
+	changed := proxyA
+	changed.Secret = "rotated"
+
+	added, removed := diffProxies([]config.ProxyEntry{proxyA}, []config.ProxyEntry{changed})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("secret change should keep the listener, got added=%v removed=%v", instances(added), instances(removed))
+	}
+}
+
+func TestDiffProxies_SettingsChanged(t *testing.T) {
+	for name, change := range map[string]func(*config.ProxyEntry){
+		"idle_timeout":      func(p *config.ProxyEntry) { p.IdleTimeout = "5m" },
+		"max_connections":   func(p *config.ProxyEntry) { p.MaxConnections = 10 },
+		"rate_limit":        func(p *config.ProxyEntry) { p.RateLimit = 1 << 20 },
+		"dial_timeout":      func(p *config.ProxyEntry) { p.DialTimeout = "5s" },
+		"dial_attempts":     func(p *config.ProxyEntry) { p.DialAttempts = 1 },
+		"buffer_size":       func(p *config.ProxyEntry) { p.BufferSize = 4096 },
+		"max_conn_lifetime": func(p *config.ProxyEntry) { p.MaxLifetime = "1h" },
+		"log_level":         func(p *config.ProxyEntry) { p.LogLevel = "debug" },
+		"access_log":        func(p *config.ProxyEntry) { p.AccessLog = true },
+		"tags":              func(p *config.ProxyEntry) { p.Tags = map[string]string{"team": "payments"} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			changed := proxyA
+			change(&changed)
+			added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB}, []config.ProxyEntry{changed, proxyB})
+			if len(added) != 1 || len(removed) != 1 || added[0].Instance != proxyA.Instance || removed[0].Instance != proxyA.Instance {
+				t.Errorf("expected %s's listener to be replaced, got added=%v removed=%v", proxyA.Instance, instances(added), instances(removed))
+			}
+		})
+	}
+
+	// Spelling out a default is no change.
+	explicit := proxyA
+	explicit.DialAttempts = config.DefaultDialAttempts
+	if added, removed := diffProxies([]config.ProxyEntry{proxyA}, []config.ProxyEntry{explicit}); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no changes, got added=%v removed=%v", instances(added), instances(removed))
+	}
+}
+
+func TestDiffProxies_ProxyReplaced(t *testing.T) {
+	replacement := proxyC
+	replacement.Port = proxyB.Port
+
+	added, removed := diffProxies([]config.ProxyEntry{proxyA, proxyB}, []config.ProxyEntry{proxyA, replacement})
+	if len(added) != 1 || added[0].Instance != proxyC.Instance {
+		t.Errorf("expected %s added, got %v", proxyC.Instance, instances(added))
+	}
+	if len(removed) != 1 || removed[0].Instance != proxyB.Instance {
+		t.Errorf("expected %s removed, got %v", proxyB.Instance, instances(removed))
+	}
+}
+
+// failDialer is a Dialer whose dials always fail, so test connections are
+// accepted and then closed.
+type failDialer struct{}
+
+func (failDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	return nil, errors.New("dial not supported in tests")
+}
+
+func (failDialer) Close() error { return nil }
+
+// freePorts returns n ports that were free at the time of the call.
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	var ports []int
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer ln.Close()
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+func TestManagerReload_KeepsUnchangedListeners(t *testing.T) {
+	ports := freePorts(t, 3)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	c := config.ProxyEntry{Instance: proxyC.Instance, Port: ports[2], Secret: "s"}
+
+	set := NewManager(context.Background(), failDialer{}, nil)
+	if err := set.Start([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+	before := set.byKey[ListenerKey(a)]
+
+	if err := set.Reload([]config.ProxyEntry{a, c}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if set.byKey[ListenerKey(a)] != before {
+		t.Error("unchanged proxy should keep its listener")
+	}
+	if _, ok := set.byKey[ListenerKey(b)]; ok {
+		t.Error("removed proxy should have no listener")
+	}
+	if got := len(set.Listeners()); got != 2 {
+		t.Errorf("expected 2 listeners, got %d", got)
+	}
+	conn, err := net.Dial("tcp", c.Addr())
+	if err != nil {
+		t.Fatalf("new listener not accepting: %v", err)
+	}
+	conn.Close()
+}
+
+func TestManagerReload_AppliesChangedSettings(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+	dialer := &mockDialer{dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+		return remoteServer, nil
+	}}
+	set := NewManager(context.Background(), dialer, nil)
+	if err := set.Start([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+	before := set.Listener(b)
+
+	a.IdleTimeout = "50ms"
+	if err := set.Reload([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if set.Listener(b) != before {
+		t.Error("unchanged proxy should keep its listener")
+	}
+	if got := set.Listener(a).IdleTimeout; got != 50*time.Millisecond {
+		t.Fatalf("expected idle_timeout 50ms after reload, got %s", got)
+	}
+
+	// A connection through the replaced listener is closed once idle.
+	conn, err := net.Dial("tcp", a.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+}
+
+func TestManagerReload_ReusesFreedPort(t *testing.T) {
+	ports := freePorts(t, 1)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[0], Secret: "s"}
+
+	set := NewManager(context.Background(), failDialer{}, nil)
+	if err := set.Start([]config.ProxyEntry{a}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+
+	if err := set.Reload([]config.ProxyEntry{b}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	ls := set.Listeners()
+	if len(ls) != 1 || ls[0].Instance != b.Instance {
+		t.Errorf("expected a listener for %s, got %v", b.Instance, ls)
+	}
+}
+
+func TestManagerReload_PortInUseKeepsOldConfig(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+
+	set := NewManager(context.Background(), failDialer{}, nil)
+	if err := set.Start([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	c := config.ProxyEntry{Instance: proxyC.Instance, Port: busy.Addr().(*net.TCPAddr).Port, Secret: "s"}
+
+	if err := set.Reload([]config.ProxyEntry{a, c}); err == nil {
+		t.Fatal("expected error for port in use")
+	}
+
+	if got := instances(set.proxies); len(got) != 2 || got[1] != b.Instance {
+		t.Errorf("expected old config to be kept, got %v", got)
+	}
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatalf("old listener should still be accepting: %v", err)
+	}
+	conn.Close()
+}
+
+func TestManagerReload_AfterFailedRestore(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := config.ProxyEntry{Instance: proxyA.Instance, Port: ports[0], Secret: "s"}
+	b := config.ProxyEntry{Instance: proxyB.Instance, Port: ports[1], Secret: "s"}
+	c := config.ProxyEntry{Instance: proxyC.Instance, Port: ports[0], Secret: "s"}
+
+	// While fail is set, every new listener gets an address it can't bind.
+	var fail atomic.Bool
+	newListener := func(p config.ProxyEntry, d Dialer) *Listener {
+		l := NewProxyListener(p, d)
+		if fail.Load() {
+			l.Host = "256.0.0.1"
+		}
+		return l
+	}
+	set := NewManager(context.Background(), failDialer{}, newListener)
+	if err := set.Start([]config.ProxyEntry{a, b}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer set.Close()
+
+	// c takes over a's port, so it is started after a and b are stopped.
+	// It fails, and so does restoring them.
+	fail.Store(true)
+	if err := set.Reload([]config.ProxyEntry{c}); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	fail.Store(false)
+	if got := instances(set.proxies); len(got) != 0 {
+		t.Errorf("expected the unrestored proxies to be dropped, got %v", got)
+	}
+
+	// A later reload must not trip over the lost listeners.
+	if err := set.Reload([]config.ProxyEntry{a}); err != nil {
+		t.Fatalf("second reload: %v", err)
+	}
+	conn, err := net.Dial("tcp", a.Addr())
+	if err != nil {
+		t.Fatalf("a should be listening again: %v", err)
+	}
+	conn.Close()
+}
+
+// echoDialer is a Dialer whose connections echo back the first message they
+// receive, then close.
+type echoDialer struct{}
+
+func (echoDialer) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 64)
+		n, err := server.Read(buf)
+		if err == nil {
+			server.Write(buf[:n])
+		}
+	}()
+	return client, nil
+}
+
+func (echoDialer) Close() error { return nil }
+
+// roundTrip sends a message through l and checks that it is echoed back.
+func roundTrip(t *testing.T, l *Listener) {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial %s: %v", l.Instance, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the message echoed through %s, got %q, %v", l.Instance, buf, err)
+	}
+}
+
+func TestRunDaemon_StartReloadStop(t *testing.T) {
+	a := config.ProxyEntry{Instance: proxyA.Instance}
+	b := config.ProxyEntry{Instance: proxyB.Instance}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	reloads := make(chan Reload)
+	started := make(chan *Manager, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunDaemon(ctx, &config.Config{Proxies: []config.ProxyEntry{a}}, RunOptions{
+			Dialer:  echoDialer{},
+			Reloads: reloads,
+			Started: func(m *Manager) { started <- m },
+		})
+	}()
+	var m *Manager
+	select {
+	case m = <-started:
+	case err := <-done:
+		t.Fatalf("RunDaemon: %v", err)
+	}
+	first := m.Listener(a)
+	if first == nil {
+		t.Fatalf("expected a listener for %s", a.Instance)
+	}
+	roundTrip(t, first)
+
+	reload := func(proxies ...config.ProxyEntry) error {
+		result := make(chan error, 1)
+		reloads <- Reload{Config: &config.Config{Proxies: proxies}, Result: result}
+		return <-result
+	}
+
+	// Adding a proxy starts its listener and keeps the other.
+	if err := reload(a, b); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if m.Listener(a) != first {
+		t.Error("unchanged proxy should keep its listener")
+	}
+	if got := len(m.Listeners()); got != 2 {
+		t.Fatalf("expected 2 listeners, got %d", got)
+	}
+	roundTrip(t, m.Listener(b))
+
+	// A port in use fails the reload and keeps both.
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	c := config.ProxyEntry{Instance: proxyC.Instance, Port: busy.Addr().(*net.TCPAddr).Port}
+	if err := reload(a, b, c); err == nil {
+		t.Error("expected an error for a port in use")
+	}
+	if got := len(m.Listeners()); got != 2 {
+		t.Errorf("expected the 2 listeners to keep running, got %d", got)
+	}
+
+	// Removing a proxy closes only its listener.
+	if err := reload(b); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if m.Listener(a) != nil {
+		t.Error("removed proxy should have no listener")
+	}
+	addr := m.Listener(b).Addr().String()
+
+	stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RunDaemon: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunDaemon did not return after ctx was canceled")
+	}
+	if got := len(m.Listeners()); got != 0 {
+		t.Errorf("expected no listeners after shutdown, got %d", got)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("expected %s to be closed after shutdown", addr)
+	}
+}
+
+func TestRunDaemon_StartFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	p := config.ProxyEntry{Instance: proxyA.Instance, Port: busy.Addr().(*net.TCPAddr).Port}
+
+	err = RunDaemon(context.Background(), &config.Config{Proxies: []config.ProxyEntry{p}}, RunOptions{
+		Dialer:  failDialer{},
+		Started: func(*Manager) { t.Error("Started called although a listener failed") },
+	})
+	if err == nil {
+		t.Fatal("expected an error for a port in use")
+	}
+}
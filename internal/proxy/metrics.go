@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// metric describes one per-listener series exposed by MetricsHandler.
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(l *Listener) int64
+}
+
+var metrics = []metric{
+	{"cspr_connections_total", "Client connections accepted.", "counter", func(l *Listener) int64 { return l.TotalConns() }},
+	{"cspr_active_connections", "Client connections currently open.", "gauge", func(l *Listener) int64 { return int64(l.ActiveConns()) }},
+	{"cspr_dial_errors_total", "Failed attempts to dial the instance.", "counter", func(l *Listener) int64 { return l.DialErrors() }},
+	{"cspr_bytes_sent_total", "Bytes copied from clients to the instance.", "counter", func(l *Listener) int64 { return l.BytesSent() }},
+	{"cspr_bytes_received_total", "Bytes copied from the instance to clients.", "counter", func(l *Listener) int64 { return l.BytesReceived() }},
+}
+
+// MetricsHandler serves the listeners' counters in the Prometheus text
+// exposition format, labeled by instance and the proxy's tags. listeners is
+// called on every scrape so that reloaded proxies are picked up.
+func MetricsHandler(listeners func() []*Listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w, listeners())
+	})
+}
+
+// WriteMetrics writes the listeners' counters in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer, listeners []*Listener) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		// A proxy with several ports has a listener per port; its series
+		// is their sum.
+		var instances []*Listener
+		sums := make(map[string]int64)
+		for _, l := range listeners {
+			if _, ok := sums[l.Instance]; !ok {
+				instances = append(instances, l)
+			}
+			sums[l.Instance] += m.value(l)
+		}
+		for _, l := range instances {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, metricLabels(l), sums[l.Instance])
+		}
+	}
+}
+
+// metricLabels returns the label pairs for a listener's series: its
+// instance, then its tags sorted by name.
+func metricLabels(l *Listener) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `instance="%s"`, escapeLabel(l.Instance))
+	for _, k := range slices.Sorted(maps.Keys(l.Tags)) {
+		fmt.Fprintf(&b, `,%s="%s"`, labelName(k), escapeLabel(l.Tags[k]))
+	}
+	return b.String()
+}
+
+// labelName turns a tag name into a valid Prometheus label name, replacing
+// characters other than letters, digits, and underscores with underscores.
+// Names that would clash with the instance label or the reserved "__"
+// prefix, or that start with a digit, are prefixed with "tag_".
+func labelName(tag string) string {
+	name := []byte(tag)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	s := string(name)
+	if s == "" || s == "instance" || strings.HasPrefix(s, "__") || s[0] >= '0' && s[0] <= '9' {
+		s = "tag_" + s
+	}
+	return s
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
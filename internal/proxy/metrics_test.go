@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	l := NewListener("proj:region:db", "", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	// One connection whose dial fails.
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+
+	srv := httptest.NewServer(MetricsHandler(func() []*Listener { return []*Listener{l} }))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		"# TYPE cspr_connections_total counter",
+		`cspr_connections_total{instance="proj:region:db"} 1`,
+		`cspr_active_connections{instance="proj:region:db"} 0`,
+		`cspr_dial_errors_total{instance="proj:region:db"} 1`,
+		`cspr_bytes_sent_total{instance="proj:region:db"} 0`,
+		`cspr_bytes_received_total{instance="proj:region:db"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteMetrics_Tags(t *testing.T) {
+	l := NewListener("proj:region:db", "", 0, &mockDialer{})
+	l.Tags = map[string]string{"tier": "prod", "team": `pay"ments`, "cost-center": "42", "instance": "x", "1st": "y"}
+
+	var b strings.Builder
+	WriteMetrics(&b, []*Listener{l})
+	want := `cspr_connections_total{instance="proj:region:db",tag_1st="y",cost_center="42",tag_instance="x",team="pay\"ments",tier="prod"} 0`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("expected metrics to contain %q, got:\n%s", want, b.String())
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	for tag, want := range map[string]string{
+		"team":                   "team",
+		"cost-center":            "cost_center",
+		"app.kubernetes.io/name": "app_kubernetes_io_name",
+		"1st":                    "tag_1st",
+		"instance":               "tag_instance",
+		"__name__":               "tag___name__",
+	} {
+		if got := labelName(tag); got != want {
+			t.Errorf("labelName(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("unexpected escaping: %s", got)
+	}
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalProcess_DeliveredToNotifySignals(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	NotifySignals(c, syscall.SIGHUP)
+
+	if err := SignalProcess(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("SignalProcess: %v", err)
+	}
+	select {
+	case sig := <-c:
+		if sig != syscall.SIGHUP {
+			t.Errorf("got %v, want SIGHUP", sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("signal not delivered")
+	}
+}
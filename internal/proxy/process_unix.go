@@ -0,0 +1,95 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SigReloadSecrets asks the daemon to re-fetch its secrets.
+const SigReloadSecrets = syscall.SIGUSR1
+
+// SigDumpState asks the daemon to log a snapshot of its listeners.
+const SigDumpState = syscall.SIGUSR2
+
+func IsRunning(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Unix, FindProcess always succeeds. Send signal 0 to check if alive.
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil
+}
+
+// DaemonSysProcAttr returns the attributes that detach a re-executed daemon
+// from the caller: a new session, so it outlives the terminal.
+func DaemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// SignalProcess sends sig to the process with the given pid.
+func SignalProcess(pid int, sig syscall.Signal) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+// NotifySignals relays sigs sent to this process, by SignalProcess or
+// anything else, to c.
+func NotifySignals(c chan<- os.Signal, sigs ...syscall.Signal) {
+	for _, sig := range sigs {
+		signal.Notify(c, sig)
+	}
+}
+
+// ReopenLog opens the log file at path, creating it if it was moved away, and
+// points this process's stdout and stderr at it. A detached daemon writes its
+// log to those, so after logrotate renames the file this carries on in a new
+// one rather than the renamed file.
+func ReopenLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	defer f.Close()
+	for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())} {
+		if err := unix.Dup2(int(f.Fd()), fd); err != nil {
+			return fmt.Errorf("redirecting output to log file: %w", err)
+		}
+	}
+	return nil
+}
+
+// PortOwners returns the pids of processes listening on TCP port, as reported
+// by lsof.
+func PortOwners(port int) ([]int, error) {
+	out, err := exec.Command("lsof", "-t", "-nP", "-iTCP:"+strconv.Itoa(port), "-sTCP:LISTEN").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(out) == 0 {
+		return nil, nil // lsof exits 1 when nothing matches
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running lsof: %w", err)
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(out)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected lsof output %q", field)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
@@ -0,0 +1,101 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDaemonSysProcAttr_NewSession(t *testing.T) {
+	if !DaemonSysProcAttr().Setsid {
+		t.Error("daemon should be started in a new session")
+	}
+}
+
+func TestPortOwners(t *testing.T) {
+	if _, err := exec.LookPath("lsof"); err != nil {
+		t.Skip("lsof not installed")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	pids, err := PortOwners(port)
+	if err != nil {
+		t.Fatalf("PortOwners: %v", err)
+	}
+	if !slices.Contains(pids, os.Getpid()) {
+		t.Errorf("PortOwners(%d) = %v, want it to include this process (%d)", port, pids, os.Getpid())
+	}
+
+	ln.Close()
+	pids, err = PortOwners(port)
+	if err != nil {
+		t.Fatalf("PortOwners after close: %v", err)
+	}
+	if len(pids) != 0 {
+		t.Errorf("PortOwners(%d) after close = %v, want none", port, pids)
+	}
+}
+
+func TestReopenLog_AfterRotation(t *testing.T) {
+	// Put the test's own stdout and stderr back afterwards.
+	for _, fd := range []int{1, 2} {
+		saved, err := unix.Dup(fd)
+		if err != nil {
+			t.Fatalf("dup: %v", err)
+		}
+		t.Cleanup(func() {
+			unix.Dup2(saved, fd)
+			unix.Close(saved)
+		})
+	}
+	sigCh := make(chan os.Signal, 1)
+	NotifySignals(sigCh, syscall.SIGHUP)
+	t.Cleanup(func() { signal.Stop(sigCh) })
+
+	path := filepath.Join(t.TempDir(), LogFile)
+	if err := ReopenLog(path); err != nil {
+		t.Fatalf("ReopenLog: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, "before rotation")
+
+	// Rotate like logrotate: rename the file, then send SIGHUP.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := SignalProcess(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("SignalProcess: %v", err)
+	}
+	select {
+	case <-sigCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("SIGHUP not received")
+	}
+	if err := ReopenLog(path); err != nil {
+		t.Fatalf("ReopenLog: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, "after rotation")
+	fmt.Fprintln(os.Stdout, "stdout too")
+
+	if data, _ := os.ReadFile(rotated); string(data) != "before rotation\n" {
+		t.Errorf("rotated file = %q, want only the line before rotation", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "after rotation\nstdout too\n" {
+		t.Errorf("new log file = %q, want the lines after rotation", data)
+	}
+}
@@ -0,0 +1,132 @@
+//go:build windows
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// SigReloadSecrets asks the daemon to re-fetch its secrets. Windows has no
+// SIGUSR1; the number only has to be distinct, since it names an event.
+const SigReloadSecrets = syscall.Signal(0xa)
+
+// SigDumpState asks the daemon to log a snapshot of its listeners, like
+// SIGUSR2 elsewhere.
+const SigDumpState = syscall.Signal(0xc)
+
+// stillActive is the exit code GetExitCodeProcess reports for a process that
+// hasn't exited.
+const stillActive = 259
+
+func IsRunning(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// DaemonSysProcAttr returns the attributes that detach a re-executed daemon
+// from the caller: no console, and its own process group so Ctrl-C in the
+// caller's console doesn't reach it.
+func DaemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+}
+
+// signalEventName names the event a process waits on for sig. Windows has no
+// signals to send another process, so each one NotifySignals listens for is
+// a named event that SignalProcess sets.
+func signalEventName(pid int, sig syscall.Signal) string {
+	return fmt.Sprintf(`Local\cloud-sql-proxy-runner-%d-signal-%d`, pid, int(sig))
+}
+
+// SignalProcess delivers sig to the process with the given pid, which must be
+// listening for it with NotifySignals.
+func SignalProcess(pid int, sig syscall.Signal) error {
+	name, err := windows.UTF16PtrFromString(signalEventName(pid, sig))
+	if err != nil {
+		return err
+	}
+	h, err := windows.OpenEvent(windows.EVENT_MODIFY_STATE, false, name)
+	if err != nil {
+		return fmt.Errorf("process %d is not accepting %v: %w", pid, sig, err)
+	}
+	defer windows.CloseHandle(h)
+	return windows.SetEvent(h)
+}
+
+// NotifySignals relays sigs to c, whether they are sent by SignalProcess or,
+// for console interrupts, by the system.
+func NotifySignals(c chan<- os.Signal, sigs ...syscall.Signal) {
+	for _, sig := range sigs {
+		signal.Notify(c, sig)
+		name, err := windows.UTF16PtrFromString(signalEventName(os.Getpid(), sig))
+		if err != nil {
+			continue
+		}
+		h, err := windows.CreateEvent(nil, 0, 0, name)
+		if err != nil {
+			continue
+		}
+		go func() {
+			for {
+				if _, err := windows.WaitForSingleObject(h, windows.INFINITE); err != nil {
+					return
+				}
+				c <- sig
+			}
+		}()
+	}
+}
+
+// ReopenLog does nothing on Windows, where a file can't be renamed while the
+// daemon has it open, so the log is never rotated out from under it.
+func ReopenLog(path string) error {
+	return nil
+}
+
+// PortOwners returns the pids of processes listening on TCP port, as reported
+// by netstat.
+func PortOwners(port int) ([]int, error) {
+	out, err := exec.Command("netstat", "-ano", "-p", "TCP").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running netstat: %w", err)
+	}
+	return parseNetstat(string(out), port), nil
+}
+
+// parseNetstat picks the pids listening on port out of netstat -ano output,
+// whose TCP rows are: proto, local address, foreign address, state, pid.
+func parseNetstat(out string, port int) []int {
+	suffix := ":" + strconv.Itoa(port)
+	seen := make(map[int]bool)
+	var pids []int
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[0] != "TCP" || fields[3] != "LISTENING" || !strings.HasSuffix(fields[1], suffix) {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+	}
+	return pids
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestDaemonSysProcAttr_Detached(t *testing.T) {
+	flags := DaemonSysProcAttr().CreationFlags
+	if flags&windows.DETACHED_PROCESS == 0 || flags&windows.CREATE_NEW_PROCESS_GROUP == 0 {
+		t.Errorf("daemon should be detached in a new process group, got flags %#x", flags)
+	}
+}
+
+func TestIsRunning_ExitedProcess(t *testing.T) {
+	cmd := exec.Command(os.Getenv("ComSpec"), "/c", "exit 0")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("running child: %v", err)
+	}
+	if IsRunning(cmd.ProcessState.Pid()) {
+		t.Error("expected IsRunning to return false for an exited process")
+	}
+}
+
+func TestSignalProcess_NotListening(t *testing.T) {
+	if err := SignalProcess(os.Getpid(), syscall.SIGQUIT); err == nil {
+		t.Error("expected error signaling a process that isn't listening")
+	}
+}
+
+func TestParseNetstat(t *testing.T) {
+	out := `
+Active Connections
+
+  Proto  Local Address          Foreign Address        State           PID
+  TCP    0.0.0.0:5432           0.0.0.0:0              LISTENING       1234
+  TCP    [::]:5432              [::]:0                 LISTENING       1234
+  TCP    127.0.0.1:15432        0.0.0.0:0              LISTENING       99
+  TCP    127.0.0.1:5432         127.0.0.1:50000        ESTABLISHED     1234
+  TCP    127.0.0.1:50000        127.0.0.1:5432         ESTABLISHED     4321
+`
+	pids := parseNetstat(out, 5432)
+	if len(pids) != 1 || pids[0] != 1234 {
+		t.Errorf("parseNetstat = %v, want [1234]", pids)
+	}
+}
@@ -2,11 +2,34 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultBufferSize is the copy buffer size of listeners that don't set
+// BufferSize, the same as io.Copy's.
+const defaultBufferSize = 32 * 1024
+
+// maxDialRetryDelay caps the backoff between dial attempts.
+const maxDialRetryDelay = 2 * time.Second
+
+// minAcceptRetryDelay and maxAcceptRetryDelay bound the backoff after a
+// temporary accept error, such as running out of file descriptors.
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
 )
 
 type Dialer interface {
@@ -16,87 +39,700 @@ type Dialer interface {
 
 type Listener struct {
 	Instance string
+	Host     string
 	Port     int
+	Socket   string // Unix socket path; when set, Host and Port are unused
+
+	// Tags are the proxy's metadata, added to its metrics as labels.
+	Tags map[string]string
+
+	// DialAttempts is how many times to try dialing the instance for each
+	// client connection; values below 2 disable retries. DialRetryDelay is
+	// the wait before the first retry, doubled after each further failure.
+	DialAttempts   int
+	DialRetryDelay time.Duration
+
+	// DialTimeout bounds each dial attempt, so a backend that never answers
+	// can't hold a client connection open forever. Zero means no limit.
+	DialTimeout time.Duration
+
+	// IdleTimeout closes a proxied connection once no data has flowed in
+	// either direction for this long. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes a proxied connection this long after it was
+	// accepted, however busy it is. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// MaxConns caps the number of connections handled at once; connections
+	// beyond it are closed as soon as they are accepted. Zero means no limit.
+	MaxConns int
+
+	// RateLimit caps each connection's throughput, in bytes per second, in
+	// each direction. Zero means no limit.
+	RateLimit int
+
+	// BufferSize is the size of the buffer each direction of a connection
+	// is copied through. Larger buffers suit bulk transfers, smaller ones
+	// save memory with many connections. Zero means 32 KiB.
+	BufferSize int
+
+	// ReusePort binds a TCP port with SO_REUSEPORT, so that another daemon
+	// can listen on it too while taking over from this one. See ListenTCP.
+	ReusePort bool
+
+	// Logger receives the listener's log entries, which carry its instance
+	// and port or socket. Nil means slog.Default().
+	Logger *slog.Logger
+
+	// AccessLog, when set, receives an entry for each connection once it
+	// closes, with the client address, start time, duration, and bytes
+	// transferred. Nil disables access logging.
+	AccessLog *slog.Logger
+
 	listener net.Listener
 	dialer   Dialer
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
+	sem      chan struct{} // holds a token per active connection when MaxConns is set
+	closing  atomic.Bool
+	// accepting is set while the accept loop is running.
+	accepting atomic.Bool
+
+	// socketFile identifies the socket file the listener bound, if any.
+	socketFile os.FileInfo
+
+	// conns holds the open client and instance connections so Drain can
+	// close them. Once forceClosed is set, new connections are closed as
+	// soon as they are tracked.
+	connsMu     sync.Mutex
+	conns       map[net.Conn]struct{}
+	forceClosed bool
+
+	// clients holds an entry per connection being handled, for Connections.
+	clientsMu sync.Mutex
+	clients   map[*connEntry]struct{}
+
+	activeConns   atomic.Int64
+	totalConns    atomic.Int64
+	dialedConns   atomic.Int64
+	dialErrors    atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	// lastDialErr is the most recent failed dial attempt, if any.
+	lastDialErr atomic.Pointer[DialError]
+}
+
+// DialError is a failed attempt to dial a listener's instance.
+type DialError struct {
+	Err string    `json:"err"`
+	At  time.Time `json:"at"`
 }
 
-func NewListener(instance string, port int, dialer Dialer) *Listener {
+// NewListener creates a listener that proxies connections on host:port to
+// instance. An empty host means localhost.
+func NewListener(instance, host string, port int, dialer Dialer) *Listener {
+	if host == "" {
+		host = "localhost"
+	}
 	return &Listener{
 		Instance: instance,
+		Host:     host,
 		Port:     port,
 		dialer:   dialer,
 	}
 }
 
+// NewSocketListener creates a listener that proxies connections on the Unix
+// socket at path to instance.
+func NewSocketListener(instance, path string, dialer Dialer) *Listener {
+	return &Listener{
+		Instance: instance,
+		Socket:   path,
+		dialer:   dialer,
+	}
+}
+
 func (l *Listener) Start(ctx context.Context) error {
-	addr := fmt.Sprintf("localhost:%d", l.Port)
-	ln, err := net.Listen("tcp", addr)
+	ln, err := l.listen()
 	if err != nil {
-		return fmt.Errorf("listening on %s: %w", addr, err)
+		return err
 	}
+	l.serve(ctx, ln)
+	return nil
+}
+
+// serve starts accepting connections on ln.
+func (l *Listener) serve(ctx context.Context, ln net.Listener) {
 	l.listener = ln
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && l.Port == 0 {
+		// Port 0 asked the OS to pick one.
+		l.Port = addr.Port
+	}
 	l.ctx, l.cancel = context.WithCancel(ctx)
+	if l.MaxConns > 0 {
+		l.sem = make(chan struct{}, l.MaxConns)
+	}
 
+	l.accepting.Store(true)
 	l.wg.Add(1)
 	go l.acceptLoop()
+}
+
+func (l *Listener) listen() (net.Listener, error) {
+	if l.Socket == "" {
+		addr := net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+		ln, err := ListenTCP(addr, l.ReusePort)
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		return ln, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.Socket), 0755); err != nil {
+		return nil, fmt.Errorf("creating socket dir: %w", err)
+	}
+	ln, info, err := listenUnix(l.Socket)
+	if err != nil {
+		return nil, err
+	}
+	l.socketFile = info
+	return ln, nil
+}
+
+// ListenTCP listens on the TCP address addr. With reuse, the port is bound
+// with SO_REUSEPORT, so that a daemon taking over with restart --graceful can
+// bind it while this one still listens; both sockets must set it.
+func ListenTCP(addr string, reuse bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reuse {
+		lc.Control = reusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenUnix listens on a Unix socket at path, replacing any socket file
+// already there, and returns the file it created. Closing the listener leaves
+// the file; see removeSocket.
+func listenUnix(path string) (net.Listener, os.FileInfo, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening on %s: %w", path, err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	info, err := os.Stat(path)
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return ln, info, nil
+}
+
+// removeSocket removes the socket file at path if it is still the one
+// described by info. A daemon taking over binds its own socket at the same
+// path, which the one it replaces must leave alone.
+func removeSocket(path string, info os.FileInfo) {
+	if current, err := os.Stat(path); err == nil && os.SameFile(current, info) {
+		os.Remove(path)
+	}
+}
 
+// removeStaleSocket removes a socket file left behind by a previous run.
+// Anything at path that isn't a socket is left alone so that a typo in the
+// config can't delete a regular file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing stale socket: %w", err)
+	}
 	return nil
 }
 
 func (l *Listener) acceptLoop() {
 	defer l.wg.Done()
+	defer l.accepting.Store(false)
+	var delay time.Duration
 	for {
 		conn, err := l.listener.Accept()
 		if err != nil {
+			if l.closing.Load() || l.ctx.Err() != nil {
+				return
+			}
+			if !temporaryAcceptError(err) {
+				l.logger().Error("accept failed, no longer accepting connections", "err", err)
+				return
+			}
+			delay = min(max(2*delay, minAcceptRetryDelay), maxAcceptRetryDelay)
+			l.logger().Warn("accept failed, retrying", "delay", delay, "err", err)
 			select {
+			case <-time.After(delay):
 			case <-l.ctx.Done():
 				return
-			default:
-				log.Printf("accept error on port %d: %v", l.Port, err)
-				return
 			}
+			continue
 		}
+		delay = 0
+		if !l.acquire() {
+			l.logger().Warn("connection limit reached, refusing connection", "max_connections", l.MaxConns)
+			conn.Close()
+			continue
+		}
+		l.totalConns.Add(1)
 		l.wg.Add(1)
 		go l.handleConn(conn)
 	}
 }
 
+// temporaryAcceptError reports whether an accept error may clear up on its
+// own, like running out of file descriptors, so accepting should go on.
+// net.Error's Temporary is deprecated for most errors, but it still marks
+// these, and net/http's server retries on it too.
+func temporaryAcceptError(err error) bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+// acquire reserves a connection slot, reporting false if MaxConns
+// connections are already being handled.
+func (l *Listener) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
 func (l *Listener) handleConn(clientConn net.Conn) {
 	defer l.wg.Done()
+	defer l.release()
 	defer clientConn.Close()
 
-	remoteConn, err := l.dialer.Dial(l.ctx, l.Instance)
+	l.activeConns.Add(1)
+	defer l.activeConns.Add(-1)
+
+	l.track(clientConn)
+	defer l.untrack(clientConn)
+
+	client := clientConn.RemoteAddr().String()
+	log := l.logger().With("client", client)
+	log.Debug("connection opened")
+
+	start := time.Now()
+	entry := l.register(client, start)
+	defer l.unregister(entry)
+
+	remoteConn, err := l.dial()
 	if err != nil {
-		log.Printf("dial error for %s: %v", l.Instance, err)
+		log.Warn("dial failed, closing connection", "err", err)
+		l.logAccess(client, start, 0, 0, err)
 		return
 	}
 	defer remoteConn.Close()
+	l.dialedConns.Add(1)
+	l.track(remoteConn)
+	defer l.untrack(remoteConn)
+
+	// Closing both ends unblocks the copies below once the connection has
+	// been idle too long.
+	activity := func() {}
+	if l.IdleTimeout > 0 {
+		idle := time.AfterFunc(l.IdleTimeout, func() {
+			log.Info("closing idle connection", "idle_timeout", l.IdleTimeout)
+			clientConn.Close()
+			remoteConn.Close()
+		})
+		defer idle.Stop()
+		activity = func() { idle.Reset(l.IdleTimeout) }
+	}
+	if l.MaxLifetime > 0 {
+		lifetime := time.AfterFunc(l.MaxLifetime-time.Since(start), func() {
+			log.Info("closing connection at max lifetime", "max_conn_lifetime", l.MaxLifetime)
+			clientConn.Close()
+			remoteConn.Close()
+		})
+		defer lifetime.Stop()
+	}
+
+	var fromClient, fromRemote io.Reader = clientConn, remoteConn
+	if l.RateLimit > 0 {
+		fromClient = newLimitedReader(l.ctx, clientConn, l.RateLimit)
+		fromRemote = newLimitedReader(l.ctx, remoteConn, l.RateLimit)
+	}
 
-	// Bidirectional copy
+	// Bidirectional copy, each direction through a pooled buffer
+	pool := bufferPool(l.BufferSize)
+	var sent int64
 	done := make(chan struct{})
 	go func() {
-		io.Copy(remoteConn, clientConn)
+		buf := pool.Get().(*[]byte)
+		defer pool.Put(buf)
+		sent = copyConn(remoteConn, fromClient, *buf, &l.bytesSent, &entry.sent, activity)
 		close(done)
 	}()
-	io.Copy(clientConn, remoteConn)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	received := copyConn(clientConn, fromRemote, *buf, &l.bytesReceived, &entry.received, activity)
 	<-done
+	log.Debug("connection closed", "sent", sent, "received", received, "duration", time.Since(start))
+	l.logAccess(client, start, sent, received, nil)
+}
+
+// logAccess writes a connection's access log entry, if access logging is on.
+// It is called once both copies have finished, so a slow log never holds up
+// the connection's traffic.
+func (l *Listener) logAccess(client string, start time.Time, sent, received int64, err error) {
+	if l.AccessLog == nil {
+		return
+	}
+	attrs := []any{
+		"client", client,
+		"instance", l.Instance,
+	}
+	if l.Socket != "" {
+		attrs = append(attrs, "socket", l.Socket)
+	} else {
+		attrs = append(attrs, "port", l.Port)
+	}
+	attrs = append(attrs,
+		"start", start.UTC(),
+		"duration_ms", time.Since(start).Milliseconds(),
+		"sent", sent,
+		"received", received,
+	)
+	if err != nil {
+		attrs = append(attrs, "err", err.Error())
+	}
+	l.AccessLog.Info("connection", attrs...)
 }
 
+// bufferPools holds a *sync.Pool of copy buffers for each buffer size, shared
+// by all listeners so connections reuse the buffers of those that closed.
+var bufferPools sync.Map
+
+// buffersAllocated counts the copy buffers the pools have had to allocate.
+var buffersAllocated atomic.Int64
+
+// bufferPool returns the pool of copy buffers of size bytes, or of
+// defaultBufferSize if size is 0.
+func bufferPool(size int) *sync.Pool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	if pool, ok := bufferPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{New: func() any {
+		buffersAllocated.Add(1)
+		buf := make([]byte, size)
+		return &buf
+	}})
+	return pool.(*sync.Pool)
+}
+
+// copyConn copies src to dst through buf until either side fails, adding
+// each chunk written to total and conn and calling activity for each chunk
+// read. Unlike io.CopyBuffer, this keeps the totals current while a
+// connection is open. It returns the number of bytes written.
+func copyConn(dst io.Writer, src io.Reader, buf []byte, total, conn *atomic.Int64, activity func()) int64 {
+	var copied int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			activity()
+			written, werr := dst.Write(buf[:n])
+			total.Add(int64(written))
+			conn.Add(int64(written))
+			copied += int64(written)
+			if werr != nil {
+				return copied
+			}
+		}
+		if err != nil {
+			return copied
+		}
+	}
+}
+
+// limitedReader throttles reads from r to a token bucket's rate, holding each
+// chunk back until its bytes are allowed through. Reads are cut to the
+// bucket's burst so no single chunk outruns it.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+// newLimitedReader returns a reader passing r's bytes at bytesPerSec, with a
+// burst of one second's worth.
+func newLimitedReader(ctx context.Context, r io.Reader, bytesPerSec int) *limitedReader {
+	return &limitedReader{ctx: ctx, r: r, limiter: rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if burst := lr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.WaitN(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// dial connects to the instance, retrying failures with exponential backoff
+// until DialAttempts is exhausted or the listener is closed.
+func (l *Listener) dial() (net.Conn, error) {
+	delay := l.DialRetryDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := l.dialOnce()
+		if err != nil {
+			l.dialErrors.Add(1)
+			l.lastDialErr.Store(&DialError{Err: err.Error(), At: time.Now()})
+		}
+		if err == nil || attempt >= l.DialAttempts {
+			return conn, err
+		}
+		l.logger().Warn("dial failed, retrying", "attempt", attempt, "attempts", l.DialAttempts, "delay", delay, "err", err)
+		select {
+		case <-l.ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxDialRetryDelay)
+	}
+}
+
+// dialOnce makes a single dial attempt, giving up after DialTimeout.
+func (l *Listener) dialOnce() (net.Conn, error) {
+	if l.DialTimeout <= 0 {
+		return l.dialer.Dial(l.ctx, l.Instance)
+	}
+	ctx, cancel := context.WithTimeout(l.ctx, l.DialTimeout)
+	defer cancel()
+	conn, err := l.dialer.Dial(ctx, l.Instance)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("dial timed out after %s: %w", l.DialTimeout, err)
+	}
+	return conn, err
+}
+
+// Accepting reports whether the listener is accepting connections: it has
+// been started and neither closed nor stopped by an accept error.
+func (l *Listener) Accepting() bool {
+	return l.accepting.Load()
+}
+
+// CheckDial dials the instance once and closes the connection, reporting
+// whether the instance is reachable right now.
+func (l *Listener) CheckDial(ctx context.Context) error {
+	conn, err := l.dialer.Dial(ctx, l.Instance)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ActiveConns returns the number of connections currently being handled.
+func (l *Listener) ActiveConns() int {
+	return int(l.activeConns.Load())
+}
+
+// TotalConns returns the number of connections accepted since Start.
+func (l *Listener) TotalConns() int64 {
+	return l.totalConns.Load()
+}
+
+// DialedConns returns the number of connections accepted since Start whose
+// instance was dialed successfully.
+func (l *Listener) DialedConns() int64 {
+	return l.dialedConns.Load()
+}
+
+// DialErrors returns the number of failed dial attempts, counting each retry.
+func (l *Listener) DialErrors() int64 {
+	return l.dialErrors.Load()
+}
+
+// LastDialError returns the most recent failed dial attempt since Start, or
+// nil if there has been none.
+func (l *Listener) LastDialError() *DialError {
+	return l.lastDialErr.Load()
+}
+
+// BytesSent returns the bytes copied from clients to the instance since
+// Start, including by open connections.
+func (l *Listener) BytesSent() int64 {
+	return l.bytesSent.Load()
+}
+
+// BytesReceived returns the bytes copied from the instance to clients since
+// Start, including by open connections.
+func (l *Listener) BytesReceived() int64 {
+	return l.bytesReceived.Load()
+}
+
+// ConnInfo describes a client connection being handled by a listener.
+type ConnInfo struct {
+	Client        string    `json:"client"`
+	StartedAt     time.Time `json:"started_at"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// connEntry is the registry entry for a connection being handled. Its
+// counters are updated by the copies while the connection is open.
+type connEntry struct {
+	client   string
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// register adds a connection to the registry read by Connections.
+func (l *Listener) register(client string, start time.Time) *connEntry {
+	c := &connEntry{client: client, start: start}
+	l.clientsMu.Lock()
+	if l.clients == nil {
+		l.clients = make(map[*connEntry]struct{})
+	}
+	l.clients[c] = struct{}{}
+	l.clientsMu.Unlock()
+	return c
+}
+
+func (l *Listener) unregister(c *connEntry) {
+	l.clientsMu.Lock()
+	delete(l.clients, c)
+	l.clientsMu.Unlock()
+}
+
+// Connections returns a snapshot of the connections being handled, oldest
+// first, with the bytes each has transferred so far.
+func (l *Listener) Connections() []ConnInfo {
+	l.clientsMu.Lock()
+	conns := make([]ConnInfo, 0, len(l.clients))
+	for c := range l.clients {
+		conns = append(conns, ConnInfo{
+			Client:        c.client,
+			StartedAt:     c.start,
+			BytesSent:     c.sent.Load(),
+			BytesReceived: c.received.Load(),
+		})
+	}
+	l.clientsMu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].StartedAt.Before(conns[j].StartedAt) })
+	return conns
+}
+
+// track records an open connection so that Drain can close it.
+func (l *Listener) track(conn net.Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if l.forceClosed {
+		conn.Close()
+		return
+	}
+	if l.conns == nil {
+		l.conns = make(map[net.Conn]struct{})
+	}
+	l.conns[conn] = struct{}{}
+}
+
+func (l *Listener) untrack(conn net.Conn) {
+	l.connsMu.Lock()
+	delete(l.conns, conn)
+	l.connsMu.Unlock()
+}
+
+// closeConns closes every open connection, and any opened afterwards.
+func (l *Listener) closeConns() {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	l.forceClosed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the listener and closes any open connections at once.
 func (l *Listener) Close() error {
+	return l.Drain(0)
+}
+
+// Drain stops accepting connections immediately, then gives open ones up to
+// timeout to finish before closing them.
+func (l *Listener) Drain(timeout time.Duration) error {
+	l.closing.Store(true)
+	if l.listener != nil {
+		l.listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		if n := l.ActiveConns(); n > 0 && timeout > 0 {
+			l.logger().Warn("closing connections still open after shutdown timeout", "connections", n, "timeout", timeout)
+		}
+		if l.cancel != nil {
+			l.cancel()
+		}
+		l.closeConns()
+		<-done
+	}
+
 	if l.cancel != nil {
 		l.cancel()
 	}
-	if l.listener != nil {
-		l.listener.Close()
+	if l.socketFile != nil {
+		removeSocket(l.Socket, l.socketFile)
 	}
-	l.wg.Wait()
 	return nil
 }
 
+// logger returns the listener's logger with its instance and address
+// attached.
+func (l *Listener) logger() *slog.Logger {
+	lg := l.Logger
+	if lg == nil {
+		lg = slog.Default()
+	}
+	if l.Socket != "" {
+		return lg.With("instance", l.Instance, "socket", l.Socket)
+	}
+	return lg.With("instance", l.Instance, "port", l.Port)
+}
+
 func (l *Listener) Addr() net.Addr {
 	if l.listener != nil {
 		return l.listener.Addr()
@@ -1,11 +1,19 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,7 +42,7 @@ func TestBidirectionalProxy(t *testing.T) {
 		},
 	}
 
-	l := NewListener("proj:region:db", 0, dialer)
+	l := NewListener("proj:region:db", "", 0, dialer)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -92,7 +100,7 @@ func TestListenerClosesOnContextCancel(t *testing.T) {
 		},
 	}
 
-	l := NewListener("proj:region:db", 0, dialer)
+	l := NewListener("proj:region:db", "", 0, dialer)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	l.Port = 0
@@ -112,6 +120,83 @@ func TestListenerClosesOnContextCancel(t *testing.T) {
 	}
 }
 
+// temporaryError is an accept error that may clear up, like EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// failingListener returns each of errs from Accept, in order, before
+// accepting from the listener it wraps.
+type failingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (f *failingListener) Accept() (net.Conn, error) {
+	f.mu.Lock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		f.mu.Unlock()
+		return nil, err
+	}
+	f.mu.Unlock()
+	return f.Listener.Accept()
+}
+
+func TestAcceptRetriesTemporaryErrors(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return nil, errors.New("dial refused")
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := NewListener("proj:region:db", "127.0.0.1", 0, dialer)
+	l.serve(context.Background(), &failingListener{Listener: ln, errs: []error{temporaryError{}, temporaryError{}}})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for l.TotalConns() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if l.TotalConns() != 1 {
+		t.Errorf("expected the connection to be accepted after the temporary errors, got %d", l.TotalConns())
+	}
+	if !l.Accepting() {
+		t.Error("listener should still be accepting")
+	}
+}
+
+func TestAcceptStopsOnFatalError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	l := NewListener("proj:region:db", "127.0.0.1", 0, &mockDialer{})
+	l.serve(context.Background(), &failingListener{Listener: ln, errs: []error{errors.New("broken")}})
+	defer l.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Accepting() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if l.Accepting() {
+		t.Error("expected the listener to stop accepting after a fatal error")
+	}
+}
+
 func TestDialerErrorHandled(t *testing.T) {
 	dialer := &mockDialer{
 		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
@@ -119,7 +204,7 @@ func TestDialerErrorHandled(t *testing.T) {
 		},
 	}
 
-	l := NewListener("proj:region:db", 0, dialer)
+	l := NewListener("proj:region:db", "", 0, dialer)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -142,4 +227,954 @@ func TestDialerErrorHandled(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected read to fail (connection should be closed)")
 	}
+	if got := l.DialedConns(); got != 0 {
+		t.Errorf("DialedConns() = %d after a failed dial, want 0", got)
+	}
+}
+
+func TestDialRetriedUntilSuccess(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+
+	var attempts atomic.Int32
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			if attempts.Add(1) <= 2 {
+				return nil, fmt.Errorf("transient error")
+			}
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.DialAttempts = 3
+	l.DialRetryDelay = 10 * time.Millisecond
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+
+	request := []byte("SELECT 1")
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	remoteClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(remoteClient, buf); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+	if string(buf) != string(request) {
+		t.Errorf("expected %q, got %q", request, buf)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected 3 dial attempts, got %d", n)
+	}
+
+	// Close both ends to unblock the io.Copy goroutines
+	conn.Close()
+	remoteClient.Close()
+}
+
+func TestDialRetriesExhausted(t *testing.T) {
+	var attempts atomic.Int32
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			attempts.Add(1)
+			return nil, fmt.Errorf("connection refused")
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.DialAttempts = 2
+	l.DialRetryDelay = 10 * time.Millisecond
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected read to fail (connection should be closed)")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected 2 dial attempts, got %d", n)
+	}
+}
+
+func TestDialTimeoutClosesClient(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			// A backend that never answers: block until the dial is abandoned.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.DialAttempts = 1
+	l.DialTimeout = 50 * time.Millisecond
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the proxy to close the connection, got %v", err)
+	}
+	if n := l.DialErrors(); n != 1 {
+		t.Errorf("expected 1 dial error, got %d", n)
+	}
+	if e := l.LastDialError(); e == nil || !strings.Contains(e.Err, "dial timed out") || e.At.IsZero() {
+		t.Errorf("expected the timeout as the last dial error, got %+v", e)
+	}
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.IdleTimeout = 100 * time.Millisecond
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// Traffic keeps the connection open past the timeout...
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if _, err := io.ReadFull(remoteClient, make([]byte, 1)); err != nil {
+			t.Fatalf("connection closed while active: %v", err)
+		}
+	}
+
+	// ...and silence closes it.
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected read to fail (connection should be closed)")
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("idle connection was not closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle connection closed after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestMaxLifetimeClosesBusyConnection(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.MaxLifetime = 200 * time.Millisecond
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// Unlike the idle timeout, traffic doesn't keep it open.
+	for time.Since(start) < 2*time.Second {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			break
+		}
+		remoteClient.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(remoteClient, make([]byte, 1)); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected read to fail (connection should be closed)")
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection was not closed at its max lifetime")
+	}
+	if elapsed := time.Since(start); elapsed < l.MaxLifetime || elapsed > time.Second {
+		t.Errorf("connection closed after %s, want about %s", elapsed, l.MaxLifetime)
+	}
+}
+
+func TestRateLimitThrottlesCopy(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	const limit = 10000
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.RateLimit = limit
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// The first second's worth passes at once; the remaining half second's
+	// worth has to wait for the bucket to refill.
+	payload := make([]byte, limit*3/2)
+	start := time.Now()
+	go conn.Write(payload)
+	remoteClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(remoteClient, make([]byte, len(payload))); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+	if elapsed, want := time.Since(start), 500*time.Millisecond; elapsed < want {
+		t.Errorf("transferred %d bytes in %s, want at least %s at %d bytes/s", len(payload), elapsed, want, limit)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	payload := make([]byte, 100*1024)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	// The remote echoes the payload back, then closes.
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				io.CopyN(server, server, int64(len(payload)))
+			}()
+			return client, nil
+		},
+	}
+
+	// An odd size, so the pool is this test's alone.
+	const size = 1500
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.BufferSize = size
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	const conns = 10
+	allocated := buffersAllocated.Load()
+	for i := 0; i < conns; i++ {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("failed to connect to proxy: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go conn.Write(payload)
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("connection %d: failed to read echo: %v", i, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("connection %d: echoed data differs from what was sent", i)
+		}
+		conn.Close()
+
+		// Wait for the connection to return its buffers before the next.
+		deadline := time.Now().Add(2 * time.Second)
+		for l.ActiveConns() > 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Each connection copies through two buffers; reusing them means far
+	// fewer are allocated than that.
+	if n := buffersAllocated.Load() - allocated; n >= 2*conns {
+		t.Errorf("allocated %d buffers for %d sequential connections, want them reused", n, conns)
+	}
+}
+
+func TestMaxConnsRefusesExcess(t *testing.T) {
+	var remotes []net.Conn
+	var mu sync.Mutex
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			remoteClient, remoteServer := net.Pipe()
+			mu.Lock()
+			remotes = append(remotes, remoteClient)
+			mu.Unlock()
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.MaxConns = 2
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("failed to connect to proxy: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	// The connection over the limit is closed without being dialed...
+	conns[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conns[2].Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("expected excess connection to be closed, got %v", err)
+	}
+
+	// ...while the others stay open.
+	for i, conn := range conns[:2] {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected connection %d to stay open, got %v", i, err)
+		}
+	}
+	if got := l.ActiveConns(); got != 2 {
+		t.Errorf("ActiveConns() = %d, want 2", got)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	mu.Lock()
+	for _, r := range remotes {
+		r.Close()
+	}
+	mu.Unlock()
+	l.Close()
+}
+
+func TestDrainLetsInFlightConnectionFinish(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	addr := l.Addr().String()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("q")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(remoteClient, make([]byte, 1)); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		l.Drain(5 * time.Second)
+		close(drained)
+	}()
+
+	// New connections are refused right away...
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepting during drain")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ...while the open one can still finish its query.
+	if _, err := remoteClient.Write([]byte("result")); err != nil {
+		t.Fatalf("failed to write response: %v", err)
+	}
+	buf := make([]byte, len("result"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("in-flight connection was cut off: %v", err)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the open connection finished")
+	default:
+	}
+	conn.Close()
+	remoteClient.Close()
+
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not return after the connection finished")
+	}
+}
+
+func TestDrainClosesConnectionsAfterTimeout(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("q")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(remoteClient, make([]byte, 1)); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+
+	start := time.Now()
+	l.Drain(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s, want about 100ms", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	l := NewListener("proj:region:db", "", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+
+	request := []byte("SELECT 1")
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(remoteClient, make([]byte, len(request))); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+	response := []byte("one row")
+	if _, err := remoteClient.Write(response); err != nil {
+		t.Fatalf("failed to write response: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(response))); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	if got := l.ActiveConns(); got != 1 {
+		t.Errorf("ActiveConns() = %d during connection, want 1", got)
+	}
+
+	// Byte counts are current while the connection is still open. The
+	// counter is bumped just after the write completes, so allow a moment.
+	deadline := time.Now().Add(time.Second)
+	for l.BytesSent() != int64(len(request)) || l.BytesReceived() != int64(len(response)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("open connection counted %d sent, %d received; want %d, %d",
+				l.BytesSent(), l.BytesReceived(), len(request), len(response))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn.Close()
+	remoteClient.Close()
+	l.Close()
+
+	if got := l.ActiveConns(); got != 0 {
+		t.Errorf("ActiveConns() = %d after close, want 0", got)
+	}
+	if got := l.TotalConns(); got != 1 {
+		t.Errorf("TotalConns() = %d, want 1", got)
+	}
+	if got := l.DialedConns(); got != 1 {
+		t.Errorf("DialedConns() = %d, want 1", got)
+	}
+	if got := l.BytesSent(); got != int64(len(request)) {
+		t.Errorf("BytesSent() = %d, want %d", got, len(request))
+	}
+	if got := l.BytesReceived(); got != int64(len(response)) {
+		t.Errorf("BytesReceived() = %d, want %d", got, len(response))
+	}
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	l := NewListener("proj:region:db", "", 0, nil)
+	if got := l.Connections(); len(got) != 0 {
+		t.Fatalf("expected no connections, got %+v", got)
+	}
+
+	start := time.Now()
+	a := l.register("10.0.0.1:5000", start.Add(time.Second))
+	b := l.register("10.0.0.2:5000", start)
+	a.sent.Add(10)
+	a.received.Add(20)
+
+	got := l.Connections()
+	want := []ConnInfo{
+		{Client: "10.0.0.2:5000", StartedAt: start},
+		{Client: "10.0.0.1:5000", StartedAt: start.Add(time.Second), BytesSent: 10, BytesReceived: 20},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d connections, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("connection %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	l.unregister(b)
+	if got := l.Connections(); len(got) != 1 || got[0].Client != "10.0.0.1:5000" {
+		t.Errorf("expected only 10.0.0.1:5000 after unregistering, got %+v", got)
+	}
+	l.unregister(a)
+	if got := l.Connections(); len(got) != 0 {
+		t.Errorf("expected no connections, got %+v", got)
+	}
+}
+
+func TestConnectionsSnapshot(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+	l := NewListener("proj:region:db", "", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	request := []byte("SELECT 1")
+	conn.Write(request)
+	if _, err := io.ReadFull(remoteClient, make([]byte, len(request))); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+
+	// The counter is bumped just after the write completes, so allow a moment.
+	deadline := time.Now().Add(time.Second)
+	for {
+		conns := l.Connections()
+		if len(conns) == 1 && conns[0].BytesSent == int64(len(request)) {
+			if conns[0].Client != conn.LocalAddr().String() {
+				t.Errorf("expected client %s, got %s", conn.LocalAddr(), conns[0].Client)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections %+v", conns)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn.Close()
+	remoteClient.Close()
+	deadline = time.Now().Add(time.Second)
+	for len(l.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still registered after close: %+v", l.Connections())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	var out syncBuffer
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.AccessLog = slog.New(slog.NewJSONHandler(&out, nil))
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	if _, err := conn.Write([]byte("SELECT 1")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(remoteClient, make([]byte, 8)); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+	if _, err := remoteClient.Write([]byte("1 row")); err != nil {
+		t.Fatalf("failed to write response: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if out.String() != "" {
+		t.Errorf("expected no entry while the connection is open, got:\n%s", out.String())
+	}
+
+	conn.Close()
+	remoteClient.Close()
+	l.Close()
+
+	var entry struct {
+		Msg        string    `json:"msg"`
+		Client     string    `json:"client"`
+		Instance   string    `json:"instance"`
+		Port       int       `json:"port"`
+		Start      time.Time `json:"start"`
+		DurationMS *int64    `json:"duration_ms"`
+		Sent       int64     `json:"sent"`
+		Received   int64     `json:"received"`
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one entry, got:\n%s", out.String())
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("entry is not JSON: %v\n%s", err, lines[0])
+	}
+	if entry.Msg != "connection" || entry.Instance != "proj:region:db" || entry.Port != l.Port {
+		t.Errorf("unexpected entry: %s", lines[0])
+	}
+	if entry.Client != conn.LocalAddr().String() {
+		t.Errorf("client = %q, want %q", entry.Client, conn.LocalAddr())
+	}
+	if entry.Start.IsZero() || entry.DurationMS == nil {
+		t.Errorf("expected start and duration_ms, got: %s", lines[0])
+	}
+	if entry.Sent != 8 || entry.Received != 5 {
+		t.Errorf("sent, received = %d, %d; want 8, 5", entry.Sent, entry.Received)
+	}
+}
+
+func TestAccessLogDialFailure(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+
+	var out syncBuffer
+	l := NewListener("proj:region:db", "", 0, dialer)
+	l.DialAttempts = 1
+	l.AccessLog = slog.New(slog.NewJSONHandler(&out, nil))
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start listener: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+	l.Close()
+
+	if logged := out.String(); !strings.Contains(logged, `"err":"unreachable"`) {
+		t.Errorf("expected the dial error in the entry, got:\n%s", logged)
+	}
+}
+
+func TestListenerBindsConfiguredHost(t *testing.T) {
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return nil, errors.New("should not be called")
+		},
+	}
+
+	l := NewListener("proj:region:db", "127.0.0.1", 0, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer l.Close()
+
+	host, _, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("splitting address: %v", err)
+	}
+	if host != "127.0.0.1" {
+		t.Errorf("expected listener on 127.0.0.1, got %s", host)
+	}
+}
+
+func TestListenerReusePort(t *testing.T) {
+	if !ReusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	first := NewListener("proj:region:db", "127.0.0.1", 0, &mockDialer{})
+	first.ReusePort = true
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer first.Close()
+
+	// A second listener that sets the option too binds the same port, as
+	// a daemon taking over does.
+	second := NewListener("proj:region:db", "127.0.0.1", first.Port, &mockDialer{})
+	second.ReusePort = true
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatalf("expected a second listener with ReusePort to bind port %d, got: %v", first.Port, err)
+	}
+	defer second.Close()
+
+	// One without it still finds the port in use.
+	third := NewListener("proj:region:db", "127.0.0.1", first.Port, &mockDialer{})
+	if err := third.Start(context.Background()); err == nil {
+		third.Close()
+		t.Errorf("expected a listener without ReusePort to fail on port %d", first.Port)
+	}
+}
+
+func TestNewListenerDefaultsToLocalhost(t *testing.T) {
+	l := NewListener("proj:region:db", "", 5432, &mockDialer{})
+	if l.Host != "localhost" {
+		t.Errorf("expected default host localhost, got %q", l.Host)
+	}
+}
+
+func TestSocketListener(t *testing.T) {
+	remoteClient, remoteServer := net.Pipe()
+	defer remoteClient.Close()
+
+	dialer := &mockDialer{
+		dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+			return remoteServer, nil
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "cloudsql", "proj:region:db")
+	l := NewSocketListener("proj:region:db", path, dialer)
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to socket: %v", err)
+	}
+	testData := []byte("hello over unix")
+	if _, err := conn.Write(testData); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	buf := make([]byte, len(testData))
+	if _, err := io.ReadFull(remoteClient, buf); err != nil {
+		t.Fatalf("failed to read from remote: %v", err)
+	}
+	if string(buf) != string(testData) {
+		t.Errorf("expected %q, got %q", testData, buf)
+	}
+	conn.Close()
+	remoteClient.Close()
+
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected socket file to be removed on Close")
+	}
+}
+
+func TestSocketListenerReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	// Leave a socket file behind without cleaning it up, as a crashed
+	// daemon would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := NewSocketListener("proj:region:db", path, &mockDialer{})
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("expected stale socket to be replaced, got: %v", err)
+	}
+	l.Close()
+}
+
+func TestSocketListenerLeavesReplacedSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+	old := NewSocketListener("proj:region:db", path, &mockDialer{})
+	if err := old.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	// A daemon taking over binds its own socket at the path, which the old
+	// listener's Close must not remove.
+	l := NewSocketListener("proj:region:db", path, &mockDialer{})
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer l.Close()
+	old.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the new listener's socket to remain, got %v", err)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to the new socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSocketListenerRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	l := NewSocketListener("proj:region:db", path, &mockDialer{})
+	if err := l.Start(context.Background()); err == nil {
+		l.Close()
+		t.Fatal("expected error when path is a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected regular file to be left alone: %v", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level      slog.Level
+		wantOpened bool
+	}{
+		{slog.LevelDebug, true},
+		{slog.LevelWarn, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			var out syncBuffer
+			dialer := &mockDialer{
+				dialFunc: func(ctx context.Context, instance string) (net.Conn, error) {
+					return nil, errors.New("unreachable")
+				},
+			}
+			l := NewListener("proj:region:db", "", 0, dialer)
+			l.DialAttempts = 1
+			l.Logger = slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: tt.level}))
+			if err := l.Start(context.Background()); err != nil {
+				t.Fatalf("failed to start listener: %v", err)
+			}
+			defer l.Close()
+
+			conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Read(make([]byte, 1))
+			conn.Close()
+
+			deadline := time.Now().Add(time.Second)
+			for !strings.Contains(out.String(), "dial failed") && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			logged := out.String()
+			if !strings.Contains(logged, "level=WARN") || !strings.Contains(logged, "instance=proj:region:db") {
+				t.Errorf("expected a warning carrying the instance, got:\n%s", logged)
+			}
+			if got := strings.Contains(logged, "connection opened"); got != tt.wantOpened {
+				t.Errorf("connection opened logged = %v, want %v; log:\n%s", got, tt.wantOpened, logged)
+			}
+		})
+	}
 }
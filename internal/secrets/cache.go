@@ -0,0 +1,56 @@
+package secrets
+
+import (
+	"context"
+	"sync"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// CachingSecretClient wraps a SecretClient so that each secret version is
+// fetched at most once, even when requested concurrently. Results, including
+// errors, are kept for the client's lifetime, so it is meant to live for a
+// single command invocation.
+type CachingSecretClient struct {
+	client SecretClient
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	done chan struct{}
+	resp *smpb.AccessSecretVersionResponse
+	err  error
+}
+
+var _ SecretClient = (*CachingSecretClient)(nil)
+
+func NewCachingSecretClient(client SecretClient) *CachingSecretClient {
+	return &CachingSecretClient{client: client, entries: make(map[string]*cacheEntry)}
+}
+
+// AccessSecretVersion returns the cached response for req.Name, which has the
+// form projects/P/secrets/S/versions/V, fetching it on first use.
+func (c *CachingSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	c.mu.Lock()
+	e, ok := c.entries[req.Name]
+	if !ok {
+		e = &cacheEntry{done: make(chan struct{})}
+		c.entries[req.Name] = e
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		e.resp, e.err = c.client.AccessSecretVersion(ctx, req, opts...)
+		close(e.done)
+	}
+
+	select {
+	case <-e.done:
+		return e.resp, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
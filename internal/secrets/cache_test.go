@@ -0,0 +1,81 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+type countingClient struct {
+	calls atomic.Int32
+	err   error
+}
+
+func (c *countingClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	c.calls.Add(1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &smpb.AccessSecretVersionResponse{
+		Payload: &smpb.SecretPayload{Data: []byte("pw-for-" + req.Name)},
+	}, nil
+}
+
+func TestCachingSecretClient_DuplicateKeysFetchedOnce(t *testing.T) {
+	underlying := &countingClient{}
+	client := NewCachingSecretClient(underlying)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := FetchSecret(context.Background(), client, "proj", "shared", "latest")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if val != "pw-for-projects/proj/secrets/shared/versions/latest" {
+				t.Errorf("unexpected value %q", val)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := underlying.calls.Load(); n != 1 {
+		t.Errorf("expected 1 underlying call, got %d", n)
+	}
+}
+
+func TestCachingSecretClient_DistinctKeys(t *testing.T) {
+	underlying := &countingClient{}
+	client := NewCachingSecretClient(underlying)
+	ctx := context.Background()
+
+	FetchSecret(ctx, client, "proj", "secret", "latest")
+	FetchSecret(ctx, client, "proj", "secret", "2")
+	FetchSecret(ctx, client, "other", "secret", "latest")
+	FetchSecret(ctx, client, "proj", "secret", "2")
+
+	if n := underlying.calls.Load(); n != 3 {
+		t.Errorf("expected 3 underlying calls, got %d", n)
+	}
+}
+
+func TestCachingSecretClient_Error(t *testing.T) {
+	underlying := &countingClient{err: errors.New("permission denied")}
+	client := NewCachingSecretClient(underlying)
+
+	for i := 0; i < 2; i++ {
+		if _, err := FetchSecret(context.Background(), client, "proj", "secret", "latest"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if n := underlying.calls.Load(); n != 1 {
+		t.Errorf("expected 1 underlying call, got %d", n)
+	}
+}
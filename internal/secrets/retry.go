@@ -0,0 +1,67 @@
+package secrets
+
+import (
+	"context"
+	"time"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultRetryDelay is the wait before the first retry of a failed fetch.
+	DefaultRetryDelay = 250 * time.Millisecond
+
+	// maxRetryDelay caps the backoff between fetch attempts.
+	maxRetryDelay = 2 * time.Second
+)
+
+// RetryingSecretClient wraps a SecretClient so that fetches failing with a
+// transient error (Unavailable, DeadlineExceeded, or ResourceExhausted) are
+// retried with exponential backoff. Other errors, such as NotFound or
+// PermissionDenied, are returned at once. When combined with a
+// CachingSecretClient, wrap this one in the cache, so that a transient error
+// isn't cached.
+type RetryingSecretClient struct {
+	client SecretClient
+
+	// Attempts is how many times to try each fetch; values below 2 disable
+	// retries. Delay is the wait before the first retry, doubled after each
+	// further failure.
+	Attempts int
+	Delay    time.Duration
+}
+
+var _ SecretClient = (*RetryingSecretClient)(nil)
+
+func NewRetryingSecretClient(client SecretClient, attempts int) *RetryingSecretClient {
+	return &RetryingSecretClient{client: client, Attempts: attempts, Delay: DefaultRetryDelay}
+}
+
+func (c *RetryingSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	delay := c.Delay
+	for attempt := 1; ; attempt++ {
+		resp, err := c.client.AccessSecretVersion(ctx, req, opts...)
+		if err == nil || attempt >= c.Attempts || !transient(err) {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// transient reports whether err is worth retrying: the service was briefly
+// unreachable, slow, or rate limiting.
+func transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
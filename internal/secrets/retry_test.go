@@ -0,0 +1,99 @@
+package secrets
+
+import (
+	"context"
+	"testing"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyClient fails its first len(errs) calls with errs in turn, then
+// succeeds.
+type flakyClient struct {
+	errs  []error
+	calls int
+}
+
+func (c *flakyClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return nil, c.errs[c.calls-1]
+	}
+	return &smpb.AccessSecretVersionResponse{
+		Payload: &smpb.SecretPayload{Data: []byte("s3cret")},
+	}, nil
+}
+
+func newTestRetryingClient(client SecretClient, attempts int) *RetryingSecretClient {
+	c := NewRetryingSecretClient(client, attempts)
+	c.Delay = 0
+	return c
+}
+
+func TestRetryingSecretClient_TransientThenSuccess(t *testing.T) {
+	underlying := &flakyClient{errs: []error{
+		status.Error(codes.Unavailable, "connection reset"),
+		status.Error(codes.ResourceExhausted, "quota exceeded"),
+	}}
+	client := newTestRetryingClient(underlying, 3)
+
+	val, err := FetchSecret(context.Background(), client, "proj", "secret", "latest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if val != "s3cret" {
+		t.Errorf("expected s3cret, got %q", val)
+	}
+	if underlying.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", underlying.calls)
+	}
+}
+
+func TestRetryingSecretClient_GivesUp(t *testing.T) {
+	underlying := &flakyClient{errs: []error{
+		status.Error(codes.DeadlineExceeded, "timeout"),
+		status.Error(codes.DeadlineExceeded, "timeout"),
+		status.Error(codes.DeadlineExceeded, "timeout"),
+	}}
+	client := newTestRetryingClient(underlying, 2)
+
+	if _, err := FetchSecret(context.Background(), client, "proj", "secret", "latest"); err == nil {
+		t.Fatal("expected error")
+	}
+	if underlying.calls != 2 {
+		t.Errorf("expected 2 calls, got %d", underlying.calls)
+	}
+}
+
+func TestRetryingSecretClient_PermissionDeniedFailsFast(t *testing.T) {
+	underlying := &flakyClient{errs: []error{
+		status.Error(codes.PermissionDenied, "denied"),
+	}}
+	client := newTestRetryingClient(underlying, 3)
+
+	if _, err := FetchSecret(context.Background(), client, "proj", "secret", "latest"); err == nil {
+		t.Fatal("expected error")
+	}
+	if underlying.calls != 1 {
+		t.Errorf("expected 1 call, got %d", underlying.calls)
+	}
+}
+
+func TestRetryingSecretClient_ContextCanceled(t *testing.T) {
+	underlying := &flakyClient{errs: []error{
+		status.Error(codes.Unavailable, "connection reset"),
+	}}
+	client := NewRetryingSecretClient(underlying, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := client.AccessSecretVersion(ctx, &smpb.AccessSecretVersionRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected the Unavailable error, got %v", err)
+	}
+	if underlying.calls != 1 {
+		t.Errorf("expected 1 call, got %d", underlying.calls)
+	}
+}
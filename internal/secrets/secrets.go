@@ -3,22 +3,42 @@ package secrets
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/googleapis/gax-go/v2"
 )
 
+// accessPermission is the IAM permission needed to read secret payloads.
+const accessPermission = "secretmanager.versions.access"
+
 type SecretClient interface {
 	AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error)
 }
 
-// Verify that the real client satisfies the interface.
-var _ SecretClient = (*secretmanager.Client)(nil)
+// AccessChecker tests IAM permissions on a secret without reading its payload.
+type AccessChecker interface {
+	TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest, opts ...gax.CallOption) (*iampb.TestIamPermissionsResponse, error)
+}
+
+// Verify that the real client satisfies the interfaces.
+var (
+	_ SecretClient  = (*secretmanager.Client)(nil)
+	_ AccessChecker = (*secretmanager.Client)(nil)
+)
+
+// VersionName returns the resource name of a secret version.
+func VersionName(project, secretName, version string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s/versions/%s", project, secretName, version)
+}
 
-func FetchSecret(ctx context.Context, client SecretClient, project, secretName string) (string, error) {
-	name := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", project, secretName)
+// FetchSecret reads a secret version's payload. version is "latest", a
+// version number, or a version alias.
+func FetchSecret(ctx context.Context, client SecretClient, project, secretName, version string) (string, error) {
+	name := VersionName(project, secretName, version)
 	resp, err := client.AccessSecretVersion(ctx, &smpb.AccessSecretVersionRequest{
 		Name: name,
 	})
@@ -27,3 +47,18 @@ func FetchSecret(ctx context.Context, client SecretClient, project, secretName s
 	}
 	return strings.TrimSpace(string(resp.Payload.Data)), nil
 }
+
+// CheckAccess verifies that the caller could read the secret's payload,
+// without actually fetching it. This suits environments where retrieving
+// secret values is restricted by policy.
+func CheckAccess(ctx context.Context, client AccessChecker, project, secretName string) error {
+	resource := fmt.Sprintf("projects/%s/secrets/%s", project, secretName)
+	resp, err := client.TestIamPermissions(ctx, &iampb.TestIamPermissionsRequest{
+		Resource:    resource,
+		Permissions: []string{accessPermission},
+	})
+	if err != nil || !slices.Contains(resp.Permissions, accessPermission) {
+		return fmt.Errorf("Cannot access secret %q in project %q.\n\nEnsure you have the Secret Manager Secret Accessor role.", secretName, project)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"testing"
 
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
 	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/googleapis/gax-go/v2"
 )
@@ -13,9 +14,11 @@ import (
 type mockSecretClient struct {
 	response *smpb.AccessSecretVersionResponse
 	err      error
+	gotName  string
 }
 
 func (m *mockSecretClient) AccessSecretVersion(ctx context.Context, req *smpb.AccessSecretVersionRequest, opts ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
+	m.gotName = req.Name
 	return m.response, m.err
 }
 
@@ -27,7 +30,7 @@ func TestFetchSecret_Success(t *testing.T) {
 			},
 		},
 	}
-	val, err := FetchSecret(context.Background(), client, "my-project", "my-secret")
+	val, err := FetchSecret(context.Background(), client, "my-project", "my-secret", "latest")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -36,11 +39,41 @@ func TestFetchSecret_Success(t *testing.T) {
 	}
 }
 
+func TestFetchSecret_PinnedVersion(t *testing.T) {
+	client := &mockSecretClient{
+		response: &smpb.AccessSecretVersionResponse{
+			Payload: &smpb.SecretPayload{Data: []byte("pw")},
+		},
+	}
+	if _, err := FetchSecret(context.Background(), client, "my-project", "my-secret", "3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "projects/my-project/secrets/my-secret/versions/3"
+	if client.gotName != want {
+		t.Errorf("expected resource %q, got %q", want, client.gotName)
+	}
+}
+
+func TestFetchSecret_Alias(t *testing.T) {
+	client := &mockSecretClient{
+		response: &smpb.AccessSecretVersionResponse{
+			Payload: &smpb.SecretPayload{Data: []byte("pw")},
+		},
+	}
+	if _, err := FetchSecret(context.Background(), client, "my-project", "my-secret", "production"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "projects/my-project/secrets/my-secret/versions/production"
+	if client.gotName != want {
+		t.Errorf("expected resource %q, got %q", want, client.gotName)
+	}
+}
+
 func TestFetchSecret_NotFound(t *testing.T) {
 	client := &mockSecretClient{
 		err: errors.New("rpc error: code = NotFound"),
 	}
-	_, err := FetchSecret(context.Background(), client, "my-project", "missing-secret")
+	_, err := FetchSecret(context.Background(), client, "my-project", "missing-secret", "latest")
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -56,7 +89,7 @@ func TestFetchSecret_PermissionDenied(t *testing.T) {
 	client := &mockSecretClient{
 		err: errors.New("rpc error: code = PermissionDenied"),
 	}
-	_, err := FetchSecret(context.Background(), client, "my-project", "restricted-secret")
+	_, err := FetchSecret(context.Background(), client, "my-project", "restricted-secret", "latest")
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -64,3 +97,48 @@ func TestFetchSecret_PermissionDenied(t *testing.T) {
 		t.Errorf("expected error to mention role, got: %v", err)
 	}
 }
+
+type mockAccessChecker struct {
+	granted []string
+	err     error
+	req     *iampb.TestIamPermissionsRequest
+}
+
+func (m *mockAccessChecker) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest, opts ...gax.CallOption) (*iampb.TestIamPermissionsResponse, error) {
+	m.req = req
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &iampb.TestIamPermissionsResponse{Permissions: m.granted}, nil
+}
+
+func TestCheckAccess_Granted(t *testing.T) {
+	client := &mockAccessChecker{granted: []string{"secretmanager.versions.access"}}
+	if err := CheckAccess(context.Background(), client, "my-project", "my-secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.req.Resource != "projects/my-project/secrets/my-secret" {
+		t.Errorf("unexpected resource: %q", client.req.Resource)
+	}
+}
+
+func TestCheckAccess_NotGranted(t *testing.T) {
+	client := &mockAccessChecker{}
+	err := CheckAccess(context.Background(), client, "my-project", "restricted-secret")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "restricted-secret") || !strings.Contains(err.Error(), "my-project") {
+		t.Errorf("expected error to name secret and project, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Secret Manager Secret Accessor role") {
+		t.Errorf("expected error to mention role, got: %v", err)
+	}
+}
+
+func TestCheckAccess_RPCError(t *testing.T) {
+	client := &mockAccessChecker{err: errors.New("rpc error: code = NotFound")}
+	if err := CheckAccess(context.Background(), client, "my-project", "missing-secret"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,39 @@
+package secrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+)
+
+// Tracker re-fetches secret versions and reports which have changed since
+// they were last fetched. Only a SHA-256 digest of each payload is kept, so
+// passwords don't linger in memory.
+type Tracker struct {
+	client SecretClient
+
+	mu      sync.Mutex
+	digests map[string][sha256.Size]byte
+}
+
+func NewTracker(client SecretClient) *Tracker {
+	return &Tracker{client: client, digests: make(map[string][sha256.Size]byte)}
+}
+
+// Check fetches a secret version and reports whether its payload differs from
+// the previous Check of the same version. The first Check of a version only
+// records it and reports false. A failed fetch leaves the record unchanged.
+func (t *Tracker) Check(ctx context.Context, project, secretName, version string) (bool, error) {
+	payload, err := FetchSecret(ctx, t.client, project, secretName, version)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256([]byte(payload))
+
+	name := VersionName(project, secretName, version)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, seen := t.digests[name]
+	t.digests[name] = digest
+	return seen && prev != digest, nil
+}
@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+func respond(payload string) *smpb.AccessSecretVersionResponse {
+	return &smpb.AccessSecretVersionResponse{Payload: &smpb.SecretPayload{Data: []byte(payload)}}
+}
+
+func TestTracker_DetectsChange(t *testing.T) {
+	client := &mockSecretClient{response: respond("old")}
+	tracker := NewTracker(client)
+	ctx := context.Background()
+
+	changed, err := tracker.Check(ctx, "proj", "db-pw", "latest")
+	if err != nil || changed {
+		t.Fatalf("first check: got changed=%v err=%v, want false, nil", changed, err)
+	}
+	changed, err = tracker.Check(ctx, "proj", "db-pw", "latest")
+	if err != nil || changed {
+		t.Fatalf("unchanged secret: got changed=%v err=%v, want false, nil", changed, err)
+	}
+
+	client.response = respond("new")
+	changed, err = tracker.Check(ctx, "proj", "db-pw", "latest")
+	if err != nil || !changed {
+		t.Fatalf("rotated secret: got changed=%v err=%v, want true, nil", changed, err)
+	}
+	changed, _ = tracker.Check(ctx, "proj", "db-pw", "latest")
+	if changed {
+		t.Error("a change should only be reported once")
+	}
+}
+
+func TestTracker_VersionsTrackedSeparately(t *testing.T) {
+	client := &mockSecretClient{response: respond("a")}
+	tracker := NewTracker(client)
+	ctx := context.Background()
+
+	tracker.Check(ctx, "proj", "db-pw", "1")
+	client.response = respond("b")
+	if changed, _ := tracker.Check(ctx, "proj", "db-pw", "2"); changed {
+		t.Error("first check of another version should not report a change")
+	}
+}
+
+func TestTracker_FailedFetchKeepsRecord(t *testing.T) {
+	client := &mockSecretClient{response: respond("old")}
+	tracker := NewTracker(client)
+	ctx := context.Background()
+
+	tracker.Check(ctx, "proj", "db-pw", "latest")
+	client.err = errors.New("permission denied")
+	if _, err := tracker.Check(ctx, "proj", "db-pw", "latest"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	client.err = nil
+	client.response = respond("new")
+	if changed, _ := tracker.Check(ctx, "proj", "db-pw", "latest"); !changed {
+		t.Error("expected change after the failed fetch to be detected")
+	}
+}